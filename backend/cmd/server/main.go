@@ -16,7 +16,10 @@ import (
 )
 
 func main() {
-	cfg := config.Load()
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
 	database, err := db.New(cfg.DBPath)
 	if err != nil {
 		log.Fatalf("db error: %v", err)
@@ -26,7 +29,7 @@ func main() {
 	app := api.NewApp(database, cfg)
 
 	if cfg.WorkerEnabled {
-		go runWorker(database)
+		go runWorker(database, cfg)
 	}
 
 	go func() {
@@ -46,17 +49,45 @@ func main() {
 	}
 }
 
-func runWorker(database *sql.DB) {
+func runWorker(database *sql.DB, cfg config.Config) {
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 
 	for {
-		sendDueForAllOrgs(database)
+		reconcilePaymentLinks(database, cfg)
+		sendDueForAllOrgs(database, cfg)
+		deliverWebhooks(database, cfg)
+		deliverOutbox(database, cfg)
 		<-ticker.C
 	}
 }
 
-func sendDueForAllOrgs(database *sql.DB) {
+func reconcilePaymentLinks(database *sql.DB, cfg config.Config) {
+	if cfg.PaymentProvider == nil {
+		return
+	}
+	if _, err := services.ReconcilePaymentLinks(database, cfg.PaymentProvider, time.Now().UTC()); err != nil {
+		log.Printf("worker payment link error: %v", err)
+	}
+}
+
+func deliverWebhooks(database *sql.DB, cfg config.Config) {
+	client := services.NewWebhookClient(cfg.AllowPrivateWebhooks)
+	if _, err := services.DeliverDueWebhooks(database, client, time.Now().UTC()); err != nil {
+		log.Printf("worker webhook delivery error: %v", err)
+	}
+}
+
+func deliverOutbox(database *sql.DB, cfg config.Config) {
+	if cfg.Mailer == nil {
+		return
+	}
+	if _, err := services.DeliverOutbox(database, cfg.Mailer, time.Now().UTC()); err != nil {
+		log.Printf("worker outbox delivery error: %v", err)
+	}
+}
+
+func sendDueForAllOrgs(database *sql.DB, cfg config.Config) {
 	rows, err := database.Query(`SELECT id FROM organizations`)
 	if err != nil {
 		log.Printf("worker org query error: %v", err)
@@ -71,8 +102,11 @@ func sendDueForAllOrgs(database *sql.DB) {
 			log.Printf("worker org scan error: %v", err)
 			continue
 		}
-		if _, err := services.SendDueReminders(database, orgID, now); err != nil {
+		if _, err := services.SendDueReminders(database, services.ReminderLinks{BaseURL: cfg.BaseURL, Payments: cfg.PaymentProvider}, orgID, now, nil); err != nil {
 			log.Printf("worker send error: %v", err)
 		}
+		if _, err := services.EmitOverdueInvoices(database, orgID, now); err != nil {
+			log.Printf("worker overdue error: %v", err)
+		}
 	}
 }
@@ -0,0 +1,556 @@
+package api
+
+import (
+	"archive/zip"
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	exportXero       = "xero"
+	exportQuickBooks = "quickbooks"
+	exportIIF        = "iif"
+	exportUBL        = "ubl"
+)
+
+// Invoices carry a single amount, so each one is exported as one line item
+// booked to these accounts.
+const (
+	xeroSalesAccount     = "200"
+	xeroTaxType          = "Tax Exempt"
+	quickBooksItem       = "Services"
+	iifReceivableAccount = "Accounts Receivable"
+	iifIncomeAccount     = "Sales"
+	iifDepositAccount    = "Undeposited Funds"
+)
+
+type exportedInvoice struct {
+	ID            string
+	Number        string
+	Status        string
+	Currency      string
+	AmountCents   int64
+	PaidCents     int64
+	DueDate       time.Time
+	Notes         string
+	CreatedAt     time.Time
+	ClientName    string
+	ClientEmail   string
+	ClientCompany string
+	Payments      []exportedPayment
+}
+
+// contact is the name accounting systems match customers on. The web app
+// saves a client without a company as "-".
+func (inv exportedInvoice) contact() string {
+	return exportContact(inv.ClientName, inv.ClientCompany)
+}
+
+func exportContact(name, company string) string {
+	if company = strings.TrimSpace(company); company != "" && company != "-" {
+		return company
+	}
+	return name
+}
+
+func (inv exportedInvoice) description() string {
+	if inv.Notes != "" {
+		return inv.Notes
+	}
+	return "Invoice " + inv.Number
+}
+
+type invoiceWriter interface {
+	Write(inv exportedInvoice) error
+	Close() error
+}
+
+// streamAccountingExport streams invoices from query, which must select the
+// columns of invoiceExportQuery, in an accounting system's import format.
+// Like streamExport it reads in batches between writes.
+func streamAccountingExport(c *fiber.Ctx, db *sql.DB, format, query string, args []interface{}, p page) error {
+	var supplier string
+	if err := db.QueryRow(`SELECT name FROM organizations WHERE id = ?`, orgIDFrom(c)).Scan(&supplier); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	p.limit = exportBatchSize
+	var batch []exportedInvoice
+	scan := func(rows *sql.Rows, _ []string) (interface{}, string, error) {
+		var inv exportedInvoice
+		var balance int64
+		var templateID, clientID sql.NullString
+		var due, created, updated string
+		if err := rows.Scan(&inv.ID, &inv.Number, &inv.Status, &inv.Currency, &inv.AmountCents, &inv.PaidCents, &balance,
+			&due, &inv.Notes, &templateID, &created, &updated,
+			&clientID, &inv.ClientName, &inv.ClientEmail, &inv.ClientCompany); err != nil {
+			return nil, "", err
+		}
+		sortValues := map[string]interface{}{"created_at": created, "due_date": due, "amount_cents": inv.AmountCents, "number": inv.Number}
+		inv.Currency = strings.ToUpper(inv.Currency)
+		inv.DueDate, _ = time.Parse(time.RFC3339, due)
+		inv.CreatedAt, _ = time.Parse(time.RFC3339, created)
+		batch = append(batch, inv)
+		return sortValues[p.field], inv.ID, nil
+	}
+	_, more, err := readExportBatch(db, &p, query, args, scan)
+	if err == nil {
+		err = loadExportPayments(db, batch)
+	}
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+
+	var filename string
+	switch format {
+	case exportXero, exportQuickBooks:
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+		filename = "invoices-" + format + ".csv"
+	case exportIIF:
+		c.Set(fiber.HeaderContentType, "text/plain; charset=utf-8")
+		filename = "invoices.iif"
+	case exportUBL:
+		c.Set(fiber.HeaderContentType, "application/zip")
+		filename = "invoices-ubl.zip"
+	}
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, filename))
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		out := newInvoiceWriter(format, w, supplier)
+		defer func() {
+			_ = out.Close()
+			_ = w.Flush()
+		}()
+		for {
+			for _, inv := range batch {
+				if err := out.Write(inv); err != nil {
+					return
+				}
+			}
+			if !more {
+				return
+			}
+			batch = batch[:0]
+			if _, more, err = readExportBatch(db, &p, query, args, scan); err != nil {
+				return
+			}
+			if err := loadExportPayments(db, batch); err != nil {
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// loadExportPayments attaches each invoice's recorded payments, oldest
+// first.
+func loadExportPayments(db *sql.DB, batch []exportedInvoice) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	index := make(map[string]int, len(batch))
+	args := make([]interface{}, 0, len(batch))
+	for i, inv := range batch {
+		index[inv.ID] = i
+		args = append(args, inv.ID)
+	}
+	rows, err := db.Query(`SELECT id, invoice_id, provider, amount_cents, currency, paid_at FROM payments
+		WHERE invoice_id IN (?`+strings.Repeat(", ?", len(args)-1)+`) ORDER BY paid_at, id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pay exportedPayment
+		var paidAt string
+		if err := rows.Scan(&pay.ID, &pay.InvoiceID, &pay.Provider, &pay.AmountCents, &pay.Currency, &paidAt); err != nil {
+			return err
+		}
+		pay.Currency = strings.ToUpper(pay.Currency)
+		pay.PaidAt, _ = time.Parse(time.RFC3339, paidAt)
+		inv := &batch[index[pay.InvoiceID]]
+		pay.InvoiceNumber, pay.ClientName, pay.ClientCompany = inv.Number, inv.ClientName, inv.ClientCompany
+		inv.Payments = append(inv.Payments, pay)
+	}
+	return rows.Err()
+}
+
+type exportedPayment struct {
+	ID            string
+	InvoiceID     string
+	InvoiceNumber string
+	Provider      string
+	AmountCents   int64
+	Currency      string
+	PaidAt        time.Time
+	ClientName    string
+	ClientCompany string
+}
+
+func (pay exportedPayment) contact() string {
+	return exportContact(pay.ClientName, pay.ClientCompany)
+}
+
+// streamPaymentExport streams payments from query, which must select the
+// columns of paymentExportQuery, as a bank statement import that Xero or
+// QuickBooks Online can reconcile against the exported invoices.
+func streamPaymentExport(c *fiber.Ctx, db *sql.DB, format, query string, args []interface{}, p page) error {
+	p.limit = exportBatchSize
+	var batch []exportedPayment
+	scan := func(rows *sql.Rows, _ []string) (interface{}, string, error) {
+		var pay exportedPayment
+		var providerPaymentID, paidAt, created, clientEmail string
+		if err := rows.Scan(&pay.ID, &pay.InvoiceID, &pay.InvoiceNumber, &pay.Provider, &providerPaymentID,
+			&pay.AmountCents, &pay.Currency, &paidAt, &created,
+			&pay.ClientName, &clientEmail, &pay.ClientCompany); err != nil {
+			return nil, "", err
+		}
+		sortValues := map[string]interface{}{"paid_at": paidAt, "amount_cents": pay.AmountCents}
+		pay.Currency = strings.ToUpper(pay.Currency)
+		pay.PaidAt, _ = time.Parse(time.RFC3339, paidAt)
+		batch = append(batch, pay)
+		return sortValues[p.field], pay.ID, nil
+	}
+	_, more, err := readExportBatch(db, &p, query, args, scan)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+
+	c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="payments-%s.csv"`, format))
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		out := csv.NewWriter(w)
+		row := xeroPaymentRow
+		if format == exportQuickBooks {
+			row = quickBooksPaymentRow
+		}
+		_ = out.Write(row(nil))
+		defer func() {
+			out.Flush()
+			_ = w.Flush()
+		}()
+		for {
+			for _, pay := range batch {
+				record := row(&pay)
+				for i, cell := range record {
+					record[i] = csvCell(cell)
+				}
+				if err := out.Write(record); err != nil {
+					return
+				}
+			}
+			out.Flush()
+			if !more {
+				return
+			}
+			batch = batch[:0]
+			if _, more, err = readExportBatch(db, &p, query, args, scan); err != nil {
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// xeroPaymentRow lays a payment out as a row of Xero's bank statement
+// import, or returns the header for nil. Reference carries the invoice
+// number so the deposit can be matched to its invoice.
+func xeroPaymentRow(pay *exportedPayment) []string {
+	if pay == nil {
+		return []string{"*Date", "*Amount", "Payee", "Description", "Reference", "Cheque Number"}
+	}
+	return []string{pay.PaidAt.Format("2006-01-02"), decimalAmount(pay.AmountCents), pay.contact(),
+		paymentDescription(*pay), pay.InvoiceNumber, ""}
+}
+
+// quickBooksPaymentRow is the three-column bank upload QuickBooks Online
+// accepts.
+func quickBooksPaymentRow(pay *exportedPayment) []string {
+	if pay == nil {
+		return []string{"Date", "Description", "Amount"}
+	}
+	return []string{pay.PaidAt.Format("01/02/2006"), paymentDescription(*pay), decimalAmount(pay.AmountCents)}
+}
+
+func paymentDescription(pay exportedPayment) string {
+	return "Payment for invoice " + pay.InvoiceNumber
+}
+
+func newInvoiceWriter(format string, w io.Writer, supplier string) invoiceWriter {
+	switch format {
+	case exportXero:
+		return newXeroWriter(w)
+	case exportQuickBooks:
+		return newQuickBooksWriter(w)
+	case exportIIF:
+		return newIIFWriter(w)
+	default:
+		return &ublWriter{zip: zip.NewWriter(w), supplier: supplier, names: map[string]bool{}}
+	}
+}
+
+// decimalAmount formats cents as a plain decimal such as 1250.50.
+func decimalAmount(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// csvInvoiceWriter writes one CSV row per invoice.
+type csvInvoiceWriter struct {
+	out *csv.Writer
+	row func(inv exportedInvoice) []string
+}
+
+func (cw *csvInvoiceWriter) Write(inv exportedInvoice) error {
+	record := cw.row(inv)
+	for i, cell := range record {
+		record[i] = csvCell(cell)
+	}
+	if err := cw.out.Write(record); err != nil {
+		return err
+	}
+	cw.out.Flush()
+	return cw.out.Error()
+}
+
+func (cw *csvInvoiceWriter) Close() error {
+	cw.out.Flush()
+	return cw.out.Error()
+}
+
+// newXeroWriter writes Xero's sales invoice import template.
+func newXeroWriter(w io.Writer) invoiceWriter {
+	out := csv.NewWriter(w)
+	_ = out.Write([]string{"*ContactName", "EmailAddress", "POAddressLine1", "POAddressLine2", "POAddressLine3", "POAddressLine4",
+		"POCity", "PORegion", "POPostalCode", "POCountry", "*InvoiceNumber", "Reference", "*InvoiceDate", "*DueDate", "Total",
+		"InventoryItemCode", "*Description", "*Quantity", "*UnitAmount", "Discount", "*AccountCode", "*TaxType", "TaxAmount",
+		"TrackingName1", "TrackingOption1", "TrackingName2", "TrackingOption2", "Currency", "BrandingTheme"})
+	return &csvInvoiceWriter{out: out, row: func(inv exportedInvoice) []string {
+		amount := decimalAmount(inv.AmountCents)
+		return []string{inv.contact(), inv.ClientEmail, "", "", "", "",
+			"", "", "", "", inv.Number, "", inv.CreatedAt.Format("2006-01-02"), inv.DueDate.Format("2006-01-02"), amount,
+			"", inv.description(), "1", amount, "", xeroSalesAccount, xeroTaxType, "",
+			"", "", "", "", inv.Currency, ""}
+	}}
+}
+
+// newQuickBooksWriter writes the QuickBooks Online invoice import layout.
+func newQuickBooksWriter(w io.Writer) invoiceWriter {
+	out := csv.NewWriter(w)
+	_ = out.Write([]string{"InvoiceNo", "Customer", "InvoiceDate", "DueDate", "Memo",
+		"Item(Product/Service)", "ItemDescription", "ItemQuantity", "ItemRate", "ItemAmount", "Currency"})
+	return &csvInvoiceWriter{out: out, row: func(inv exportedInvoice) []string {
+		amount := decimalAmount(inv.AmountCents)
+		return []string{inv.Number, inv.contact(), inv.CreatedAt.Format("01/02/2006"), inv.DueDate.Format("01/02/2006"), inv.Notes,
+			quickBooksItem, inv.description(), "1", amount, amount, inv.Currency}
+	}}
+}
+
+// iifWriter writes QuickBooks Desktop IIF: an INVOICE transaction per
+// invoice, followed by a PAYMENT transaction for each recorded payment.
+type iifWriter struct {
+	w io.Writer
+}
+
+func newIIFWriter(w io.Writer) invoiceWriter {
+	_, _ = io.WriteString(w, "!TRNS\tTRNSTYPE\tDATE\tACCNT\tNAME\tAMOUNT\tDOCNUM\tMEMO\tDUEDATE\n"+
+		"!SPL\tTRNSTYPE\tDATE\tACCNT\tNAME\tAMOUNT\tDOCNUM\tMEMO\n"+
+		"!ENDTRNS\n")
+	return &iifWriter{w: w}
+}
+
+func (iw *iifWriter) Write(inv exportedInvoice) error {
+	name, number, memo := iifField(inv.contact()), iifField(inv.Number), iifField(inv.description())
+	amount := decimalAmount(inv.AmountCents)
+	issued := inv.CreatedAt.Format("01/02/2006")
+	if _, err := fmt.Fprintf(iw.w, "TRNS\tINVOICE\t%s\t%s\t%s\t%s\t%s\t%s\t%s\nSPL\tINVOICE\t%s\t%s\t%s\t%s\t%s\t%s\nENDTRNS\n",
+		issued, iifReceivableAccount, name, amount, number, memo, inv.DueDate.Format("01/02/2006"),
+		issued, iifIncomeAccount, name, decimalAmount(-inv.AmountCents), number, memo); err != nil {
+		return err
+	}
+	for _, pay := range inv.Payments {
+		paid := pay.PaidAt.Format("01/02/2006")
+		if _, err := fmt.Fprintf(iw.w, "TRNS\tPAYMENT\t%s\t%s\t%s\t%s\t%s\t%s\t\nSPL\tPAYMENT\t%s\t%s\t%s\t%s\t%s\t%s\nENDTRNS\n",
+			paid, iifDepositAccount, name, decimalAmount(pay.AmountCents), number, memo,
+			paid, iifReceivableAccount, name, decimalAmount(-pay.AmountCents), number, memo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (iw *iifWriter) Close() error {
+	return nil
+}
+
+// iifField strips the tabs and line breaks that would split an IIF row.
+func iifField(value string) string {
+	return strings.NewReplacer("\t", " ", "\r", " ", "\n", " ", `"`, "'").Replace(value)
+}
+
+const (
+	ublInvoiceNamespace   = "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2"
+	ublAggregateNamespace = "urn:oasis:names:specification:ubl:schema:xsd:CommonAggregateComponents-2"
+	ublBasicNamespace     = "urn:oasis:names:specification:ubl:schema:xsd:CommonBasicComponents-2"
+)
+
+// ublInvoice is a UBL 2.1 Invoice. Fields follow the element order of the
+// Invoice schema, which is significant.
+type ublInvoice struct {
+	XMLName              xml.Name         `xml:"Invoice"`
+	Xmlns                string           `xml:"xmlns,attr"`
+	XmlnsCac             string           `xml:"xmlns:cac,attr"`
+	XmlnsCbc             string           `xml:"xmlns:cbc,attr"`
+	UBLVersionID         string           `xml:"cbc:UBLVersionID"`
+	ID                   string           `xml:"cbc:ID"`
+	UUID                 string           `xml:"cbc:UUID"`
+	IssueDate            string           `xml:"cbc:IssueDate"`
+	DueDate              string           `xml:"cbc:DueDate"`
+	InvoiceTypeCode      string           `xml:"cbc:InvoiceTypeCode"`
+	Note                 string           `xml:"cbc:Note,omitempty"`
+	DocumentCurrencyCode string           `xml:"cbc:DocumentCurrencyCode"`
+	Supplier             ublParty         `xml:"cac:AccountingSupplierParty>cac:Party"`
+	Customer             ublParty         `xml:"cac:AccountingCustomerParty>cac:Party"`
+	PrepaidPayment       []ublPayment     `xml:"cac:PrepaidPayment"`
+	LegalMonetaryTotal   ublMonetaryTotal `xml:"cac:LegalMonetaryTotal"`
+	InvoiceLine          ublInvoiceLine   `xml:"cac:InvoiceLine"`
+}
+
+type ublAmount struct {
+	Value      string `xml:",chardata"`
+	CurrencyID string `xml:"currencyID,attr"`
+}
+
+type ublParty struct {
+	Name    string      `xml:"cac:PartyName>cbc:Name"`
+	Contact *ublContact `xml:"cac:Contact"`
+}
+
+type ublContact struct {
+	Name           string `xml:"cbc:Name,omitempty"`
+	ElectronicMail string `xml:"cbc:ElectronicMail,omitempty"`
+}
+
+type ublPayment struct {
+	ID         string    `xml:"cbc:ID"`
+	PaidAmount ublAmount `xml:"cbc:PaidAmount"`
+	PaidDate   string    `xml:"cbc:PaidDate"`
+}
+
+type ublMonetaryTotal struct {
+	LineExtensionAmount ublAmount  `xml:"cbc:LineExtensionAmount"`
+	TaxExclusiveAmount  ublAmount  `xml:"cbc:TaxExclusiveAmount"`
+	TaxInclusiveAmount  ublAmount  `xml:"cbc:TaxInclusiveAmount"`
+	PrepaidAmount       *ublAmount `xml:"cbc:PrepaidAmount"`
+	PayableAmount       ublAmount  `xml:"cbc:PayableAmount"`
+}
+
+type ublQuantity struct {
+	Value    string `xml:",chardata"`
+	UnitCode string `xml:"unitCode,attr"`
+}
+
+type ublInvoiceLine struct {
+	ID                  string      `xml:"cbc:ID"`
+	InvoicedQuantity    ublQuantity `xml:"cbc:InvoicedQuantity"`
+	LineExtensionAmount ublAmount   `xml:"cbc:LineExtensionAmount"`
+	Description         string      `xml:"cac:Item>cbc:Description"`
+	Name                string      `xml:"cac:Item>cbc:Name"`
+	PriceAmount         ublAmount   `xml:"cac:Price>cbc:PriceAmount"`
+}
+
+// ublWriter zips one UBL invoice document per invoice, named by number.
+type ublWriter struct {
+	zip      *zip.Writer
+	supplier string
+	names    map[string]bool
+}
+
+func (uw *ublWriter) Write(inv exportedInvoice) error {
+	amount := ublAmount{Value: decimalAmount(inv.AmountCents), CurrencyID: inv.Currency}
+	doc := ublInvoice{
+		Xmlns:                ublInvoiceNamespace,
+		XmlnsCac:             ublAggregateNamespace,
+		XmlnsCbc:             ublBasicNamespace,
+		UBLVersionID:         "2.1",
+		ID:                   inv.Number,
+		UUID:                 inv.ID,
+		IssueDate:            inv.CreatedAt.Format("2006-01-02"),
+		DueDate:              inv.DueDate.Format("2006-01-02"),
+		InvoiceTypeCode:      "380",
+		Note:                 inv.Notes,
+		DocumentCurrencyCode: inv.Currency,
+		Supplier:             ublParty{Name: uw.supplier},
+		Customer:             ublParty{Name: inv.contact(), Contact: &ublContact{Name: inv.ClientName, ElectronicMail: inv.ClientEmail}},
+		LegalMonetaryTotal: ublMonetaryTotal{
+			LineExtensionAmount: amount,
+			TaxExclusiveAmount:  amount,
+			TaxInclusiveAmount:  amount,
+			PayableAmount:       amount,
+		},
+		InvoiceLine: ublInvoiceLine{
+			ID:                  "1",
+			InvoicedQuantity:    ublQuantity{Value: "1", UnitCode: "C62"},
+			LineExtensionAmount: amount,
+			Description:         inv.description(),
+			Name:                "Invoice " + inv.Number,
+			PriceAmount:         amount,
+		},
+	}
+	// Only recorded payments are prepaid, so an invoice marked paid by hand
+	// still shows its full amount payable.
+	if len(inv.Payments) > 0 {
+		for _, pay := range inv.Payments {
+			doc.PrepaidPayment = append(doc.PrepaidPayment, ublPayment{
+				ID:         pay.ID,
+				PaidAmount: ublAmount{Value: decimalAmount(pay.AmountCents), CurrencyID: pay.Currency},
+				PaidDate:   pay.PaidAt.Format("2006-01-02"),
+			})
+		}
+		payable := inv.AmountCents - inv.PaidCents
+		if payable < 0 {
+			payable = 0
+		}
+		doc.LegalMonetaryTotal.PrepaidAmount = &ublAmount{Value: decimalAmount(inv.PaidCents), CurrencyID: inv.Currency}
+		doc.LegalMonetaryTotal.PayableAmount = ublAmount{Value: decimalAmount(payable), CurrencyID: inv.Currency}
+	}
+
+	name := uw.filename(inv)
+	f, err := uw.zip.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(f)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
+
+func (uw *ublWriter) filename(inv exportedInvoice) string {
+	base := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r < ' ' {
+			return '-'
+		}
+		return r
+	}, inv.Number)
+	if base == "" || uw.names[base] {
+		base += "-" + inv.ID
+	}
+	uw.names[base] = true
+	return base + ".xml"
+}
+
+func (uw *ublWriter) Close() error {
+	return uw.zip.Close()
+}
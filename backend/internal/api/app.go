@@ -6,6 +6,8 @@ import (
 	"github.com/gofiber/fiber/v2"
 
 	"nudgepay/internal/config"
+	"nudgepay/internal/services"
+	"nudgepay/internal/sso"
 )
 
 func NewApp(db *sql.DB, cfg config.Config) *fiber.App {
@@ -19,36 +21,127 @@ func NewApp(db *sql.DB, cfg config.Config) *fiber.App {
 
 	app.Post("/api/auth/register", handleRegister(db, cfg))
 	app.Post("/api/auth/login", handleLogin(db, cfg))
+	app.Post("/api/auth/login/2fa", handleLoginTwoFactor(db, cfg))
+	app.Post("/api/auth/refresh", handleRefresh(db, cfg))
+	app.Post("/api/auth/verify-email", handleVerifyEmail(db, cfg))
+	app.Post("/api/auth/forgot-password", handleForgotPassword(db, cfg))
+	app.Post("/api/auth/reset-password", handleResetPassword(db, cfg))
+	app.Post("/api/auth/accept-invite", handleAcceptInvitation(db, cfg))
 
-	secured := app.Group("/api", authRequired(cfg.JWTSecret))
-	secured.Get("/me", handleMe(db))
-	secured.Get("/org", handleGetOrg(db))
-	secured.Put("/org", handleUpdateOrg(db))
+	ssoClient := sso.NewClient(nil)
+	app.Get("/api/auth/sso/providers", handleSSOProviders(cfg))
+	app.Post("/api/auth/sso/:provider/start", handleSSOStart(db, cfg, ssoClient))
+	app.Post("/api/auth/sso/callback", handleSSOCallback(db, cfg, ssoClient))
+	app.Post("/api/payment-webhooks/:org_id/:provider", handlePaymentWebhook(db, cfg))
+	app.Get("/pay/:token", handlePublicInvoice(db, cfg))
+	app.Get("/pay/:token/pdf", handlePublicInvoicePDF(db, cfg))
+	app.Get("/unsubscribe/:token", handleUnsubscribePage(db))
+	app.Post("/unsubscribe/:token", handleUnsubscribe(db, cfg))
 
-	secured.Get("/metrics", handleMetrics(db))
+	// The client portal has its own sessions and never reaches the staff API.
+	app.Post("/api/portal/login", handlePortalLogin(db, cfg))
+	app.Post("/api/portal/session", handlePortalSession(db, cfg))
+	portal := app.Group("/api/portal", portalRequired(db, cfg))
+	portal.Post("/logout", handlePortalLogout(db, cfg))
+	portal.Get("/me", handlePortalMe(db))
+	portal.Get("/invoices", handlePortalInvoices(db))
+	portal.Get("/invoices/:id", handlePortalInvoice(db))
+	portal.Get("/invoices/:id/pdf", handlePortalInvoicePDF(db))
+	portal.Get("/payments", handlePortalPayments(db))
+	portal.Get("/reminders", handlePortalReminders(db))
+	portal.Get("/statement", handlePortalStatement(db, cfg))
 
-	secured.Get("/clients", handleListClients(db))
-	secured.Post("/clients", handleCreateClient(db))
-	secured.Get("/clients/:id", handleGetClient(db))
-	secured.Put("/clients/:id", handleUpdateClient(db))
-	secured.Delete("/clients/:id", handleDeleteClient(db))
+	secured := app.Group("/api", authRequired(db, cfg), membershipRequired(db), ssoEnforced(db), twoFactorEnforced(db), idempotent(db, cfg))
+	anyMember := requireRole(services.RoleAccountant)
+	member := services.RoleMember
+	admin := services.RoleAdmin
+	reader := services.RoleAccountant
 
-	secured.Get("/templates", handleListTemplates(db))
-	secured.Post("/templates", handleCreateTemplate(db))
-	secured.Put("/templates/:id", handleUpdateTemplate(db))
-	secured.Delete("/templates/:id", handleDeleteTemplate(db))
+	secured.Post("/auth/logout", anyMember, handleLogout(db, cfg))
+	secured.Post("/auth/verify-email/resend", anyMember, handleResendVerification(db, cfg))
+	secured.Get("/sessions", anyMember, handleListSessions(db, cfg))
+	secured.Delete("/sessions/:id", anyMember, handleRevokeSession(db, cfg))
+	secured.Get("/me", anyMember, handleMe(db))
+	secured.Get("/me/orgs", anyMember, handleListMyOrgs(db))
+	secured.Post("/me/orgs", anyMember, handleCreateOrg(db, cfg))
+	secured.Post("/me/orgs/:id/switch", anyMember, handleSwitchOrg(db, cfg))
+	secured.Post("/me/2fa/setup", anyMember, handleTwoFactorSetup(db))
+	secured.Post("/me/2fa/enable", anyMember, handleTwoFactorEnable(db, cfg))
+	secured.Post("/me/2fa/disable", anyMember, handleTwoFactorDisable(db, cfg))
+	secured.Post("/me/2fa/recovery-codes", anyMember, handleRegenerateRecoveryCodes(db, cfg))
+	secured.Get("/org", requireRoleOrScope(reader, services.ScopeOrgRead), handleGetOrg(db))
+	secured.Put("/org", requireRole(admin), handleUpdateOrg(db, cfg))
+	secured.Get("/org/payment-webhook", requireRole(admin), handleGetPaymentWebhook(db, cfg))
+	secured.Put("/org/payment-webhook", requireRole(admin), handleSetPaymentWebhook(db, cfg))
 
-	secured.Get("/invoices", handleListInvoices(db))
-	secured.Post("/invoices", handleCreateInvoice(db))
-	secured.Get("/invoices/:id", handleGetInvoice(db))
-	secured.Put("/invoices/:id", handleUpdateInvoice(db))
-	secured.Delete("/invoices/:id", handleDeleteInvoice(db))
+	secured.Get("/members", anyMember, handleListMembers(db))
+	secured.Put("/members/:id", requireRole(admin), handleUpdateMember(db, cfg))
+	secured.Delete("/members/:id", anyMember, handleRemoveMember(db, cfg))
+	secured.Get("/invitations", requireRole(admin), handleListInvitations(db, cfg))
+	secured.Post("/invitations", requireRole(admin), handleCreateInvitation(db, cfg))
+	secured.Delete("/invitations/:id", requireRole(admin), handleRevokeInvitation(db, cfg))
 
-	secured.Get("/reminders", handleListReminders(db))
-	secured.Post("/reminders/:id/send", handleSendReminder(db))
-	secured.Post("/reminders/send-due", handleSendDueReminders(db))
+	secured.Get("/api-keys", requireRole(admin), handleListAPIKeys(db))
+	secured.Post("/api-keys", requireRole(admin), handleCreateAPIKey(db, cfg))
+	secured.Delete("/api-keys/:id", requireRole(admin), handleRevokeAPIKey(db, cfg))
 
-	secured.Get("/outbox", handleListOutbox(db))
+	secured.Get("/webhooks", requireRole(admin), handleListWebhooks(db))
+	secured.Post("/webhooks", requireRole(admin), handleCreateWebhook(db, cfg))
+	secured.Put("/webhooks/:id", requireRole(admin), handleUpdateWebhook(db, cfg))
+	secured.Delete("/webhooks/:id", requireRole(admin), handleDeleteWebhook(db, cfg))
+	secured.Get("/webhooks/:id/deliveries", requireRole(admin), handleListWebhookDeliveries(db))
+	secured.Post("/webhooks/:id/deliveries/:delivery_id/redeliver", requireRole(admin), handleRedeliverWebhook(db, cfg))
+
+	secured.Get("/audit", requireRoleOrScope(admin, services.ScopeAuditRead), handleListAudit(db))
+	secured.Get("/audit/export", requireRoleOrScope(admin, services.ScopeAuditRead), handleExportAudit(db))
+
+	secured.Get("/metrics", requireRoleOrScope(reader, services.ScopeMetricsRead), handleMetrics(db))
+
+	secured.Get("/exports/invoices", requireRoleOrScope(reader, services.ScopeInvoicesRead), handleExportInvoices(db))
+	secured.Get("/exports/reminders", requireRoleOrScope(reader, services.ScopeRemindersRead), handleExportReminders(db))
+	secured.Get("/exports/outbox", requireRoleOrScope(reader, services.ScopeOutboxRead), handleExportOutbox(db))
+	secured.Get("/exports/payments", requireRoleOrScope(reader, services.ScopeInvoicesRead), handleExportPayments(db))
+	// Search spans several resources, so it is left to users rather than
+	// per-resource API key scopes.
+	secured.Get("/search", requireRole(reader), handleSearch(db))
+
+	secured.Get("/clients", requireRoleOrScope(reader, services.ScopeClientsRead), handleListClients(db))
+	secured.Post("/clients", requireRoleOrScope(member, services.ScopeClientsWrite), handleCreateClient(db, cfg))
+	secured.Get("/clients/:id", requireRoleOrScope(reader, services.ScopeClientsRead), handleGetClient(db))
+	secured.Put("/clients/:id", requireRoleOrScope(member, services.ScopeClientsWrite), handleUpdateClient(db, cfg))
+	secured.Patch("/clients/:id", requireRoleOrScope(member, services.ScopeClientsWrite), handlePatchClient(db, cfg))
+	secured.Delete("/clients/:id", requireRoleOrScope(member, services.ScopeClientsWrite), handleDeleteClient(db, cfg))
+
+	secured.Get("/templates", requireRoleOrScope(reader, services.ScopeTemplatesRead), handleListTemplates(db))
+	secured.Post("/templates", requireRoleOrScope(member, services.ScopeTemplatesWrite), handleCreateTemplate(db, cfg))
+	secured.Put("/templates/:id", requireRoleOrScope(member, services.ScopeTemplatesWrite), handleUpdateTemplate(db, cfg))
+	secured.Patch("/templates/:id", requireRoleOrScope(member, services.ScopeTemplatesWrite), handlePatchTemplate(db, cfg))
+	secured.Delete("/templates/:id", requireRoleOrScope(member, services.ScopeTemplatesWrite), handleDeleteTemplate(db, cfg))
+	secured.Post("/templates/:id/default", requireRoleOrScope(member, services.ScopeTemplatesWrite), handleSetDefaultTemplate(db, cfg))
+
+	secured.Post("/import/clients", requireRoleOrScope(member, services.ScopeClientsWrite), handleImportClients(db, cfg))
+	secured.Post("/import/invoices", requireRoleOrScope(member, services.ScopeInvoicesWrite), handleImportInvoices(db, cfg))
+
+	secured.Get("/invoices", requireRoleOrScope(reader, services.ScopeInvoicesRead), handleListInvoices(db))
+	secured.Post("/invoices", requireRoleOrScope(member, services.ScopeInvoicesWrite), handleCreateInvoice(db, cfg))
+	secured.Get("/invoices/:id", requireRoleOrScope(reader, services.ScopeInvoicesRead), handleGetInvoice(db))
+	secured.Put("/invoices/:id", requireRoleOrScope(member, services.ScopeInvoicesWrite), handleUpdateInvoice(db, cfg))
+	secured.Patch("/invoices/:id", requireRoleOrScope(member, services.ScopeInvoicesWrite), handlePatchInvoice(db, cfg))
+	secured.Delete("/invoices/:id", requireRoleOrScope(member, services.ScopeInvoicesWrite), handleDeleteInvoice(db, cfg))
+	secured.Post("/invoices/:id/payment-link", requireRoleOrScope(member, services.ScopeInvoicesWrite), handleCreatePaymentLink(db, cfg))
+	secured.Get("/invoices/:id/share-links", requireRoleOrScope(reader, services.ScopeInvoicesRead), handleListShareLinks(db))
+	secured.Post("/invoices/:id/share-links", requireRoleOrScope(member, services.ScopeInvoicesWrite), handleCreateShareLink(db, cfg))
+	secured.Delete("/invoices/:id/share-links/:link_id", requireRoleOrScope(member, services.ScopeInvoicesWrite), handleRevokeShareLink(db, cfg))
+
+	secured.Get("/reminders", requireRoleOrScope(reader, services.ScopeRemindersRead), handleListReminders(db))
+	secured.Post("/reminders/:id/send", requireRoleOrScope(member, services.ScopeRemindersSend), handleSendReminder(db, cfg))
+	secured.Post("/reminders/send-due", requireRoleOrScope(member, services.ScopeRemindersSend), handleSendDueReminders(db, cfg))
+
+	secured.Get("/outbox", requireRoleOrScope(reader, services.ScopeOutboxRead), handleListOutbox(db))
+
+	secured.Get("/suppressions", requireRoleOrScope(reader, services.ScopeSuppressionsRead), handleListSuppressions(db))
+	secured.Post("/suppressions", requireRoleOrScope(member, services.ScopeSuppressionsWrite), handleCreateSuppression(db, cfg))
+	secured.Delete("/suppressions/:id", requireRoleOrScope(member, services.ScopeSuppressionsWrite), handleDeleteSuppression(db, cfg))
 
 	return app
 }
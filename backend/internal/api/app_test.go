@@ -1,18 +1,36 @@
 package api_test
 
 import (
+	"archive/zip"
 	"bytes"
+	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 
 	"nudgepay/internal/api"
+	"nudgepay/internal/auth"
 	"nudgepay/internal/config"
 	"nudgepay/internal/db"
+	"nudgepay/internal/mail"
+	"nudgepay/internal/payments"
+	"nudgepay/internal/services"
 )
 
 type registerResponse struct {
@@ -28,7 +46,8 @@ type registerResponse struct {
 }
 
 type loginResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
 }
 
 type createResponse struct {
@@ -37,22 +56,41 @@ type createResponse struct {
 
 type outboxResponse struct {
 	Outbox []struct {
-		ID string `json:"id"`
+		ID      string `json:"id"`
+		ToEmail string `json:"to_email"`
+		Subject string `json:"subject"`
 	} `json:"outbox"`
 }
 
+type fakeClock struct {
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.now = f.now.Add(d)
+}
+
 func newTestApp(t *testing.T) (*fiber.App, func()) {
+	t.Helper()
+	app, _, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", WorkerEnabled: false})
+	return app, cleanup
+}
+
+func newTestAppWithConfig(t *testing.T, cfg config.Config) (*fiber.App, *sql.DB, func()) {
 	t.Helper()
 	database, err := db.New(":memory:")
 	if err != nil {
 		t.Fatalf("db error: %v", err)
 	}
-	cfg := config.Config{JWTSecret: "test-secret", WorkerEnabled: false}
 	app := api.NewApp(database, cfg)
 	cleanup := func() {
 		_ = database.Close()
 	}
-	return app, cleanup
+	return app, database, cleanup
 }
 
 func TestRegisterAndLogin(t *testing.T) {
@@ -86,6 +124,681 @@ func TestRegisterAndLogin(t *testing.T) {
 	}
 }
 
+func TestRefreshRotationLogoutAndRevocation(t *testing.T) {
+	app, cleanup := newTestApp(t)
+	defer cleanup()
+
+	registerOrg(t, app, "owner@example.com", "Studio One")
+	login := func() loginResponse {
+		resp := performRequest(t, app, "POST", "/api/auth/login", map[string]string{
+			"email": "owner@example.com", "password": "password123",
+		}, "")
+		var out loginResponse
+		decodeJSON(t, resp, &out)
+		if out.Token == "" || out.RefreshToken == "" {
+			t.Fatalf("expected access and refresh tokens")
+		}
+		return out
+	}
+
+	first := login()
+	resp := performRequest(t, app, "POST", "/api/auth/refresh", map[string]string{"refresh_token": first.RefreshToken}, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var rotated loginResponse
+	decodeJSON(t, resp, &rotated)
+	if rotated.RefreshToken == first.RefreshToken {
+		t.Fatalf("expected a new refresh token")
+	}
+	if resp := performRequest(t, app, "GET", "/api/me", nil, rotated.Token); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 with rotated token, got %d", resp.StatusCode)
+	}
+
+	// Replaying the first refresh token kills the whole session family.
+	resp = performRequest(t, app, "POST", "/api/auth/refresh", map[string]string{"refresh_token": first.RefreshToken}, "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 on reuse, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "GET", "/api/me", nil, rotated.Token); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 after reuse detection, got %d", resp.StatusCode)
+	}
+	resp = performRequest(t, app, "POST", "/api/auth/refresh", map[string]string{"refresh_token": rotated.RefreshToken}, "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for descendant token, got %d", resp.StatusCode)
+	}
+
+	laptop := login()
+	phone := login()
+	var sessions struct {
+		Sessions []struct {
+			ID      string `json:"id"`
+			Current bool   `json:"current"`
+		} `json:"sessions"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/sessions", nil, laptop.Token), &sessions)
+	if len(sessions.Sessions) != 3 {
+		t.Fatalf("expected 3 active sessions, got %d", len(sessions.Sessions))
+	}
+	for _, s := range sessions.Sessions {
+		if !s.Current {
+			if resp := performRequest(t, app, "DELETE", "/api/sessions/"+s.ID, nil, laptop.Token); resp.StatusCode != http.StatusNoContent {
+				t.Fatalf("expected 204, got %d", resp.StatusCode)
+			}
+		}
+	}
+	if resp := performRequest(t, app, "GET", "/api/me", nil, phone.Token); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for revoked session, got %d", resp.StatusCode)
+	}
+
+	if resp := performRequest(t, app, "POST", "/api/auth/logout", nil, laptop.Token); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "GET", "/api/me", nil, laptop.Token); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 after logout, got %d", resp.StatusCode)
+	}
+	resp = performRequest(t, app, "POST", "/api/auth/refresh", map[string]string{"refresh_token": laptop.RefreshToken}, "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 refreshing logged out session, got %d", resp.StatusCode)
+	}
+}
+
+func TestEmailVerificationAndPasswordReset(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{
+		JWTSecret: "test-secret",
+		BaseURL:   "https://app.example.com",
+		Clock:     clock.Now,
+	})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	var me struct {
+		User struct {
+			EmailVerified bool `json:"email_verified"`
+		} `json:"user"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/me", nil, reg.Token), &me)
+	if me.User.EmailVerified {
+		t.Fatalf("expected unverified email after sign-up")
+	}
+
+	var outbox outboxResponse
+	decodeJSON(t, performRequest(t, app, "GET", "/api/outbox", nil, reg.Token), &outbox)
+	if len(outbox.Outbox) != 0 {
+		t.Fatalf("expected account emails to stay out of the org outbox")
+	}
+
+	verifyToken := latestEmailToken(t, database, "verify_email", "owner@example.com")
+	resp := performRequest(t, app, "POST", "/api/auth/verify-email", map[string]string{"token": verifyToken}, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/me", nil, reg.Token), &me)
+	if !me.User.EmailVerified {
+		t.Fatalf("expected verified email")
+	}
+	resp = performRequest(t, app, "POST", "/api/auth/verify-email", map[string]string{"token": verifyToken}, "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 reusing verification token, got %d", resp.StatusCode)
+	}
+
+	for i := 0; i < 3; i++ {
+		resp = performRequest(t, app, "POST", "/api/auth/forgot-password", map[string]string{"email": "owner@example.com"}, "")
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d", resp.StatusCode)
+		}
+	}
+	resp = performRequest(t, app, "POST", "/api/auth/forgot-password", map[string]string{"email": "owner@example.com"}, "")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 after limit, got %d", resp.StatusCode)
+	}
+	resp = performRequest(t, app, "POST", "/api/auth/forgot-password", map[string]string{"email": "nobody@example.com"}, "")
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202 for unknown address, got %d", resp.StatusCode)
+	}
+
+	staleToken := latestEmailToken(t, database, "password_reset", "owner@example.com")
+	clock.Advance(61 * time.Minute)
+	resp = performRequest(t, app, "POST", "/api/auth/reset-password", map[string]string{"token": staleToken, "password": "new-password"}, "")
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("expected 410 for expired token, got %d", resp.StatusCode)
+	}
+
+	resp = performRequest(t, app, "POST", "/api/auth/forgot-password", map[string]string{"email": "owner@example.com"}, "")
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202 once the window passed, got %d", resp.StatusCode)
+	}
+	resetToken := latestEmailToken(t, database, "password_reset", "owner@example.com")
+	resp = performRequest(t, app, "POST", "/api/auth/reset-password", map[string]string{"token": resetToken, "password": "new-password"}, "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	resp = performRequest(t, app, "POST", "/api/auth/reset-password", map[string]string{"token": resetToken, "password": "other-password"}, "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 reusing reset token, got %d", resp.StatusCode)
+	}
+
+	if resp := performRequest(t, app, "GET", "/api/me", nil, reg.Token); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected existing sessions revoked after reset, got %d", resp.StatusCode)
+	}
+	resp = performRequest(t, app, "POST", "/api/auth/login", map[string]string{"email": "owner@example.com", "password": "password123"}, "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected old password rejected, got %d", resp.StatusCode)
+	}
+	resp = performRequest(t, app, "POST", "/api/auth/login", map[string]string{"email": "owner@example.com", "password": "new-password"}, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected login with new password, got %d", resp.StatusCode)
+	}
+}
+
+func TestTwoFactorEnrollmentLoginAndOrgRequirement(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", Clock: clock.Now})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	var setup struct {
+		Secret     string `json:"secret"`
+		OtpauthURI string `json:"otpauth_uri"`
+	}
+	decodeJSON(t, performRequest(t, app, "POST", "/api/me/2fa/setup", nil, reg.Token), &setup)
+	if setup.Secret == "" || !strings.HasPrefix(setup.OtpauthURI, "otpauth://totp/NudgePay:owner@example.com?") {
+		t.Fatalf("unexpected enrollment %+v", setup)
+	}
+
+	resp := performRequest(t, app, "POST", "/api/me/2fa/enable", map[string]string{"code": "000000"}, reg.Token)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for wrong code, got %d", resp.StatusCode)
+	}
+	code := totpCode(t, setup.Secret, clock.Now())
+	resp = performRequest(t, app, "POST", "/api/me/2fa/enable", map[string]string{"code": code}, reg.Token)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var enabled struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	decodeJSON(t, resp, &enabled)
+	if len(enabled.RecoveryCodes) != 10 {
+		t.Fatalf("expected 10 recovery codes, got %d", len(enabled.RecoveryCodes))
+	}
+
+	type challengeResponse struct {
+		Token             string `json:"token"`
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		MFAToken          string `json:"mfa_token"`
+	}
+	startLogin := func() challengeResponse {
+		var out challengeResponse
+		decodeJSON(t, performRequest(t, app, "POST", "/api/auth/login", map[string]string{
+			"email": "owner@example.com", "password": "password123",
+		}, ""), &out)
+		if !out.TwoFactorRequired || out.MFAToken == "" || out.Token != "" {
+			t.Fatalf("expected a second step instead of a token, got %+v", out)
+		}
+		return out
+	}
+
+	challenge := startLogin()
+	resp = performRequest(t, app, "POST", "/api/auth/login/2fa", map[string]string{"mfa_token": challenge.MFAToken, "code": code}, "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected replayed code rejected, got %d", resp.StatusCode)
+	}
+	clock.Advance(30 * time.Second)
+	resp = performRequest(t, app, "POST", "/api/auth/login/2fa", map[string]string{
+		"mfa_token": challenge.MFAToken, "code": totpCode(t, setup.Secret, clock.Now()),
+	}, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var session loginResponse
+	decodeJSON(t, resp, &session)
+	if session.Token == "" {
+		t.Fatalf("expected access token after second step")
+	}
+
+	challenge = startLogin()
+	recovery := map[string]string{"mfa_token": challenge.MFAToken, "code": enabled.RecoveryCodes[0]}
+	if resp := performRequest(t, app, "POST", "/api/auth/login/2fa", recovery, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected recovery code accepted, got %d", resp.StatusCode)
+	}
+	challenge = startLogin()
+	recovery["mfa_token"] = challenge.MFAToken
+	if resp := performRequest(t, app, "POST", "/api/auth/login/2fa", recovery, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected used recovery code rejected, got %d", resp.StatusCode)
+	}
+
+	clock.Advance(10 * time.Minute)
+	resp = performRequest(t, app, "POST", "/api/auth/login/2fa", map[string]string{
+		"mfa_token": challenge.MFAToken, "code": totpCode(t, setup.Secret, clock.Now()),
+	}, "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected expired challenge rejected, got %d", resp.StatusCode)
+	}
+
+	resp = performRequest(t, app, "PUT", "/api/org", map[string]interface{}{"name": "Studio One", "require_2fa": true}, session.Token)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	resp = performRequest(t, app, "POST", "/api/me/2fa/disable", map[string]string{"code": enabled.RecoveryCodes[1]}, session.Token)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 disabling while required, got %d", resp.StatusCode)
+	}
+
+	other := registerOrg(t, app, "other@example.com", "Studio Two")
+	resp = performRequest(t, app, "PUT", "/api/org", map[string]interface{}{"name": "Studio Two", "require_2fa": true}, other.Token)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 requiring 2FA without enrolling, got %d", resp.StatusCode)
+	}
+	if _, err := database.Exec(`UPDATE organizations SET require_2fa = 1 WHERE id = ?`, other.Org.ID); err != nil {
+		t.Fatalf("db error: %v", err)
+	}
+	if resp := performRequest(t, app, "GET", "/api/clients", nil, other.Token); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 until enrolled, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "GET", "/api/me", nil, other.Token); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected /api/me reachable while enrolling, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "POST", "/api/me/2fa/setup", nil, other.Token); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected setup reachable while enrolling, got %d", resp.StatusCode)
+	}
+	// Only the enrolment routes are open, not everything under /api/me.
+	if resp := performRequest(t, app, "POST", "/api/me/orgs", map[string]string{"name": "Side Project"}, other.Token); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected creating an org blocked until enrolled, got %d", resp.StatusCode)
+	}
+}
+
+func TestLoginThrottlingAndLockout(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", Clock: clock.Now})
+	defer cleanup()
+
+	registerOrg(t, app, "owner@example.com", "Studio One")
+	login := func(email, password string) *http.Response {
+		return performRequest(t, app, "POST", "/api/auth/login", map[string]string{"email": email, "password": password}, "")
+	}
+
+	for i := 0; i < 3; i++ {
+		if resp := login("owner@example.com", "wrong-password"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i+1, resp.StatusCode)
+		}
+	}
+	resp := login("owner@example.com", "password123")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+		t.Fatalf("expected 429 with Retry-After 1, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	clock.Advance(time.Second)
+	if resp := login("owner@example.com", "password123"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected success after the delay, got %d", resp.StatusCode)
+	}
+
+	// A successful login resets the count, so three more failures are free.
+	for i := 0; i < 3; i++ {
+		if resp := login("owner@example.com", "wrong-password"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected failures reset after success, got %d", resp.StatusCode)
+		}
+	}
+	for i := 3; i < 10; i++ {
+		clock.Advance(time.Second << (i - 3))
+		if resp := login("owner@example.com", "wrong-password"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401 after waiting, got %d", i+1, resp.StatusCode)
+		}
+	}
+	clock.Advance(5 * time.Minute)
+	resp = login("owner@example.com", "password123")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "600" {
+		t.Fatalf("expected locked account, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	var userID sql.NullString
+	if err := database.QueryRow(`SELECT user_id FROM auth_events WHERE kind = 'account_locked' AND email = 'owner@example.com'`).Scan(&userID); err != nil || !userID.Valid {
+		t.Fatalf("expected lockout event for the user, got %v (%v)", userID, err)
+	}
+	clock.Advance(10 * time.Minute)
+	if resp := login("owner@example.com", "password123"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected login after lockout expired, got %d", resp.StatusCode)
+	}
+
+	// Unknown addresses answer and throttle exactly like real ones.
+	for i := 0; i < 3; i++ {
+		if resp := login("ghost@example.com", "whatever"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for unknown email, got %d", resp.StatusCode)
+		}
+	}
+	if resp := login("ghost@example.com", "whatever"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected unknown email throttled, got %d", resp.StatusCode)
+	}
+}
+
+func TestTwoFactorCodesCountAsLoginFailures(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", Clock: clock.Now})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	var setup struct {
+		Secret string `json:"secret"`
+	}
+	decodeJSON(t, performRequest(t, app, "POST", "/api/me/2fa/setup", nil, reg.Token), &setup)
+	if resp := performRequest(t, app, "POST", "/api/me/2fa/enable", map[string]string{"code": totpCode(t, setup.Secret, clock.Now())}, reg.Token); resp.StatusCode != http.StatusOK {
+		t.Fatalf("enable: expected 200, got %d", resp.StatusCode)
+	}
+	startLogin := func() string {
+		var out struct {
+			MFAToken string `json:"mfa_token"`
+		}
+		resp := performRequest(t, app, "POST", "/api/auth/login", map[string]string{"email": "owner@example.com", "password": "password123"}, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("login: expected 200, got %d", resp.StatusCode)
+		}
+		decodeJSON(t, resp, &out)
+		return out.MFAToken
+	}
+
+	// A fresh challenge per guess must not reset the count.
+	var challenge string
+	for i := 0; i < 3; i++ {
+		challenge = startLogin()
+		resp := performRequest(t, app, "POST", "/api/auth/login/2fa", map[string]string{"mfa_token": challenge, "code": "000000"}, "")
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("guess %d: expected 401, got %d", i+1, resp.StatusCode)
+		}
+	}
+	resp := performRequest(t, app, "POST", "/api/auth/login/2fa", map[string]string{"mfa_token": challenge, "code": "000000"}, "")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+		t.Fatalf("expected 429 with Retry-After 1, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if resp := performRequest(t, app, "POST", "/api/auth/login", map[string]string{"email": "owner@example.com", "password": "password123"}, ""); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected password step throttled too, got %d", resp.StatusCode)
+	}
+
+	clock.Advance(30 * time.Second)
+	challenge = startLogin()
+	resp = performRequest(t, app, "POST", "/api/auth/login/2fa", map[string]string{"mfa_token": challenge, "code": totpCode(t, setup.Secret, clock.Now())}, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var failures int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM login_failures WHERE email = 'owner@example.com'`).Scan(&failures); err != nil || failures != 0 {
+		t.Fatalf("expected failures cleared after the session was issued, got %d (%v)", failures, err)
+	}
+}
+
+func TestMultiOrgSwitchingKeepsDataIsolated(t *testing.T) {
+	app, cleanup := newTestApp(t)
+	defer cleanup()
+
+	agency := registerOrg(t, app, "agency@example.com", "Sister A")
+	outsider := registerOrg(t, app, "outsider@example.com", "Other Co")
+
+	resp := performRequest(t, app, "POST", "/api/me/orgs", map[string]string{"name": "Sister B"}, agency.Token)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 creating org, got %d", resp.StatusCode)
+	}
+	var orgB createResponse
+	decodeJSON(t, resp, &orgB)
+
+	resp = performRequest(t, app, "POST", "/api/clients", map[string]string{
+		"name": "Only In A", "email": "a-client@example.com", "company": "ACo",
+	}, agency.Token)
+	var clientA createResponse
+	decodeJSON(t, resp, &clientA)
+
+	switchTo := func(orgID, token string) loginResponse {
+		t.Helper()
+		resp := performRequest(t, app, "POST", "/api/me/orgs/"+orgID+"/switch", nil, token)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("switch: expected 200, got %d", resp.StatusCode)
+		}
+		var out loginResponse
+		decodeJSON(t, resp, &out)
+		return out
+	}
+	tokenB := switchTo(orgB.ID, agency.Token).Token
+
+	if resp := performRequest(t, app, "GET", "/api/me", nil, agency.Token); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the pre-switch session revoked, got %d", resp.StatusCode)
+	}
+	var clients struct {
+		Clients []createResponse `json:"clients"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/clients", nil, tokenB), &clients)
+	if len(clients.Clients) != 0 {
+		t.Fatalf("expected no clients in Sister B, got %d", len(clients.Clients))
+	}
+	if resp := performRequest(t, app, "GET", "/api/clients/"+clientA.ID, nil, tokenB); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 reading Sister A client from B, got %d", resp.StatusCode)
+	}
+	resp = performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+		"client_id": clientA.ID, "number": "INV-1", "amount_cents": 100, "currency": "usd", "due_date": "2030-01-01",
+	}, tokenB)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 invoicing a Sister A client from B, got %d", resp.StatusCode)
+	}
+
+	var orgs struct {
+		Orgs []struct {
+			ID      string `json:"id"`
+			Role    string `json:"role"`
+			Current bool   `json:"current"`
+		} `json:"orgs"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/me/orgs", nil, tokenB), &orgs)
+	if len(orgs.Orgs) != 2 {
+		t.Fatalf("expected 2 orgs, got %d", len(orgs.Orgs))
+	}
+	for _, o := range orgs.Orgs {
+		if o.ID == outsider.Org.ID {
+			t.Fatalf("listed an org the user does not belong to")
+		}
+		if o.Current != (o.ID == orgB.ID) || o.Role != "owner" {
+			t.Fatalf("unexpected org entry: %+v", o)
+		}
+	}
+	if resp := performRequest(t, app, "POST", "/api/me/orgs/"+outsider.Org.ID+"/switch", nil, tokenB); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 switching to a foreign org, got %d", resp.StatusCode)
+	}
+
+	// Logging in again resumes the last org switched to.
+	resp = performRequest(t, app, "POST", "/api/auth/login", map[string]string{"email": "agency@example.com", "password": "password123"}, "")
+	var login loginResponse
+	decodeJSON(t, resp, &login)
+	var me struct {
+		Org struct {
+			ID string `json:"id"`
+		} `json:"org"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/me", nil, login.Token), &me)
+	if me.Org.ID != orgB.ID {
+		t.Fatalf("expected login to land in Sister B")
+	}
+
+	tokenA := switchTo(agency.Org.ID, login.Token).Token
+	decodeJSON(t, performRequest(t, app, "GET", "/api/clients", nil, tokenA), &clients)
+	if len(clients.Clients) != 1 || clients.Clients[0].ID != clientA.ID {
+		t.Fatalf("expected Sister A client back after switching, got %+v", clients.Clients)
+	}
+}
+
+func TestAuditLogRecordsMutations(t *testing.T) {
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", BaseURL: "http://app.test"})
+	defer cleanup()
+
+	owner := registerOrg(t, app, "owner@example.com", "Studio One")
+	memberToken := inviteAndAccept(t, app, database, owner.Token, "member@example.com", "member")
+	key := createAPIKey(t, app, owner.Token, []string{"clients:write", "audit:read"}, "")
+
+	var client createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{
+		"name": "Acme", "email": "billing@acme.test",
+	}, owner.Token), &client)
+	resp := performRequest(t, app, "PUT", "/api/clients/"+client.ID, map[string]string{
+		"name": "Acme Ltd", "email": "billing@acme.test",
+	}, key)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("update client: expected 200, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "DELETE", "/api/clients/"+client.ID, nil, memberToken); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete client: expected 204, got %d", resp.StatusCode)
+	}
+
+	type auditEvent struct {
+		ActorUserID   *string                           `json:"actor_user_id"`
+		ActorEmail    *string                           `json:"actor_email"`
+		ActorAPIKeyID *string                           `json:"actor_api_key_id"`
+		Action        string                            `json:"action"`
+		ResourceType  string                            `json:"resource_type"`
+		ResourceID    string                            `json:"resource_id"`
+		Changes       map[string]map[string]interface{} `json:"changes"`
+	}
+	var out struct {
+		Events []auditEvent `json:"events"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/audit?resource_type=client&resource_id="+client.ID, nil, owner.Token), &out)
+	if len(out.Events) != 3 {
+		t.Fatalf("expected 3 client events, got %+v", out.Events)
+	}
+	deleted, updated, created := out.Events[0], out.Events[1], out.Events[2]
+	if created.Action != "create" || created.ActorEmail == nil || *created.ActorEmail != "owner@example.com" ||
+		created.Changes["name"]["after"] != "Acme" || created.Changes["name"]["before"] != nil {
+		t.Fatalf("unexpected create event %+v", created)
+	}
+	if updated.Action != "update" || updated.ActorAPIKeyID == nil || updated.ActorUserID != nil ||
+		updated.Changes["name"]["before"] != "Acme" || updated.Changes["name"]["after"] != "Acme Ltd" {
+		t.Fatalf("unexpected update event %+v", updated)
+	}
+	if _, ok := updated.Changes["email"]; ok {
+		t.Fatalf("expected unchanged fields left out of the diff, got %v", updated.Changes)
+	}
+	if deleted.Action != "delete" || deleted.ActorEmail == nil || *deleted.ActorEmail != "member@example.com" ||
+		deleted.Changes["name"]["before"] != "Acme Ltd" || deleted.Changes["name"]["after"] != nil {
+		t.Fatalf("unexpected delete event %+v", deleted)
+	}
+
+	// "Who deleted this client?" by actor, and by date.
+	decodeJSON(t, performRequest(t, app, "GET", "/api/audit?actor=member@example.com&action=delete", nil, key), &out)
+	if len(out.Events) != 1 || out.Events[0].ResourceID != client.ID {
+		t.Fatalf("expected the member's delete, got %+v", out.Events)
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/audit?to=2000-01-01", nil, owner.Token), &out)
+	if len(out.Events) != 0 {
+		t.Fatalf("expected no events before 2000, got %d", len(out.Events))
+	}
+	today := time.Now().UTC().Format("2006-01-02")
+	decodeJSON(t, performRequest(t, app, "GET", "/api/audit?from="+today+"&to="+today, nil, owner.Token), &out)
+	types := map[string]bool{}
+	for _, e := range out.Events {
+		types[e.ResourceType] = true
+	}
+	if !types["member"] || !types["invitation"] || !types["api_key"] || !types["client"] {
+		t.Fatalf("expected member, invitation, api key and client events today, got %v", types)
+	}
+	if resp := performRequest(t, app, "GET", "/api/audit?from=yesterday", nil, owner.Token); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad date, got %d", resp.StatusCode)
+	}
+
+	resp = performRequest(t, app, "GET", "/api/audit/export?resource_type=client", nil, owner.Token)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/csv") {
+		t.Fatalf("expected CSV export, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	resp.Body.Close()
+	if err != nil || len(records) != 4 || records[0][4] != "action" || records[3][4] != "create" {
+		t.Fatalf("unexpected CSV %v (%v)", records, err)
+	}
+
+	if _, err := database.Exec(`DELETE FROM audit_events`); err == nil {
+		t.Fatalf("expected the audit log to reject deletes")
+	}
+	if _, err := database.Exec(`UPDATE audit_events SET action = 'x'`); err == nil {
+		t.Fatalf("expected the audit log to reject updates")
+	}
+}
+
+func TestAuditLogCoversAccountSecurityAndCommitsWithTheChange(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", Clock: clock.Now})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	var setup struct {
+		Secret string `json:"secret"`
+	}
+	decodeJSON(t, performRequest(t, app, "POST", "/api/me/2fa/setup", nil, reg.Token), &setup)
+	var enabled struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	decodeJSON(t, performRequest(t, app, "POST", "/api/me/2fa/enable", map[string]string{"code": totpCode(t, setup.Secret, clock.Now())}, reg.Token), &enabled)
+	clock.Advance(30 * time.Second)
+	if resp := performRequest(t, app, "POST", "/api/me/2fa/recovery-codes", map[string]string{"code": totpCode(t, setup.Secret, clock.Now())}, reg.Token); resp.StatusCode != http.StatusOK {
+		t.Fatalf("regenerate recovery codes: expected 200, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "POST", "/api/me/2fa/disable", map[string]string{"code": "000000"}, reg.Token); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("disable with a wrong code: expected 401, got %d", resp.StatusCode)
+	}
+	clock.Advance(30 * time.Second)
+	if resp := performRequest(t, app, "POST", "/api/me/2fa/disable", map[string]string{"code": totpCode(t, setup.Secret, clock.Now())}, reg.Token); resp.StatusCode != http.StatusOK {
+		t.Fatalf("disable: expected 200, got %d", resp.StatusCode)
+	}
+
+	var second loginResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/auth/login", map[string]string{"email": "owner@example.com", "password": "password123"}, ""), &second)
+	var sessions struct {
+		Sessions []struct {
+			ID      string `json:"id"`
+			Current bool   `json:"current"`
+		} `json:"sessions"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/sessions", nil, reg.Token), &sessions)
+	for _, s := range sessions.Sessions {
+		if !s.Current {
+			if resp := performRequest(t, app, "DELETE", "/api/sessions/"+s.ID, nil, reg.Token); resp.StatusCode != http.StatusNoContent {
+				t.Fatalf("revoke session: expected 204, got %d", resp.StatusCode)
+			}
+		}
+	}
+
+	// A change whose audit row cannot be written is rolled back with it.
+	createAPIKey(t, app, reg.Token, []string{"clients:read"}, "")
+	var keyID string
+	if err := database.QueryRow(`SELECT id FROM api_keys WHERE org_id = ?`, reg.Org.ID).Scan(&keyID); err != nil {
+		t.Fatalf("load api key: %v", err)
+	}
+	if _, err := database.Exec(`CREATE TRIGGER audit_down BEFORE INSERT ON audit_events WHEN NEW.resource_type = 'api_key'
+		BEGIN SELECT RAISE(ABORT, 'audit unavailable'); END`); err != nil {
+		t.Fatalf("create trigger: %v", err)
+	}
+	if resp := performRequest(t, app, "DELETE", "/api/api-keys/"+keyID, nil, reg.Token); resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("revoke without audit: expected 500, got %d", resp.StatusCode)
+	}
+	var revoked int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM api_keys WHERE id = ? AND revoked_at IS NOT NULL`, keyID).Scan(&revoked); err != nil || revoked != 0 {
+		t.Fatalf("expected the key still active, got %d (%v)", revoked, err)
+	}
+
+	if resp := performRequest(t, app, "POST", "/api/auth/logout", nil, reg.Token); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("logout: expected 204, got %d", resp.StatusCode)
+	}
+	rows, err := database.Query(`SELECT resource_type || ':' || action FROM audit_events
+		WHERE org_id = ? AND resource_type IN ('two_factor', 'session') ORDER BY rowid`, reg.Org.ID)
+	if err != nil {
+		t.Fatalf("query audit: %v", err)
+	}
+	var events []string
+	for rows.Next() {
+		var event string
+		if err := rows.Scan(&event); err != nil {
+			t.Fatalf("scan audit: %v", err)
+		}
+		events = append(events, event)
+	}
+	rows.Close()
+	want := "two_factor:create two_factor:update two_factor:delete session:delete session:delete"
+	if strings.Join(events, " ") != want {
+		t.Fatalf("expected %q, got %q", want, events)
+	}
+}
+
 func TestInvoiceReminderFlow(t *testing.T) {
 	app, cleanup := newTestApp(t)
 	defer cleanup()
@@ -143,18 +856,2829 @@ func TestInvoiceReminderFlow(t *testing.T) {
 	}
 }
 
-func performRequest(t *testing.T, app *fiber.App, method, path string, body interface{}, token string) *http.Response {
-	t.Helper()
-	var buf bytes.Buffer
-	if body != nil {
-		if err := json.NewEncoder(&buf).Encode(body); err != nil {
-			t.Fatalf("encode error: %v", err)
+func TestListPaginationSortingAndFilters(t *testing.T) {
+	app, cleanup := newTestApp(t)
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	clientIDs := make([]string, 2)
+	for i, email := range []string{"a@example.com", "b@example.com"} {
+		var client createResponse
+		decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{"name": "Client " + email, "email": email}, reg.Token), &client)
+		clientIDs[i] = client.ID
+	}
+	// Seven invoices with three sharing an amount, so ties need the id
+	// tie-break to page correctly.
+	amounts := []int{500, 300, 300, 900, 300, 100, 700}
+	for i, amount := range amounts {
+		currency := "USD"
+		if i%2 == 1 {
+			currency = "EUR"
+		}
+		resp := performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+			"client_id": clientIDs[i%2], "number": fmt.Sprintf("INV-%d", i), "amount_cents": amount, "currency": currency,
+			"due_date": fmt.Sprintf("2024-05-%02d", i+1), "reminder_offsets": []int{0},
+		}, reg.Token)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("create invoice %d: expected 201, got %d", i, resp.StatusCode)
 		}
 	}
-	req := httptest.NewRequest(method, path, &buf)
-	req.Header.Set("Content-Type", "application/json")
-	if token != "" {
-		req.Header.Set("Authorization", "Bearer "+token)
+
+	type invoicePage struct {
+		Invoices []struct {
+			ID          string `json:"id"`
+			Number      string `json:"number"`
+			AmountCents int    `json:"amount_cents"`
+		} `json:"invoices"`
+		NextCursor *string `json:"next_cursor"`
+	}
+	seen := map[string]bool{}
+	got := []int{}
+	path := "/api/invoices?sort=-amount_cents&limit=3"
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("pagination did not terminate")
+		}
+		var pg invoicePage
+		decodeJSON(t, performRequest(t, app, "GET", path, nil, reg.Token), &pg)
+		for _, inv := range pg.Invoices {
+			if seen[inv.ID] {
+				t.Fatalf("invoice %s returned twice", inv.Number)
+			}
+			seen[inv.ID] = true
+			got = append(got, inv.AmountCents)
+		}
+		if pg.NextCursor == nil {
+			break
+		}
+		path = "/api/invoices?sort=-amount_cents&limit=3&cursor=" + *pg.NextCursor
+	}
+	if fmt.Sprint(got) != "[900 700 500 300 300 300 100]" {
+		t.Fatalf("unexpected order %v", got)
+	}
+
+	var pg invoicePage
+	decodeJSON(t, performRequest(t, app, "GET", "/api/invoices?client_id="+clientIDs[0]+"&currency=usd&min_amount_cents=300&max_amount_cents=600", nil, reg.Token), &pg)
+	if len(pg.Invoices) != 3 || pg.NextCursor != nil {
+		t.Fatalf("expected INV-0, INV-2 and INV-4, got %+v", pg.Invoices)
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/invoices?due_from=2024-05-02&due_to=2024-05-03&sort=due_date", nil, reg.Token), &pg)
+	if len(pg.Invoices) != 2 || pg.Invoices[0].Number != "INV-1" || pg.Invoices[1].Number != "INV-2" {
+		t.Fatalf("expected INV-1 and INV-2 by due date, got %+v", pg.Invoices)
+	}
+
+	decodeJSON(t, performRequest(t, app, "GET", "/api/invoices?sort=-amount_cents&limit=1", nil, reg.Token), &pg)
+	if resp := performRequest(t, app, "GET", "/api/invoices?sort=number&cursor="+*pg.NextCursor, nil, reg.Token); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a cursor from another sort, got %d", resp.StatusCode)
+	}
+	for _, query := range []string{"cursor=garbage", "sort=notes", "limit=0", "min_amount_cents=abc", "due_from=soon"} {
+		if resp := performRequest(t, app, "GET", "/api/invoices?"+query, nil, reg.Token); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", query, resp.StatusCode)
+		}
+	}
+
+	var reminders struct {
+		Reminders []struct {
+			InvoiceNumber string `json:"invoice_number"`
+		} `json:"reminders"`
+		NextCursor *string `json:"next_cursor"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/reminders?from=2024-05-03&to=2024-05-04&limit=1", nil, reg.Token), &reminders)
+	if len(reminders.Reminders) != 1 || reminders.Reminders[0].InvoiceNumber != "INV-2" || reminders.NextCursor == nil {
+		t.Fatalf("unexpected first reminder page %+v", reminders)
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/reminders?from=2024-05-03&to=2024-05-04&limit=1&cursor="+*reminders.NextCursor, nil, reg.Token), &reminders)
+	if len(reminders.Reminders) != 1 || reminders.Reminders[0].InvoiceNumber != "INV-3" || reminders.NextCursor != nil {
+		t.Fatalf("unexpected second reminder page %+v", reminders)
+	}
+
+	if resp := performRequest(t, app, "POST", "/api/reminders/send-due", nil, reg.Token); resp.StatusCode != http.StatusOK {
+		t.Fatalf("send-due: expected 200, got %d", resp.StatusCode)
+	}
+	var outbox outboxResponse
+	decodeJSON(t, performRequest(t, app, "GET", "/api/outbox?to_email=b@example.com", nil, reg.Token), &outbox)
+	for _, email := range outbox.Outbox {
+		if email.ToEmail != "b@example.com" {
+			t.Fatalf("expected only b@example.com, got %s", email.ToEmail)
+		}
+	}
+	if len(outbox.Outbox) != 3 {
+		t.Fatalf("expected 3 emails to b@example.com, got %d", len(outbox.Outbox))
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/outbox?to=2000-01-01", nil, reg.Token), &outbox)
+	if len(outbox.Outbox) != 0 {
+		t.Fatalf("expected no emails before 2000, got %d", len(outbox.Outbox))
+	}
+}
+
+func TestSearchAcrossClientsInvoicesAndOutbox(t *testing.T) {
+	app, cleanup := newTestApp(t)
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	other := registerOrg(t, app, "other@example.com", "Studio Two")
+
+	type searchResults struct {
+		Results []struct {
+			Type      string  `json:"type"`
+			ID        string  `json:"id"`
+			Title     string  `json:"title"`
+			Highlight string  `json:"highlight"`
+			Snippet   string  `json:"snippet"`
+			Score     float64 `json:"score"`
+		} `json:"results"`
+	}
+	search := func(token, query string) searchResults {
+		t.Helper()
+		resp := performRequest(t, app, "GET", "/api/search?"+query, nil, token)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("search %s: expected 200, got %d", query, resp.StatusCode)
+		}
+		var out searchResults
+		decodeJSON(t, resp, &out)
+		return out
+	}
+
+	var client, invoice createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{
+		"name": "<b>Wile</b> Coyote", "email": "wile@acme.test", "company": "Acme", "notes": "Prefers email",
+	}, reg.Token), &client)
+	decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+		"client_id": client.ID, "number": "INV-100", "amount_cents": 5000, "currency": "USD",
+		"due_date": "2024-05-01", "notes": "Website redesign", "reminder_offsets": []int{0},
+	}, reg.Token), &invoice)
+
+	res := search(reg.Token, "q=acme+redesig")
+	if len(res.Results) != 1 || res.Results[0].Type != "invoice" || res.Results[0].ID != invoice.ID {
+		t.Fatalf("expected the redesign invoice, got %+v", res.Results)
+	}
+	if !strings.Contains(res.Results[0].Snippet, "<mark>") {
+		t.Fatalf("expected a highlighted snippet, got %q", res.Results[0].Snippet)
+	}
+
+	res = search(reg.Token, "q=wile")
+	if len(res.Results) != 2 || res.Results[0].Type != "client" || res.Results[0].ID != client.ID {
+		t.Fatalf("expected the client ranked above its invoice, got %+v", res.Results)
+	}
+	if res.Results[0].Highlight != "&lt;b&gt;<mark>Wile</mark>&lt;/b&gt; Coyote" {
+		t.Fatalf("unexpected highlight %q", res.Results[0].Highlight)
+	}
+	if res = search(reg.Token, "q=wile&type=invoice"); len(res.Results) != 1 || res.Results[0].ID != invoice.ID {
+		t.Fatalf("expected only the invoice, got %+v", res.Results)
+	}
+	if res = search(other.Token, "q=acme"); len(res.Results) != 0 {
+		t.Fatalf("search leaked another org's records: %+v", res.Results)
+	}
+
+	// Edits reach the index, including the client name copied onto invoices.
+	resp := performRequest(t, app, "PUT", "/api/clients/"+client.ID, map[string]string{
+		"name": "Road Runner", "email": "wile@acme.test", "company": "Beep Inc", "notes": "",
+	}, reg.Token)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("update client: expected 200, got %d", resp.StatusCode)
+	}
+	if res = search(reg.Token, "q=coyote"); len(res.Results) != 0 {
+		t.Fatalf("expected stale client name to be gone, got %+v", res.Results)
+	}
+	if res = search(reg.Token, "q=beep+redesign"); len(res.Results) != 1 || res.Results[0].ID != invoice.ID {
+		t.Fatalf("expected the invoice under its client's new company, got %+v", res.Results)
+	}
+
+	resp = performRequest(t, app, "POST", "/api/reminders/send-due", nil, reg.Token)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("send due: expected 200, got %d", resp.StatusCode)
+	}
+	if res = search(reg.Token, "q=INV-100&type=outbox"); len(res.Results) != 1 {
+		t.Fatalf("expected the sent reminder, got %+v", res.Results)
+	}
+	// Account emails such as the verification link are never indexed.
+	if res = search(reg.Token, "q=owner"); len(res.Results) != 0 {
+		t.Fatalf("account email was searchable: %+v", res.Results)
+	}
+
+	resp = performRequest(t, app, "DELETE", "/api/invoices/"+invoice.ID, nil, reg.Token)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete invoice: expected 204, got %d", resp.StatusCode)
+	}
+	if res = search(reg.Token, "q=redesign"); len(res.Results) != 0 {
+		t.Fatalf("expected deleted invoice and its emails to be gone, got %+v", res.Results)
+	}
+
+	for _, query := range []string{"", "q=%22*", "q=acme&type=users", "q=acme&limit=0"} {
+		resp := performRequest(t, app, "GET", "/api/search?"+query, nil, reg.Token)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("search %q: expected 400, got %d", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestMergePatchAndETags(t *testing.T) {
+	app, cleanup := newTestApp(t)
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	var client, invoice createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{
+		"name": "Acme", "email": "billing@acme.test", "phone": "555-0100", "notes": "VIP",
+	}, reg.Token), &client)
+	decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+		"client_id": client.ID, "number": "INV-1", "amount_cents": 5000, "currency": "USD",
+		"due_date": "2024-05-01", "notes": "Rush job",
+	}, reg.Token), &invoice)
+
+	type invoiceBody struct {
+		Number      string  `json:"number"`
+		AmountCents int64   `json:"amount_cents"`
+		DueDate     string  `json:"due_date"`
+		Notes       string  `json:"notes"`
+		TemplateID  *string `json:"template_id"`
+		Version     int64   `json:"version"`
+		Reminders   []struct {
+			ScheduledFor string `json:"scheduled_for"`
+		} `json:"reminders"`
+	}
+	getInvoice := func() (invoiceBody, string) {
+		t.Helper()
+		resp := performRequest(t, app, "GET", "/api/invoices/"+invoice.ID, nil, reg.Token)
+		var out invoiceBody
+		decodeJSON(t, resp, &out)
+		return out, resp.Header.Get("ETag")
+	}
+	patch := func(path string, body interface{}, ifMatch string) *http.Response {
+		t.Helper()
+		headers := map[string]string{"Content-Type": "application/merge-patch+json"}
+		if ifMatch != "" {
+			headers["If-Match"] = ifMatch
+		}
+		return performRequestWithHeaders(t, app, "PATCH", path, body, reg.Token, headers)
+	}
+
+	current, tag := getInvoice()
+	if tag != `"1"` || current.Version != 1 || current.TemplateID == nil {
+		t.Fatalf("unexpected initial invoice %+v with etag %s", current, tag)
+	}
+
+	// null clears and absent fields are kept. Moving the due date moves the
+	// pending reminders with it.
+	resp := patch("/api/invoices/"+invoice.ID, map[string]interface{}{"notes": nil, "template_id": nil, "amount_cents": 7500, "due_date": "2024-05-11"}, tag)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"2"` {
+		t.Fatalf("patch invoice: expected 200 with etag \"2\", got %d %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	current, tag = getInvoice()
+	if current.Notes != "" || current.TemplateID != nil || current.AmountCents != 7500 || current.Number != "INV-1" ||
+		!strings.HasPrefix(current.DueDate, "2024-05-11") || tag != `"2"` {
+		t.Fatalf("unexpected patched invoice %+v with etag %s", current, tag)
+	}
+	if len(current.Reminders) != 3 || current.Reminders[0].ScheduledFor != "2024-05-08T09:00:00Z" ||
+		current.Reminders[1].ScheduledFor != "2024-05-11T09:00:00Z" || current.Reminders[2].ScheduledFor != "2024-05-18T09:00:00Z" {
+		t.Fatalf("expected reminders moved with the due date, got %+v", current.Reminders)
+	}
+
+	// A teammate still holding version 1 is refused instead of overwriting.
+	if resp := patch("/api/invoices/"+invoice.ID, map[string]string{"notes": "stale"}, `"1"`); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("stale patch: expected 412, got %d", resp.StatusCode)
+	}
+	resp = performRequestWithHeaders(t, app, "PUT", "/api/invoices/"+invoice.ID, map[string]string{"notes": "stale"}, reg.Token,
+		map[string]string{"If-Match": `"1"`})
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("stale put: expected 412, got %d", resp.StatusCode)
+	}
+	if current, _ = getInvoice(); current.Notes != "" {
+		t.Fatalf("stale write was applied: %+v", current)
+	}
+
+	// Any other write, with or without a patch, moves the version on.
+	resp = performRequest(t, app, "PUT", "/api/invoices/"+invoice.ID, map[string]string{"status": "paid"}, reg.Token)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("put invoice: expected 200, got %d", resp.StatusCode)
+	}
+	if resp := patch("/api/invoices/"+invoice.ID, map[string]string{"notes": "late"}, tag); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("patch after put: expected 412, got %d", resp.StatusCode)
+	}
+
+	for name, body := range map[string]interface{}{
+		"required field": map[string]interface{}{"number": nil},
+		"null amount":    map[string]interface{}{"amount_cents": nil},
+		"zero amount":    map[string]interface{}{"amount_cents": 0},
+		"unknown client": map[string]interface{}{"client_id": "missing"},
+		"unknown field":  map[string]interface{}{"reminder_offsets": []int{1}},
+		"wrong type":     map[string]interface{}{"amount_cents": "ten"},
+		"not an object":  []int{1},
+	} {
+		if resp := patch("/api/invoices/"+invoice.ID, body, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", name, resp.StatusCode)
+		}
+	}
+	resp = performRequestWithHeaders(t, app, "PATCH", "/api/invoices/"+invoice.ID, nil, reg.Token, map[string]string{"Content-Type": "text/plain"})
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("text patch: expected 415, got %d", resp.StatusCode)
+	}
+
+	resp = patch("/api/clients/"+client.ID, map[string]interface{}{"notes": nil, "phone": ""}, `"1"`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("patch client: expected 200, got %d", resp.StatusCode)
+	}
+	var clientBody struct {
+		Name  string `json:"name"`
+		Phone string `json:"phone"`
+		Notes string `json:"notes"`
+	}
+	resp = performRequest(t, app, "GET", "/api/clients/"+client.ID, nil, reg.Token)
+	if resp.Header.Get("ETag") != `"2"` {
+		t.Fatalf("expected client etag \"2\", got %q", resp.Header.Get("ETag"))
+	}
+	decodeJSON(t, resp, &clientBody)
+	if clientBody.Name != "Acme" || clientBody.Phone != "" || clientBody.Notes != "" {
+		t.Fatalf("unexpected patched client %+v", clientBody)
+	}
+
+	var tmpl createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/templates", map[string]interface{}{
+		"name": "Firm", "subject": "Invoice {{invoice_number}}", "body": "Please pay.",
+		"variants": []map[string]string{{"language": "de", "subject": "Rechnung", "body": "Bitte zahlen."}},
+	}, reg.Token), &tmpl)
+	resp = patch("/api/templates/"+tmpl.ID, map[string]interface{}{"variants": nil, "subject": "Overdue: {{invoice_number}}"}, `"1"`)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"2"` {
+		t.Fatalf("patch template: expected 200 with etag \"2\", got %d %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	var templates struct {
+		Templates []struct {
+			ID       string        `json:"id"`
+			Name     string        `json:"name"`
+			Subject  string        `json:"subject"`
+			Variants []interface{} `json:"variants"`
+			Version  int64         `json:"version"`
+		} `json:"templates"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/templates", nil, reg.Token), &templates)
+	for _, got := range templates.Templates {
+		if got.ID == tmpl.ID && (got.Name != "Firm" || got.Subject != "Overdue: {{invoice_number}}" || len(got.Variants) != 0 || got.Version != 2) {
+			t.Fatalf("unexpected patched template %+v", got)
+		}
+	}
+}
+
+func TestIdempotencyKeyReplaysPosts(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", Clock: clock.Now})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	var client createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{"name": "Acme", "email": "billing@acme.test"}, reg.Token), &client)
+	invoiceBody := map[string]interface{}{
+		"client_id": client.ID, "number": "INV-1", "amount_cents": 5000, "currency": "USD", "due_date": "2024-05-01",
+	}
+	post := func(path string, body interface{}, token, key string) *http.Response {
+		t.Helper()
+		return performRequestWithHeaders(t, app, "POST", path, body, token, map[string]string{"Idempotency-Key": key})
+	}
+	count := func(query string, args ...interface{}) int {
+		t.Helper()
+		var n int
+		if err := database.QueryRow(query, args...).Scan(&n); err != nil {
+			t.Fatalf("count: %v", err)
+		}
+		return n
+	}
+
+	var first, second createResponse
+	resp := post("/api/invoices", invoiceBody, reg.Token, "create-inv-1")
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first create: expected fresh 201, got %d", resp.StatusCode)
+	}
+	decodeJSON(t, resp, &first)
+	resp = post("/api/invoices", invoiceBody, reg.Token, "create-inv-1")
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry: expected replayed 201, got %d", resp.StatusCode)
+	}
+	decodeJSON(t, resp, &second)
+	if first.ID != second.ID || count(`SELECT COUNT(*) FROM invoices`) != 1 || count(`SELECT COUNT(*) FROM reminders`) != 3 {
+		t.Fatalf("retry created a duplicate invoice or schedule")
+	}
+
+	changed := map[string]interface{}{}
+	for k, v := range invoiceBody {
+		changed[k] = v
+	}
+	changed["number"] = "INV-2"
+	if resp := post("/api/invoices", changed, reg.Token, "create-inv-1"); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("reused key: expected 422, got %d", resp.StatusCode)
+	}
+	// Keys are per org and per caller.
+	other := registerOrg(t, app, "other@example.com", "Studio Two")
+	if resp := post("/api/clients", map[string]string{"name": "Beta", "email": "beta@example.com"}, other.Token, "create-inv-1"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("same key in another org: expected 201, got %d", resp.StatusCode)
+	}
+
+	// A failed request is not stored, so the corrected retry goes through.
+	bad := map[string]interface{}{"client_id": client.ID, "number": "INV-3"}
+	if resp := post("/api/invoices", bad, reg.Token, "create-inv-3"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid create: expected 400, got %d", resp.StatusCode)
+	}
+	changed["number"] = "INV-3"
+	if resp := post("/api/invoices", changed, reg.Token, "create-inv-3"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("corrected retry: expected 201, got %d", resp.StatusCode)
+	}
+
+	var reminderID string
+	if err := database.QueryRow(`SELECT id FROM reminders WHERE invoice_id = ? ORDER BY scheduled_for LIMIT 1`, first.ID).Scan(&reminderID); err != nil {
+		t.Fatalf("load reminder: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if resp := post("/api/reminders/"+reminderID+"/send", nil, reg.Token, "send-1"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("send %d: expected 200, got %d", i, resp.StatusCode)
+		}
+	}
+	if n := count(`SELECT COUNT(*) FROM outbox WHERE reminder_id = ?`, reminderID); n != 1 {
+		t.Fatalf("expected one email for a double-clicked send, got %d", n)
+	}
+
+	// A webhook endpoint's secret is only in the create response, so it is
+	// never stored for a replay.
+	for i := 0; i < 2; i++ {
+		resp := post("/api/webhooks", map[string]interface{}{"url": "https://hooks.example.com/nudgepay", "events": []string{"invoice.paid"}}, reg.Token, "hook-1")
+		if resp.StatusCode != http.StatusCreated || resp.Header.Get("Idempotent-Replayed") != "" {
+			t.Fatalf("create webhook %d: expected fresh 201, got %d", i, resp.StatusCode)
+		}
+	}
+	if n := count(`SELECT COUNT(*) FROM idempotency_keys WHERE idempotency_key = 'hook-1' OR response_body LIKE '%whsec_%'`); n != 0 {
+		t.Fatalf("expected no stored webhook responses, got %d", n)
+	}
+	// Nor is a share link, whose URL carries the page's token.
+	for i := 0; i < 2; i++ {
+		resp := post("/api/invoices/"+first.ID+"/share-links", map[string]string{}, reg.Token, "share-1")
+		if resp.StatusCode != http.StatusCreated || resp.Header.Get("Idempotent-Replayed") != "" {
+			t.Fatalf("create share link %d: expected fresh 201, got %d", i, resp.StatusCode)
+		}
+	}
+	if n := count(`SELECT COUNT(*) FROM idempotency_keys WHERE idempotency_key = 'share-1' OR response_body LIKE '%/pay/%'`); n != 0 {
+		t.Fatalf("expected no stored share link responses, got %d", n)
+	}
+
+	// Once the retention window has passed the key runs as a new request.
+	clock.Advance(25 * time.Hour)
+	if resp := post("/api/invoices", invoiceBody, reg.Token, "create-inv-1"); resp.StatusCode != http.StatusCreated || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("expired key: expected fresh 201, got %d", resp.StatusCode)
+	}
+	if n := count(`SELECT COUNT(*) FROM invoices WHERE org_id = ?`, reg.Org.ID); n != 3 {
+		t.Fatalf("expected 3 invoices, got %d", n)
+	}
+}
+
+func TestImportClientsAndInvoicesFromCSV(t *testing.T) {
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret"})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	var existing createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{"name": "Acme", "email": "billing@acme.test"}, reg.Token), &existing)
+
+	type importResponse struct {
+		DryRun  bool `json:"dry_run"`
+		Created int  `json:"created"`
+		Skipped int  `json:"skipped"`
+		Failed  int  `json:"failed"`
+		Rows    []struct {
+			Row    int      `json:"row"`
+			Action string   `json:"action"`
+			ID     *string  `json:"id"`
+			Errors []string `json:"errors"`
+		} `json:"rows"`
+	}
+	importCSV := func(path string, body map[string]interface{}, status int) importResponse {
+		t.Helper()
+		resp := performRequest(t, app, "POST", path, body, reg.Token)
+		if resp.StatusCode != status {
+			t.Fatalf("%s: expected %d, got %d", path, status, resp.StatusCode)
+		}
+		var out importResponse
+		decodeJSON(t, resp, &out)
+		return out
+	}
+	count := func(table string) int {
+		t.Helper()
+		var n int
+		if err := database.QueryRow(`SELECT COUNT(*) FROM ` + table + ` WHERE org_id = ?`, reg.Org.ID).Scan(&n); err != nil {
+			t.Fatalf("count %s: %v", table, err)
+		}
+		return n
+	}
+
+	clientsCSV := "Full Name,E-mail,Company\n" +
+		"Globex,ap@globex.test,Globex Corp\n" +
+		"Acme again,BILLING@acme.test,\n" +
+		",missing@name.test,\n" +
+		"Initech,ap@initech.test,\n"
+	mapping := map[string]string{"name": "Full Name", "email": "E-mail"}
+	res := importCSV("/api/import/clients", map[string]interface{}{"csv": clientsCSV, "mapping": mapping, "dry_run": true}, http.StatusOK)
+	if !res.DryRun || res.Created != 2 || res.Skipped != 1 || res.Failed != 1 || res.Rows[1].Action != "skip" ||
+		*res.Rows[1].ID != existing.ID || res.Rows[2].Row != 4 || len(res.Rows[2].Errors) != 1 {
+		t.Fatalf("unexpected dry run %+v", res)
+	}
+	// Errors make the whole import fail without writing anything.
+	importCSV("/api/import/clients", map[string]interface{}{"csv": clientsCSV, "mapping": mapping}, http.StatusUnprocessableEntity)
+	if n := count("clients"); n != 1 {
+		t.Fatalf("failed import wrote %d clients", n-1)
+	}
+	clientsCSV = strings.Replace(clientsCSV, ",missing@name.test", "Hooli,missing@name.test", 1)
+	if res = importCSV("/api/import/clients", map[string]interface{}{"csv": clientsCSV, "mapping": mapping}, http.StatusOK); res.Created != 3 || res.Skipped != 1 {
+		t.Fatalf("unexpected import %+v", res)
+	}
+	if n := count("clients"); n != 4 {
+		t.Fatalf("expected 4 clients, got %d", n)
+	}
+
+	resp := performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+		"client_id": existing.ID, "number": "INV-1", "amount_cents": 5000, "currency": "USD", "due_date": "2024-05-01",
+	}, reg.Token)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create invoice: expected 201, got %d", resp.StatusCode)
+	}
+	invoicesCSV := "Client,Invoice #,Total,Currency,Due,Offsets\n" +
+		"ap@globex.test,INV-1,50.00,usd,2024-05-01,\n" +
+		"ap@globex.test,INV-2,\"1,250.5\",usd,2024-06-10,0;7\n" +
+		"ap@initech.test,INV-3,99,eur,2024-06-15,\n" +
+		"nobody@example.com,INV-4,10,usd,2024-06-15,\n" +
+		"ap@initech.test,INV-3,abc,eur,15/06/2024,\n"
+	mapping = map[string]string{"client_email": "Client", "number": "Invoice #", "amount": "Total", "currency": "Currency",
+		"due_date": "Due", "reminder_offsets": "Offsets"}
+	res = importCSV("/api/import/invoices", map[string]interface{}{"csv": invoicesCSV, "mapping": mapping, "dry_run": true}, http.StatusOK)
+	if res.Created != 2 || res.Skipped != 1 || res.Failed != 2 || len(res.Rows[4].Errors) != 3 {
+		t.Fatalf("unexpected dry run %+v", res)
+	}
+	invoicesCSV = strings.Join(strings.Split(invoicesCSV, "\n")[:4], "\n")
+	if res = importCSV("/api/import/invoices", map[string]interface{}{"csv": invoicesCSV, "mapping": mapping}, http.StatusOK); res.Created != 2 || res.Skipped != 1 {
+		t.Fatalf("unexpected import %+v", res)
+	}
+
+	// Reminders follow the same schedule as invoices created through the API.
+	var amount int64
+	var currency string
+	if err := database.QueryRow(`SELECT amount_cents, currency FROM invoices WHERE id = ?`, *res.Rows[1].ID).Scan(&amount, &currency); err != nil {
+		t.Fatalf("load imported invoice: %v", err)
+	}
+	if amount != 125050 || currency != "USD" {
+		t.Fatalf("unexpected imported amount %d %s", amount, currency)
+	}
+	schedule := func(invoiceID string) string {
+		t.Helper()
+		var out string
+		if err := database.QueryRow(`SELECT group_concat(scheduled_for, ' ') FROM (SELECT scheduled_for FROM reminders WHERE invoice_id = ? ORDER BY scheduled_for)`,
+			invoiceID).Scan(&out); err != nil {
+			t.Fatalf("load reminders: %v", err)
+		}
+		return out
+	}
+	if got := schedule(*res.Rows[1].ID); got != "2024-06-10T09:00:00Z 2024-06-17T09:00:00Z" {
+		t.Fatalf("unexpected schedule %s", got)
+	}
+	if got := schedule(*res.Rows[2].ID); got != "2024-06-12T09:00:00Z 2024-06-15T09:00:00Z 2024-06-22T09:00:00Z" {
+		t.Fatalf("unexpected default schedule %s", got)
+	}
+
+	for name, body := range map[string]map[string]interface{}{
+		"unknown field":   {"csv": invoicesCSV, "mapping": map[string]string{"total": "Total"}},
+		"missing column":  {"csv": invoicesCSV, "mapping": map[string]string{"number": "Invoice No"}},
+		"required column": {"csv": "number\nINV-9\n"},
+		"empty csv":       {"csv": ""},
+	} {
+		if resp := performRequest(t, app, "POST", "/api/import/invoices", body, reg.Token); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", name, resp.StatusCode)
+		}
+	}
+}
+
+func TestStreamingExports(t *testing.T) {
+	app, cleanup := newTestApp(t)
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	var client createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{
+		"name": "Acme", "email": "billing@acme.test", "company": "Acme Corp",
+	}, reg.Token), &client)
+	invoiceIDs := make([]string, 2)
+	for i, notes := range []string{"=HYPERLINK(\"http://evil.test\")", "Phase 2"} {
+		var inv createResponse
+		decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+			"client_id": client.ID, "number": fmt.Sprintf("INV-%d", i+1), "amount_cents": 1000 * (i + 1), "currency": "USD",
+			"due_date": fmt.Sprintf("2024-05-0%d", i+1), "notes": notes, "reminder_offsets": []int{0, 7},
+		}, reg.Token), &inv)
+		invoiceIDs[i] = inv.ID
+	}
+	performRequest(t, app, "POST", "/api/reminders/send-due", nil, reg.Token).Body.Close()
+	performRequest(t, app, "PUT", "/api/invoices/"+invoiceIDs[1], map[string]string{"status": "paid"}, reg.Token).Body.Close()
+
+	export := func(path string) (*http.Response, []byte) {
+		t.Helper()
+		resp := performRequest(t, app, "GET", path, nil, reg.Token)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, resp.StatusCode)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("read export: %v", err)
+		}
+		return resp, body
+	}
+
+	resp, body := export("/api/exports/invoices?sort=number")
+	if resp.Header.Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatalf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+	records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatalf("parse csv: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected header and 2 rows, got %d", len(records))
+	}
+	col := map[string]int{}
+	for i, name := range records[0] {
+		col[name] = i
+	}
+	first, second := records[1], records[2]
+	if first[col["number"]] != "INV-1" || first[col["balance_cents"]] != "1000" || first[col["client_company"]] != "Acme Corp" ||
+		first[col["notes"]] != "'=HYPERLINK(\"http://evil.test\")" {
+		t.Fatalf("unexpected first row %v", first)
+	}
+	if second[col["status"]] != "paid" || second[col["amount_cents"]] != "2000" || second[col["balance_cents"]] != "0" {
+		t.Fatalf("unexpected second row %v", second)
+	}
+
+	// The list filters apply, and NDJSON carries one typed object per line.
+	resp, body = export("/api/exports/invoices?format=ndjson&status=paid")
+	if resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	var row map[string]interface{}
+	if len(lines) != 1 || json.Unmarshal([]byte(lines[0]), &row) != nil || row["number"] != "INV-2" || row["balance_cents"] != float64(0) {
+		t.Fatalf("unexpected ndjson export %q", body)
+	}
+
+	_, body = export("/api/exports/reminders?format=ndjson&invoice_id=" + invoiceIDs[0])
+	if lines = strings.Split(strings.TrimSpace(string(body)), "\n"); len(lines) != 2 {
+		t.Fatalf("expected 2 reminders, got %q", body)
+	}
+	if json.Unmarshal([]byte(lines[0]), &row) != nil || row["invoice_number"] != "INV-1" || row["status"] != "sent" || row["sent_at"] == nil {
+		t.Fatalf("unexpected reminder row %q", lines[0])
+	}
+
+	_, body = export("/api/exports/outbox?to_email=billing@acme.test")
+	if records, err = csv.NewReader(bytes.NewReader(body)).ReadAll(); err != nil || len(records) != 5 {
+		t.Fatalf("expected 4 sent reminders, got %d rows (%v)", len(records)-1, err)
+	}
+	_, body = export("/api/exports/outbox?to_email=someone@else.test")
+	if strings.TrimSpace(string(body)) != "id,reminder_id,to_email,subject,body,created_at" {
+		t.Fatalf("expected only a header, got %q", body)
+	}
+
+	for _, path := range []string{"/api/exports/invoices?format=xml", "/api/exports/reminders?sort=amount", "/api/exports/outbox?from=yesterday"} {
+		if resp := performRequest(t, app, "GET", path, nil, reg.Token); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestExportsPageThroughLargeResults(t *testing.T) {
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret"})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	// Exports read in batches; ties on the sort column span batch boundaries.
+	const total = 1201
+	for i := 0; i < total; i++ {
+		createdAt := fmt.Sprintf("2024-05-0%dT10:00:00Z", 1+i%3)
+		if _, err := database.Exec(`INSERT INTO outbox (id, org_id, to_email, subject, body, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			fmt.Sprintf("out-%04d", i), reg.Org.ID, "billing@acme.test", "Reminder", "Please pay", createdAt); err != nil {
+			t.Fatalf("insert outbox: %v", err)
+		}
+	}
+
+	resp := performRequest(t, app, "GET", "/api/exports/outbox?format=ndjson", nil, reg.Token)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d (%v)", resp.StatusCode, err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	seen := map[string]bool{}
+	last := "9999"
+	for _, line := range lines {
+		var row struct {
+			ID        string `json:"id"`
+			CreatedAt string `json:"created_at"`
+		}
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			t.Fatalf("unexpected line %q", line)
+		}
+		if seen[row.ID] || row.CreatedAt > last {
+			t.Fatalf("row %s repeated or out of order", row.ID)
+		}
+		seen[row.ID] = true
+		last = row.CreatedAt
+	}
+	if len(seen) != total {
+		t.Fatalf("expected %d rows, got %d", total, len(seen))
+	}
+}
+
+func TestAccountingExports(t *testing.T) {
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret"})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	var client createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{
+		"name": "Ada Lovelace", "email": "billing@acme.test", "company": "Acme Corp",
+	}, reg.Token), &client)
+	var invoiceIDs []string
+	for i, notes := range []string{"Design\tsprint", ""} {
+		var inv createResponse
+		decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+			"client_id": client.ID, "number": fmt.Sprintf("INV/%d", i+1), "amount_cents": 125050 * (i + 1), "currency": "eur",
+			"due_date": fmt.Sprintf("2024-05-0%d", i+1), "notes": notes,
+		}, reg.Token), &inv)
+		invoiceIDs = append(invoiceIDs, inv.ID)
+	}
+	performRequest(t, app, "PUT", "/api/invoices/"+invoiceIDs[1], map[string]string{"status": "paid"}, reg.Token).Body.Close()
+	if _, err := database.Exec(`INSERT INTO payments (id, org_id, invoice_id, provider, provider_payment_id, amount_cents, currency, paid_at, created_at)
+		VALUES ('pay-1', ?, ?, 'generic', 'ext-1', 250100, 'EUR', '2024-05-04T09:00:00Z', '2024-05-04T09:00:00Z')`, reg.Org.ID, invoiceIDs[1]); err != nil {
+		t.Fatalf("insert payment: %v", err)
+	}
+	today := time.Now().UTC()
+
+	export := func(format string) (*http.Response, []byte) {
+		t.Helper()
+		resp := performRequest(t, app, "GET", "/api/exports/invoices?sort=number&format="+format, nil, reg.Token)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", format, resp.StatusCode)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("read export: %v", err)
+		}
+		return resp, body
+	}
+	readCSV := func(body []byte) []map[string]string {
+		t.Helper()
+		records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+		if err != nil {
+			t.Fatalf("parse csv: %v", err)
+		}
+		var rows []map[string]string
+		for _, record := range records[1:] {
+			row := map[string]string{}
+			for i, name := range records[0] {
+				row[name] = record[i]
+			}
+			rows = append(rows, row)
+		}
+		return rows
+	}
+
+	resp, body := export("xero")
+	if !strings.Contains(resp.Header.Get("Content-Disposition"), "invoices-xero.csv") {
+		t.Fatalf("unexpected disposition %s", resp.Header.Get("Content-Disposition"))
+	}
+	xero := readCSV(body)
+	if len(xero) != 2 || xero[0]["*ContactName"] != "Acme Corp" || xero[0]["*InvoiceNumber"] != "INV/1" ||
+		xero[0]["*InvoiceDate"] != today.Format("2006-01-02") || xero[0]["*DueDate"] != "2024-05-01" ||
+		xero[0]["*UnitAmount"] != "1250.50" || xero[0]["*Quantity"] != "1" || xero[0]["Currency"] != "EUR" ||
+		xero[1]["*Description"] != "Invoice INV/2" || xero[1]["Total"] != "2501.00" {
+		t.Fatalf("unexpected xero export %v", xero)
+	}
+
+	_, body = export("quickbooks")
+	qb := readCSV(body)
+	if len(qb) != 2 || qb[0]["InvoiceNo"] != "INV/1" || qb[0]["Customer"] != "Acme Corp" || qb[0]["DueDate"] != "05/01/2024" ||
+		qb[0]["ItemAmount"] != "1250.50" || qb[1]["ItemRate"] != "2501.00" {
+		t.Fatalf("unexpected quickbooks export %v", qb)
+	}
+
+	// Invoices are posted to receivables, followed by their recorded payments.
+	_, body = export("iif")
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if len(lines) != 12 || !strings.HasPrefix(lines[0], "!TRNS\t") {
+		t.Fatalf("unexpected iif export %q", body)
+	}
+	if fields := strings.Split(lines[3], "\t"); len(fields) != 9 || fields[1] != "INVOICE" || fields[3] != "Accounts Receivable" ||
+		fields[5] != "1250.50" || fields[7] != "Design sprint" || fields[8] != "05/01/2024" {
+		t.Fatalf("unexpected iif invoice %q", lines[3])
+	}
+	if fields := strings.Split(lines[4], "\t"); fields[3] != "Sales" || fields[5] != "-1250.50" {
+		t.Fatalf("unexpected iif split %q", lines[4])
+	}
+	if strings.Count(string(body), "TRNS\tPAYMENT\t") != 1 || !strings.HasPrefix(lines[9], "TRNS\tPAYMENT\t05/04/2024\t") ||
+		!strings.Contains(lines[9], "Undeposited Funds\tAcme Corp\t2501.00\tINV/2") {
+		t.Fatalf("expected one payment for the paid invoice, got %q", body)
+	}
+
+	resp, body = export("ubl")
+	if resp.Header.Get("Content-Type") != "application/zip" {
+		t.Fatalf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("open zip: %v", err)
+	}
+	if len(archive.File) != 2 || archive.File[0].Name != "INV-1.xml" || archive.File[1].Name != "INV-2.xml" {
+		t.Fatalf("unexpected archive entries %v", archive.File)
+	}
+	// The children of Invoice must appear in the order the UBL 2.1 schema
+	// defines, and everything the schema requires must be present.
+	schemaOrder := []string{"UBLVersionID", "ID", "UUID", "IssueDate", "DueDate", "InvoiceTypeCode", "Note", "DocumentCurrencyCode",
+		"AccountingSupplierParty", "AccountingCustomerParty", "PrepaidPayment", "LegalMonetaryTotal", "InvoiceLine"}
+	required := []string{"ID", "IssueDate", "AccountingSupplierParty", "AccountingCustomerParty", "LegalMonetaryTotal", "InvoiceLine"}
+	type amount struct {
+		Value    string `xml:",chardata"`
+		Currency string `xml:"currencyID,attr"`
+	}
+	type ublDoc struct {
+		XMLName  xml.Name
+		ID       string `xml:"ID"`
+		Supplier string `xml:"AccountingSupplierParty>Party>PartyName>Name"`
+		Customer string `xml:"AccountingCustomerParty>Party>PartyName>Name"`
+		Email    string `xml:"AccountingCustomerParty>Party>Contact>ElectronicMail"`
+		PaidDate string `xml:"PrepaidPayment>PaidDate"`
+		Prepaid  amount `xml:"LegalMonetaryTotal>PrepaidAmount"`
+		Payable  amount `xml:"LegalMonetaryTotal>PayableAmount"`
+		Line     amount `xml:"InvoiceLine>LineExtensionAmount"`
+	}
+	var docs []ublDoc
+	for _, file := range archive.File {
+		f, err := file.Open()
+		if err != nil {
+			t.Fatalf("open %s: %v", file.Name, err)
+		}
+		content, _ := io.ReadAll(f)
+		f.Close()
+
+		var children []string
+		dec := xml.NewDecoder(bytes.NewReader(content))
+		depth := 0
+		for {
+			tok, err := dec.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: invalid xml: %v", file.Name, err)
+			}
+			switch el := tok.(type) {
+			case xml.StartElement:
+				if depth == 1 {
+					if el.Name.Space != "urn:oasis:names:specification:ubl:schema:xsd:CommonBasicComponents-2" &&
+						el.Name.Space != "urn:oasis:names:specification:ubl:schema:xsd:CommonAggregateComponents-2" {
+						t.Fatalf("%s: %s is outside the UBL component namespaces", file.Name, el.Name.Local)
+					}
+					children = append(children, el.Name.Local)
+				}
+				depth++
+			case xml.EndElement:
+				depth--
+			}
+		}
+		next := 0
+		for _, child := range children {
+			for next < len(schemaOrder) && schemaOrder[next] != child {
+				next++
+			}
+			if next == len(schemaOrder) {
+				t.Fatalf("%s: %s out of schema order in %v", file.Name, child, children)
+			}
+			next++
+		}
+		for _, name := range required {
+			if !strings.Contains(","+strings.Join(children, ",")+",", ","+name+",") {
+				t.Fatalf("%s: missing required %s", file.Name, name)
+			}
+		}
+
+		var doc ublDoc
+		if err := xml.Unmarshal(content, &doc); err != nil {
+			t.Fatalf("decode %s: %v", file.Name, err)
+		}
+		if doc.XMLName.Space != "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2" || doc.XMLName.Local != "Invoice" {
+			t.Fatalf("%s: unexpected root %v", file.Name, doc.XMLName)
+		}
+		docs = append(docs, doc)
+	}
+	if docs[0].ID != "INV/1" || docs[0].Supplier != "Studio One" || docs[0].Customer != "Acme Corp" || docs[0].Email != "billing@acme.test" ||
+		docs[0].Payable != (amount{"1250.50", "EUR"}) || docs[0].PaidDate != "" {
+		t.Fatalf("unexpected unpaid invoice %+v", docs[0])
+	}
+	if docs[1].Line.Value != "2501.00" || docs[1].Prepaid != (amount{"2501.00", "EUR"}) || docs[1].Payable.Value != "0.00" ||
+		docs[1].PaidDate != "2024-05-04" {
+		t.Fatalf("unexpected paid invoice %+v", docs[1])
+	}
+
+	// Accounting formats only apply to invoices.
+	if resp := performRequest(t, app, "GET", "/api/exports/reminders?format=xero", nil, reg.Token); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for xero reminders, got %d", resp.StatusCode)
+	}
+}
+
+func TestPaymentExportsAndClientsWithoutCompany(t *testing.T) {
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret"})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	// The web app saves a missing company as "-"; exports fall back to the name.
+	var client createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{
+		"name": "Ada Lovelace", "email": "ada@example.test", "company": "-",
+	}, reg.Token), &client)
+	var invoice createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+		"client_id": client.ID, "number": "INV-7", "amount_cents": 30000, "currency": "usd", "due_date": "2024-05-01",
+	}, reg.Token), &invoice)
+	for i, paid := range []struct {
+		cents int64
+		at    string
+	}{{10000, "2024-05-03T09:00:00Z"}, {20000, "2024-05-10T09:00:00Z"}} {
+		if _, err := database.Exec(`INSERT INTO payments (id, org_id, invoice_id, provider, provider_payment_id, amount_cents, currency, paid_at, created_at)
+			VALUES (?, ?, ?, 'generic', ?, ?, 'USD', ?, ?)`, fmt.Sprintf("pay-%d", i), reg.Org.ID, invoice.ID, fmt.Sprintf("ext-%d", i), paid.cents, paid.at, paid.at); err != nil {
+			t.Fatalf("insert payment: %v", err)
+		}
+	}
+
+	export := func(path string) [][]string {
+		t.Helper()
+		resp := performRequest(t, app, "GET", path, nil, reg.Token)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, resp.StatusCode)
+		}
+		records, err := csv.NewReader(resp.Body).ReadAll()
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: parse csv: %v", path, err)
+		}
+		return records
+	}
+
+	if records := export("/api/exports/invoices?format=xero"); len(records) != 2 || records[1][0] != "Ada Lovelace" {
+		t.Fatalf("expected the client name as the xero contact, got %v", records)
+	}
+	if records := export("/api/exports/invoices?format=quickbooks"); len(records) != 2 || records[1][1] != "Ada Lovelace" {
+		t.Fatalf("expected the client name as the quickbooks customer, got %v", records)
+	}
+
+	xero := export("/api/exports/payments?format=xero")
+	if len(xero) != 3 || xero[0][0] != "*Date" ||
+		strings.Join(xero[1], ",") != "2024-05-03,100.00,Ada Lovelace,Payment for invoice INV-7,INV-7," ||
+		xero[2][0] != "2024-05-10" || xero[2][1] != "200.00" {
+		t.Fatalf("unexpected xero payments %v", xero)
+	}
+	qb := export("/api/exports/payments?format=quickbooks&sort=-amount_cents")
+	if len(qb) != 3 || strings.Join(qb[0], ",") != "Date,Description,Amount" ||
+		strings.Join(qb[1], ",") != "05/10/2024,Payment for invoice INV-7,200.00" {
+		t.Fatalf("unexpected quickbooks payments %v", qb)
+	}
+	all := export("/api/exports/payments?from=2024-05-05")
+	if len(all) != 2 || all[1][0] != "pay-1" || all[1][2] != "INV-7" {
+		t.Fatalf("unexpected csv payments %v", all)
+	}
+	if resp := performRequest(t, app, "GET", "/api/exports/payments?format=iif", nil, reg.Token); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for iif payments, got %d", resp.StatusCode)
+	}
+
+	// Balances and accounting payments come from the recorded payments, not
+	// the status; an invoice marked paid by hand has no payment to export.
+	var handPaid createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+		"client_id": client.ID, "number": "INV-8", "amount_cents": 5000, "currency": "USD", "due_date": "2024-05-01",
+	}, reg.Token), &handPaid)
+	performRequest(t, app, "PUT", "/api/invoices/"+handPaid.ID, map[string]string{"status": "paid"}, reg.Token).Body.Close()
+	invoices := export("/api/exports/invoices?sort=number")
+	col := map[string]int{}
+	for i, name := range invoices[0] {
+		col[name] = i
+	}
+	if len(invoices) != 3 || invoices[1][col["status"]] == "paid" || invoices[1][col["paid_cents"]] != "30000" || invoices[1][col["balance_cents"]] != "0" ||
+		invoices[2][col["paid_cents"]] != "0" || invoices[2][col["balance_cents"]] != "0" {
+		t.Fatalf("unexpected balances %v", invoices)
+	}
+	resp := performRequest(t, app, "GET", "/api/exports/invoices?format=iif&sort=number", nil, reg.Token)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Count(string(body), "TRNS\tPAYMENT\t") != 2 || !strings.Contains(string(body), "TRNS\tPAYMENT\t05/03/2024\tUndeposited Funds\tAda Lovelace\t100.00\tINV-7") ||
+		!strings.Contains(string(body), "TRNS\tPAYMENT\t05/10/2024\tUndeposited Funds\tAda Lovelace\t200.00\tINV-7") {
+		t.Fatalf("expected the two recorded payments in iif, got %q", body)
+	}
+}
+
+// TestUBLExportMatchesSchema validates the UBL export against the OASIS UBL
+// 2.1 schemas with xmllint. The schemas are not checked in; see
+// testdata/ubl/README.md.
+func TestUBLExportMatchesSchema(t *testing.T) {
+	xmllint, err := exec.LookPath("xmllint")
+	if err != nil {
+		t.Skip("xmllint not installed")
+	}
+	schema, err := filepath.Abs("testdata/ubl/xsd/maindoc/UBL-Invoice-2.1.xsd")
+	if err != nil {
+		t.Fatalf("schema path: %v", err)
+	}
+	if _, err := os.Stat(schema); err != nil {
+		t.Skip("UBL 2.1 schemas not downloaded to testdata/ubl")
+	}
+
+	app, cleanup := newTestApp(t)
+	defer cleanup()
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	var client createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{
+		"name": "Ada Lovelace", "email": "ada@example.test", "company": "Acme Corp",
+	}, reg.Token), &client)
+	for i, status := range []string{"sent", "paid"} {
+		performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+			"client_id": client.ID, "number": fmt.Sprintf("INV-%d", i+1), "amount_cents": 125050, "currency": "EUR",
+			"due_date": "2024-05-01", "notes": "Design & build", "status": status,
+		}, reg.Token).Body.Close()
+	}
+
+	resp := performRequest(t, app, "GET", "/api/exports/invoices?format=ubl", nil, reg.Token)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d (%v)", resp.StatusCode, err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil || len(archive.File) != 2 {
+		t.Fatalf("unexpected archive (%v)", err)
+	}
+	dir := t.TempDir()
+	for _, file := range archive.File {
+		f, err := file.Open()
+		if err != nil {
+			t.Fatalf("open %s: %v", file.Name, err)
+		}
+		content, _ := io.ReadAll(f)
+		f.Close()
+		path := filepath.Join(dir, file.Name)
+		if err := os.WriteFile(path, content, 0o600); err != nil {
+			t.Fatalf("write %s: %v", file.Name, err)
+		}
+		if out, err := exec.Command(xmllint, "--noout", "--schema", schema, path).CombinedOutput(); err != nil {
+			t.Fatalf("%s does not match the UBL 2.1 schema: %s", file.Name, out)
+		}
+	}
+}
+
+func TestWebhookEndpointsMustBePublic(t *testing.T) {
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret"})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	for _, target := range []string{
+		"http://127.0.0.1:8080/hook", "http://localhost/hook", "http://[::1]/hook", "http://10.1.2.3/hook",
+		"http://192.168.0.10/hook", "http://172.16.5.4/hook", "http://169.254.169.254/latest/meta-data", "http://0.0.0.0/hook",
+	} {
+		resp := performRequest(t, app, "POST", "/api/webhooks", map[string]interface{}{"url": target, "events": []string{"invoice.paid"}}, reg.Token)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", target, resp.StatusCode)
+		}
+	}
+
+	// A saved endpoint that now resolves to a private address is refused when
+	// connecting, and redirects are not followed.
+	var hits int
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data", http.StatusFound)
+	}))
+	defer receiver.Close()
+	var hook struct {
+		ID string `json:"id"`
+	}
+	decodeJSON(t, performRequest(t, app, "POST", "/api/webhooks", map[string]interface{}{
+		"url": "https://hooks.example.com/nudgepay", "events": []string{"invoice.created"},
+	}, reg.Token), &hook)
+	if _, err := database.Exec(`UPDATE webhook_endpoints SET url = ? WHERE id = ?`, receiver.URL, hook.ID); err != nil {
+		t.Fatalf("point endpoint at loopback: %v", err)
+	}
+	var client createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{"name": "Acme", "email": "billing@acme.test"}, reg.Token), &client)
+	performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+		"client_id": client.ID, "number": "INV-1", "amount_cents": 1000, "currency": "USD", "due_date": "2030-01-01",
+	}, reg.Token).Body.Close()
+	if n, err := services.DeliverDueWebhooks(database, nil, time.Now().UTC().Add(time.Minute)); err != nil || n != 0 || hits != 0 {
+		t.Fatalf("expected the loopback delivery to be refused, delivered %d with %d hits (%v)", n, hits, err)
+	}
+	var lastError string
+	if err := database.QueryRow(`SELECT error FROM webhook_deliveries WHERE endpoint_id = ?`, hook.ID).Scan(&lastError); err != nil ||
+		!strings.Contains(lastError, "public address") {
+		t.Fatalf("expected a blocked address error, got %q (%v)", lastError, err)
+	}
+
+	resp, err := services.NewWebhookClient(true).Get(receiver.URL)
+	if err != nil {
+		t.Fatalf("request receiver: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || hits != 1 {
+		t.Fatalf("expected the redirect to be returned, not followed; got %d after %d hits", resp.StatusCode, hits)
+	}
+}
+
+func TestOutboxQueuedWebhookEvents(t *testing.T) {
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret"})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	// Nothing sends from the outbox, so there is no delivered or failed
+	// event to subscribe to.
+	for _, event := range []string{"outbox.delivered", "outbox.failed"} {
+		if resp := performRequest(t, app, "POST", "/api/webhooks", map[string]interface{}{
+			"url": "https://hooks.example.com/nudgepay", "events": []string{event},
+		}, reg.Token); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", event, resp.StatusCode)
+		}
+	}
+	var hook struct {
+		ID string `json:"id"`
+	}
+	decodeJSON(t, performRequest(t, app, "POST", "/api/webhooks", map[string]interface{}{
+		"url": "https://hooks.example.com/nudgepay", "events": []string{"outbox.queued"},
+	}, reg.Token), &hook)
+
+	var client, invoice createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{"name": "Acme", "email": "billing@acme.test"}, reg.Token), &client)
+	decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+		"client_id": client.ID, "number": "INV-1", "amount_cents": 1000, "currency": "USD", "due_date": "2030-01-01", "reminder_offsets": []int{0},
+	}, reg.Token), &invoice)
+	var reminderID string
+	if err := database.QueryRow(`SELECT id FROM reminders WHERE invoice_id = ?`, invoice.ID).Scan(&reminderID); err != nil {
+		t.Fatalf("load reminder: %v", err)
+	}
+	if resp := performRequest(t, app, "POST", "/api/reminders/"+reminderID+"/send", nil, reg.Token); resp.StatusCode != http.StatusOK {
+		t.Fatalf("send reminder: expected 200, got %d", resp.StatusCode)
+	}
+
+	var outboxID, payload string
+	if err := database.QueryRow(`SELECT id FROM outbox WHERE reminder_id = ?`, reminderID).Scan(&outboxID); err != nil {
+		t.Fatalf("load outbox: %v", err)
+	}
+	if err := database.QueryRow(`SELECT e.payload FROM webhook_events e JOIN webhook_deliveries d ON d.event_id = e.id
+		WHERE e.event_type = 'outbox.queued' AND e.resource_id = ? AND d.endpoint_id = ?`, outboxID, hook.ID).Scan(&payload); err != nil {
+		t.Fatalf("expected an outbox.queued delivery: %v", err)
+	}
+	var event struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(payload), &event); err != nil || event.Data["reminder_id"] != reminderID || event.Data["to_email"] != "billing@acme.test" {
+		t.Fatalf("unexpected outbox event %s", payload)
+	}
+}
+
+func TestMarkingInvoicePaidSettlesIt(t *testing.T) {
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", PaymentProvider: payments.NewFakeProvider("https://pay.example.com")})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	var client, invoice createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{"name": "Acme", "email": "billing@acme.test"}, reg.Token), &client)
+	decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+		"client_id": client.ID, "number": "INV-1", "amount_cents": 1000, "currency": "USD", "due_date": "2030-01-01", "reminder_offsets": []int{-3, 0, 3},
+	}, reg.Token), &invoice)
+	if resp := performRequest(t, app, "POST", "/api/invoices/"+invoice.ID+"/payment-link", nil, reg.Token); resp.StatusCode != http.StatusOK {
+		t.Fatalf("payment link: expected 200, got %d", resp.StatusCode)
+	}
+
+	// Marking the invoice paid by hand settles it like a recorded payment.
+	if resp := performRequest(t, app, "PATCH", "/api/invoices/"+invoice.ID, map[string]string{"status": "paid"}, reg.Token); resp.StatusCode != http.StatusOK {
+		t.Fatalf("mark paid: expected 200, got %d", resp.StatusCode)
+	}
+	var scheduled, cancelled, openLinks int
+	if err := database.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM reminders WHERE invoice_id = ? AND status = 'scheduled'),
+		(SELECT COUNT(*) FROM webhook_events WHERE event_type = 'reminder.cancelled'),
+		(SELECT COUNT(*) FROM payment_links WHERE invoice_id = ? AND status = 'open')`, invoice.ID, invoice.ID).
+		Scan(&scheduled, &cancelled, &openLinks); err != nil {
+		t.Fatalf("load settlement: %v", err)
+	}
+	if scheduled != 0 || cancelled != 3 || openLinks != 0 {
+		t.Fatalf("expected 3 cancelled reminders and no open links, got %d scheduled, %d cancelled events, %d open links", scheduled, cancelled, openLinks)
+	}
+}
+
+func TestWebhooksAreSignedRetriedAndLogged(t *testing.T) {
+	// Handlers stamp events with the wall clock; the worker runs on the fake
+	// clock, which starts just ahead of it.
+	clock := &fakeClock{now: time.Now().UTC().Add(time.Minute).Truncate(time.Second)}
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", Clock: clock.Now, AllowPrivateWebhooks: true})
+	defer cleanup()
+
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	var mu sync.Mutex
+	var requests []received
+	status := http.StatusInternalServerError
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, received{r.Header.Clone(), body})
+		w.WriteHeader(status)
+		fmt.Fprint(w, "ack")
+	}))
+	defer receiver.Close()
+	setStatus := func(code int) {
+		mu.Lock()
+		status = code
+		mu.Unlock()
+	}
+	deliver := func() int {
+		t.Helper()
+		n, err := services.DeliverDueWebhooks(database, services.NewWebhookClient(true), clock.Now())
+		if err != nil {
+			t.Fatalf("deliver webhooks: %v", err)
+		}
+		return n
+	}
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	for _, body := range []map[string]interface{}{
+		{"url": "ftp://crm.example.com/hook", "events": []string{"invoice.paid"}},
+		{"url": receiver.URL, "events": []string{"invoice.refunded"}},
+		{"url": receiver.URL, "events": []string{}},
+		{"url": receiver.URL, "events": []string{"invoice.paid"}, "secret": "short"},
+	} {
+		if resp := performRequest(t, app, "POST", "/api/webhooks", body, reg.Token); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %v, got %d", body, resp.StatusCode)
+		}
+	}
+	var hook struct {
+		ID     string   `json:"id"`
+		Events []string `json:"events"`
+		Secret string   `json:"secret"`
+	}
+	resp := performRequest(t, app, "POST", "/api/webhooks", map[string]interface{}{
+		"url": receiver.URL, "events": []string{"invoice.created", "invoice.paid", "reminder.sent", "invoice.created"},
+	}, reg.Token)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	decodeJSON(t, resp, &hook)
+	if !strings.HasPrefix(hook.Secret, "whsec_") || len(hook.Events) != 3 {
+		t.Fatalf("unexpected webhook %+v", hook)
+	}
+	listResp := performRequest(t, app, "GET", "/api/webhooks", nil, reg.Token)
+	listBody, _ := io.ReadAll(listResp.Body)
+	if strings.Contains(string(listBody), hook.Secret) || !strings.Contains(string(listBody), hook.ID) {
+		t.Fatalf("unexpected webhook list %s", listBody)
+	}
+
+	var client, invoice createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{
+		"name": "Acme", "email": "billing@acme.test",
+	}, reg.Token), &client)
+	decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+		"client_id": client.ID, "number": "INV-1", "amount_cents": 5000, "currency": "USD",
+		"due_date": "2024-05-01", "reminder_offsets": []int{0},
+	}, reg.Token), &invoice)
+	performRequest(t, app, "POST", "/api/reminders/send-due", nil, reg.Token).Body.Close()
+	performRequest(t, app, "PUT", "/api/invoices/"+invoice.ID, map[string]string{"notes": "Net 30"}, reg.Token).Body.Close()
+	performRequest(t, app, "PUT", "/api/invoices/"+invoice.ID, map[string]string{"status": "paid"}, reg.Token).Body.Close()
+	if len(requests) != 0 {
+		t.Fatalf("webhooks must be sent by the worker, got %d requests", len(requests))
+	}
+
+	type delivery struct {
+		ID             string          `json:"id"`
+		EventType      string          `json:"event_type"`
+		Payload        json.RawMessage `json:"payload"`
+		Status         string          `json:"status"`
+		Attempts       int             `json:"attempts"`
+		NextAttemptAt  *string         `json:"next_attempt_at"`
+		ResponseStatus *int            `json:"response_status"`
+		ResponseBody   string          `json:"response_body"`
+	}
+	deliveries := func() []delivery {
+		t.Helper()
+		var log struct {
+			Deliveries []delivery `json:"deliveries"`
+		}
+		decodeJSON(t, performRequest(t, app, "GET", "/api/webhooks/"+hook.ID+"/deliveries", nil, reg.Token), &log)
+		return log.Deliveries
+	}
+
+	// The endpoint fails, so every delivery is retried a minute later.
+	if n := deliver(); n != 0 || len(requests) != 3 {
+		t.Fatalf("expected 3 failed attempts, got %d delivered of %d", n, len(requests))
+	}
+	retryAt := clock.Now().Add(time.Minute).Format(time.RFC3339)
+	for _, d := range deliveries() {
+		if d.Status != "pending" || d.Attempts != 1 || d.ResponseStatus == nil || *d.ResponseStatus != 500 ||
+			d.NextAttemptAt == nil || *d.NextAttemptAt != retryAt {
+			t.Fatalf("unexpected delivery after failure %+v", d)
+		}
+	}
+	setStatus(http.StatusOK)
+	if n := deliver(); n != 0 {
+		t.Fatalf("retries are not due yet, delivered %d", n)
+	}
+	clock.Advance(time.Minute)
+	if n := deliver(); n != 3 {
+		t.Fatalf("expected 3 deliveries, got %d", n)
+	}
+
+	types := map[string]bool{}
+	for _, req := range requests[3:] {
+		var event struct {
+			ID   string                 `json:"id"`
+			Type string                 `json:"type"`
+			Data map[string]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal(req.body, &event); err != nil {
+			t.Fatalf("decode event: %v", err)
+		}
+		var timestamp int64
+		var signature string
+		if _, err := fmt.Sscanf(strings.Replace(req.header.Get("NudgePay-Signature"), ",v1=", " ", 1), "t=%d %s", &timestamp, &signature); err != nil {
+			t.Fatalf("parse signature %q: %v", req.header.Get("NudgePay-Signature"), err)
+		}
+		if timestamp != clock.Now().Unix() || signature != services.WebhookSignature(hook.Secret, timestamp, req.body) {
+			t.Fatalf("signature does not verify: %q", req.header.Get("NudgePay-Signature"))
+		}
+		if services.WebhookSignature("another-secret", timestamp, req.body) == signature {
+			t.Fatalf("signature does not depend on the secret")
+		}
+		if req.header.Get("NudgePay-Event") != event.Type || req.header.Get("Content-Type") != "application/json" {
+			t.Fatalf("unexpected headers %v", req.header)
+		}
+		types[event.Type] = true
+		if event.Type != "reminder.sent" && (event.Data["id"] != invoice.ID || event.Data["number"] != "INV-1") {
+			t.Fatalf("unexpected invoice event %s", req.body)
+		}
+		if event.Type == "reminder.sent" && (event.Data["invoice_id"] != invoice.ID || event.Data["status"] != "sent") {
+			t.Fatalf("unexpected reminder event %s", req.body)
+		}
+	}
+	if len(types) != 3 || !types["invoice.created"] || !types["reminder.sent"] || !types["invoice.paid"] {
+		t.Fatalf("expected created, sent and paid events, got %v", types)
+	}
+
+	// A delivery that keeps failing is given up on after its retries.
+	setStatus(http.StatusServiceUnavailable)
+	performRequest(t, app, "PUT", "/api/invoices/"+invoice.ID, map[string]string{"status": "sent"}, reg.Token).Body.Close()
+	performRequest(t, app, "PUT", "/api/invoices/"+invoice.ID, map[string]string{"status": "paid"}, reg.Token).Body.Close()
+	for i := 0; i < 7; i++ {
+		deliver()
+		clock.Advance(25 * time.Hour)
+	}
+	log := deliveries()
+	var failed delivery
+	for _, d := range log {
+		if d.Status != "delivered" {
+			failed = d
+		}
+	}
+	if len(log) != 4 || failed.Status != "failed" || failed.Attempts != 7 || failed.NextAttemptAt != nil || failed.ResponseBody != "ack" {
+		t.Fatalf("expected the last delivery to fail after 7 attempts, got %+v", failed)
+	}
+	if n := deliver(); n != 0 {
+		t.Fatalf("failed deliveries are not retried, delivered %d", n)
+	}
+
+	// Redelivery sends the same event again and keeps the failed attempt.
+	setStatus(http.StatusNoContent)
+	var redelivered delivery
+	resp = performRequest(t, app, "POST", "/api/webhooks/"+hook.ID+"/deliveries/"+failed.ID+"/redeliver", nil, reg.Token)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	decodeJSON(t, resp, &redelivered)
+	if redelivered.ID == failed.ID || redelivered.Status != "delivered" || redelivered.Attempts != 1 ||
+		string(redelivered.Payload) != string(failed.Payload) {
+		t.Fatalf("unexpected redelivery %+v", redelivered)
+	}
+	if len(deliveries()) != 5 {
+		t.Fatalf("expected the redelivery in the log")
+	}
+	var redeliveryEvents int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM audit_events WHERE resource_type = 'webhook_delivery' AND action = 'send' AND resource_id = ?`, redelivered.ID).Scan(&redeliveryEvents); err != nil || redeliveryEvents != 1 {
+		t.Fatalf("expected the redelivery to be audited, got %d (%v)", redeliveryEvents, err)
+	}
+	if resp := performRequest(t, app, "POST", "/api/webhooks/"+hook.ID+"/deliveries/missing/redeliver", nil, reg.Token); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.StatusCode)
+	}
+
+	// Overdue invoices are announced once; only subscribed endpoints hear it.
+	performRequest(t, app, "PUT", "/api/webhooks/"+hook.ID, map[string]interface{}{
+		"url": receiver.URL, "events": []string{"invoice.overdue"},
+	}, reg.Token).Body.Close()
+	performRequest(t, app, "PUT", "/api/invoices/"+invoice.ID, map[string]string{"status": "sent"}, reg.Token).Body.Close()
+	for _, want := range []int{1, 0} {
+		if n, err := services.EmitOverdueInvoices(database, reg.Org.ID, clock.Now()); err != nil || n != want {
+			t.Fatalf("expected %d overdue events, got %d (%v)", want, n, err)
+		}
+	}
+	overdue := 0
+	for _, d := range deliveries() {
+		if d.EventType == "invoice.overdue" {
+			overdue++
+		}
+	}
+	if overdue != 1 {
+		t.Fatalf("expected one overdue delivery, got %d", overdue)
+	}
+
+	if resp := performRequest(t, app, "DELETE", "/api/webhooks/"+hook.ID, nil, reg.Token); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "GET", "/api/webhooks/"+hook.ID+"/deliveries", nil, reg.Token); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 after delete, got %d", resp.StatusCode)
+	}
+}
+
+func TestInboundPaymentWebhook(t *testing.T) {
+	clock := &fakeClock{now: time.Now().UTC().Truncate(time.Second)}
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", BaseURL: "https://app.example.com", Clock: clock.Now})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	deliver := func(orgID, provider, secret string, body interface{}, signedAt time.Time) *http.Response {
+		t.Helper()
+		payload, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("encode error: %v", err)
+		}
+		header := "NudgePay-Signature"
+		if provider == payments.ProviderStripe {
+			header = "Stripe-Signature"
+		}
+		req := httptest.NewRequest("POST", "/api/payment-webhooks/"+orgID+"/"+provider, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(header, fmt.Sprintf("t=%d,v1=%s", signedAt.Unix(), payments.Sign(secret, signedAt.Unix(), payload)))
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		return resp
+	}
+	type webhookResult struct {
+		PaymentID          string `json:"payment_id"`
+		InvoiceID          string `json:"invoice_id"`
+		Duplicate          bool   `json:"duplicate"`
+		InvoicePaid        bool   `json:"invoice_paid"`
+		Ignored            bool   `json:"ignored"`
+		CancelledReminders int    `json:"cancelled_reminders"`
+	}
+
+	generic := map[string]interface{}{"id": "pay_1", "invoice_number": "INV-1", "amount_cents": 100, "currency": "USD"}
+	if resp := deliver(reg.Org.ID, payments.ProviderGeneric, "not-configured-yet", generic, clock.Now()); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 before configuration, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "PUT", "/api/org/payment-webhook", map[string]string{"secret": "short"}, reg.Token); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for short secret, got %d", resp.StatusCode)
+	}
+	var webhookConfig struct {
+		Configured bool   `json:"configured"`
+		StripeURL  string `json:"stripe_url"`
+		Secret     string `json:"secret"`
+	}
+	resp := performRequest(t, app, "PUT", "/api/org/payment-webhook", map[string]string{}, reg.Token)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	decodeJSON(t, resp, &webhookConfig)
+	if !webhookConfig.Configured || webhookConfig.Secret == "" || webhookConfig.StripeURL != "https://app.example.com/api/payment-webhooks/"+reg.Org.ID+"/stripe" {
+		t.Fatalf("unexpected payment webhook config %+v", webhookConfig)
+	}
+	secret := webhookConfig.Secret
+	getBody, _ := io.ReadAll(performRequest(t, app, "GET", "/api/org/payment-webhook", nil, reg.Token).Body)
+	if strings.Contains(string(getBody), secret) || !strings.Contains(string(getBody), `"configured":true`) {
+		t.Fatalf("unexpected payment webhook config %s", getBody)
+	}
+
+	var client, first, second createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{
+		"name": "Acme", "email": "billing@acme.test",
+	}, reg.Token), &client)
+	dueDate := clock.Now().AddDate(0, 0, 30).Format("2006-01-02")
+	decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+		"client_id": client.ID, "number": "INV-1", "amount_cents": 5000, "currency": "USD",
+		"due_date": dueDate, "reminder_offsets": []int{-3, 0, 7},
+	}, reg.Token), &first)
+	decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+		"client_id": client.ID, "number": "INV-2", "amount_cents": 3000, "currency": "USD",
+		"due_date": dueDate, "reminder_offsets": []int{0},
+	}, reg.Token), &second)
+
+	checkout := map[string]interface{}{
+		"id": "evt_1", "type": "checkout.session.completed", "created": clock.Now().Unix(),
+		"data": map[string]interface{}{"object": map[string]interface{}{
+			"id": "cs_1", "payment_intent": "pi_1", "payment_status": "paid", "client_reference_id": first.ID,
+			"amount_total": 5000, "currency": "usd", "metadata": map[string]string{},
+		}},
+	}
+	if resp := deliver(reg.Org.ID, payments.ProviderStripe, "whsec_wrong_secret_value", checkout, clock.Now()); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad signature, got %d", resp.StatusCode)
+	}
+	if resp := deliver(reg.Org.ID, payments.ProviderStripe, secret, checkout, clock.Now().Add(-10*time.Minute)); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a stale signature, got %d", resp.StatusCode)
+	}
+	var result webhookResult
+	resp = deliver(reg.Org.ID, payments.ProviderStripe, secret, checkout, clock.Now())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	decodeJSON(t, resp, &result)
+	if result.InvoiceID != first.ID || !result.InvoicePaid || result.Duplicate || result.CancelledReminders != 3 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	// Stripe reports the same PaymentIntent again; it must count once.
+	succeeded := map[string]interface{}{
+		"id": "evt_2", "type": "payment_intent.succeeded", "created": clock.Now().Unix(),
+		"data": map[string]interface{}{"object": map[string]interface{}{
+			"id": "pi_1", "amount_received": 5000, "currency": "usd", "metadata": map[string]string{"invoice_id": first.ID},
+		}},
+	}
+	var duplicate webhookResult
+	decodeJSON(t, deliver(reg.Org.ID, payments.ProviderStripe, secret, succeeded, clock.Now()), &duplicate)
+	if !duplicate.Duplicate || duplicate.PaymentID != result.PaymentID || duplicate.InvoicePaid {
+		t.Fatalf("unexpected duplicate result %+v", duplicate)
+	}
+	var ignored webhookResult
+	decodeJSON(t, deliver(reg.Org.ID, payments.ProviderStripe, secret, map[string]interface{}{
+		"id": "evt_3", "type": "customer.created", "data": map[string]interface{}{"object": map[string]interface{}{"id": "cus_1"}},
+	}, clock.Now()), &ignored)
+	if !ignored.Ignored {
+		t.Fatalf("expected the event to be ignored, got %+v", ignored)
+	}
+
+	var invoice struct {
+		Status    string `json:"status"`
+		Reminders []struct {
+			Status string `json:"status"`
+		} `json:"reminders"`
+		Payments []struct {
+			Provider          string `json:"provider"`
+			ProviderPaymentID string `json:"provider_payment_id"`
+			AmountCents       int64  `json:"amount_cents"`
+		} `json:"payments"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/invoices/"+first.ID, nil, reg.Token), &invoice)
+	if invoice.Status != "paid" || len(invoice.Payments) != 1 || invoice.Payments[0].ProviderPaymentID != "pi_1" || invoice.Payments[0].AmountCents != 5000 {
+		t.Fatalf("unexpected invoice %+v", invoice)
+	}
+	for _, reminder := range invoice.Reminders {
+		if reminder.Status != "cancelled" {
+			t.Fatalf("expected reminders to be cancelled, got %+v", invoice.Reminders)
+		}
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"id": "pay_x", "invoice_number": "INV-404", "amount_cents": 100, "currency": "USD"},
+		{"id": "pay_x", "invoice_number": "INV-2", "amount_cents": 100, "currency": "EUR"},
+	} {
+		if resp := deliver(reg.Org.ID, payments.ProviderGeneric, secret, body, clock.Now()); resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf("expected 422 for %v, got %d", body, resp.StatusCode)
+		}
+	}
+	if resp := deliver(reg.Org.ID, payments.ProviderGeneric, secret, map[string]interface{}{"id": "pay_x", "invoice_number": "INV-2"}, clock.Now()); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a payment without an amount, got %d", resp.StatusCode)
+	}
+
+	var partial, rest webhookResult
+	decodeJSON(t, deliver(reg.Org.ID, payments.ProviderGeneric, secret, map[string]interface{}{
+		"id": "pay_2", "amount_cents": 1000, "currency": "usd", "metadata": map[string]string{"invoice_number": "INV-2"},
+	}, clock.Now()), &partial)
+	if partial.InvoiceID != second.ID || partial.InvoicePaid {
+		t.Fatalf("unexpected partial result %+v", partial)
+	}
+	decodeJSON(t, deliver(reg.Org.ID, payments.ProviderGeneric, secret, map[string]interface{}{
+		"id": "pay_3", "invoice_number": "INV-2", "amount_cents": 2000, "currency": "USD", "paid_at": "2024-05-02T10:00:00Z",
+	}, clock.Now()), &rest)
+	if !rest.InvoicePaid || rest.CancelledReminders != 1 {
+		t.Fatalf("unexpected result %+v", rest)
+	}
+
+	var cancelled int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM webhook_events WHERE org_id = ? AND event_type = ?`,
+		reg.Org.ID, services.WebhookReminderCancelled).Scan(&cancelled); err != nil || cancelled != 4 {
+		t.Fatalf("expected 4 reminder.cancelled events, got %d (%v)", cancelled, err)
+	}
+	var audited int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM audit_events WHERE org_id = ? AND resource_type = 'payment'`, reg.Org.ID).
+		Scan(&audited); err != nil || audited != 3 {
+		t.Fatalf("expected 3 audited payments, got %d (%v)", audited, err)
+	}
+
+	// Another org's secret cannot settle this org's invoices.
+	other := registerOrg(t, app, "other@example.com", "Studio Two")
+	var otherConfig struct {
+		Secret string `json:"secret"`
+	}
+	decodeJSON(t, performRequest(t, app, "PUT", "/api/org/payment-webhook", map[string]string{}, other.Token), &otherConfig)
+	if resp := deliver(other.Org.ID, payments.ProviderGeneric, otherConfig.Secret, generic, clock.Now()); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 across orgs, got %d", resp.StatusCode)
+	}
+	if resp := deliver(reg.Org.ID, "paypal", secret, generic, clock.Now()); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown provider, got %d", resp.StatusCode)
+	}
+}
+
+// failingProvider counts link requests and fails them while down is set.
+// Lookups of the links in broken fail too.
+type failingProvider struct {
+	*payments.FakeProvider
+	down    bool
+	calls   int
+	broken  map[string]bool
+	lookups int
+}
+
+func (p *failingProvider) CreateLink(req payments.LinkRequest, now time.Time) (payments.Link, error) {
+	p.calls++
+	if p.down {
+		return payments.Link{}, fmt.Errorf("provider unavailable")
+	}
+	return p.FakeProvider.CreateLink(req, now)
+}
+
+func (p *failingProvider) LinkPayment(linkID string) (payments.Payment, bool, error) {
+	p.lookups++
+	if p.broken[linkID] {
+		return payments.Payment{}, false, fmt.Errorf("lookup failed")
+	}
+	return p.FakeProvider.LinkPayment(linkID)
+}
+
+func TestRemindersOnlyRequestPaymentLinksTheyShow(t *testing.T) {
+	provider := &failingProvider{FakeProvider: payments.NewFakeProvider("https://pay.example.com")}
+	app, _, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", PaymentProvider: provider})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	var client, tmpl createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{"name": "Acme", "email": "billing@acme.test"}, reg.Token), &client)
+	decodeJSON(t, performRequest(t, app, "POST", "/api/templates", map[string]string{
+		"name": "With link", "subject": "Invoice {{invoice_number}}", "body": "Pay {{amount}} here: {{payment_link}}",
+	}, reg.Token), &tmpl)
+	due := time.Now().UTC().Add(-24 * time.Hour).Format("2006-01-02")
+	createInvoice := func(number, templateID string) {
+		t.Helper()
+		resp := performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+			"client_id": client.ID, "template_id": templateID, "number": number, "amount_cents": 5000, "currency": "USD",
+			"due_date": due, "reminder_offsets": []int{0},
+		}, reg.Token)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("create %s: expected 201, got %d", number, resp.StatusCode)
+		}
+	}
+	sendDue := func() (int, int) {
+		t.Helper()
+		resp := performRequest(t, app, "POST", "/api/reminders/send-due", nil, reg.Token)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("send-due: expected 200, got %d", resp.StatusCode)
+		}
+		var out struct {
+			Sent         int `json:"sent"`
+			LinkFailures int `json:"payment_link_failures"`
+		}
+		decodeJSON(t, resp, &out)
+		return out.Sent, out.LinkFailures
+	}
+
+	// The default template has no {{payment_link}}, so no link is created.
+	createInvoice("INV-1", "")
+	if sent, failures := sendDue(); sent != 1 || failures != 0 || provider.calls != 0 {
+		t.Fatalf("expected 1 reminder and no link requests, got %d, %d failures and %d", sent, failures, provider.calls)
+	}
+
+	// A provider outage leaves the link out instead of holding up reminders,
+	// and the response says so.
+	provider.down = true
+	createInvoice("INV-2", tmpl.ID)
+	createInvoice("INV-3", "")
+	if sent, failures := sendDue(); sent != 2 || failures != 1 || provider.calls != 1 {
+		t.Fatalf("expected 2 reminders after 1 failed link request, got %d, %d failures and %d", sent, failures, provider.calls)
+	}
+	var outbox struct {
+		Outbox []struct {
+			Body string `json:"body"`
+		} `json:"outbox"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/outbox", nil, reg.Token), &outbox)
+	found := false
+	for _, email := range outbox.Outbox {
+		found = found || email.Body == "Pay USD 50.00 here: "
+	}
+	if !found {
+		t.Fatalf("expected the linked reminder without its link, got %+v", outbox.Outbox)
+	}
+}
+
+func TestPaymentLinksInRemindersReconcileThroughFakeProvider(t *testing.T) {
+	clock := &fakeClock{now: time.Now().UTC().Truncate(time.Second)}
+	fake := payments.NewFakeProvider("https://pay.example.com")
+	fake.TTL = 24 * time.Hour
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", Clock: clock.Now, PaymentProvider: fake})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	var client, tmpl, invoice createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{
+		"name": "Acme", "email": "billing@acme.test",
+	}, reg.Token), &client)
+	decodeJSON(t, performRequest(t, app, "POST", "/api/templates", map[string]string{
+		"name": "With link", "subject": "Invoice {{invoice_number}}", "body": "Pay {{amount}} here: {{payment_link}}",
+	}, reg.Token), &tmpl)
+	decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+		"client_id": client.ID, "template_id": tmpl.ID, "number": "INV-1", "amount_cents": 5000, "currency": "USD",
+		"due_date": time.Now().UTC().Add(-24 * time.Hour).Format("2006-01-02"), "reminder_offsets": []int{0, 7},
+	}, reg.Token), &invoice)
+
+	performRequest(t, app, "POST", "/api/reminders/send-due", nil, reg.Token).Body.Close()
+	var outbox struct {
+		Outbox []struct {
+			Body string `json:"body"`
+		} `json:"outbox"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/outbox", nil, reg.Token), &outbox)
+	if len(outbox.Outbox) != 1 || outbox.Outbox[0].Body != "Pay USD 50.00 here: https://pay.example.com/fake-checkout/fake_cs_1" {
+		t.Fatalf("unexpected outbox %+v", outbox.Outbox)
+	}
+
+	type paymentLink struct {
+		URL         string `json:"url"`
+		Provider    string `json:"provider"`
+		AmountCents int64  `json:"amount_cents"`
+		ExpiresAt   string `json:"expires_at"`
+	}
+	var link paymentLink
+	resp := performRequest(t, app, "POST", "/api/invoices/"+invoice.ID+"/payment-link", nil, reg.Token)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	decodeJSON(t, resp, &link)
+	if link.URL != "https://pay.example.com/fake-checkout/fake_cs_1" || link.Provider != payments.ProviderFake || link.AmountCents != 5000 {
+		t.Fatalf("expected the reminder's link to be reused, got %+v", link)
+	}
+	decodeJSON(t, performRequest(t, app, "POST", "/api/invoices/"+invoice.ID+"/payment-link", map[string]bool{"refresh": true}, reg.Token), &link)
+	if link.URL != "https://pay.example.com/fake-checkout/fake_cs_2" {
+		t.Fatalf("expected a refreshed link, got %+v", link)
+	}
+	clock.Advance(23*time.Hour + 30*time.Minute)
+	decodeJSON(t, performRequest(t, app, "POST", "/api/invoices/"+invoice.ID+"/payment-link", nil, reg.Token), &link)
+	if link.URL != "https://pay.example.com/fake-checkout/fake_cs_3" {
+		t.Fatalf("expected a link about to expire to be replaced, got %+v", link)
+	}
+	if resp := performRequest(t, app, "POST", "/api/invoices/missing/payment-link", nil, reg.Token); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.StatusCode)
+	}
+	// New links are audited on the request clock; reusing one is not a change.
+	var linkEvents int
+	var lastAudited string
+	if err := database.QueryRow(`SELECT COUNT(*), MAX(created_at) FROM audit_events WHERE resource_type = 'payment_link' AND action = 'create'`).Scan(&linkEvents, &lastAudited); err != nil {
+		t.Fatalf("count payment link audit events: %v", err)
+	}
+	if linkEvents != 2 || lastAudited != clock.Now().Format(time.RFC3339) {
+		t.Fatalf("expected 2 payment link events ending at %s, got %d ending at %s", clock.Now().Format(time.RFC3339), linkEvents, lastAudited)
+	}
+
+	// The client pays through the link from the reminder, which is still open.
+	if n, err := services.ReconcilePaymentLinks(database, fake, clock.Now()); err != nil || n != 0 {
+		t.Fatalf("expected nothing to reconcile, got %d (%v)", n, err)
+	}
+	if err := fake.Pay("fake_cs_1", clock.Now()); err != nil {
+		t.Fatalf("pay: %v", err)
+	}
+	if n, err := services.ReconcilePaymentLinks(database, fake, clock.Now()); err != nil || n != 1 {
+		t.Fatalf("expected one payment reconciled, got %d (%v)", n, err)
+	}
+	if n, err := services.ReconcilePaymentLinks(database, fake, clock.Now()); err != nil || n != 0 {
+		t.Fatalf("expected the payment to be recorded once, got %d (%v)", n, err)
+	}
+
+	var detail struct {
+		Status    string `json:"status"`
+		Reminders []struct {
+			Status string `json:"status"`
+		} `json:"reminders"`
+		Payments []struct {
+			Provider    string `json:"provider"`
+			AmountCents int64  `json:"amount_cents"`
+		} `json:"payments"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/invoices/"+invoice.ID, nil, reg.Token), &detail)
+	if detail.Status != "paid" || len(detail.Payments) != 1 || detail.Payments[0].Provider != payments.ProviderFake || detail.Payments[0].AmountCents != 5000 {
+		t.Fatalf("unexpected invoice %+v", detail)
+	}
+	if len(detail.Reminders) != 2 || detail.Reminders[1].Status != "cancelled" {
+		t.Fatalf("expected the pending reminder to be cancelled, got %+v", detail.Reminders)
+	}
+	if resp := performRequest(t, app, "POST", "/api/invoices/"+invoice.ID+"/payment-link", nil, reg.Token); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for a paid invoice, got %d", resp.StatusCode)
+	}
+	linkStatuses := func() string {
+		t.Helper()
+		rows, err := database.Query(`SELECT status FROM payment_links WHERE invoice_id = ? ORDER BY rowid`, invoice.ID)
+		if err != nil {
+			t.Fatalf("query links: %v", err)
+		}
+		defer rows.Close()
+		var statuses []string
+		for rows.Next() {
+			var status string
+			if err := rows.Scan(&status); err != nil {
+				t.Fatalf("scan link: %v", err)
+			}
+			statuses = append(statuses, status)
+		}
+		return strings.Join(statuses, ",")
+	}
+	// Settling the invoice closes its other links.
+	if got := linkStatuses(); got != "paid,expired,expired" {
+		t.Fatalf("unexpected link statuses %s", got)
+	}
+}
+
+func TestReconcilePaymentLinksContinuesPastFailures(t *testing.T) {
+	clock := &fakeClock{now: time.Now().UTC().Truncate(time.Second)}
+	provider := &failingProvider{FakeProvider: payments.NewFakeProvider("https://pay.example.com"), broken: map[string]bool{"fake_cs_1": true}}
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", Clock: clock.Now, PaymentProvider: provider})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	var client createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{"name": "Acme", "email": "billing@acme.test"}, reg.Token), &client)
+	invoiceIDs := []string{}
+	for i, number := range []string{"INV-1", "INV-2"} {
+		var invoice createResponse
+		decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+			"client_id": client.ID, "number": number, "amount_cents": 5000, "currency": "USD", "due_date": "2024-05-01",
+		}, reg.Token), &invoice)
+		if resp := performRequest(t, app, "POST", "/api/invoices/"+invoice.ID+"/payment-link", nil, reg.Token); resp.StatusCode != http.StatusOK {
+			t.Fatalf("create link: expected 200, got %d", resp.StatusCode)
+		}
+		if err := provider.Pay(fmt.Sprintf("fake_cs_%d", i+1), clock.Now()); err != nil {
+			t.Fatalf("pay: %v", err)
+		}
+		invoiceIDs = append(invoiceIDs, invoice.ID)
+	}
+	status := func(id string) string {
+		t.Helper()
+		var status string
+		if err := database.QueryRow(`SELECT status FROM invoices WHERE id = ?`, id).Scan(&status); err != nil {
+			t.Fatalf("load invoice: %v", err)
+		}
+		return status
+	}
+
+	// The first link's lookup fails; the second is still reconciled.
+	n, err := services.ReconcilePaymentLinks(database, provider, clock.Now())
+	if n != 1 || err == nil || !strings.Contains(err.Error(), "lookup failed") {
+		t.Fatalf("expected one payment and the lookup error, got %d (%v)", n, err)
+	}
+	if status(invoiceIDs[0]) == "paid" || status(invoiceIDs[1]) != "paid" {
+		t.Fatalf("expected only INV-2 paid, got %s and %s", status(invoiceIDs[0]), status(invoiceIDs[1]))
+	}
+	delete(provider.broken, "fake_cs_1")
+	if n, err := services.ReconcilePaymentLinks(database, provider, clock.Now()); n != 1 || err != nil {
+		t.Fatalf("expected INV-1 reconciled once the provider recovers, got %d (%v)", n, err)
+	}
+
+	// Links of invoices settled some other way are not polled.
+	if _, err := database.Exec(`UPDATE payment_links SET status = 'open'`); err != nil {
+		t.Fatalf("reopen links: %v", err)
+	}
+	lookups := provider.lookups
+	if n, err := services.ReconcilePaymentLinks(database, provider, clock.Now()); n != 0 || err != nil || provider.lookups != lookups {
+		t.Fatalf("expected no lookups for paid invoices, got %d lookups (%d, %v)", provider.lookups-lookups, n, err)
+	}
+}
+
+func TestStripeCheckoutPaymentLinks(t *testing.T) {
+	clock := &fakeClock{now: time.Now().UTC().Truncate(time.Second)}
+	var mu sync.Mutex
+	var created url.Values
+	paid := false
+	stripe := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if user, _, ok := r.BasicAuth(); !ok || user != "sk_test_123" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/v1/checkout/sessions":
+			r.ParseForm()
+			created = r.PostForm
+			fmt.Fprintf(w, `{"id":"cs_test_1","url":"https://checkout.stripe.test/c/cs_test_1","expires_at":%d}`, clock.Now().Add(24*time.Hour).Unix())
+		case r.Method == "GET" && r.URL.Path == "/v1/checkout/sessions/cs_test_1":
+			status := "unpaid"
+			if paid {
+				status = "paid"
+			}
+			fmt.Fprintf(w, `{"id":"cs_test_1","payment_status":%q,"payment_intent":"pi_test_1","amount_total":12500,"currency":"eur","metadata":{"invoice_id":%q}}`,
+				status, created.Get("metadata[invoice_id]"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer stripe.Close()
+
+	provider := &payments.StripeCheckout{SecretKey: "sk_test_123", APIURL: stripe.URL, ReturnURL: "https://app.example.com"}
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", Clock: clock.Now, PaymentProvider: provider})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	var client, invoice createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{
+		"name": "Acme", "email": "billing@acme.test",
+	}, reg.Token), &client)
+	decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+		"client_id": client.ID, "number": "INV-7", "amount_cents": 12500, "currency": "EUR", "due_date": "2030-01-01",
+	}, reg.Token), &invoice)
+
+	var link struct {
+		URL       string `json:"url"`
+		Provider  string `json:"provider"`
+		ExpiresAt string `json:"expires_at"`
+	}
+	decodeJSON(t, performRequest(t, app, "POST", "/api/invoices/"+invoice.ID+"/payment-link", nil, reg.Token), &link)
+	if link.URL != "https://checkout.stripe.test/c/cs_test_1" || link.Provider != payments.ProviderStripe || link.ExpiresAt == "" {
+		t.Fatalf("unexpected link %+v", link)
+	}
+	mu.Lock()
+	for field, want := range map[string]string{
+		"mode":                                      "payment",
+		"line_items[0][price_data][currency]":       "eur",
+		"line_items[0][price_data][unit_amount]":    "12500",
+		"client_reference_id":                       invoice.ID,
+		"metadata[invoice_number]":                  "INV-7",
+		"payment_intent_data[metadata][invoice_id]": invoice.ID,
+		"customer_email":                            "billing@acme.test",
+		"success_url":                               "https://app.example.com",
+	} {
+		if got := created.Get(field); got != want {
+			t.Fatalf("%s: expected %q, got %q", field, want, got)
+		}
+	}
+	paid = true
+	mu.Unlock()
+
+	if n, err := services.ReconcilePaymentLinks(database, provider, clock.Now()); err != nil || n != 1 {
+		t.Fatalf("expected one payment reconciled, got %d (%v)", n, err)
+	}
+	var providerPaymentID, status string
+	if err := database.QueryRow(`SELECT p.provider_payment_id, i.status FROM payments p JOIN invoices i ON i.id = p.invoice_id
+		WHERE p.invoice_id = ?`, invoice.ID).Scan(&providerPaymentID, &status); err != nil {
+		t.Fatalf("load payment: %v", err)
+	}
+	if providerPaymentID != "pi_test_1" || status != "paid" {
+		t.Fatalf("unexpected payment %s for invoice status %s", providerPaymentID, status)
+	}
+}
+
+func TestPublicInvoicePageWithShareLinks(t *testing.T) {
+	clock := &fakeClock{now: time.Now().UTC().Truncate(time.Second)}
+	fake := payments.NewFakeProvider("https://pay.example.com")
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{
+		JWTSecret: "test-secret", BaseURL: "https://app.example.com", Clock: clock.Now, PaymentProvider: fake,
+	})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	var client, tmpl, invoice createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{
+		"name": "Acme", "email": "billing@acme.test", "company": "Acme Corp",
+	}, reg.Token), &client)
+	decodeJSON(t, performRequest(t, app, "POST", "/api/templates", map[string]string{
+		"name": "With page", "subject": "Invoice {{invoice_number}}", "body": "See {{invoice_url}}",
+	}, reg.Token), &tmpl)
+	decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+		"client_id": client.ID, "template_id": tmpl.ID, "number": "INV-1", "amount_cents": 5000, "currency": "USD",
+		"due_date": time.Now().UTC().Add(-24 * time.Hour).Format("2006-01-02"), "reminder_offsets": []int{0},
+		"notes": "<script>alert(1)</script>",
+	}, reg.Token), &invoice)
+	performRequest(t, app, "POST", "/api/reminders/send-due", nil, reg.Token).Body.Close()
+
+	var outbox struct {
+		Outbox []struct {
+			Body string `json:"body"`
+		} `json:"outbox"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/outbox", nil, reg.Token), &outbox)
+	match := regexp.MustCompile(`^See https://app\.example\.com(/pay/[A-Za-z0-9_-]+)$`).FindStringSubmatch(outbox.Outbox[0].Body)
+	if match == nil {
+		t.Fatalf("expected an invoice URL in the reminder, got %q", outbox.Outbox[0].Body)
+	}
+	reminderPath := match[1]
+
+	resp := performRequest(t, app, "GET", reminderPath, nil, "")
+	page, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") ||
+		resp.Header.Get("Cache-Control") != "no-store" || resp.Header.Get("Referrer-Policy") != "no-referrer" {
+		t.Fatalf("unexpected response %d %v", resp.StatusCode, resp.Header)
+	}
+	for _, want := range []string{
+		"Studio One", "Invoice INV-1", "Acme, Acme Corp", "USD 50.00",
+		`href="https://app.example.com` + reminderPath + `/pdf"`,
+		"&lt;script&gt;",
+	} {
+		if !strings.Contains(string(page), want) {
+			t.Fatalf("expected page to contain %q:\n%s", want, page)
+		}
+	}
+	if strings.Contains(string(page), "<script>") || strings.Contains(string(page), invoice.ID) {
+		t.Fatalf("page leaks unescaped notes or internal ids:\n%s", page)
+	}
+	// Viewing the page never creates a checkout session; it shows one once
+	// staff or a reminder made it.
+	var linkCount int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM payment_links`).Scan(&linkCount); err != nil {
+		t.Fatalf("count payment links: %v", err)
+	}
+	if strings.Contains(string(page), "fake-checkout") || linkCount != 0 {
+		t.Fatalf("expected no payment link from a page view, got %d:\n%s", linkCount, page)
+	}
+	if resp := performRequest(t, app, "POST", "/api/invoices/"+invoice.ID+"/payment-link", nil, reg.Token); resp.StatusCode != http.StatusOK {
+		t.Fatalf("payment link: expected 200, got %d", resp.StatusCode)
+	}
+	page, _ = io.ReadAll(performRequest(t, app, "GET", reminderPath, nil, "").Body)
+	if !strings.Contains(string(page), `href="https://pay.example.com/fake-checkout/fake_cs_1"`) {
+		t.Fatalf("expected the staff-created payment link on the page:\n%s", page)
+	}
+
+	resp = performRequest(t, app, "GET", reminderPath+"/pdf", nil, "")
+	pdf, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/pdf" ||
+		resp.Header.Get("Content-Disposition") != `attachment; filename="invoice-INV-1.pdf"` {
+		t.Fatalf("unexpected PDF response %d %v", resp.StatusCode, resp.Header)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) ||
+		!bytes.Contains(pdf, []byte("(Invoice INV-1)")) || !bytes.Contains(pdf, []byte("(Balance due: USD 50.00)")) {
+		t.Fatalf("unexpected PDF:\n%s", pdf)
+	}
+
+	// Staff links can expire; their URL is only shown once.
+	if resp := performRequest(t, app, "POST", "/api/invoices/"+invoice.ID+"/share-links", map[string]string{
+		"expires_at": clock.Now().Add(-time.Minute).Format(time.RFC3339),
+	}, reg.Token); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a past expiry, got %d", resp.StatusCode)
+	}
+	var staffLink struct {
+		ID        string `json:"id"`
+		URL       string `json:"url"`
+		ExpiresAt string `json:"expires_at"`
+	}
+	resp = performRequest(t, app, "POST", "/api/invoices/"+invoice.ID+"/share-links", map[string]string{
+		"expires_at": clock.Now().Add(time.Hour).Format(time.RFC3339),
+	}, reg.Token)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	decodeJSON(t, resp, &staffLink)
+	staffPath := strings.TrimPrefix(staffLink.URL, "https://app.example.com")
+	if !strings.HasPrefix(staffPath, "/pay/") || staffPath == reminderPath {
+		t.Fatalf("unexpected share link %+v", staffLink)
+	}
+	// A "-" placeholder company is left off the billed-to line.
+	if _, err := database.Exec(`UPDATE clients SET company = '-' WHERE id = ?`, client.ID); err != nil {
+		t.Fatalf("update client: %v", err)
+	}
+	resp = performRequest(t, app, "GET", staffPath, nil, "")
+	page, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(page), "Billed to Acme ·") {
+		t.Fatalf("expected the client name alone, got %d:\n%s", resp.StatusCode, page)
+	}
+	clock.Advance(2 * time.Hour)
+	if resp := performRequest(t, app, "GET", staffPath, nil, ""); resp.StatusCode != http.StatusGone {
+		t.Fatalf("expected 410 for an expired link, got %d", resp.StatusCode)
+	}
+
+	var list struct {
+		ShareLinks []struct {
+			ID           string  `json:"id"`
+			CreatedBy    *string `json:"created_by"`
+			LastViewedAt *string `json:"last_viewed_at"`
+		} `json:"share_links"`
+	}
+	resp = performRequest(t, app, "GET", "/api/invoices/"+invoice.ID+"/share-links", nil, reg.Token)
+	listBody, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(listBody, &list); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if len(list.ShareLinks) != 2 || list.ShareLinks[0].CreatedBy != nil || list.ShareLinks[0].LastViewedAt == nil ||
+		list.ShareLinks[1].CreatedBy == nil || strings.Contains(string(listBody), strings.TrimPrefix(staffPath, "/pay/")) {
+		t.Fatalf("unexpected share links %s", listBody)
+	}
+
+	other := registerOrg(t, app, "other@example.com", "Studio Two")
+	reminderLinkID := list.ShareLinks[0].ID
+	if resp := performRequest(t, app, "DELETE", "/api/invoices/"+invoice.ID+"/share-links/"+reminderLinkID, nil, other.Token); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 across orgs, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "GET", "/api/invoices/"+invoice.ID+"/share-links", nil, other.Token); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 across orgs, got %d", resp.StatusCode)
+	}
+
+	// Paying through the page's link settles the invoice it shows.
+	if err := fake.Pay("fake_cs_1", clock.Now()); err != nil {
+		t.Fatalf("pay: %v", err)
+	}
+	if _, err := services.ReconcilePaymentLinks(database, fake, clock.Now()); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	page, _ = io.ReadAll(performRequest(t, app, "GET", reminderPath, nil, "").Body)
+	if !strings.Contains(string(page), "This invoice is paid") || strings.Contains(string(page), "fake-checkout") {
+		t.Fatalf("expected a settled invoice page:\n%s", page)
+	}
+
+	if resp := performRequest(t, app, "DELETE", "/api/invoices/"+invoice.ID+"/share-links/"+reminderLinkID, nil, reg.Token); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "DELETE", "/api/invoices/"+invoice.ID+"/share-links/"+reminderLinkID, nil, reg.Token); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a revoked link, got %d", resp.StatusCode)
+	}
+	for _, path := range []string{reminderPath, reminderPath + "/pdf", "/pay/not-a-real-token"} {
+		if resp := performRequest(t, app, "GET", path, nil, ""); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s: expected 404, got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestClientPortalScopesToOneClient(t *testing.T) {
+	clock := &fakeClock{now: time.Now().UTC().Truncate(time.Second)}
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{
+		JWTSecret: "test-secret", BaseURL: "https://app.example.com", Clock: clock.Now,
+	})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	other := registerOrg(t, app, "owner@other.test", "Other Studio")
+	dueDate := time.Now().UTC().Add(-24 * time.Hour).Format("2006-01-02")
+	newInvoice := func(token, clientID, number string, amountCents int) string {
+		var invoice createResponse
+		decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+			"client_id": clientID, "number": number, "amount_cents": amountCents, "currency": "USD",
+			"due_date": dueDate, "reminder_offsets": []int{0},
+		}, token), &invoice)
+		return invoice.ID
+	}
+	var acme, beta, otherAcme createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{
+		"name": "Acme", "email": "billing@acme.test", "company": "Acme Corp",
+	}, reg.Token), &acme)
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{
+		"name": "Beta", "email": "ap@beta.test",
+	}, reg.Token), &beta)
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{
+		"name": "Acme", "email": "billing@acme.test",
+	}, other.Token), &otherAcme)
+	inv1 := newInvoice(reg.Token, acme.ID, "INV-1", 5000)
+	newInvoice(reg.Token, acme.ID, "INV-2", 3000)
+	inv3 := newInvoice(reg.Token, beta.ID, "INV-3", 7000)
+	inv9 := newInvoice(other.Token, otherAcme.ID, "INV-9", 9000)
+	performRequest(t, app, "POST", "/api/reminders/send-due", nil, reg.Token).Body.Close()
+	performRequest(t, app, "POST", "/api/reminders/send-due", nil, other.Token).Body.Close()
+	for i, invoiceID := range []string{inv1, inv3} {
+		if _, err := database.Exec(`INSERT INTO payments (id, org_id, invoice_id, provider, provider_payment_id, amount_cents, currency, paid_at, created_at)
+			VALUES (?, ?, ?, 'manual', ?, 2000, 'USD', ?, ?)`, fmt.Sprintf("pay-%d", i), reg.Org.ID, invoiceID, fmt.Sprintf("p%d", i),
+			clock.Now().Format(time.RFC3339), clock.Now().Format(time.RFC3339)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	magicLink := func(orgID string) string {
+		t.Helper()
+		var body string
+		if err := database.QueryRow(`SELECT body FROM outbox WHERE org_id = ? AND kind = 'portal_login' ORDER BY created_at DESC, rowid DESC LIMIT 1`,
+			orgID).Scan(&body); err != nil {
+			t.Fatalf("expected a portal login email: %v", err)
+		}
+		match := regexp.MustCompile(`https://app\.example\.com/portal/login\?token=([A-Za-z0-9_-]+)`).FindStringSubmatch(body)
+		if match == nil {
+			t.Fatalf("expected a magic link in %q", body)
+		}
+		return match[1]
+	}
+	startSession := func(magic string) string {
+		t.Helper()
+		var session struct {
+			Token string `json:"token"`
+		}
+		resp := performRequest(t, app, "POST", "/api/portal/session", map[string]string{"token": magic}, "")
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected 201, got %d", resp.StatusCode)
+		}
+		decodeJSON(t, resp, &session)
+		if !strings.HasPrefix(session.Token, "npc_") {
+			t.Fatalf("unexpected portal token %q", session.Token)
+		}
+		return session.Token
+	}
+
+	// Unknown addresses get the same answer and no email.
+	if resp := performRequest(t, app, "POST", "/api/portal/login", map[string]string{"org_id": reg.Org.ID, "email": "nobody@acme.test"}, ""); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	var count int
+	database.QueryRow(`SELECT COUNT(*) FROM outbox WHERE kind = 'portal_login'`).Scan(&count)
+	if count != 0 {
+		t.Fatalf("expected no portal email for an unknown address, got %d", count)
+	}
+	if resp := performRequest(t, app, "POST", "/api/portal/login", map[string]string{"org_id": reg.Org.ID, "email": " Billing@ACME.test "}, ""); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	magic := magicLink(reg.Org.ID)
+	portalToken := startSession(magic)
+	if resp := performRequest(t, app, "POST", "/api/portal/session", map[string]string{"token": magic}, ""); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a used magic link to be refused, got %d", resp.StatusCode)
+	}
+	// Portal outbox mail stays out of the org's reminder outbox.
+	var outbox struct {
+		Outbox []struct {
+			ToEmail string `json:"to_email"`
+		} `json:"outbox"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/outbox", nil, reg.Token), &outbox)
+	if len(outbox.Outbox) != 3 {
+		t.Fatalf("expected only the 3 reminders in the outbox, got %d", len(outbox.Outbox))
+	}
+
+	var me struct {
+		Org    struct{ Name string } `json:"org"`
+		Client struct{ ID string }   `json:"client"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/portal/me", nil, portalToken), &me)
+	if me.Org.Name != "Studio One" || me.Client.ID != acme.ID {
+		t.Fatalf("unexpected portal identity %+v", me)
+	}
+
+	var list struct {
+		Invoices []struct {
+			ID           string `json:"id"`
+			Number       string `json:"number"`
+			PaidCents    int64  `json:"paid_cents"`
+			BalanceCents int64  `json:"balance_cents"`
+		} `json:"invoices"`
+		Outstanding map[string]int64 `json:"outstanding_cents"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/portal/invoices", nil, portalToken), &list)
+	if len(list.Invoices) != 2 || list.Invoices[0].Number != "INV-1" || list.Invoices[1].Number != "INV-2" ||
+		list.Invoices[0].PaidCents != 2000 || list.Invoices[0].BalanceCents != 3000 || list.Outstanding["USD"] != 6000 {
+		t.Fatalf("unexpected portal invoices %+v", list)
+	}
+
+	var detail struct {
+		Number    string                   `json:"number"`
+		Payments  []map[string]interface{} `json:"payments"`
+		Reminders []map[string]interface{} `json:"reminders"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/portal/invoices/"+inv1, nil, portalToken), &detail)
+	if detail.Number != "INV-1" || len(detail.Payments) != 1 || len(detail.Reminders) != 1 || detail.Reminders[0]["sent_at"] == nil {
+		t.Fatalf("unexpected portal invoice %+v", detail)
+	}
+	// Another client's invoice, in the same org or another, does not exist.
+	for _, path := range []string{
+		"/api/portal/invoices/" + inv3, "/api/portal/invoices/" + inv9,
+		"/api/portal/invoices/" + inv3 + "/pdf", "/api/portal/invoices/" + inv9 + "/pdf",
+	} {
+		if resp := performRequest(t, app, "GET", path, nil, portalToken); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected 404 for %s, got %d", path, resp.StatusCode)
+		}
+	}
+	resp := performRequest(t, app, "GET", "/api/portal/invoices/"+inv1+"/pdf", nil, portalToken)
+	pdf, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !bytes.Contains(pdf, []byte("(Balance due: USD 30.00)")) {
+		t.Fatalf("unexpected portal PDF %d:\n%s", resp.StatusCode, pdf)
+	}
+
+	var paymentList struct {
+		Payments []struct {
+			InvoiceID string `json:"invoice_id"`
+		} `json:"payments"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/portal/payments", nil, portalToken), &paymentList)
+	if len(paymentList.Payments) != 1 || paymentList.Payments[0].InvoiceID != inv1 {
+		t.Fatalf("unexpected portal payments %+v", paymentList)
+	}
+	var reminderList struct {
+		Reminders []struct {
+			InvoiceNumber string `json:"invoice_number"`
+		} `json:"reminders"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/portal/reminders", nil, portalToken), &reminderList)
+	if len(reminderList.Reminders) != 2 {
+		t.Fatalf("expected the reminders of INV-1 and INV-2, got %+v", reminderList)
+	}
+	for _, r := range reminderList.Reminders {
+		if r.InvoiceNumber != "INV-1" && r.InvoiceNumber != "INV-2" {
+			t.Fatalf("portal leaks reminder of %s", r.InvoiceNumber)
+		}
+	}
+	resp = performRequest(t, app, "GET", "/api/portal/statement", nil, portalToken)
+	statement, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(statement), "INV-1,") || !strings.Contains(string(statement), "INV-2,") ||
+		strings.Contains(string(statement), "INV-3") || strings.Contains(string(statement), "INV-9") {
+		t.Fatalf("unexpected statement %d:\n%s", resp.StatusCode, statement)
+	}
+	// Invoice numbers a spreadsheet would run as a formula are quoted.
+	if _, err := database.Exec(`UPDATE invoices SET number = '=HYPERLINK("http://evil.test")' WHERE number = 'INV-2'`); err != nil {
+		t.Fatalf("rename invoice: %v", err)
+	}
+	statement, _ = io.ReadAll(performRequest(t, app, "GET", "/api/portal/statement", nil, portalToken).Body)
+	if !strings.Contains(string(statement), "\n\"'=HYPERLINK(\"\"http://evil.test\"\")\",") {
+		t.Fatalf("expected the formula number to be quoted:\n%s", statement)
+	}
+
+	// Portal and staff credentials are not interchangeable.
+	if resp := performRequest(t, app, "GET", "/api/invoices", nil, portalToken); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected a portal token to be refused by the staff API, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "GET", "/api/portal/invoices", nil, reg.Token); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected a staff token to be refused by the portal, got %d", resp.StatusCode)
+	}
+
+	// The same address in another org signs in to that org's client only.
+	performRequest(t, app, "POST", "/api/portal/login", map[string]string{"org_id": other.Org.ID, "email": "billing@acme.test"}, "").Body.Close()
+	otherToken := startSession(magicLink(other.Org.ID))
+	decodeJSON(t, performRequest(t, app, "GET", "/api/portal/invoices", nil, otherToken), &list)
+	if len(list.Invoices) != 1 || list.Invoices[0].ID != inv9 {
+		t.Fatalf("unexpected invoices for the other org %+v", list)
+	}
+
+	// Magic links expire quickly; sessions last longer but not forever.
+	performRequest(t, app, "POST", "/api/portal/login", map[string]string{"org_id": reg.Org.ID, "email": "billing@acme.test"}, "").Body.Close()
+	stale := magicLink(reg.Org.ID)
+	clock.Advance(16 * time.Minute)
+	if resp := performRequest(t, app, "POST", "/api/portal/session", map[string]string{"token": stale}, ""); resp.StatusCode != http.StatusGone {
+		t.Fatalf("expected an expired magic link to be refused, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "POST", "/api/portal/logout", nil, otherToken); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "GET", "/api/portal/me", nil, otherToken); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected a logged out session to be refused, got %d", resp.StatusCode)
+	}
+	clock.Advance(12 * time.Hour)
+	if resp := performRequest(t, app, "GET", "/api/portal/me", nil, portalToken); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected an expired session to be refused, got %d", resp.StatusCode)
+	}
+}
+
+// recordingSender keeps what it was asked to send and refuses mail to fail.
+type recordingSender struct {
+	sent []mail.Message
+	fail string
+}
+
+func (s *recordingSender) Send(msg mail.Message) error {
+	if msg.To == s.fail {
+		return errors.New("mailbox unavailable")
+	}
+	s.sent = append(s.sent, msg)
+	return nil
+}
+
+func TestDeliverOutboxClearsAccountTokens(t *testing.T) {
+	clock := &fakeClock{now: time.Now().UTC().Truncate(time.Second)}
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", Clock: clock.Now})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	for _, email := range []string{"billing@acme.test", "ap@globex.test"} {
+		performRequest(t, app, "POST", "/api/clients", map[string]string{"name": "Client", "email": email}, reg.Token).Body.Close()
+		if resp := performRequest(t, app, "POST", "/api/portal/login", map[string]string{"org_id": reg.Org.ID, "email": email}, ""); resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("portal login: expected 202, got %d", resp.StatusCode)
+		}
+	}
+	var queued int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM outbox`).Scan(&queued); err != nil {
+		t.Fatalf("count outbox: %v", err)
+	}
+	magic := latestEmailToken(t, database, services.OutboxKindPortalLogin, "billing@acme.test")
+
+	sender := &recordingSender{fail: "ap@globex.test"}
+	sent, err := services.DeliverOutbox(database, sender, clock.Now())
+	if sent != queued-1 || err == nil || !strings.Contains(err.Error(), "mailbox unavailable") {
+		t.Fatalf("expected all but the failing email sent, got %d of %d (%v)", sent, queued, err)
+	}
+	found := false
+	for _, msg := range sender.sent {
+		found = found || (msg.To == "billing@acme.test" && strings.Contains(msg.Body, magic))
+	}
+	if !found {
+		t.Fatalf("expected the magic link in the sent email, got %+v", sender.sent)
+	}
+	// Once sent, the token is only in the email; the failed one waits.
+	var kept int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM outbox WHERE instr(body, 'token=') > 0`).Scan(&kept); err != nil {
+		t.Fatalf("count tokens: %v", err)
+	}
+	var delivered sql.NullString
+	database.QueryRow(`SELECT delivered_at FROM outbox WHERE to_email = 'billing@acme.test'`).Scan(&delivered)
+	if kept != 1 || !delivered.Valid {
+		t.Fatalf("expected only the undelivered token left, got %d (delivered %v)", kept, delivered)
+	}
+	if resp := performRequest(t, app, "POST", "/api/portal/session", map[string]string{"token": magic}, ""); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected the delivered magic link to work, got %d", resp.StatusCode)
+	}
+
+	// A day later the failed email is left alone rather than sent late.
+	sender.fail = ""
+	clock.Advance(25 * time.Hour)
+	if sent, err := services.DeliverOutbox(database, sender, clock.Now()); sent != 0 || err != nil {
+		t.Fatalf("expected nothing left to send, got %d (%v)", sent, err)
+	}
+}
+
+func TestUnsubscribeAndSuppressionList(t *testing.T) {
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", BaseURL: "https://app.example.com"})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	other := registerOrg(t, app, "owner@other.test", "Other Studio")
+	dueDate := time.Now().UTC().Add(-24 * time.Hour).Format("2006-01-02")
+	var acme, beta createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{"name": "Acme", "email": "Billing@Acme.test"}, reg.Token), &acme)
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{"name": "Beta", "email": "ap@beta.test"}, reg.Token), &beta)
+	newInvoice := func(clientID, number string) string {
+		var invoice createResponse
+		decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+			"client_id": clientID, "number": number, "amount_cents": 5000, "currency": "USD",
+			"due_date": dueDate, "reminder_offsets": []int{0},
+		}, reg.Token), &invoice)
+		return invoice.ID
+	}
+	type sendDue struct {
+		Sent       int `json:"sent"`
+		Suppressed int `json:"suppressed"`
+	}
+	var outbox struct {
+		Outbox []struct {
+			ToEmail string            `json:"to_email"`
+			Headers map[string]string `json:"headers"`
+		} `json:"outbox"`
+	}
+
+	newInvoice(acme.ID, "INV-1")
+	var result sendDue
+	decodeJSON(t, performRequest(t, app, "POST", "/api/reminders/send-due", nil, reg.Token), &result)
+	decodeJSON(t, performRequest(t, app, "GET", "/api/outbox", nil, reg.Token), &outbox)
+	if result.Sent != 1 || len(outbox.Outbox) != 1 || outbox.Outbox[0].Headers["List-Unsubscribe-Post"] != "List-Unsubscribe=One-Click" {
+		t.Fatalf("unexpected send %+v / outbox %+v", result, outbox)
+	}
+	match := regexp.MustCompile(`^<https://app\.example\.com(/unsubscribe/[A-Za-z0-9_-]+)>$`).FindStringSubmatch(outbox.Outbox[0].Headers["List-Unsubscribe"])
+	if match == nil {
+		t.Fatalf("unexpected List-Unsubscribe header %q", outbox.Outbox[0].Headers["List-Unsubscribe"])
+	}
+	unsubscribePath := match[1]
+
+	// Opening the link only asks for confirmation, so link scanners do not
+	// unsubscribe anyone.
+	resp := performRequest(t, app, "GET", unsubscribePath, nil, "")
+	page, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(page), "Stop payment reminders from Studio One to billing@acme.test?") {
+		t.Fatalf("unexpected unsubscribe page %d:\n%s", resp.StatusCode, page)
+	}
+	var list struct {
+		Suppressions []struct {
+			ID        string  `json:"id"`
+			Email     string  `json:"email"`
+			Reason    string  `json:"reason"`
+			CreatedBy *string `json:"created_by"`
+		} `json:"suppressions"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/suppressions", nil, reg.Token), &list)
+	if len(list.Suppressions) != 0 {
+		t.Fatalf("expected GET not to unsubscribe, got %+v", list)
+	}
+
+	oneClick := func(path string) *http.Response {
+		req := httptest.NewRequest("POST", path, strings.NewReader("List-Unsubscribe=One-Click"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		return resp
+	}
+	for i := 0; i < 2; i++ {
+		resp := oneClick(unsubscribePath)
+		page, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(page), "You are unsubscribed") {
+			t.Fatalf("unexpected one-click response %d:\n%s", resp.StatusCode, page)
+		}
+	}
+	if resp := oneClick("/unsubscribe/not-a-token"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown token, got %d", resp.StatusCode)
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/suppressions", nil, reg.Token), &list)
+	if len(list.Suppressions) != 1 || list.Suppressions[0].Email != "billing@acme.test" ||
+		list.Suppressions[0].Reason != "unsubscribe" || list.Suppressions[0].CreatedBy != nil {
+		t.Fatalf("unexpected suppressions %+v", list)
+	}
+	acmeSuppression := list.Suppressions[0].ID
+	var audited int
+	database.QueryRow(`SELECT COUNT(*) FROM audit_events WHERE org_id = ? AND resource_type = 'suppression' AND resource_id = ?`,
+		reg.Org.ID, acmeSuppression).Scan(&audited)
+	if audited != 1 {
+		t.Fatalf("expected the unsubscribe to be audited once, got %d", audited)
+	}
+
+	// Due reminders to suppressed addresses are closed without an email.
+	inv2 := newInvoice(acme.ID, "INV-2")
+	decodeJSON(t, performRequest(t, app, "POST", "/api/reminders/send-due", nil, reg.Token), &result)
+	decodeJSON(t, performRequest(t, app, "GET", "/api/outbox", nil, reg.Token), &outbox)
+	if result.Sent != 0 || result.Suppressed != 1 || len(outbox.Outbox) != 1 {
+		t.Fatalf("unexpected send %+v with %d outbox emails", result, len(outbox.Outbox))
+	}
+	var reminders struct {
+		Reminders []struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		} `json:"reminders"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/reminders?invoice_id="+inv2, nil, reg.Token), &reminders)
+	if len(reminders.Reminders) != 1 || reminders.Reminders[0].Status != "suppressed" {
+		t.Fatalf("unexpected reminders %+v", reminders)
+	}
+
+	// Staff record bounces and complaints, one entry per address.
+	if resp := performRequest(t, app, "POST", "/api/suppressions", map[string]string{"email": "ap@beta.test", "reason": "bounced"}, reg.Token); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown reason, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "POST", "/api/suppressions", map[string]string{"email": "AP@beta.test", "reason": "hard_bounce"}, reg.Token); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "POST", "/api/suppressions", map[string]string{"email": "ap@beta.test", "reason": "complaint"}, reg.Token); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for a suppressed address, got %d", resp.StatusCode)
+	}
+	inv3 := newInvoice(beta.ID, "INV-3")
+	decodeJSON(t, performRequest(t, app, "GET", "/api/reminders?invoice_id="+inv3, nil, reg.Token), &reminders)
+	var sent struct {
+		Status string `json:"status"`
+	}
+	decodeJSON(t, performRequest(t, app, "POST", "/api/reminders/"+reminders.Reminders[0].ID+"/send", nil, reg.Token), &sent)
+	if sent.Status != "suppressed" {
+		t.Fatalf("expected the reminder to be suppressed, got %+v", sent)
+	}
+
+	// The list belongs to the org.
+	decodeJSON(t, performRequest(t, app, "GET", "/api/suppressions", nil, other.Token), &list)
+	if len(list.Suppressions) != 0 {
+		t.Fatalf("suppressions leak across orgs: %+v", list)
+	}
+	if resp := performRequest(t, app, "DELETE", "/api/suppressions/"+acmeSuppression, nil, other.Token); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 across orgs, got %d", resp.StatusCode)
+	}
+
+	// Lifting the suppression lets reminders through again.
+	if resp := performRequest(t, app, "DELETE", "/api/suppressions/"+acmeSuppression, nil, reg.Token); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	newInvoice(acme.ID, "INV-4")
+	decodeJSON(t, performRequest(t, app, "POST", "/api/reminders/send-due", nil, reg.Token), &result)
+	if result.Sent != 1 || result.Suppressed != 0 {
+		t.Fatalf("unexpected send after lifting the suppression %+v", result)
+	}
+}
+
+func TestReminderUsesClientLanguageVariant(t *testing.T) {
+	app, cleanup := newTestApp(t)
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	dueDate := time.Now().UTC().Add(-24 * time.Hour).Format("2006-01-02")
+
+	templateBody := map[string]interface{}{
+		"name":     "Polite",
+		"subject":  "Reminder {{invoice_number}}",
+		"body":     "Please pay {{amount}}.",
+		"language": "en",
+		"variants": []map[string]string{
+			{"language": "es", "subject": "Recordatorio {{invoice_number}}", "body": "Por favor pague {{amount}}."},
+		},
+	}
+	templateResp := performRequest(t, app, "POST", "/api/templates", templateBody, reg.Token)
+	if templateResp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", templateResp.StatusCode)
+	}
+	var tmpl createResponse
+	decodeJSON(t, templateResp, &tmpl)
+
+	cases := []struct {
+		email      string
+		language   string
+		templateID string
+		subject    string
+	}{
+		{"de@example.com", "de", "", "Freundliche Erinnerung: Rechnung INV-DE"},
+		{"es@example.com", "es-MX", tmpl.ID, "Recordatorio INV-ES"},
+		{"fr@example.com", "fr", tmpl.ID, "Reminder INV-FR"},
+		{"none@example.com", "", "", "Friendly reminder: invoice INV-NONE"},
+	}
+	expected := map[string]string{}
+	for _, tc := range cases {
+		clientResp := performRequest(t, app, "POST", "/api/clients", map[string]string{
+			"name": "Client", "email": tc.email, "language": tc.language,
+		}, reg.Token)
+		if clientResp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected 201, got %d", clientResp.StatusCode)
+		}
+		var client createResponse
+		decodeJSON(t, clientResp, &client)
+
+		number := "INV-" + strings.ToUpper(strings.SplitN(tc.email, "@", 2)[0])
+		invoiceResp := performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+			"client_id":        client.ID,
+			"template_id":      tc.templateID,
+			"number":           number,
+			"amount_cents":     5000,
+			"currency":         "eur",
+			"due_date":         dueDate,
+			"reminder_offsets": []int{0},
+		}, reg.Token)
+		if invoiceResp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected 201, got %d", invoiceResp.StatusCode)
+		}
+		expected[tc.email] = tc.subject
+	}
+
+	sendResp := performRequest(t, app, "POST", "/api/reminders/send-due", nil, reg.Token)
+	if sendResp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", sendResp.StatusCode)
+	}
+
+	var outbox outboxResponse
+	decodeJSON(t, performRequest(t, app, "GET", "/api/outbox", nil, reg.Token), &outbox)
+	if len(outbox.Outbox) != len(cases) {
+		t.Fatalf("expected %d outbox entries, got %d", len(cases), len(outbox.Outbox))
+	}
+	for _, item := range outbox.Outbox {
+		if item.Subject != expected[item.ToEmail] {
+			t.Fatalf("%s: expected subject %q, got %q", item.ToEmail, expected[item.ToEmail], item.Subject)
+		}
+	}
+}
+
+func TestTemplateDeletionProtectsDefaultAndScheduledReminders(t *testing.T) {
+	app, cleanup := newTestApp(t)
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+
+	var harsh createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/templates", map[string]string{
+		"name": "Final notice", "subject": "FINAL NOTICE {{invoice_number}}", "body": "Pay now.",
+	}, reg.Token), &harsh)
+
+	var client createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/clients", map[string]string{
+		"name": "Jamie Client", "email": "client@example.com",
+	}, reg.Token), &client)
+
+	dueDate := time.Now().UTC().AddDate(0, 0, 14).Format("2006-01-02")
+	var invoice createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+		"client_id": client.ID, "template_id": harsh.ID, "number": "INV-7",
+		"amount_cents": 1000, "currency": "usd", "due_date": dueDate,
+	}, reg.Token), &invoice)
+
+	// An invoice without a template uses the built-in default even though
+	// an older template exists in the org.
+	var plain createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+		"client_id": client.ID, "number": "INV-8",
+		"amount_cents": 1000, "currency": "usd", "due_date": dueDate,
+	}, reg.Token), &plain)
+
+	var list struct {
+		Templates []struct {
+			ID        string `json:"id"`
+			Name      string `json:"name"`
+			IsDefault bool   `json:"is_default"`
+		} `json:"templates"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/templates", nil, reg.Token), &list)
+	defaultID := ""
+	for _, tmpl := range list.Templates {
+		if tmpl.IsDefault {
+			if defaultID != "" {
+				t.Fatalf("expected a single default template")
+			}
+			defaultID = tmpl.ID
+		}
+	}
+	if defaultID == "" || defaultID == harsh.ID {
+		t.Fatalf("expected built-in template to be the default, got %q", defaultID)
+	}
+
+	resp := performRequest(t, app, "DELETE", "/api/templates/"+defaultID, nil, reg.Token)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 deleting default, got %d", resp.StatusCode)
+	}
+
+	resp = performRequest(t, app, "DELETE", "/api/templates/"+harsh.ID, nil, reg.Token)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 deleting template in use, got %d", resp.StatusCode)
+	}
+	var conflict struct {
+		Invoices []struct {
+			ID     string `json:"id"`
+			Number string `json:"number"`
+		} `json:"invoices"`
+	}
+	decodeJSON(t, resp, &conflict)
+	if len(conflict.Invoices) != 1 || conflict.Invoices[0].ID != invoice.ID {
+		t.Fatalf("expected affected invoice %s, got %+v", invoice.ID, conflict.Invoices)
+	}
+
+	resp = performRequest(t, app, "DELETE", "/api/templates/"+harsh.ID+"?reassign_to="+defaultID, nil, reg.Token)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	var detail struct {
+		TemplateID *string `json:"template_id"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/invoices/"+invoice.ID, nil, reg.Token), &detail)
+	if detail.TemplateID == nil || *detail.TemplateID != defaultID {
+		t.Fatalf("expected invoice reassigned to default template")
+	}
+
+	var gentle createResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/templates", map[string]string{
+		"name": "Gentle", "subject": "Hi", "body": "Whenever you can.",
+	}, reg.Token), &gentle)
+	resp = performRequest(t, app, "POST", "/api/templates/"+gentle.ID+"/default", nil, reg.Token)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	resp = performRequest(t, app, "DELETE", "/api/templates/"+defaultID+"?reassign_to="+gentle.ID, nil, reg.Token)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 deleting former default, got %d", resp.StatusCode)
+	}
+}
+
+func registerOrg(t *testing.T, app *fiber.App, email, orgName string) registerResponse {
+	t.Helper()
+	resp := performRequest(t, app, "POST", "/api/auth/register", map[string]string{
+		"email":    email,
+		"password": "password123",
+		"org_name": orgName,
+	}, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("register: expected 200, got %d", resp.StatusCode)
+	}
+	var reg registerResponse
+	decodeJSON(t, resp, &reg)
+	return reg
+}
+
+var emailTokenPattern = regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+func latestEmailToken(t *testing.T, database *sql.DB, kind, to string) string {
+	t.Helper()
+	var body string
+	if err := database.QueryRow(`SELECT body FROM outbox WHERE kind = ? AND to_email = ? ORDER BY rowid DESC LIMIT 1`, kind, to).Scan(&body); err != nil {
+		t.Fatalf("no %s email for %s: %v", kind, to, err)
+	}
+	match := emailTokenPattern.FindStringSubmatch(body)
+	if match == nil {
+		t.Fatalf("no token in %s email", kind)
+	}
+	return match[1]
+}
+
+func totpCode(t *testing.T, secret string, now time.Time) string {
+	t.Helper()
+	code, err := auth.TOTPCode(secret, now)
+	if err != nil {
+		t.Fatalf("totp error: %v", err)
+	}
+	return code
+}
+
+func performRequest(t *testing.T, app *fiber.App, method, path string, body interface{}, token string) *http.Response {
+	t.Helper()
+	return performRequestWithHeaders(t, app, method, path, body, token, nil)
+}
+
+func performRequestWithHeaders(t *testing.T, app *fiber.App, method, path string, body interface{}, token string, headers map[string]string) *http.Response {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatalf("encode error: %v", err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
 	}
 	resp, err := app.Test(req, -1)
 	if err != nil {
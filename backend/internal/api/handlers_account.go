@@ -0,0 +1,134 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"nudgepay/internal/auth"
+	"nudgepay/internal/config"
+	"nudgepay/internal/services"
+)
+
+type tokenRequest struct {
+	Token string `json:"token"`
+}
+
+type forgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func handleVerifyEmail(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req tokenRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		if strings.TrimSpace(req.Token) == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "token required")
+		}
+		userID, err := services.VerifyEmail(db, strings.TrimSpace(req.Token), cfg.Now())
+		if err != nil {
+			return accountTokenError(err)
+		}
+		return c.JSON(fiber.Map{"user_id": userID, "email_verified": true})
+	}
+}
+
+func handleResendVerification(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := userIDFrom(c)
+		now := cfg.Now()
+		var email string
+		var verifiedAt sql.NullString
+		if err := db.QueryRow(`SELECT email, email_verified_at FROM users WHERE id = ?`, userID).Scan(&email, &verifiedAt); err != nil {
+			return fiber.NewError(fiber.StatusNotFound, "user not found")
+		}
+		if verifiedAt.Valid {
+			return fiber.NewError(fiber.StatusConflict, "email already verified")
+		}
+		allowed, err := services.AllowEmailRequest(db, email, services.TokenPurposeVerifyEmail, now)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if !allowed {
+			return fiber.NewError(fiber.StatusTooManyRequests, "too many requests; try again later")
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+		if err := services.QueueVerificationEmail(tx, userID, cfg.BaseURL, now); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.SendStatus(fiber.StatusAccepted)
+	}
+}
+
+func handleForgotPassword(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req forgotPasswordRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		email := strings.TrimSpace(strings.ToLower(req.Email))
+		if email == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "email required")
+		}
+		now := cfg.Now()
+		allowed, err := services.AllowEmailRequest(db, email, services.TokenPurposePasswordReset, now)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if !allowed {
+			return fiber.NewError(fiber.StatusTooManyRequests, "too many requests; try again later")
+		}
+		if err := services.RequestPasswordReset(db, email, cfg.BaseURL, now); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		// Same answer whether or not the address has an account.
+		return c.SendStatus(fiber.StatusAccepted)
+	}
+}
+
+func handleResetPassword(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req resetPasswordRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		if strings.TrimSpace(req.Token) == "" || req.Password == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "token and password required")
+		}
+		hash, err := auth.HashPassword(req.Password)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "password hashing failed")
+		}
+		if _, err := services.ResetPassword(db, strings.TrimSpace(req.Token), hash, cfg.Now()); err != nil {
+			return accountTokenError(err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func accountTokenError(err error) error {
+	if errors.Is(err, services.ErrTokenExpired) {
+		return fiber.NewError(fiber.StatusGone, "token expired")
+	}
+	if errors.Is(err, services.ErrTokenInvalid) {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid token")
+	}
+	return fiber.NewError(fiber.StatusInternalServerError, "db error")
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"nudgepay/internal/auth"
+	"nudgepay/internal/config"
+	"nudgepay/internal/services"
+)
+
+type apiKeyRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresAt string   `json:"expires_at"`
+}
+
+func handleListAPIKeys(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		rows, err := db.Query(`SELECT id, name, key_id, scopes, created_at, expires_at, last_used_at FROM api_keys
+			WHERE org_id = ? AND revoked_at IS NULL ORDER BY created_at DESC`, orgIDFrom(c))
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer rows.Close()
+
+		keys := make([]fiber.Map, 0)
+		for rows.Next() {
+			var id, name, keyID, scopes, createdAt string
+			var expiresAt, lastUsedAt sql.NullString
+			if err := rows.Scan(&id, &name, &keyID, &scopes, &createdAt, &expiresAt, &lastUsedAt); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "db error")
+			}
+			keys = append(keys, fiber.Map{
+				"id":           id,
+				"name":         name,
+				"prefix":       auth.APIKeyPrefix + keyID,
+				"scopes":       strings.Fields(scopes),
+				"created_at":   createdAt,
+				"expires_at":   nullIfEmpty(expiresAt.String),
+				"last_used_at": nullIfEmpty(lastUsedAt.String),
+			})
+		}
+		return c.JSON(fiber.Map{"api_keys": keys})
+	}
+}
+
+func handleCreateAPIKey(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req apiKeyRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		name := strings.TrimSpace(req.Name)
+		if name == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "name required")
+		}
+		if len(req.Scopes) == 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "at least one scope required")
+		}
+		scopes := make([]string, 0, len(req.Scopes))
+		for _, scope := range req.Scopes {
+			scope = strings.TrimSpace(strings.ToLower(scope))
+			if !services.ValidScope(scope) {
+				return fiber.NewError(fiber.StatusBadRequest, "unknown scope "+scope)
+			}
+			if !services.HasScope(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+		now := cfg.Now()
+		var expiresAt *time.Time
+		if req.ExpiresAt != "" {
+			parsed, err := time.Parse(time.RFC3339, req.ExpiresAt)
+			if err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, "expires_at must be RFC3339")
+			}
+			if !parsed.After(now) {
+				return fiber.NewError(fiber.StatusBadRequest, "expires_at must be in the future")
+			}
+			expiresAt = &parsed
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		key, record, err := services.CreateAPIKey(tx, orgIDFrom(c), userIDFrom(c), name, scopes, expiresAt, now)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		after, err := snapshot(tx, "api_keys", orgIDFrom(c), record.ID)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(c, tx, now, services.AuditActionCreate, "api_key", record.ID, nil, after); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		resp := fiber.Map{
+			"id":         record.ID,
+			"name":       record.Name,
+			"key":        key,
+			"prefix":     auth.APIKeyPrefix + record.KeyID,
+			"scopes":     record.Scopes,
+			"created_at": record.CreatedAt.Format(time.RFC3339),
+			"expires_at": nil,
+		}
+		if expiresAt != nil {
+			resp["expires_at"] = expiresAt.UTC().Format(time.RFC3339)
+		}
+		return c.Status(fiber.StatusCreated).JSON(resp)
+	}
+}
+
+func handleRevokeAPIKey(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Params("id")
+		now := cfg.Now()
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		before, err := snapshot(tx, "api_keys", orgIDFrom(c), id)
+		if err != nil {
+			return err
+		}
+		revoked, err := services.RevokeAPIKey(tx, orgIDFrom(c), id, now)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if !revoked {
+			return fiber.NewError(fiber.StatusNotFound, "api key not found")
+		}
+		after, err := snapshot(tx, "api_keys", orgIDFrom(c), id)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(c, tx, now, services.AuditActionDelete, "api_key", id, before, after); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"nudgepay/internal/services"
+)
+
+const (
+	auditDefaultLimit = 100
+	auditMaxLimit     = 1000
+)
+
+func auditEntry(c *fiber.Ctx, action, resourceType, resourceID string) services.AuditEntry {
+	return services.AuditEntry{
+		OrgID:         orgIDFrom(c),
+		ActorUserID:   userIDFrom(c),
+		ActorAPIKeyID: apiKeyIDFrom(c),
+		Action:        action,
+		ResourceType:  resourceType,
+		ResourceID:    resourceID,
+		IP:            c.IP(),
+	}
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx, so audit rows can be
+// written in the same transaction as the change they describe.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// recordAudit logs a mutation made by the caller in their current org.
+func recordAudit(c *fiber.Ctx, q queryer, now time.Time, action, resourceType, resourceID string, before, after map[string]interface{}) error {
+	if err := services.RecordAudit(q, auditEntry(c, action, resourceType, resourceID), before, after, now); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	return nil
+}
+
+// snapshot loads an org-owned row for the audit log.
+func snapshot(q queryer, table, orgID, id string) (map[string]interface{}, error) {
+	row, err := services.AuditSnapshot(q, `SELECT * FROM `+table+` WHERE id = ? AND org_id = ?`, id, orgID)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	return row, nil
+}
+
+func parseAuditFilter(c *fiber.Ctx) (services.AuditFilter, error) {
+	filter := services.AuditFilter{
+		Actor:        strings.TrimSpace(c.Query("actor")),
+		Action:       strings.TrimSpace(c.Query("action")),
+		ResourceType: strings.TrimSpace(c.Query("resource_type")),
+		ResourceID:   strings.TrimSpace(c.Query("resource_id")),
+	}
+	var err error
+	if filter.From, err = parseTimeBound(c.Query("from"), false); err != nil {
+		return filter, fiber.NewError(fiber.StatusBadRequest, "from must be a date or RFC3339 time")
+	}
+	if filter.To, err = parseTimeBound(c.Query("to"), true); err != nil {
+		return filter, fiber.NewError(fiber.StatusBadRequest, "to must be a date or RFC3339 time")
+	}
+	return filter, nil
+}
+
+func handleListAudit(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		filter, err := parseAuditFilter(c)
+		if err != nil {
+			return err
+		}
+		filter.Limit = auditDefaultLimit
+		if raw := c.Query("limit"); raw != "" {
+			limit, err := strconv.Atoi(raw)
+			if err != nil || limit <= 0 {
+				return fiber.NewError(fiber.StatusBadRequest, "limit must be a positive integer")
+			}
+			if limit > auditMaxLimit {
+				limit = auditMaxLimit
+			}
+			filter.Limit = limit
+		}
+		events, err := services.ListAuditEvents(db, orgIDFrom(c), filter)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		out := make([]fiber.Map, 0, len(events))
+		for _, e := range events {
+			out = append(out, fiber.Map{
+				"id":               e.ID,
+				"actor_user_id":    nullIfEmpty(e.ActorUserID),
+				"actor_email":      nullIfEmpty(e.ActorEmail),
+				"actor_api_key_id": nullIfEmpty(e.ActorAPIKeyID),
+				"action":           e.Action,
+				"resource_type":    e.ResourceType,
+				"resource_id":      e.ResourceID,
+				"changes":          e.Changes,
+				"ip":               e.IP,
+				"created_at":       e.CreatedAt,
+			})
+		}
+		return c.JSON(fiber.Map{"events": out})
+	}
+}
+
+func handleExportAudit(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		filter, err := parseAuditFilter(c)
+		if err != nil {
+			return err
+		}
+		events, err := services.ListAuditEvents(db, orgIDFrom(c), filter)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		_ = w.Write([]string{"created_at", "actor_user_id", "actor_email", "actor_api_key_id", "action", "resource_type", "resource_id", "ip", "changes"})
+		for _, e := range events {
+			_ = w.Write([]string{e.CreatedAt, e.ActorUserID, e.ActorEmail, e.ActorAPIKeyID, e.Action, e.ResourceType, e.ResourceID, e.IP, string(e.Changes)})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "export failed")
+		}
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="audit.csv"`)
+		return c.Send(buf.Bytes())
+	}
+}
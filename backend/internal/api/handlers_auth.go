@@ -2,6 +2,8 @@ package api
 
 import (
 	"database/sql"
+	"math"
+	"strconv"
 	"strings"
 	"time"
 
@@ -10,6 +12,7 @@ import (
 
 	"nudgepay/internal/auth"
 	"nudgepay/internal/config"
+	"nudgepay/internal/services"
 )
 
 type registerRequest struct {
@@ -46,7 +49,8 @@ func handleRegister(db *sql.DB, cfg config.Config) fiber.Handler {
 
 		orgID := uuid.NewString()
 		userID := uuid.NewString()
-		now := time.Now().UTC().Format(time.RFC3339)
+		clock := cfg.Now()
+		now := clock.Format(time.RFC3339)
 
 		tx, err := db.Begin()
 		if err != nil {
@@ -62,26 +66,31 @@ func handleRegister(db *sql.DB, cfg config.Config) fiber.Handler {
 			userID, req.Email, hash, orgID, now); err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
+		if err := services.AddMembership(tx, orgID, userID, services.RoleOwner, clock); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if err := services.QueueVerificationEmail(tx, userID, cfg.BaseURL, clock); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
 		if err := tx.Commit(); err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
 
-		token, err := auth.GenerateToken(cfg.JWTSecret, userID, orgID)
+		resp, err := issueSession(c, db, cfg, userID, orgID, services.AuthMethodPassword)
 		if err != nil {
-			return fiber.NewError(fiber.StatusInternalServerError, "token error")
+			return err
 		}
-
-		return c.JSON(fiber.Map{
-			"token": token,
-			"user": fiber.Map{
-				"id":    userID,
-				"email": req.Email,
-			},
-			"org": fiber.Map{
-				"id":   orgID,
-				"name": req.OrgName,
-			},
-		})
+		resp["user"] = fiber.Map{
+			"id":             userID,
+			"email":          req.Email,
+			"email_verified": false,
+		}
+		resp["org"] = fiber.Map{
+			"id":   orgID,
+			"name": req.OrgName,
+			"role": services.RoleOwner,
+		}
+		return c.JSON(resp)
 	}
 }
 
@@ -96,19 +105,95 @@ func handleLogin(db *sql.DB, cfg config.Config) fiber.Handler {
 			return fiber.NewError(fiber.StatusBadRequest, "missing required fields")
 		}
 
-		var userID, hash, orgID string
-		if err := db.QueryRow(`SELECT id, password_hash, org_id FROM users WHERE email = ?`, req.Email).Scan(&userID, &hash, &orgID); err != nil {
-			return fiber.NewError(fiber.StatusUnauthorized, "invalid credentials")
+		now := cfg.Now()
+		if err := checkLoginThrottle(c, db, req.Email, now); err != nil {
+			return err
+		}
+
+		var userID, hash string
+		var totpEnabledAt sql.NullString
+		err := db.QueryRow(`SELECT id, password_hash, totp_enabled_at FROM users WHERE email = ?`, req.Email).
+			Scan(&userID, &hash, &totpEnabledAt)
+		if err != nil && err != sql.ErrNoRows {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
-		if err := auth.CheckPassword(hash, req.Password); err != nil {
+		if err == sql.ErrNoRows {
+			auth.CheckDummyPassword(req.Password)
+		} else {
+			err = auth.CheckPassword(hash, req.Password)
+		}
+		if err != nil {
+			if err := services.RecordLoginFailure(db, req.Email, c.IP(), now); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "db error")
+			}
 			return fiber.NewError(fiber.StatusUnauthorized, "invalid credentials")
 		}
-		token, err := auth.GenerateToken(cfg.JWTSecret, userID, orgID)
+		// Failures are only cleared once a session is issued, so guessing the
+		// second factor stays throttled.
+		if totpEnabledAt.Valid {
+			challenge, err := services.StartMFAChallenge(db, userID, services.AuthMethodPassword, now)
+			if err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "db error")
+			}
+			return c.JSON(fiber.Map{"two_factor_required": true, "mfa_token": challenge})
+		}
+		orgID, err := loginOrg(db, userID, services.AuthMethodPassword)
+		if err != nil {
+			return err
+		}
+		resp, err := issueSession(c, db, cfg, userID, orgID, services.AuthMethodPassword)
 		if err != nil {
-			return fiber.NewError(fiber.StatusInternalServerError, "token error")
+			return err
+		}
+		if err := services.ClearLoginFailures(db, req.Email); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
-		return c.JSON(fiber.Map{"token": token})
+		return c.JSON(resp)
+	}
+}
+
+// checkLoginThrottle refuses a login step while the address or IP is
+// backing off or locked out.
+func checkLoginThrottle(c *fiber.Ctx, db *sql.DB, email string, now time.Time) error {
+	wait, err := services.LoginRetryAfter(db, email, c.IP(), now)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	if wait > 0 {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return fiber.NewError(fiber.StatusTooManyRequests, "too many login attempts; try again later")
+	}
+	return nil
+}
+
+// loginOrg picks the org a new session starts in and refuses password
+// logins into orgs that require single sign-on.
+func loginOrg(db *sql.DB, userID, authMethod string) (string, error) {
+	orgID, err := services.DefaultOrgForUser(db, userID)
+	if err == services.ErrNotMember {
+		return "", fiber.NewError(fiber.StatusForbidden, "account is not a member of any organization")
+	}
+	if err != nil {
+		return "", fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	if err := checkSSORequirement(db, orgID, authMethod); err != nil {
+		return "", err
+	}
+	return orgID, nil
+}
+
+func checkSSORequirement(db *sql.DB, orgID, authMethod string) error {
+	if authMethod == services.AuthMethodSSO {
+		return nil
+	}
+	required, err := services.SSORequired(db, orgID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	if required {
+		return fiber.NewError(fiber.StatusForbidden, "organization requires single sign-on")
 	}
+	return nil
 }
 
 func handleMe(db *sql.DB) fiber.Handler {
@@ -116,7 +201,9 @@ func handleMe(db *sql.DB) fiber.Handler {
 		userID := userIDFrom(c)
 		orgID := orgIDFrom(c)
 		var email string
-		if err := db.QueryRow(`SELECT email FROM users WHERE id = ?`, userID).Scan(&email); err != nil {
+		var verifiedAt, totpEnabledAt sql.NullString
+		if err := db.QueryRow(`SELECT email, email_verified_at, totp_enabled_at FROM users WHERE id = ?`, userID).
+			Scan(&email, &verifiedAt, &totpEnabledAt); err != nil {
 			return fiber.NewError(fiber.StatusNotFound, "user not found")
 		}
 		var orgName string
@@ -124,8 +211,8 @@ func handleMe(db *sql.DB) fiber.Handler {
 			return fiber.NewError(fiber.StatusNotFound, "org not found")
 		}
 		return c.JSON(fiber.Map{
-			"user": fiber.Map{"id": userID, "email": email},
-			"org":  fiber.Map{"id": orgID, "name": orgName},
+			"user": fiber.Map{"id": userID, "email": email, "email_verified": verifiedAt.Valid, "two_factor_enabled": totpEnabledAt.Valid},
+			"org":  fiber.Map{"id": orgID, "name": orgName, "role": roleFrom(c)},
 		})
 	}
 }
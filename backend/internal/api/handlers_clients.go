@@ -7,20 +7,41 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
+
+	"nudgepay/internal/config"
+	"nudgepay/internal/services"
 )
 
 type clientPayload struct {
-	Name    string `json:"name"`
-	Email   string `json:"email"`
-	Company string `json:"company"`
-	Phone   string `json:"phone"`
-	Notes   string `json:"notes"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Company  string `json:"company"`
+	Phone    string `json:"phone"`
+	Notes    string `json:"notes"`
+	Language string `json:"language"`
+}
+
+var clientListSpec = listSpec{
+	sorts:       map[string]string{"created_at": "created_at", "name": "name", "email": "email"},
+	defaultSort: "-created_at",
+	idColumn:    "id",
 }
 
 func handleListClients(db *sql.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		orgID := orgIDFrom(c)
-		rows, err := db.Query(`SELECT id, name, email, company, phone, notes, created_at FROM clients WHERE org_id = ? ORDER BY created_at DESC`, orgID)
+		p, err := parsePage(c, clientListSpec)
+		if err != nil {
+			return err
+		}
+		query := `SELECT id, name, email, company, phone, notes, language, version, created_at FROM clients WHERE org_id = ?`
+		args := []interface{}{orgID}
+		if email := strings.TrimSpace(strings.ToLower(c.Query("email"))); email != "" {
+			query += " AND email = ?"
+			args = append(args, email)
+		}
+		query, args = p.apply(query, args)
+		rows, err := db.Query(query, args...)
 		if err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
@@ -28,19 +49,22 @@ func handleListClients(db *sql.DB) fiber.Handler {
 
 		clients := make([]fiber.Map, 0)
 		for rows.Next() {
-			var id, name, email, company, phone, notes, createdAt string
-			if err := rows.Scan(&id, &name, &email, &company, &phone, &notes, &createdAt); err != nil {
+			var id, name, email, company, phone, notes, language, createdAt string
+			var version int64
+			if err := rows.Scan(&id, &name, &email, &company, &phone, &notes, &language, &version, &createdAt); err != nil {
 				return fiber.NewError(fiber.StatusInternalServerError, "db error")
 			}
 			clients = append(clients, fiber.Map{
-				"id": id, "name": name, "email": email, "company": company, "phone": phone, "notes": notes, "created_at": createdAt,
+				"id": id, "name": name, "email": email, "company": company, "phone": phone, "notes": notes,
+				"language": nullIfEmpty(language), "version": version, "created_at": createdAt,
 			})
 		}
-		return c.JSON(fiber.Map{"clients": clients})
+		clients, next := p.finish(clients)
+		return c.JSON(fiber.Map{"clients": clients, "next_cursor": next})
 	}
 }
 
-func handleCreateClient(db *sql.DB) fiber.Handler {
+func handleCreateClient(db *sql.DB, cfg config.Config) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		orgID := orgIDFrom(c)
 		var req clientPayload
@@ -55,10 +79,31 @@ func handleCreateClient(db *sql.DB) fiber.Handler {
 		if req.Company == "" {
 			req.Company = "-"
 		}
+		req.Language = services.NormalizeLanguage(req.Language)
+		if req.Language != "" && !services.ValidLanguage(req.Language) {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid language")
+		}
 		id := uuid.NewString()
-		now := time.Now().UTC().Format(time.RFC3339)
-		if _, err := db.Exec(`INSERT INTO clients (id, org_id, name, email, company, phone, notes, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-			id, orgID, req.Name, req.Email, req.Company, req.Phone, req.Notes, now); err != nil {
+		now := cfg.Now()
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(`INSERT INTO clients (id, org_id, name, email, company, phone, notes, language, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, orgID, req.Name, req.Email, req.Company, req.Phone, req.Notes, req.Language, now.Format(time.RFC3339)); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		after, err := snapshot(tx, "clients", orgID, id)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(c, tx, now, services.AuditActionCreate, "client", id, nil, after); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
 		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"id": id})
@@ -69,54 +114,125 @@ func handleGetClient(db *sql.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		orgID := orgIDFrom(c)
 		id := c.Params("id")
-		var name, email, company, phone, notes, createdAt string
-		if err := db.QueryRow(`SELECT name, email, company, phone, notes, created_at FROM clients WHERE id = ? AND org_id = ?`, id, orgID).
-			Scan(&name, &email, &company, &phone, &notes, &createdAt); err != nil {
+		var name, email, company, phone, notes, language, createdAt string
+		var version int64
+		if err := db.QueryRow(`SELECT name, email, company, phone, notes, language, version, created_at FROM clients WHERE id = ? AND org_id = ?`, id, orgID).
+			Scan(&name, &email, &company, &phone, &notes, &language, &version, &createdAt); err != nil {
 			if err == sql.ErrNoRows {
 				return fiber.NewError(fiber.StatusNotFound, "client not found")
 			}
 			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
+		c.Set(fiber.HeaderETag, etag(version))
 		return c.JSON(fiber.Map{
-			"id": id, "name": name, "email": email, "company": company, "phone": phone, "notes": notes, "created_at": createdAt,
+			"id": id, "name": name, "email": email, "company": company, "phone": phone, "notes": notes,
+			"language": nullIfEmpty(language), "version": version, "created_at": createdAt,
 		})
 	}
 }
 
-func handleUpdateClient(db *sql.DB) fiber.Handler {
+func handleUpdateClient(db *sql.DB, cfg config.Config) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		orgID := orgIDFrom(c)
-		id := c.Params("id")
 		var req clientPayload
 		if err := c.BodyParser(&req); err != nil {
 			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
 		}
-		name := strings.TrimSpace(req.Name)
-		email := strings.TrimSpace(strings.ToLower(req.Email))
-		if name == "" || email == "" {
-			return fiber.NewError(fiber.StatusBadRequest, "name and email required")
-		}
-		if req.Company == "" {
-			req.Company = "-"
+		version, err := checkIfMatch(c, db, "clients", orgIDFrom(c), c.Params("id"))
+		if err != nil {
+			return err
 		}
-		res, err := db.Exec(`UPDATE clients SET name = ?, email = ?, company = ?, phone = ?, notes = ? WHERE id = ? AND org_id = ?`,
-			name, email, req.Company, req.Phone, req.Notes, id, orgID)
+		return saveClient(c, db, cfg.Now(), req, version)
+	}
+}
+
+// handlePatchClient applies a JSON merge patch, so fields can be cleared with
+// null while absent ones are left alone.
+func handlePatchClient(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		orgID := orgIDFrom(c)
+		id := c.Params("id")
+		version, err := checkIfMatch(c, db, "clients", orgID, id)
 		if err != nil {
+			return err
+		}
+		var req clientPayload
+		if err := db.QueryRow(`SELECT name, email, company, phone, notes, language FROM clients WHERE id = ? AND org_id = ?`, id, orgID).
+			Scan(&req.Name, &req.Email, &req.Company, &req.Phone, &req.Notes, &req.Language); err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
-		affected, _ := res.RowsAffected()
-		if affected == 0 {
-			return fiber.NewError(fiber.StatusNotFound, "client not found")
+		if err := applyMergePatch(c, &req); err != nil {
+			return err
 		}
-		return c.JSON(fiber.Map{"id": id})
+		return saveClient(c, db, cfg.Now(), req, version)
 	}
 }
 
-func handleDeleteClient(db *sql.DB) fiber.Handler {
+// saveClient replaces the client's fields, provided it is still at version.
+func saveClient(c *fiber.Ctx, db *sql.DB, now time.Time, req clientPayload, version int64) error {
+	orgID := orgIDFrom(c)
+	id := c.Params("id")
+	name := strings.TrimSpace(req.Name)
+	email := strings.TrimSpace(strings.ToLower(req.Email))
+	if name == "" || email == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "name and email required")
+	}
+	if req.Company == "" {
+		req.Company = "-"
+	}
+	language := services.NormalizeLanguage(req.Language)
+	if language != "" && !services.ValidLanguage(language) {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid language")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	defer tx.Rollback()
+
+	before, err := snapshot(tx, "clients", orgID, id)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(`UPDATE clients SET name = ?, email = ?, company = ?, phone = ?, notes = ?, language = ? WHERE id = ? AND org_id = ? AND version = ?`,
+		name, email, req.Company, req.Phone, req.Notes, language, id, orgID, version)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	affected, _ := res.RowsAffected()
+	if affected == 0 {
+		return errPreconditionFailed
+	}
+	after, err := snapshot(tx, "clients", orgID, id)
+	if err != nil {
+		return err
+	}
+	if err := recordAudit(c, tx, now, services.AuditActionUpdate, "client", id, before, after); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	c.Set(fiber.HeaderETag, etag(version+1))
+	return c.JSON(fiber.Map{"id": id})
+}
+
+func handleDeleteClient(db *sql.DB, cfg config.Config) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		orgID := orgIDFrom(c)
 		id := c.Params("id")
-		res, err := db.Exec(`DELETE FROM clients WHERE id = ? AND org_id = ?`, id, orgID)
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		before, err := snapshot(tx, "clients", orgID, id)
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(`DELETE FROM clients WHERE id = ? AND org_id = ?`, id, orgID)
 		if err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
@@ -124,6 +240,12 @@ func handleDeleteClient(db *sql.DB) fiber.Handler {
 		if affected == 0 {
 			return fiber.NewError(fiber.StatusNotFound, "client not found")
 		}
+		if err := recordAudit(c, tx, cfg.Now(), services.AuditActionDelete, "client", id, before, nil); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
 		return c.SendStatus(fiber.StatusNoContent)
 	}
 }
@@ -0,0 +1,281 @@
+package api
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	exportCSV    = "csv"
+	exportNDJSON = "ndjson"
+)
+
+// invoiceExportQuery selects paid_cents from the recorded payments; the
+// balance follows balanceCents, so invoices marked paid by hand owe nothing.
+const invoiceExportQuery = `SELECT i.id, i.number, i.status, i.currency, i.amount_cents,
+	COALESCE((SELECT SUM(p.amount_cents) FROM payments p WHERE p.invoice_id = i.id), 0) AS paid_cents,
+	CASE WHEN i.status = 'paid' THEN 0
+		ELSE MAX(i.amount_cents - COALESCE((SELECT SUM(p.amount_cents) FROM payments p WHERE p.invoice_id = i.id), 0), 0)
+	END AS balance_cents,
+	i.due_date, i.notes, i.template_id, i.created_at, i.updated_at,
+	i.client_id, cl.name AS client_name, cl.email AS client_email, cl.company AS client_company
+	FROM invoices i JOIN clients cl ON cl.id = i.client_id
+	WHERE i.org_id = ?`
+
+func handleExportInvoices(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		format, err := exportFormat(c, exportXero, exportQuickBooks, exportIIF, exportUBL)
+		if err != nil {
+			return err
+		}
+		p, err := parsePage(c, invoiceListSpec)
+		if err != nil {
+			return err
+		}
+		query, args, err := filterInvoices(c, invoiceExportQuery, []interface{}{orgIDFrom(c)})
+		if err != nil {
+			return err
+		}
+		if format != exportCSV && format != exportNDJSON {
+			return streamAccountingExport(c, db, format, query, args, p)
+		}
+		return streamExport(c, db, "invoices", format, query, args, p)
+	}
+}
+
+func handleExportReminders(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		format, err := exportFormat(c)
+		if err != nil {
+			return err
+		}
+		p, err := parsePage(c, reminderListSpec)
+		if err != nil {
+			return err
+		}
+		query, args, err := filterReminders(c, `SELECT r.id, r.invoice_id, i.number AS invoice_number, cl.email AS client_email,
+			r.template_id, r.scheduled_for, r.sent_at, r.status
+			FROM reminders r JOIN invoices i ON r.invoice_id = i.id JOIN clients cl ON cl.id = i.client_id
+			WHERE r.org_id = ?`, []interface{}{orgIDFrom(c)})
+		if err != nil {
+			return err
+		}
+		return streamExport(c, db, "reminders", format, query, args, p)
+	}
+}
+
+func handleExportOutbox(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		format, err := exportFormat(c)
+		if err != nil {
+			return err
+		}
+		p, err := parsePage(c, outboxListSpec)
+		if err != nil {
+			return err
+		}
+		query, args, err := filterOutbox(c, `SELECT id, reminder_id, to_email, subject, body, created_at
+			FROM outbox WHERE org_id = ? AND kind = 'reminder'`, []interface{}{orgIDFrom(c)})
+		if err != nil {
+			return err
+		}
+		return streamExport(c, db, "outbox", format, query, args, p)
+	}
+}
+
+var paymentListSpec = listSpec{
+	sorts:       map[string]string{"paid_at": "p.paid_at", "amount_cents": "p.amount_cents"},
+	defaultSort: "paid_at",
+	idColumn:    "p.id",
+}
+
+const paymentExportQuery = `SELECT p.id, p.invoice_id, i.number AS invoice_number, p.provider, p.provider_payment_id,
+	p.amount_cents, p.currency, p.paid_at, p.created_at,
+	cl.name AS client_name, cl.email AS client_email, cl.company AS client_company
+	FROM payments p JOIN invoices i ON i.id = p.invoice_id JOIN clients cl ON cl.id = i.client_id
+	WHERE p.org_id = ?`
+
+func handleExportPayments(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		format, err := exportFormat(c, exportXero, exportQuickBooks)
+		if err != nil {
+			return err
+		}
+		p, err := parsePage(c, paymentListSpec)
+		if err != nil {
+			return err
+		}
+		query, args := paymentExportQuery, []interface{}{orgIDFrom(c)}
+		if invoiceID := strings.TrimSpace(c.Query("invoice_id")); invoiceID != "" {
+			query += " AND p.invoice_id = ?"
+			args = append(args, invoiceID)
+		}
+		query, args, err = addTimeRange(c, "p.paid_at", "from", "to", query, args)
+		if err != nil {
+			return err
+		}
+		if format != exportCSV && format != exportNDJSON {
+			return streamPaymentExport(c, db, format, query, args, p)
+		}
+		return streamExport(c, db, "payments", format, query, args, p)
+	}
+}
+
+// exportFormat reads the format query parameter. Every export accepts csv
+// and ndjson; extra lists the formats specific to the resource.
+func exportFormat(c *fiber.Ctx, extra ...string) (string, error) {
+	accepted := append([]string{exportCSV, exportNDJSON}, extra...)
+	format := strings.ToLower(c.Query("format", exportCSV))
+	for _, name := range accepted {
+		if format == name {
+			return format, nil
+		}
+	}
+	return "", fiber.NewError(fiber.StatusBadRequest, "format must be one of "+strings.Join(accepted, ", "))
+}
+
+// exportBatchSize is how many rows an export reads per query. Each batch is
+// read in full before it is written, so no read stays open while a slow
+// client downloads and writers are never blocked behind an export.
+const exportBatchSize = 500
+
+// readExportBatch reads the next batch of query, keyset-paged on p, calling
+// scan for each row with the selected column names. scan returns the row's
+// sort value and id, which move p past the batch; more reports whether rows
+// remain.
+func readExportBatch(db *sql.DB, p *page, query string, args []interface{}, scan func(*sql.Rows, []string) (interface{}, string, error)) (columns []string, more bool, err error) {
+	q, a := p.apply(query, args)
+	rows, err := db.Query(q, a...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	if columns, err = rows.Columns(); err != nil {
+		return nil, false, err
+	}
+	n := 0
+	for rows.Next() {
+		if n == p.limit {
+			more = true
+			break
+		}
+		value, id, err := scan(rows, columns)
+		if err != nil {
+			return nil, false, err
+		}
+		p.after = &pageCursor{Sort: p.sort, Value: value, ID: id}
+		n++
+	}
+	return columns, more, rows.Err()
+}
+
+// streamExport writes the query's rows in batches, with the selected column
+// names as the CSV header or NDJSON keys; the query must select the sort
+// field and id. Once streaming has started the status is sent, so a later
+// database error ends the body early; NDJSON exports then end with an
+// {"error": ...} line.
+func streamExport(c *fiber.Ctx, db *sql.DB, name, format, query string, args []interface{}, p page) error {
+	p.limit = exportBatchSize
+	var batch [][]interface{}
+	scan := func(rows *sql.Rows, columns []string) (interface{}, string, error) {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, "", err
+		}
+		var sortValue interface{}
+		var id string
+		for i, column := range columns {
+			if raw, ok := values[i].([]byte); ok {
+				values[i] = string(raw)
+			}
+			switch column {
+			case p.field:
+				sortValue = values[i]
+			case "id":
+				id, _ = values[i].(string)
+			}
+		}
+		batch = append(batch, values)
+		return sortValue, id, nil
+	}
+	columns, more, err := readExportBatch(db, &p, query, args, scan)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+
+	if format == exportNDJSON {
+		c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	} else {
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	}
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.%s"`, name, format))
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		var out *csv.Writer
+		if format == exportCSV {
+			out = csv.NewWriter(w)
+			_ = out.Write(columns)
+		}
+		enc := json.NewEncoder(w)
+		record := make([]string, len(columns))
+		for {
+			for _, values := range batch {
+				if out == nil {
+					item := make(map[string]interface{}, len(columns))
+					for i, column := range columns {
+						item[column] = values[i]
+					}
+					_ = enc.Encode(item)
+				} else {
+					for i := range columns {
+						record[i] = csvCell(values[i])
+					}
+					_ = out.Write(record)
+				}
+			}
+			if out != nil {
+				out.Flush()
+			}
+			_ = w.Flush()
+			if !more {
+				return
+			}
+			batch = batch[:0]
+			if _, more, err = readExportBatch(db, &p, query, args, scan); err != nil {
+				if out == nil {
+					_ = enc.Encode(map[string]string{"error": "export failed"})
+				}
+				_ = w.Flush()
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// csvCell formats a value for CSV, quoting text a spreadsheet would
+// otherwise run as a formula.
+func csvCell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return csvCell(string(v))
+	case string:
+		if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+			return "'" + v
+		}
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,436 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"nudgepay/internal/config"
+	"nudgepay/internal/services"
+)
+
+const maxImportRows = 5000
+
+// importRequest carries the CSV text and, per field, the CSV header that
+// holds it. Fields left out of the mapping are read from a header of the
+// same name when there is one.
+type importRequest struct {
+	CSV     string            `json:"csv"`
+	Mapping map[string]string `json:"mapping"`
+	DryRun  bool              `json:"dry_run"`
+}
+
+type importRecord struct {
+	line   int
+	values map[string]string
+}
+
+// importResult is the outcome of one CSV row: "create", "skip" when it
+// matches an existing record, or "error".
+type importResult struct {
+	line   int
+	action string
+	id     string
+	reason string
+	errors []string
+}
+
+func (r *importResult) fail(format string, args ...interface{}) {
+	r.action = "error"
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+var importClientFields = []string{"name", "email", "company", "phone", "notes", "language"}
+
+var importInvoiceFields = []string{"client_email", "number", "amount", "amount_cents", "currency", "due_date", "status", "notes", "reminder_offsets"}
+
+var importAmountPattern = regexp.MustCompile(`^\d+(\.\d{1,2})?$`)
+
+func handleImportClients(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		orgID := orgIDFrom(c)
+		var req importRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		records, err := readImportCSV(req, importClientFields, []string{"name", "email"})
+		if err != nil {
+			return err
+		}
+		existing, err := clientIDsByEmail(db, orgID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+
+		results := make([]*importResult, len(records))
+		seen := map[string]int{}
+		for i, rec := range records {
+			res := &importResult{line: rec.line, action: "create"}
+			results[i] = res
+			v := rec.values
+			v["name"] = strings.TrimSpace(v["name"])
+			v["email"] = strings.TrimSpace(strings.ToLower(v["email"]))
+			if v["name"] == "" {
+				res.fail("name is required")
+			}
+			if v["email"] == "" {
+				res.fail("email is required")
+			}
+			v["language"] = services.NormalizeLanguage(v["language"])
+			if v["language"] != "" && !services.ValidLanguage(v["language"]) {
+				res.fail("invalid language %q", v["language"])
+			}
+			if v["email"] == "" {
+				continue
+			}
+			if line, ok := seen[v["email"]]; ok {
+				res.fail("email %s already appears on row %d", v["email"], line)
+				continue
+			}
+			seen[v["email"]] = rec.line
+			if id, ok := existing[v["email"]]; ok && res.action == "create" {
+				res.action, res.id, res.reason = "skip", id, "a client with this email exists"
+			}
+		}
+		if req.DryRun || importFailed(results) {
+			return importResponse(c, req.DryRun, results)
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+		now := cfg.Now()
+		for i, res := range results {
+			if res.action != "create" {
+				continue
+			}
+			v := records[i].values
+			if v["company"] == "" {
+				v["company"] = "-"
+			}
+			res.id = uuid.NewString()
+			if _, err := tx.Exec(`INSERT INTO clients (id, org_id, name, email, company, phone, notes, language, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				res.id, orgID, v["name"], v["email"], v["company"], v["phone"], v["notes"], v["language"], now.Format(time.RFC3339)); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "db error")
+			}
+		}
+		if err := auditImported(c, tx, now, "clients", "client", results); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return importResponse(c, false, results)
+	}
+}
+
+// handleImportInvoices imports open invoices for existing clients, matched
+// by email. Invoice numbers already in use are skipped, and reminders are
+// scheduled as for POST /api/invoices with the org's default template.
+func handleImportInvoices(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		orgID := orgIDFrom(c)
+		var req importRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		records, err := readImportCSV(req, importInvoiceFields, []string{"client_email", "number", "currency", "due_date"})
+		if err != nil {
+			return err
+		}
+		clients, err := clientIDsByEmail(db, orgID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		numbers := map[string]string{}
+		rows, err := db.Query(`SELECT id, number FROM invoices WHERE org_id = ?`, orgID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id, number string
+			if err := rows.Scan(&id, &number); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "db error")
+			}
+			numbers[number] = id
+		}
+		if err := rows.Err(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		rows.Close()
+
+		results := make([]*importResult, len(records))
+		invoices := make([]services.NewInvoice, len(records))
+		seen := map[string]int{}
+		for i, rec := range records {
+			res := &importResult{line: rec.line, action: "create"}
+			results[i] = res
+			v := rec.values
+			inv := services.NewInvoice{
+				OrgID:    orgID,
+				Number:   strings.TrimSpace(v["number"]),
+				Currency: strings.ToUpper(strings.TrimSpace(v["currency"])),
+				Status:   strings.TrimSpace(v["status"]),
+				Notes:    v["notes"],
+			}
+			email := strings.TrimSpace(strings.ToLower(v["client_email"]))
+			if email == "" {
+				res.fail("client_email is required")
+			} else if id, ok := clients[email]; ok {
+				inv.ClientID = id
+			} else {
+				res.fail("no client with email %s", email)
+			}
+			if inv.Currency == "" {
+				res.fail("currency is required")
+			}
+			if inv.Status == "" {
+				inv.Status = "sent"
+			}
+			if amount, err := parseImportAmount(v["amount"], v["amount_cents"]); err != nil {
+				res.fail("%v", err)
+			} else {
+				inv.AmountCents = amount
+			}
+			if due, err := time.Parse("2006-01-02", strings.TrimSpace(v["due_date"])); err != nil {
+				res.fail("due_date must be YYYY-MM-DD")
+			} else {
+				inv.DueDate = due
+			}
+			for _, raw := range strings.FieldsFunc(v["reminder_offsets"], func(r rune) bool { return r == ',' || r == ';' || r == ' ' }) {
+				offset, err := strconv.Atoi(raw)
+				if err != nil {
+					res.fail("reminder_offsets must be whole days")
+					break
+				}
+				inv.ReminderOffsets = append(inv.ReminderOffsets, offset)
+			}
+			invoices[i] = inv
+
+			if inv.Number == "" {
+				res.fail("number is required")
+				continue
+			}
+			if line, ok := seen[inv.Number]; ok {
+				res.fail("number %s already appears on row %d", inv.Number, line)
+				continue
+			}
+			seen[inv.Number] = rec.line
+			if id, ok := numbers[inv.Number]; ok && res.action == "create" {
+				res.action, res.id, res.reason = "skip", id, "an invoice with this number exists"
+			}
+		}
+		if req.DryRun || importFailed(results) {
+			return importResponse(c, req.DryRun, results)
+		}
+
+		templateID, err := services.EnsureDefaultTemplate(db, orgID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+		now := cfg.Now()
+		for i, res := range results {
+			if res.action != "create" {
+				continue
+			}
+			invoices[i].TemplateID = templateID
+			if res.id, err = services.CreateInvoice(tx, invoices[i], now); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "db error")
+			}
+		}
+		if err := auditImported(c, tx, now, "invoices", "invoice", results); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return importResponse(c, false, results)
+	}
+}
+
+// readImportCSV resolves the column of each field from the header row and
+// returns the data rows keyed by field.
+func readImportCSV(req importRequest, fields, required []string) ([]importRecord, error) {
+	known := map[string]bool{}
+	for _, field := range fields {
+		known[field] = true
+	}
+	for field := range req.Mapping {
+		if !known[field] {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "unknown field in mapping: "+field)
+		}
+	}
+
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(req.CSV, "\ufeff")))
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "csv is empty")
+	}
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "invalid csv: "+err.Error())
+	}
+	positions := map[string]int{}
+	for i, name := range header {
+		positions[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	columns := map[string]int{}
+	for _, field := range fields {
+		name, mapped := req.Mapping[field]
+		if !mapped {
+			name = field
+		}
+		if pos, ok := positions[strings.ToLower(strings.TrimSpace(name))]; ok {
+			columns[field] = pos
+		} else if mapped {
+			return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("column %q mapped to %s not found", name, field))
+		}
+	}
+	for _, field := range required {
+		if _, ok := columns[field]; !ok {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "no column for required field "+field)
+		}
+	}
+
+	records := []importRecord{}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "invalid csv: "+err.Error())
+		}
+		line, _ := reader.FieldPos(0)
+		if len(records) == maxImportRows {
+			return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("csv has more than %d rows", maxImportRows))
+		}
+		rec := importRecord{line: line, values: map[string]string{}}
+		blank := true
+		for field, pos := range columns {
+			if pos < len(row) {
+				rec.values[field] = row[pos]
+				blank = blank && strings.TrimSpace(row[pos]) == ""
+			}
+		}
+		if !blank {
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+// parseImportAmount reads a decimal amount such as "1,250.00", or whole
+// cents when only amount_cents is given.
+func parseImportAmount(amount, cents string) (int64, error) {
+	amount = strings.ReplaceAll(strings.TrimSpace(amount), ",", "")
+	cents = strings.TrimSpace(cents)
+	switch {
+	case amount != "":
+		if !importAmountPattern.MatchString(amount) {
+			return 0, fmt.Errorf("amount must be a positive number with at most two decimals")
+		}
+		whole, fraction, _ := strings.Cut(amount, ".")
+		value, err := strconv.ParseInt(whole+(fraction + "00")[:2], 10, 64)
+		if err != nil || value <= 0 {
+			return 0, fmt.Errorf("amount must be greater than zero")
+		}
+		return value, nil
+	case cents != "":
+		value, err := strconv.ParseInt(cents, 10, 64)
+		if err != nil || value <= 0 {
+			return 0, fmt.Errorf("amount_cents must be a positive whole number")
+		}
+		return value, nil
+	}
+	return 0, fmt.Errorf("amount is required")
+}
+
+func clientIDsByEmail(db *sql.DB, orgID string) (map[string]string, error) {
+	rows, err := db.Query(`SELECT id, email FROM clients WHERE org_id = ? ORDER BY created_at ASC`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := map[string]string{}
+	for rows.Next() {
+		var id, email string
+		if err := rows.Scan(&id, &email); err != nil {
+			return nil, err
+		}
+		if _, ok := ids[email]; !ok {
+			ids[email] = id
+		}
+	}
+	return ids, rows.Err()
+}
+
+func importFailed(results []*importResult) bool {
+	for _, res := range results {
+		if res.action == "error" {
+			return true
+		}
+	}
+	return false
+}
+
+func auditImported(c *fiber.Ctx, tx *sql.Tx, now time.Time, table, resourceType string, results []*importResult) error {
+	for _, res := range results {
+		if res.action != "create" {
+			continue
+		}
+		after, err := snapshot(tx, table, orgIDFrom(c), res.id)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(c, tx, now, services.AuditActionCreate, resourceType, res.id, nil, after); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importResponse reports every row. A committed import with any row in error
+// writes nothing and answers 422.
+func importResponse(c *fiber.Ctx, dryRun bool, results []*importResult) error {
+	counts := map[string]int{"create": 0, "skip": 0, "error": 0}
+	rows := make([]fiber.Map, 0, len(results))
+	for _, res := range results {
+		counts[res.action]++
+		row := fiber.Map{"row": res.line, "action": res.action, "id": nullIfEmpty(res.id)}
+		if res.reason != "" {
+			row["reason"] = res.reason
+		}
+		if len(res.errors) > 0 {
+			row["errors"] = res.errors
+		}
+		rows = append(rows, row)
+	}
+	status := fiber.StatusOK
+	if !dryRun && counts["error"] > 0 {
+		status = fiber.StatusUnprocessableEntity
+	}
+	return c.Status(status).JSON(fiber.Map{
+		"dry_run": dryRun,
+		"created": counts["create"],
+		"skipped": counts["skip"],
+		"failed":  counts["error"],
+		"rows":    rows,
+	})
+}
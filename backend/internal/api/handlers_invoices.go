@@ -2,12 +2,14 @@ package api
 
 import (
 	"database/sql"
+	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/google/uuid"
 
+	"nudgepay/internal/config"
 	"nudgepay/internal/services"
 )
 
@@ -23,18 +25,28 @@ type invoicePayload struct {
 	ReminderOffsets []int  `json:"reminder_offsets"`
 }
 
+var invoiceListSpec = listSpec{
+	sorts: map[string]string{
+		"created_at": "i.created_at", "due_date": "i.due_date", "amount_cents": "i.amount_cents", "number": "i.number",
+	},
+	defaultSort: "-created_at",
+	idColumn:    "i.id",
+}
+
 func handleListInvoices(db *sql.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		orgID := orgIDFrom(c)
-		status := strings.TrimSpace(c.Query("status"))
-		query := `SELECT id, client_id, template_id, number, amount_cents, currency, due_date, status, notes, created_at, updated_at
-			FROM invoices WHERE org_id = ?`
-		args := []interface{}{orgID}
-		if status != "" {
-			query += " AND status = ?"
-			args = append(args, status)
-		}
-		query += " ORDER BY created_at DESC"
+		p, err := parsePage(c, invoiceListSpec)
+		if err != nil {
+			return err
+		}
+		query, args, err := filterInvoices(c, `SELECT i.id, i.client_id, i.template_id, i.number, i.amount_cents, i.currency, i.due_date,
+			i.status, i.notes, i.version, i.created_at, i.updated_at
+			FROM invoices i WHERE i.org_id = ?`, []interface{}{orgID})
+		if err != nil {
+			return err
+		}
+		query, args = p.apply(query, args)
 		rows, err := db.Query(query, args...)
 		if err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "db error")
@@ -45,8 +57,8 @@ func handleListInvoices(db *sql.DB) fiber.Handler {
 		for rows.Next() {
 			var id, clientID, number, currency, dueDate, status, notes, createdAt, updatedAt string
 			var templateID sql.NullString
-			var amountCents int64
-			if err := rows.Scan(&id, &clientID, &templateID, &number, &amountCents, &currency, &dueDate, &status, &notes, &createdAt, &updatedAt); err != nil {
+			var amountCents, version int64
+			if err := rows.Scan(&id, &clientID, &templateID, &number, &amountCents, &currency, &dueDate, &status, &notes, &version, &createdAt, &updatedAt); err != nil {
 				return fiber.NewError(fiber.StatusInternalServerError, "db error")
 			}
 			invoices = append(invoices, fiber.Map{
@@ -59,15 +71,44 @@ func handleListInvoices(db *sql.DB) fiber.Handler {
 				"due_date": dueDate,
 				"status": status,
 				"notes": notes,
+				"version": version,
 				"created_at": createdAt,
 				"updated_at": updatedAt,
 			})
 		}
-		return c.JSON(fiber.Map{"invoices": invoices})
+		invoices, next := p.finish(invoices)
+		return c.JSON(fiber.Map{"invoices": invoices, "next_cursor": next})
 	}
 }
 
-func handleCreateInvoice(db *sql.DB) fiber.Handler {
+// filterInvoices adds the list filters to a query over invoices aliased i.
+func filterInvoices(c *fiber.Ctx, query string, args []interface{}) (string, []interface{}, error) {
+	for param, column := range map[string]string{"status": "i.status", "client_id": "i.client_id"} {
+		if value := strings.TrimSpace(c.Query(param)); value != "" {
+			query += " AND " + column + " = ?"
+			args = append(args, value)
+		}
+	}
+	if currency := strings.ToUpper(strings.TrimSpace(c.Query("currency"))); currency != "" {
+		query += " AND i.currency = ?"
+		args = append(args, currency)
+	}
+	for param, op := range map[string]string{"min_amount_cents": ">=", "max_amount_cents": "<="} {
+		raw := c.Query(param)
+		if raw == "" {
+			continue
+		}
+		amount, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return query, args, fiber.NewError(fiber.StatusBadRequest, param+" must be an integer")
+		}
+		query += " AND i.amount_cents " + op + " ?"
+		args = append(args, amount)
+	}
+	return addTimeRange(c, "i.due_date", "due_from", "due_to", query, args)
+}
+
+func handleCreateInvoice(db *sql.DB, cfg config.Config) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		orgID := orgIDFrom(c)
 		var req invoicePayload
@@ -77,31 +118,14 @@ func handleCreateInvoice(db *sql.DB) fiber.Handler {
 		req.ClientID = strings.TrimSpace(req.ClientID)
 		req.Number = strings.TrimSpace(req.Number)
 		req.Currency = strings.ToUpper(strings.TrimSpace(req.Currency))
-		if req.ClientID == "" || req.Number == "" || req.AmountCents <= 0 || req.Currency == "" || req.DueDate == "" {
-			return fiber.NewError(fiber.StatusBadRequest, "missing required fields")
-		}
-
 		if req.Status == "" {
 			req.Status = "sent"
 		}
-		if req.Notes == "" {
-			req.Notes = ""
-		}
-		if len(req.ReminderOffsets) == 0 {
-			req.ReminderOffsets = []int{-3, 0, 7}
-		}
-
-		var clientExists string
-		if err := db.QueryRow(`SELECT id FROM clients WHERE id = ? AND org_id = ?`, req.ClientID, orgID).Scan(&clientExists); err != nil {
-			return fiber.NewError(fiber.StatusBadRequest, "client not found")
+		dueDate, err := validateInvoice(db, orgID, req)
+		if err != nil {
+			return err
 		}
-
-		if req.TemplateID != "" {
-			var tmp string
-			if err := db.QueryRow(`SELECT id FROM templates WHERE id = ? AND org_id = ?`, req.TemplateID, orgID).Scan(&tmp); err != nil {
-				return fiber.NewError(fiber.StatusBadRequest, "template not found")
-			}
-		} else {
+		if req.TemplateID == "" {
 			tid, err := services.EnsureDefaultTemplate(db, orgID)
 			if err != nil {
 				return fiber.NewError(fiber.StatusInternalServerError, "db error")
@@ -109,30 +133,29 @@ func handleCreateInvoice(db *sql.DB) fiber.Handler {
 			req.TemplateID = tid
 		}
 
-		dueDate, err := time.Parse("2006-01-02", req.DueDate)
+		now := cfg.Now()
+		tx, err := db.Begin()
 		if err != nil {
-			return fiber.NewError(fiber.StatusBadRequest, "invalid due_date")
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
-		dueDate = time.Date(dueDate.Year(), dueDate.Month(), dueDate.Day(), 0, 0, 0, 0, time.UTC)
-
-		invoiceID := uuid.NewString()
-		now := time.Now().UTC().Format(time.RFC3339)
-		if _, err := db.Exec(`INSERT INTO invoices (id, org_id, client_id, template_id, number, amount_cents, currency, due_date, status, notes, created_at, updated_at)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-			invoiceID, orgID, req.ClientID, req.TemplateID, req.Number, req.AmountCents, req.Currency, dueDate.Format(time.RFC3339), req.Status, req.Notes, now, now); err != nil {
+		defer tx.Rollback()
+		invoiceID, err := services.CreateInvoice(tx, services.NewInvoice{
+			OrgID: orgID, ClientID: req.ClientID, TemplateID: req.TemplateID, Number: req.Number, AmountCents: req.AmountCents,
+			Currency: req.Currency, DueDate: dueDate, Status: req.Status, Notes: req.Notes, ReminderOffsets: req.ReminderOffsets,
+		}, now)
+		if err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
-
-		for _, offset := range req.ReminderOffsets {
-			scheduled := time.Date(dueDate.Year(), dueDate.Month(), dueDate.Day(), 9, 0, 0, 0, time.UTC).AddDate(0, 0, offset)
-			reminderID := uuid.NewString()
-			if _, err := db.Exec(`INSERT INTO reminders (id, org_id, invoice_id, template_id, scheduled_for, sent_at, status, created_at)
-				VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-				reminderID, orgID, invoiceID, req.TemplateID, scheduled.Format(time.RFC3339), nil, "scheduled", now); err != nil {
-				return fiber.NewError(fiber.StatusInternalServerError, "db error")
-			}
+		after, err := snapshot(tx, "invoices", orgID, invoiceID)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(c, tx, now, services.AuditActionCreate, "invoice", invoiceID, nil, after); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
-
 		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"id": invoiceID})
 	}
 }
@@ -143,10 +166,10 @@ func handleGetInvoice(db *sql.DB) fiber.Handler {
 		id := c.Params("id")
 		var clientID, number, currency, dueDate, status, notes, createdAt, updatedAt string
 		var templateID sql.NullString
-		var amountCents int64
-		if err := db.QueryRow(`SELECT client_id, template_id, number, amount_cents, currency, due_date, status, notes, created_at, updated_at
+		var amountCents, version int64
+		if err := db.QueryRow(`SELECT client_id, template_id, number, amount_cents, currency, due_date, status, notes, version, created_at, updated_at
 			FROM invoices WHERE id = ? AND org_id = ?`, id, orgID).
-			Scan(&clientID, &templateID, &number, &amountCents, &currency, &dueDate, &status, &notes, &createdAt, &updatedAt); err != nil {
+			Scan(&clientID, &templateID, &number, &amountCents, &currency, &dueDate, &status, &notes, &version, &createdAt, &updatedAt); err != nil {
 			if err == sql.ErrNoRows {
 				return fiber.NewError(fiber.StatusNotFound, "invoice not found")
 			}
@@ -170,6 +193,26 @@ func handleGetInvoice(db *sql.DB) fiber.Handler {
 			})
 		}
 
+		paymentRows, err := db.Query(`SELECT id, provider, provider_payment_id, amount_cents, currency, paid_at FROM payments
+			WHERE invoice_id = ? AND org_id = ? ORDER BY paid_at ASC`, id, orgID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer paymentRows.Close()
+		payments := make([]fiber.Map, 0)
+		for paymentRows.Next() {
+			var paymentID, provider, providerPaymentID, pCurrency, paidAt string
+			var pAmountCents int64
+			if err := paymentRows.Scan(&paymentID, &provider, &providerPaymentID, &pAmountCents, &pCurrency, &paidAt); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "db error")
+			}
+			payments = append(payments, fiber.Map{
+				"id": paymentID, "provider": provider, "provider_payment_id": providerPaymentID,
+				"amount_cents": pAmountCents, "currency": pCurrency, "paid_at": paidAt,
+			})
+		}
+
+		c.Set(fiber.HeaderETag, etag(version))
 		return c.JSON(fiber.Map{
 			"id": id,
 			"client_id": clientID,
@@ -180,14 +223,16 @@ func handleGetInvoice(db *sql.DB) fiber.Handler {
 			"due_date": dueDate,
 			"status": status,
 			"notes": notes,
+			"version": version,
 			"created_at": createdAt,
 			"updated_at": updatedAt,
 			"reminders": reminders,
+			"payments": payments,
 		})
 	}
 }
 
-func handleUpdateInvoice(db *sql.DB) fiber.Handler {
+func handleUpdateInvoice(db *sql.DB, cfg config.Config) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		orgID := orgIDFrom(c)
 		id := c.Params("id")
@@ -249,28 +294,173 @@ func handleUpdateInvoice(db *sql.DB) fiber.Handler {
 		if len(fields) == 0 {
 			return fiber.NewError(fiber.StatusBadRequest, "no fields to update")
 		}
-		fields = append(fields, "updated_at = ?")
-		args = append(args, time.Now().UTC().Format(time.RFC3339))
-		args = append(args, id, orgID)
+		version, err := checkIfMatch(c, db, "invoices", orgID, id)
+		if err != nil {
+			return err
+		}
+		return saveInvoice(c, db, cfg.Now(), fields, args, version)
+	}
+}
+
+// invoicePatch holds the invoice fields a merge patch may change. Unlike
+// PUT, an empty string here is a value to store.
+type invoicePatch struct {
+	ClientID    string `json:"client_id"`
+	TemplateID  string `json:"template_id"`
+	Number      string `json:"number"`
+	AmountCents int64  `json:"amount_cents"`
+	Currency    string `json:"currency"`
+	DueDate     string `json:"due_date"`
+	Status      string `json:"status"`
+	Notes       string `json:"notes"`
+}
+
+func handlePatchInvoice(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		orgID := orgIDFrom(c)
+		id := c.Params("id")
+		version, err := checkIfMatch(c, db, "invoices", orgID, id)
+		if err != nil {
+			return err
+		}
+		var req invoicePatch
+		var templateID sql.NullString
+		if err := db.QueryRow(`SELECT client_id, template_id, number, amount_cents, currency, due_date, status, notes FROM invoices WHERE id = ? AND org_id = ?`, id, orgID).
+			Scan(&req.ClientID, &templateID, &req.Number, &req.AmountCents, &req.Currency, &req.DueDate, &req.Status, &req.Notes); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		req.TemplateID = templateID.String
+		if due, err := time.Parse(time.RFC3339, req.DueDate); err == nil {
+			req.DueDate = due.Format("2006-01-02")
+		}
+		if err := applyMergePatch(c, &req); err != nil {
+			return err
+		}
 
-		query := `UPDATE invoices SET ` + strings.Join(fields, ", ") + ` WHERE id = ? AND org_id = ?`
-		res, err := db.Exec(query, args...)
+		req.ClientID = strings.TrimSpace(req.ClientID)
+		req.Number = strings.TrimSpace(req.Number)
+		req.Currency = strings.ToUpper(strings.TrimSpace(req.Currency))
+		req.Status = strings.TrimSpace(req.Status)
+		if req.ClientID == "" || req.Number == "" || req.Currency == "" || req.DueDate == "" || req.Status == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "client_id, number, currency, due_date and status cannot be cleared")
+		}
+		if req.AmountCents <= 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "amount_cents must be positive")
+		}
+		// The merged invoice meets the same rules as a new one.
+		dueDate, err := validateInvoice(db, orgID, invoicePayload{
+			ClientID: req.ClientID, TemplateID: req.TemplateID, Number: req.Number, AmountCents: req.AmountCents,
+			Currency: req.Currency, DueDate: req.DueDate, Status: req.Status, Notes: req.Notes,
+		})
 		if err != nil {
+			return err
+		}
+
+		fields := []string{"client_id = ?", "template_id = ?", "number = ?", "amount_cents = ?", "currency = ?", "due_date = ?", "status = ?", "notes = ?"}
+		args := []interface{}{req.ClientID, nullIfEmpty(req.TemplateID), req.Number, req.AmountCents, req.Currency,
+			dueDate.UTC().Format(time.RFC3339), req.Status, req.Notes}
+		return saveInvoice(c, db, cfg.Now(), fields, args, version)
+	}
+}
+
+// validateInvoice checks the rules every stored invoice meets, with inv's
+// fields already trimmed, and returns its due date. An empty template means
+// the org's default.
+func validateInvoice(db *sql.DB, orgID string, inv invoicePayload) (time.Time, error) {
+	if inv.ClientID == "" || inv.Number == "" || inv.AmountCents <= 0 || inv.Currency == "" || inv.DueDate == "" {
+		return time.Time{}, fiber.NewError(fiber.StatusBadRequest, "missing required fields")
+	}
+	var exists string
+	if err := db.QueryRow(`SELECT id FROM clients WHERE id = ? AND org_id = ?`, inv.ClientID, orgID).Scan(&exists); err != nil {
+		return time.Time{}, fiber.NewError(fiber.StatusBadRequest, "client not found")
+	}
+	if inv.TemplateID != "" {
+		if err := db.QueryRow(`SELECT id FROM templates WHERE id = ? AND org_id = ?`, inv.TemplateID, orgID).Scan(&exists); err != nil {
+			return time.Time{}, fiber.NewError(fiber.StatusBadRequest, "template not found")
+		}
+	}
+	dueDate, err := time.Parse("2006-01-02", inv.DueDate)
+	if err != nil {
+		return time.Time{}, fiber.NewError(fiber.StatusBadRequest, "invalid due_date")
+	}
+	return dueDate, nil
+}
+
+// saveInvoice writes the given assignments, provided the invoice is still at
+// version.
+func saveInvoice(c *fiber.Ctx, db *sql.DB, now time.Time, fields []string, args []interface{}, version int64) error {
+	orgID := orgIDFrom(c)
+	id := c.Params("id")
+	fields = append(fields, "updated_at = ?")
+	args = append(args, now.Format(time.RFC3339))
+	args = append(args, id, orgID, version)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	defer tx.Rollback()
+
+	before, err := snapshot(tx, "invoices", orgID, id)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE invoices SET ` + strings.Join(fields, ", ") + ` WHERE id = ? AND org_id = ? AND version = ?`
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	affected, _ := res.RowsAffected()
+	if affected == 0 {
+		return errPreconditionFailed
+	}
+	after, err := snapshot(tx, "invoices", orgID, id)
+	if err != nil {
+		return err
+	}
+	if err := recordAudit(c, tx, now, services.AuditActionUpdate, "invoice", id, before, after); err != nil {
+		return err
+	}
+	if before["due_date"] != after["due_date"] {
+		if err := services.RescheduleReminders(tx, orgID, id, fmt.Sprint(before["due_date"]), fmt.Sprint(after["due_date"])); err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
-		affected, _ := res.RowsAffected()
-		if affected == 0 {
-			return fiber.NewError(fiber.StatusNotFound, "invoice not found")
+	}
+	events := []string{services.WebhookInvoiceUpdated}
+	if after["status"] == "paid" && before["status"] != "paid" {
+		events = append(events, services.WebhookInvoicePaid)
+		if _, err := services.SettleInvoice(tx, orgID, id, now); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
-		return c.JSON(fiber.Map{"id": id})
 	}
+	for _, event := range events {
+		if err := services.EmitInvoiceEvent(tx, orgID, id, event, now); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	c.Set(fiber.HeaderETag, etag(version+1))
+	return c.JSON(fiber.Map{"id": id})
 }
 
-func handleDeleteInvoice(db *sql.DB) fiber.Handler {
+func handleDeleteInvoice(db *sql.DB, cfg config.Config) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		orgID := orgIDFrom(c)
 		id := c.Params("id")
-		res, err := db.Exec(`DELETE FROM invoices WHERE id = ? AND org_id = ?`, id, orgID)
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		before, err := snapshot(tx, "invoices", orgID, id)
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(`DELETE FROM invoices WHERE id = ? AND org_id = ?`, id, orgID)
 		if err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
@@ -278,6 +468,12 @@ func handleDeleteInvoice(db *sql.DB) fiber.Handler {
 		if affected == 0 {
 			return fiber.NewError(fiber.StatusNotFound, "invoice not found")
 		}
+		if err := recordAudit(c, tx, cfg.Now(), services.AuditActionDelete, "invoice", id, before, nil); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
 		return c.SendStatus(fiber.StatusNoContent)
 	}
 }
@@ -0,0 +1,305 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"nudgepay/internal/auth"
+	"nudgepay/internal/config"
+	"nudgepay/internal/services"
+)
+
+type inviteRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type memberRoleRequest struct {
+	Role string `json:"role"`
+}
+
+type acceptInviteRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func handleListMembers(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		rows, err := db.Query(`SELECT u.id, u.email, m.role, m.created_at FROM memberships m JOIN users u ON u.id = m.user_id
+			WHERE m.org_id = ? ORDER BY m.created_at ASC`, orgIDFrom(c))
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer rows.Close()
+
+		members := make([]fiber.Map, 0)
+		for rows.Next() {
+			var userID, email, role, createdAt string
+			if err := rows.Scan(&userID, &email, &role, &createdAt); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "db error")
+			}
+			members = append(members, fiber.Map{"user_id": userID, "email": email, "role": role, "joined_at": createdAt})
+		}
+		return c.JSON(fiber.Map{"members": members})
+	}
+}
+
+func handleUpdateMember(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req memberRoleRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		role := strings.TrimSpace(strings.ToLower(req.Role))
+		if !services.ValidRole(role) {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid role")
+		}
+		userID := c.Params("id")
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		before, err := memberSnapshot(tx, orgIDFrom(c), userID)
+		if err != nil {
+			return err
+		}
+		if err := services.UpdateMemberRole(tx, orgIDFrom(c), roleFrom(c), userID, role); err != nil {
+			return memberError(err)
+		}
+		after, err := memberSnapshot(tx, orgIDFrom(c), userID)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(c, tx, cfg.Now(), services.AuditActionUpdate, "member", userID, before, after); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.JSON(fiber.Map{"user_id": userID, "role": role})
+	}
+}
+
+func handleRemoveMember(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Params("id")
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		before, err := memberSnapshot(tx, orgIDFrom(c), userID)
+		if err != nil {
+			return err
+		}
+		now := cfg.Now()
+		if err := services.RemoveMember(tx, orgIDFrom(c), userIDFrom(c), roleFrom(c), userID, now); err != nil {
+			return memberError(err)
+		}
+		if err := recordAudit(c, tx, now, services.AuditActionDelete, "member", userID, before, nil); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func handleListInvitations(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		rows, err := db.Query(`SELECT id, email, role, created_at, expires_at FROM invitations
+			WHERE org_id = ? AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > ? ORDER BY created_at DESC`,
+			orgIDFrom(c), cfg.Now().Format(time.RFC3339))
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer rows.Close()
+
+		invitations := make([]fiber.Map, 0)
+		for rows.Next() {
+			var id, email, role, createdAt, expiresAt string
+			if err := rows.Scan(&id, &email, &role, &createdAt, &expiresAt); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "db error")
+			}
+			invitations = append(invitations, fiber.Map{
+				"id": id, "email": email, "role": role, "created_at": createdAt, "expires_at": expiresAt,
+			})
+		}
+		return c.JSON(fiber.Map{"invitations": invitations})
+	}
+}
+
+func handleCreateInvitation(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req inviteRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		email := strings.TrimSpace(strings.ToLower(req.Email))
+		role := strings.TrimSpace(strings.ToLower(req.Role))
+		if email == "" || !strings.Contains(email, "@") {
+			return fiber.NewError(fiber.StatusBadRequest, "valid email required")
+		}
+		if !services.ValidRole(role) {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid role")
+		}
+		now := cfg.Now()
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		inv, err := services.CreateInvitation(tx, orgIDFrom(c), userIDFrom(c), roleFrom(c), email, role, cfg.BaseURL, now)
+		if err != nil {
+			return memberError(err)
+		}
+		after, err := snapshot(tx, "invitations", orgIDFrom(c), inv.ID)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(c, tx, now, services.AuditActionCreate, "invitation", inv.ID, nil, after); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"id": inv.ID, "email": inv.Email, "role": inv.Role, "expires_at": inv.ExpiresAt.Format(time.RFC3339),
+		})
+	}
+}
+
+func handleRevokeInvitation(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Params("id")
+		now := cfg.Now()
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		before, err := snapshot(tx, "invitations", orgIDFrom(c), id)
+		if err != nil {
+			return err
+		}
+		revoked, err := services.RevokeInvitation(tx, orgIDFrom(c), id, now)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if !revoked {
+			return fiber.NewError(fiber.StatusNotFound, "invitation not found")
+		}
+		after, err := snapshot(tx, "invitations", orgIDFrom(c), id)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(c, tx, now, services.AuditActionDelete, "invitation", id, before, after); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// handleAcceptInvitation signs in brand new accounts straight away. Existing
+// accounts only gain the membership and still log in as usual, so the link
+// cannot bypass their password or second factor.
+func handleAcceptInvitation(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req acceptInviteRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		token := strings.TrimSpace(req.Token)
+		if token == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "token required")
+		}
+		var hash string
+		if req.Password != "" {
+			var err error
+			if hash, err = auth.HashPassword(req.Password); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "password hashing failed")
+			}
+		}
+		now := cfg.Now()
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		accepted, err := services.AcceptInvitation(tx, token, hash, now)
+		if err != nil {
+			if errors.Is(err, services.ErrPasswordRequired) {
+				return fiber.NewError(fiber.StatusBadRequest, "password required to create your account")
+			}
+			return accountTokenError(err)
+		}
+		// Public route: the new member is the actor, in the invitation's org.
+		after, err := memberSnapshot(tx, accepted.OrgID, accepted.UserID)
+		if err != nil {
+			return err
+		}
+		entry := auditEntry(c, services.AuditActionCreate, "member", accepted.UserID)
+		entry.OrgID, entry.ActorUserID = accepted.OrgID, accepted.UserID
+		if err := services.RecordAudit(tx, entry, nil, after, now); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if !accepted.UserCreated {
+			return c.JSON(fiber.Map{"accepted": true, "org_id": accepted.OrgID})
+		}
+		ssoRequired, err := services.SSORequired(db, accepted.OrgID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if ssoRequired {
+			// The account exists now; the user signs in through the org's provider.
+			return c.JSON(fiber.Map{"accepted": true, "org_id": accepted.OrgID, "sso_required": true})
+		}
+		resp, err := issueSession(c, db, cfg, accepted.UserID, accepted.OrgID, services.AuthMethodPassword)
+		if err != nil {
+			return err
+		}
+		resp["accepted"] = true
+		resp["org_id"] = accepted.OrgID
+		return c.JSON(resp)
+	}
+}
+
+func memberSnapshot(q queryer, orgID, userID string) (map[string]interface{}, error) {
+	row, err := services.AuditSnapshot(q, `SELECT m.user_id, u.email, m.role, m.created_at FROM memberships m
+		JOIN users u ON u.id = m.user_id WHERE m.org_id = ? AND m.user_id = ?`, orgID, userID)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	return row, nil
+}
+
+func memberError(err error) error {
+	switch {
+	case errors.Is(err, services.ErrNotMember):
+		return fiber.NewError(fiber.StatusNotFound, "member not found")
+	case errors.Is(err, services.ErrAlreadyMember):
+		return fiber.NewError(fiber.StatusConflict, "already a member of this organization")
+	case errors.Is(err, services.ErrOwnerImmutable):
+		return fiber.NewError(fiber.StatusConflict, "the owner cannot be changed or removed")
+	case errors.Is(err, services.ErrRoleNotAllowed):
+		return fiber.NewError(fiber.StatusForbidden, "your role cannot manage that role")
+	}
+	return fiber.NewError(fiber.StatusInternalServerError, "db error")
+}
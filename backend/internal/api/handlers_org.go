@@ -5,24 +5,36 @@ import (
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
+
+	"nudgepay/internal/config"
+	"nudgepay/internal/services"
 )
 
-type updateOrgRequest struct {
+type createOrgRequest struct {
 	Name string `json:"name"`
 }
 
+type updateOrgRequest struct {
+	Name       string `json:"name"`
+	Require2FA *bool  `json:"require_2fa"`
+	RequireSSO *bool  `json:"require_sso"`
+	SSOSkip2FA *bool  `json:"sso_skip_2fa"`
+}
+
 func handleGetOrg(db *sql.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		orgID := orgIDFrom(c)
 		var name string
-		if err := db.QueryRow(`SELECT name FROM organizations WHERE id = ?`, orgID).Scan(&name); err != nil {
+		var require2FA, requireSSO, ssoSkip2FA bool
+		if err := db.QueryRow(`SELECT name, require_2fa, require_sso, sso_skip_2fa FROM organizations WHERE id = ?`, orgID).
+			Scan(&name, &require2FA, &requireSSO, &ssoSkip2FA); err != nil {
 			return fiber.NewError(fiber.StatusNotFound, "org not found")
 		}
-		return c.JSON(fiber.Map{"id": orgID, "name": name})
+		return c.JSON(fiber.Map{"id": orgID, "name": name, "require_2fa": require2FA, "require_sso": requireSSO, "sso_skip_2fa": ssoSkip2FA})
 	}
 }
 
-func handleUpdateOrg(db *sql.DB) fiber.Handler {
+func handleUpdateOrg(db *sql.DB, cfg config.Config) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		orgID := orgIDFrom(c)
 		var req updateOrgRequest
@@ -33,9 +45,164 @@ func handleUpdateOrg(db *sql.DB) fiber.Handler {
 		if name == "" {
 			return fiber.NewError(fiber.StatusBadRequest, "name required")
 		}
-		if _, err := db.Exec(`UPDATE organizations SET name = ? WHERE id = ?`, name, orgID); err != nil {
+		var require2FA, requireSSO, ssoSkip2FA bool
+		if err := db.QueryRow(`SELECT require_2fa, require_sso, sso_skip_2fa FROM organizations WHERE id = ?`, orgID).
+			Scan(&require2FA, &requireSSO, &ssoSkip2FA); err != nil {
+			return fiber.NewError(fiber.StatusNotFound, "org not found")
+		}
+		if req.Require2FA != nil {
+			if *req.Require2FA && !require2FA {
+				enabled, err := services.TwoFactorEnabled(db, userIDFrom(c))
+				if err != nil {
+					return fiber.NewError(fiber.StatusInternalServerError, "db error")
+				}
+				if !enabled {
+					return fiber.NewError(fiber.StatusConflict, "enable two-factor authentication on your own account first")
+				}
+			}
+			require2FA = *req.Require2FA
+		}
+		if req.RequireSSO != nil {
+			// Only someone already signed in through a provider can switch this
+			// on, so admins cannot lock themselves out.
+			if *req.RequireSSO && !requireSSO {
+				if len(cfg.OIDCProviders) == 0 {
+					return fiber.NewError(fiber.StatusConflict, "no single sign-on provider is configured")
+				}
+				method, err := services.SessionAuthMethod(db, sessionIDFrom(c))
+				if err != nil {
+					return fiber.NewError(fiber.StatusInternalServerError, "db error")
+				}
+				if method != services.AuthMethodSSO {
+					return fiber.NewError(fiber.StatusConflict, "sign in with single sign-on first")
+				}
+			}
+			requireSSO = *req.RequireSSO
+		}
+		if req.SSOSkip2FA != nil {
+			ssoSkip2FA = *req.SSOSkip2FA
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		before, err := services.AuditSnapshot(tx, `SELECT * FROM organizations WHERE id = ?`, orgID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if _, err := tx.Exec(`UPDATE organizations SET name = ?, require_2fa = ?, require_sso = ?, sso_skip_2fa = ? WHERE id = ?`,
+			name, require2FA, requireSSO, ssoSkip2FA, orgID); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		after, err := services.AuditSnapshot(tx, `SELECT * FROM organizations WHERE id = ?`, orgID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if err := recordAudit(c, tx, cfg.Now(), services.AuditActionUpdate, "organization", orgID, before, after); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.JSON(fiber.Map{"id": orgID, "name": name, "require_2fa": require2FA, "require_sso": requireSSO, "sso_skip_2fa": ssoSkip2FA})
+	}
+}
+
+func handleListMyOrgs(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		current := orgIDFrom(c)
+		rows, err := db.Query(`SELECT o.id, o.name, m.role FROM memberships m JOIN organizations o ON o.id = m.org_id
+			WHERE m.user_id = ? ORDER BY o.name ASC, o.id ASC`, userIDFrom(c))
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer rows.Close()
+
+		orgs := make([]fiber.Map, 0)
+		for rows.Next() {
+			var id, name, role string
+			if err := rows.Scan(&id, &name, &role); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "db error")
+			}
+			orgs = append(orgs, fiber.Map{"id": id, "name": name, "role": role, "current": id == current})
+		}
+		return c.JSON(fiber.Map{"orgs": orgs})
+	}
+}
+
+func handleCreateOrg(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req createOrgRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		name := strings.TrimSpace(req.Name)
+		if name == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "name required")
+		}
+		now := cfg.Now()
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		orgID, err := services.CreateOrganization(tx, userIDFrom(c), name, now)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		after, err := services.AuditSnapshot(tx, `SELECT * FROM organizations WHERE id = ?`, orgID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		// The event belongs to the new org, not the one the caller is in.
+		entry := auditEntry(c, services.AuditActionCreate, "organization", orgID)
+		entry.OrgID = orgID
+		if err := services.RecordAudit(tx, entry, nil, after, now); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"id": orgID, "name": name, "role": services.RoleOwner})
+	}
+}
+
+// handleSwitchOrg trades the current session for one scoped to another org
+// the user belongs to. Tokens only ever carry a single org, so every other
+// handler keeps relying on orgIDFrom alone.
+func handleSwitchOrg(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := userIDFrom(c)
+		orgID := c.Params("id")
+		role, err := services.MemberRole(db, orgID, userID)
+		if err == services.ErrNotMember {
+			return fiber.NewError(fiber.StatusNotFound, "org not found")
+		}
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		method, err := services.SessionAuthMethod(db, sessionIDFrom(c))
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if err := checkSSORequirement(db, orgID, method); err != nil {
+			return err
+		}
+		resp, err := issueSession(c, db, cfg, userID, orgID, method)
+		if err != nil {
+			return err
+		}
+		if _, err := services.RevokeSession(db, userID, sessionIDFrom(c), cfg.Now()); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if err := services.SetHomeOrg(db, userID, orgID); err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
-		return c.JSON(fiber.Map{"id": orgID, "name": name})
+		resp["org"] = fiber.Map{"id": orgID, "role": role}
+		return c.JSON(resp)
 	}
 }
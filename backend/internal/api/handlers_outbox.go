@@ -2,14 +2,43 @@ package api
 
 import (
 	"database/sql"
+	"encoding/json"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
 )
 
+var outboxListSpec = listSpec{
+	sorts:       map[string]string{"created_at": "created_at"},
+	defaultSort: "-created_at",
+	idColumn:    "id",
+}
+
+// filterOutbox adds the list filters to a query over the outbox.
+func filterOutbox(c *fiber.Ctx, query string, args []interface{}) (string, []interface{}, error) {
+	if to := strings.TrimSpace(strings.ToLower(c.Query("to_email"))); to != "" {
+		query += " AND to_email = ?"
+		args = append(args, to)
+	}
+	return addTimeRange(c, "created_at", "from", "to", query, args)
+}
+
 func handleListOutbox(db *sql.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		orgID := orgIDFrom(c)
-		rows, err := db.Query(`SELECT id, reminder_id, to_email, subject, body, created_at FROM outbox WHERE org_id = ? ORDER BY created_at DESC`, orgID)
+		p, err := parsePage(c, outboxListSpec)
+		if err != nil {
+			return err
+		}
+		// Account emails carry verification and reset links, so they stay
+		// out of the org-wide listing.
+		query, args, err := filterOutbox(c, `SELECT id, reminder_id, to_email, subject, body, headers, created_at FROM outbox WHERE org_id = ? AND kind = 'reminder'`,
+			[]interface{}{orgID})
+		if err != nil {
+			return err
+		}
+		query, args = p.apply(query, args)
+		rows, err := db.Query(query, args...)
 		if err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
@@ -17,19 +46,28 @@ func handleListOutbox(db *sql.DB) fiber.Handler {
 
 		items := make([]fiber.Map, 0)
 		for rows.Next() {
-			var id, reminderID, toEmail, subject, body, createdAt string
-			if err := rows.Scan(&id, &reminderID, &toEmail, &subject, &body, &createdAt); err != nil {
+			var id, toEmail, subject, body, rawHeaders, createdAt string
+			var reminderID sql.NullString
+			if err := rows.Scan(&id, &reminderID, &toEmail, &subject, &body, &rawHeaders, &createdAt); err != nil {
 				return fiber.NewError(fiber.StatusInternalServerError, "db error")
 			}
+			headers := map[string]string{}
+			if rawHeaders != "" {
+				if err := json.Unmarshal([]byte(rawHeaders), &headers); err != nil {
+					return fiber.NewError(fiber.StatusInternalServerError, "db error")
+				}
+			}
 			items = append(items, fiber.Map{
 				"id": id,
-				"reminder_id": reminderID,
+				"reminder_id": reminderID.String,
 				"to_email": toEmail,
 				"subject": subject,
 				"body": body,
+				"headers": headers,
 				"created_at": createdAt,
 			})
 		}
-		return c.JSON(fiber.Map{"outbox": items})
+		items, next := p.finish(items)
+		return c.JSON(fiber.Map{"outbox": items, "next_cursor": next})
 	}
 }
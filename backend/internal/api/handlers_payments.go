@@ -0,0 +1,207 @@
+package api
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"nudgepay/internal/config"
+	"nudgepay/internal/payments"
+	"nudgepay/internal/services"
+)
+
+const minPaymentWebhookSecretLength = 16
+
+type paymentWebhookRequest struct {
+	Secret string `json:"secret"`
+}
+
+// handlePaymentWebhook receives payments from a processor. It sits outside
+// the secured group: the caller proves itself with a signature made with
+// the org's payment webhook secret.
+func handlePaymentWebhook(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		orgID := c.Params("org_id")
+		provider := c.Params("provider")
+		header := "NudgePay-Signature"
+		switch provider {
+		case payments.ProviderStripe:
+			header = "Stripe-Signature"
+		case payments.ProviderGeneric:
+		default:
+			return fiber.NewError(fiber.StatusNotFound, "unknown payment provider")
+		}
+
+		var secret string
+		err := db.QueryRow(`SELECT payment_webhook_secret FROM organizations WHERE id = ?`, orgID).Scan(&secret)
+		if err != nil && err != sql.ErrNoRows {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if secret == "" {
+			return fiber.NewError(fiber.StatusNotFound, "payment webhook not configured")
+		}
+		now := cfg.Now()
+		payload := c.Body()
+		if err := payments.VerifySignature(c.Get(header), secret, payload, now); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid signature")
+		}
+
+		var payment payments.Payment
+		if provider == payments.ProviderStripe {
+			var ok bool
+			if payment, ok, err = payments.ParseStripeEvent(payload); err == nil && !ok {
+				return c.JSON(fiber.Map{"received": true, "ignored": true})
+			}
+		} else {
+			payment, err = payments.ParseGenericPayment(payload, now)
+		}
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+
+		invoiceID, err := services.MatchPaymentInvoice(db, orgID, payment)
+		if err == services.ErrPaymentUnmatched {
+			return fiber.NewError(fiber.StatusUnprocessableEntity, "no invoice matches this payment")
+		}
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		entry := services.AuditEntry{OrgID: orgID, IP: c.IP()}
+		result, err := services.ApplyPayment(db, entry, invoiceID, payment, now)
+		switch {
+		case err == services.ErrPaymentUnmatched:
+			return fiber.NewError(fiber.StatusUnprocessableEntity, "no invoice matches this payment")
+		case err == services.ErrPaymentCurrencyMismatch:
+			return fiber.NewError(fiber.StatusUnprocessableEntity, "payment currency does not match the invoice")
+		case err != nil:
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.JSON(fiber.Map{
+			"received":            true,
+			"payment_id":          result.PaymentID,
+			"invoice_id":          result.InvoiceID,
+			"duplicate":           result.Duplicate,
+			"invoice_paid":        result.InvoicePaid,
+			"cancelled_reminders": len(result.CancelledReminders),
+		})
+	}
+}
+
+func paymentWebhookJSON(cfg config.Config, orgID string, configured bool) fiber.Map {
+	base := strings.TrimRight(cfg.BaseURL, "/") + "/api/payment-webhooks/" + orgID + "/"
+	return fiber.Map{
+		"configured":  configured,
+		"stripe_url":  base + payments.ProviderStripe,
+		"generic_url": base + payments.ProviderGeneric,
+	}
+}
+
+func handleGetPaymentWebhook(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		orgID := orgIDFrom(c)
+		var secret string
+		if err := db.QueryRow(`SELECT payment_webhook_secret FROM organizations WHERE id = ?`, orgID).Scan(&secret); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.JSON(paymentWebhookJSON(cfg, orgID, secret != ""))
+	}
+}
+
+// handleSetPaymentWebhook stores the signing secret: the one Stripe shows
+// for the endpoint, or a generated one for the generic schema.
+func handleSetPaymentWebhook(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req paymentWebhookRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		secret := strings.TrimSpace(req.Secret)
+		if secret == "" {
+			var err error
+			if secret, err = services.NewWebhookSecret(); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "secret generation failed")
+			}
+		} else if len(secret) < minPaymentWebhookSecretLength {
+			return fiber.NewError(fiber.StatusBadRequest, "secret must be at least 16 characters")
+		}
+		orgID := orgIDFrom(c)
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(`UPDATE organizations SET payment_webhook_secret = ? WHERE id = ?`, secret, orgID); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if err := recordAudit(c, tx, cfg.Now(), services.AuditActionUpdate, "payment_webhook", orgID, nil, nil); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		resp := paymentWebhookJSON(cfg, orgID, true)
+		resp["secret"] = secret
+		return c.JSON(resp)
+	}
+}
+
+type paymentLinkRequest struct {
+	Refresh bool `json:"refresh"`
+}
+
+// handleCreatePaymentLink returns the invoice's payment link, creating one
+// when needed. refresh forces a new link, e.g. after the client lost theirs.
+func handleCreatePaymentLink(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if cfg.PaymentProvider == nil {
+			return fiber.NewError(fiber.StatusConflict, "payment links are not configured")
+		}
+		var req paymentLinkRequest
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&req); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+			}
+		}
+		orgID := orgIDFrom(c)
+		now := cfg.Now()
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		link, err := services.EnsurePaymentLink(tx, cfg.PaymentProvider, orgID, c.Params("id"), req.Refresh, now)
+		switch {
+		case err == sql.ErrNoRows:
+			return fiber.NewError(fiber.StatusNotFound, "invoice not found")
+		case err == services.ErrInvoiceAlreadyPaid:
+			return fiber.NewError(fiber.StatusConflict, "invoice is already paid")
+		case err != nil:
+			return fiber.NewError(fiber.StatusBadGateway, "payment provider error")
+		}
+		if link.Created {
+			after, err := snapshot(tx, "payment_links", orgID, link.ID)
+			if err != nil {
+				return err
+			}
+			if err := recordAudit(c, tx, now, services.AuditActionCreate, "payment_link", link.ID, nil, after); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.JSON(fiber.Map{
+			"id":           link.ID,
+			"provider":     link.Provider,
+			"url":          link.URL,
+			"amount_cents": link.AmountCents,
+			"currency":     link.Currency,
+			"status":       link.Status,
+			"expires_at":   nullIfEmpty(link.ExpiresAt),
+			"created_at":   link.CreatedAt,
+		})
+	}
+}
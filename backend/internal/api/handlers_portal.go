@@ -0,0 +1,333 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"nudgepay/internal/config"
+	"nudgepay/internal/services"
+)
+
+// Portal routes answer for the session's client only: every query below is
+// filtered on both org_id and client_id, and other invoices are "not found".
+
+type portalLoginRequest struct {
+	OrgID string `json:"org_id"`
+	Email string `json:"email"`
+}
+
+func handlePortalLogin(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req portalLoginRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		orgID := strings.TrimSpace(req.OrgID)
+		email := strings.TrimSpace(strings.ToLower(req.Email))
+		if orgID == "" || email == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "org_id and email required")
+		}
+		now := cfg.Now()
+		allowed, err := services.AllowEmailRequest(db, email, services.TokenPurposePortalLogin, now)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if !allowed {
+			return fiber.NewError(fiber.StatusTooManyRequests, "too many requests; try again later")
+		}
+		if err := services.RequestPortalLogin(db, orgID, email, cfg.BaseURL, now); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		// Same answer whether or not the address belongs to a client.
+		return c.SendStatus(fiber.StatusAccepted)
+	}
+}
+
+func handlePortalSession(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req tokenRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		if strings.TrimSpace(req.Token) == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "token required")
+		}
+		token, session, err := services.StartPortalSession(db, strings.TrimSpace(req.Token), cfg.Now())
+		if err != nil {
+			return accountTokenError(err)
+		}
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"token":      token,
+			"expires_at": session.ExpiresAt,
+			"client_id":  session.ClientID,
+			"org_id":     session.OrgID,
+		})
+	}
+}
+
+func handlePortalLogout(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if err := services.RevokePortalSession(db, portalSessionIDFrom(c), cfg.Now()); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func handlePortalMe(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var orgName, name, email, company string
+		if err := db.QueryRow(`SELECT o.name, c.name, c.email, c.company FROM clients c JOIN organizations o ON o.id = c.org_id
+			WHERE c.id = ? AND c.org_id = ?`, clientIDFrom(c), orgIDFrom(c)).Scan(&orgName, &name, &email, &company); err != nil {
+			if err == sql.ErrNoRows {
+				return fiber.NewError(fiber.StatusUnauthorized, "invalid portal token")
+			}
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.JSON(fiber.Map{
+			"org":    fiber.Map{"id": orgIDFrom(c), "name": orgName},
+			"client": fiber.Map{"id": clientIDFrom(c), "name": name, "email": email, "company": company},
+		})
+	}
+}
+
+const portalInvoiceQuery = `SELECT i.id, i.number, i.amount_cents,
+	COALESCE((SELECT SUM(p.amount_cents) FROM payments p WHERE p.invoice_id = i.id), 0),
+	i.currency, i.due_date, i.status, i.created_at
+	FROM invoices i WHERE i.org_id = ? AND i.client_id = ?`
+
+type portalInvoice struct {
+	ID, Number, Currency, DueDate, Status, CreatedAt string
+	AmountCents, PaidCents                           int64
+}
+
+func (inv portalInvoice) BalanceCents() int64 {
+	return balanceCents(inv.Status, inv.AmountCents, inv.PaidCents)
+}
+
+func (inv portalInvoice) JSON() fiber.Map {
+	return fiber.Map{
+		"id":            inv.ID,
+		"number":        inv.Number,
+		"amount_cents":  inv.AmountCents,
+		"paid_cents":    inv.AmountCents - inv.BalanceCents(),
+		"balance_cents": inv.BalanceCents(),
+		"currency":      inv.Currency,
+		"due_date":      inv.DueDate,
+		"status":        inv.Status,
+		"created_at":    inv.CreatedAt,
+	}
+}
+
+func scanPortalInvoice(row interface{ Scan(...interface{}) error }) (portalInvoice, error) {
+	var inv portalInvoice
+	err := row.Scan(&inv.ID, &inv.Number, &inv.AmountCents, &inv.PaidCents, &inv.Currency, &inv.DueDate, &inv.Status, &inv.CreatedAt)
+	return inv, err
+}
+
+func listPortalInvoices(db *sql.DB, orgID, clientID string) ([]portalInvoice, error) {
+	rows, err := db.Query(portalInvoiceQuery+` ORDER BY i.due_date, i.rowid`, orgID, clientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	invoices := make([]portalInvoice, 0)
+	for rows.Next() {
+		inv, err := scanPortalInvoice(rows)
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, inv)
+	}
+	return invoices, rows.Err()
+}
+
+// loadPortalInvoice returns a fiber 404 for invoices of other clients.
+func loadPortalInvoice(c *fiber.Ctx, db *sql.DB) (portalInvoice, error) {
+	inv, err := scanPortalInvoice(db.QueryRow(portalInvoiceQuery+` AND i.id = ?`, orgIDFrom(c), clientIDFrom(c), c.Params("id")))
+	if err == sql.ErrNoRows {
+		return portalInvoice{}, fiber.NewError(fiber.StatusNotFound, "invoice not found")
+	}
+	if err != nil {
+		return portalInvoice{}, fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	return inv, nil
+}
+
+// portalPayments lists the client's payments, limited to one invoice unless
+// invoiceID is empty.
+func portalPayments(db *sql.DB, orgID, clientID, invoiceID string) ([]fiber.Map, error) {
+	query := `SELECT p.id, p.invoice_id, i.number, p.amount_cents, p.currency, p.paid_at
+		FROM payments p JOIN invoices i ON i.id = p.invoice_id
+		WHERE p.org_id = ? AND i.org_id = ? AND i.client_id = ?`
+	args := []interface{}{orgID, orgID, clientID}
+	if invoiceID != "" {
+		query += ` AND i.id = ?`
+		args = append(args, invoiceID)
+	}
+	rows, err := db.Query(query+` ORDER BY p.paid_at DESC, p.rowid DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	payments := make([]fiber.Map, 0)
+	for rows.Next() {
+		var id, invID, number, currency, paidAt string
+		var amountCents int64
+		if err := rows.Scan(&id, &invID, &number, &amountCents, &currency, &paidAt); err != nil {
+			return nil, err
+		}
+		payments = append(payments, fiber.Map{
+			"id": id, "invoice_id": invID, "invoice_number": number,
+			"amount_cents": amountCents, "currency": currency, "paid_at": paidAt,
+		})
+	}
+	return payments, rows.Err()
+}
+
+// portalReminders is the client's reminder history: reminders actually
+// sent, not the org's schedule.
+func portalReminders(db *sql.DB, orgID, clientID, invoiceID string) ([]fiber.Map, error) {
+	query := `SELECT r.id, r.invoice_id, i.number, r.sent_at,
+		COALESCE((SELECT o.subject FROM outbox o WHERE o.reminder_id = r.id ORDER BY o.created_at DESC LIMIT 1), '')
+		FROM reminders r JOIN invoices i ON i.id = r.invoice_id
+		WHERE r.org_id = ? AND i.org_id = ? AND i.client_id = ? AND r.status = 'sent'`
+	args := []interface{}{orgID, orgID, clientID}
+	if invoiceID != "" {
+		query += ` AND i.id = ?`
+		args = append(args, invoiceID)
+	}
+	rows, err := db.Query(query+` ORDER BY r.sent_at DESC, r.rowid DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reminders := make([]fiber.Map, 0)
+	for rows.Next() {
+		var id, invID, number, subject string
+		var sentAt sql.NullString
+		if err := rows.Scan(&id, &invID, &number, &sentAt, &subject); err != nil {
+			return nil, err
+		}
+		reminders = append(reminders, fiber.Map{
+			"id": id, "invoice_id": invID, "invoice_number": number,
+			"sent_at": nullIfEmpty(sentAt.String), "subject": subject,
+		})
+	}
+	return reminders, rows.Err()
+}
+
+func handlePortalInvoices(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		invoices, err := listPortalInvoices(db, orgIDFrom(c), clientIDFrom(c))
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		resp := make([]fiber.Map, 0, len(invoices))
+		outstanding := map[string]int64{}
+		for _, inv := range invoices {
+			resp = append(resp, inv.JSON())
+			if balance := inv.BalanceCents(); balance > 0 {
+				outstanding[inv.Currency] += balance
+			}
+		}
+		return c.JSON(fiber.Map{"invoices": resp, "outstanding_cents": outstanding})
+	}
+}
+
+func handlePortalInvoice(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		inv, err := loadPortalInvoice(c, db)
+		if err != nil {
+			return err
+		}
+		payments, err := portalPayments(db, orgIDFrom(c), clientIDFrom(c), inv.ID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		reminders, err := portalReminders(db, orgIDFrom(c), clientIDFrom(c), inv.ID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		resp := inv.JSON()
+		resp["payments"] = payments
+		resp["reminders"] = reminders
+		return c.JSON(resp)
+	}
+}
+
+func handlePortalInvoicePDF(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		inv, err := loadPortalInvoice(c, db)
+		if err != nil {
+			return err
+		}
+		doc, err := loadPublicInvoice(db, orgIDFrom(c), inv.ID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		var pdf bytes.Buffer
+		if err := writeInvoicePDF(&pdf, doc); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "pdf failed")
+		}
+		c.Set(fiber.HeaderContentType, "application/pdf")
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="invoice-`+unsafeFilenameChars.ReplaceAllString(inv.Number, "_")+`.pdf"`)
+		return c.Send(pdf.Bytes())
+	}
+}
+
+func handlePortalPayments(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		payments, err := portalPayments(db, orgIDFrom(c), clientIDFrom(c), "")
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.JSON(fiber.Map{"payments": payments})
+	}
+}
+
+func handlePortalReminders(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		reminders, err := portalReminders(db, orgIDFrom(c), clientIDFrom(c), "")
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.JSON(fiber.Map{"reminders": reminders})
+	}
+}
+
+// handlePortalStatement is a CSV statement of account listing every invoice
+// of the client with what was paid and what is still due.
+func handlePortalStatement(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		invoices, err := listPortalInvoices(db, orgIDFrom(c), clientIDFrom(c))
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		_ = w.Write([]string{"invoice_number", "issued_on", "due_date", "status", "currency", "amount_cents", "paid_cents", "balance_cents"})
+		for _, inv := range invoices {
+			issuedOn := inv.CreatedAt
+			if len(issuedOn) >= 10 {
+				issuedOn = issuedOn[:10]
+			}
+			_ = w.Write([]string{csvCell(inv.Number), issuedOn, inv.DueDate, inv.Status, inv.Currency,
+				strconv.FormatInt(inv.AmountCents, 10),
+				strconv.FormatInt(inv.AmountCents-inv.BalanceCents(), 10),
+				strconv.FormatInt(inv.BalanceCents(), 10)})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "export failed")
+		}
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="statement-`+cfg.Now().UTC().Format("2006-01-02")+`.csv"`)
+		return c.Send(buf.Bytes())
+	}
+}
@@ -0,0 +1,240 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"html/template"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"nudgepay/internal/config"
+	"nudgepay/internal/services"
+)
+
+type publicPayment struct {
+	Amount string
+	PaidOn string
+}
+
+// publicInvoice is what a client may see of an invoice: no internal ids,
+// templates or reminder schedule.
+type publicInvoice struct {
+	orgID     string
+	invoiceID string
+
+	OrgName       string
+	Number        string
+	ClientName    string
+	ClientCompany string
+	AmountCents   int64
+	PaidCents     int64
+	Currency      string
+	DueDate       string
+	Status        string
+	Notes         string
+	CreatedAt     string
+	Payments      []publicPayment
+	PaymentURL    string
+	PDFURL        string
+}
+
+func (inv publicInvoice) BilledTo() string {
+	if company := strings.TrimSpace(inv.ClientCompany); company != "" && company != "-" {
+		return inv.ClientName + ", " + company
+	}
+	return inv.ClientName
+}
+
+func (inv publicInvoice) IssuedOn() string {
+	if len(inv.CreatedAt) >= 10 {
+		return inv.CreatedAt[:10]
+	}
+	return inv.CreatedAt
+}
+
+func (inv publicInvoice) BalanceCents() int64 {
+	return balanceCents(inv.Status, inv.AmountCents, inv.PaidCents)
+}
+
+func (inv publicInvoice) Amount() string {
+	return services.FormatAmount(inv.AmountCents, inv.Currency)
+}
+
+func (inv publicInvoice) Paid() string {
+	return services.FormatAmount(inv.AmountCents-inv.BalanceCents(), inv.Currency)
+}
+
+func (inv publicInvoice) Balance() string {
+	return services.FormatAmount(inv.BalanceCents(), inv.Currency)
+}
+
+// balanceCents is what is left to pay. Invoices marked paid by hand owe
+// nothing even without recorded payments.
+func balanceCents(status string, amountCents, paidCents int64) int64 {
+	if status == "paid" || paidCents >= amountCents {
+		return 0
+	}
+	return amountCents - paidCents
+}
+
+func loadPublicInvoice(db *sql.DB, orgID, invoiceID string) (publicInvoice, error) {
+	var inv publicInvoice
+	if err := db.QueryRow(`SELECT o.name, i.number, c.name, c.company, i.amount_cents, i.currency, i.due_date, i.status, i.notes, i.created_at
+		FROM invoices i JOIN clients c ON c.id = i.client_id JOIN organizations o ON o.id = i.org_id
+		WHERE i.id = ? AND i.org_id = ?`, invoiceID, orgID).
+		Scan(&inv.OrgName, &inv.Number, &inv.ClientName, &inv.ClientCompany, &inv.AmountCents, &inv.Currency,
+			&inv.DueDate, &inv.Status, &inv.Notes, &inv.CreatedAt); err != nil {
+		return publicInvoice{}, err
+	}
+	rows, err := db.Query(`SELECT amount_cents, paid_at FROM payments WHERE invoice_id = ? AND org_id = ? ORDER BY paid_at`, invoiceID, orgID)
+	if err != nil {
+		return publicInvoice{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var amountCents int64
+		var paidAt string
+		if err := rows.Scan(&amountCents, &paidAt); err != nil {
+			return publicInvoice{}, err
+		}
+		inv.PaidCents += amountCents
+		if len(paidAt) >= 10 {
+			paidAt = paidAt[:10]
+		}
+		inv.Payments = append(inv.Payments, publicPayment{Amount: services.FormatAmount(amountCents, inv.Currency), PaidOn: paidAt})
+	}
+	return inv, rows.Err()
+}
+
+var publicInvoicePage = template.Must(template.New("invoice").Parse(`<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Invoice {{.Number}} from {{.OrgName}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 40rem; margin: 3rem auto; padding: 0 1rem; color: #1f2937; }
+table { width: 100%; border-collapse: collapse; margin: 1.5rem 0; }
+td { padding: .4rem 0; border-bottom: 1px solid #e5e7eb; }
+td:last-child { text-align: right; }
+.balance td { font-weight: 600; font-size: 1.15rem; }
+.actions a { display: inline-block; margin-right: 1rem; padding: .6rem 1.2rem; border-radius: .4rem; text-decoration: none; }
+.pay { background: #2563eb; color: #fff; }
+.pdf { border: 1px solid #2563eb; color: #2563eb; }
+</style>
+</head>
+<body>
+<p>{{.OrgName}}</p>
+<h1>Invoice {{.Number}}</h1>
+<p>Billed to {{.BilledTo}} · Issued {{.IssuedOn}} · Due {{.DueDate}}</p>
+<table>
+<tr><td>Amount</td><td>{{.Amount}}</td></tr>
+{{range .Payments}}<tr><td>Payment on {{.PaidOn}}</td><td>{{.Amount}}</td></tr>
+{{end}}<tr class="balance"><td>Balance due</td><td>{{.Balance}}</td></tr>
+</table>
+{{if .Notes}}<p>{{.Notes}}</p>{{end}}
+<p class="actions">
+{{if .PaymentURL}}<a class="pay" href="{{.PaymentURL}}">Pay {{.Balance}}</a>{{end}}
+<a class="pdf" href="{{.PDFURL}}">Download PDF</a>
+</p>
+{{if eq .BalanceCents 0}}<p>This invoice is paid. Thank you!</p>{{end}}
+</body>
+</html>
+`))
+
+var publicErrorPage = template.Must(template.New("error").Parse(`<!doctype html>
+<html lang="en">
+<head><meta charset="utf-8"><meta name="robots" content="noindex"><title>Invoice unavailable</title></head>
+<body style="font-family: system-ui, sans-serif; max-width: 40rem; margin: 3rem auto;">
+<h1>Invoice unavailable</h1>
+<p>{{.}}</p>
+</body>
+</html>
+`))
+
+// resolvePublicInvoice loads the invoice a /pay token opens.
+func resolvePublicInvoice(c *fiber.Ctx, db *sql.DB, cfg config.Config) (publicInvoice, error) {
+	// The token is a credential: keep it out of caches and referrers.
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set(fiber.HeaderReferrerPolicy, "no-referrer")
+	c.Set("X-Robots-Tag", "noindex")
+
+	orgID, invoiceID, err := services.ResolveInvoiceShareLink(db, c.Params("token"), cfg.Now())
+	switch {
+	case err == services.ErrTokenInvalid:
+		return publicInvoice{}, fiber.NewError(fiber.StatusNotFound, "This link is not valid. Ask the sender for a new one.")
+	case err == services.ErrTokenExpired:
+		return publicInvoice{}, fiber.NewError(fiber.StatusGone, "This link has expired. Ask the sender for a new one.")
+	case err != nil:
+		return publicInvoice{}, fiber.NewError(fiber.StatusInternalServerError, "Something went wrong. Please try again later.")
+	}
+	inv, err := loadPublicInvoice(db, orgID, invoiceID)
+	if err == sql.ErrNoRows {
+		return publicInvoice{}, fiber.NewError(fiber.StatusNotFound, "This link is not valid. Ask the sender for a new one.")
+	}
+	if err != nil {
+		return publicInvoice{}, fiber.NewError(fiber.StatusInternalServerError, "Something went wrong. Please try again later.")
+	}
+	inv.orgID, inv.invoiceID = orgID, invoiceID
+	return inv, nil
+}
+
+// renderPublicError shows err as a page rather than the API's JSON, since
+// clients open these links in a browser.
+func renderPublicError(c *fiber.Ctx, err error) error {
+	status, message := fiber.StatusInternalServerError, "Something went wrong. Please try again later."
+	if e, ok := err.(*fiber.Error); ok {
+		status, message = e.Code, e.Message
+	}
+	var page bytes.Buffer
+	if err := publicErrorPage.Execute(&page, message); err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return c.Status(status).Send(page.Bytes())
+}
+
+func handlePublicInvoice(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		inv, err := resolvePublicInvoice(c, db, cfg)
+		if err != nil {
+			return renderPublicError(c, err)
+		}
+		inv.PDFURL = services.InvoiceURL(cfg.BaseURL, c.Params("token")) + "/pdf"
+		if cfg.PaymentProvider != nil && inv.BalanceCents() > 0 {
+			// Anyone with the URL can load the page, so it only shows a link
+			// a reminder or staff already created and never calls the
+			// provider itself.
+			if link, err := services.OpenPaymentLink(db, cfg.PaymentProvider, inv.orgID, inv.invoiceID, cfg.Now()); err == nil {
+				inv.PaymentURL = link.URL
+			}
+		}
+		var page bytes.Buffer
+		if err := publicInvoicePage.Execute(&page, inv); err != nil {
+			return renderPublicError(c, err)
+		}
+		c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+		return c.Send(page.Bytes())
+	}
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func handlePublicInvoicePDF(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		inv, err := resolvePublicInvoice(c, db, cfg)
+		if err != nil {
+			return renderPublicError(c, err)
+		}
+		var pdf bytes.Buffer
+		if err := writeInvoicePDF(&pdf, inv); err != nil {
+			return renderPublicError(c, err)
+		}
+		c.Set(fiber.HeaderContentType, "application/pdf")
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="invoice-`+unsafeFilenameChars.ReplaceAllString(inv.Number, "_")+`.pdf"`)
+		return c.Send(pdf.Bytes())
+	}
+}
@@ -2,27 +2,47 @@ package api
 
 import (
 	"database/sql"
+	"errors"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 
+	"nudgepay/internal/config"
 	"nudgepay/internal/services"
 )
 
+var reminderListSpec = listSpec{
+	sorts:       map[string]string{"scheduled_for": "r.scheduled_for", "invoice_number": "i.number"},
+	defaultSort: "scheduled_for",
+	idColumn:    "r.id",
+}
+
+// filterReminders adds the list filters to a query over reminders aliased r.
+func filterReminders(c *fiber.Ctx, query string, args []interface{}) (string, []interface{}, error) {
+	for param, column := range map[string]string{"status": "r.status", "invoice_id": "r.invoice_id"} {
+		if value := strings.TrimSpace(c.Query(param)); value != "" {
+			query += " AND " + column + " = ?"
+			args = append(args, value)
+		}
+	}
+	return addTimeRange(c, "r.scheduled_for", "from", "to", query, args)
+}
+
 func handleListReminders(db *sql.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		orgID := orgIDFrom(c)
-		status := strings.TrimSpace(c.Query("status"))
-		query := `SELECT r.id, r.invoice_id, r.scheduled_for, r.sent_at, r.status, i.number
+		p, err := parsePage(c, reminderListSpec)
+		if err != nil {
+			return err
+		}
+		query, args, err := filterReminders(c, `SELECT r.id, r.invoice_id, r.scheduled_for, r.sent_at, r.status, i.number
 			FROM reminders r JOIN invoices i ON r.invoice_id = i.id
-			WHERE r.org_id = ?`
-		args := []interface{}{orgID}
-		if status != "" {
-			query += " AND r.status = ?"
-			args = append(args, status)
+			WHERE r.org_id = ?`, []interface{}{orgID})
+		if err != nil {
+			return err
 		}
-		query += " ORDER BY r.scheduled_for ASC"
+		query, args = p.apply(query, args)
 
 		rows, err := db.Query(query, args...)
 		if err != nil {
@@ -47,32 +67,114 @@ func handleListReminders(db *sql.DB) fiber.Handler {
 			})
 		}
 
-		return c.JSON(fiber.Map{"reminders": reminders})
+		reminders, next := p.finish(reminders)
+		return c.JSON(fiber.Map{"reminders": reminders, "next_cursor": next})
 	}
 }
 
-func handleSendReminder(db *sql.DB) fiber.Handler {
+func reminderLinks(cfg config.Config) services.ReminderLinks {
+	return services.ReminderLinks{BaseURL: cfg.BaseURL, Payments: cfg.PaymentProvider}
+}
+
+func handleSendReminder(db *sql.DB, cfg config.Config) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		orgID := orgIDFrom(c)
 		reminderID := c.Params("id")
-		sent, err := services.SendReminderByID(db, orgID, reminderID, time.Now().UTC())
+		now := cfg.Now()
+		before, err := snapshot(db, "reminders", orgID, reminderID)
+		if err != nil {
+			return err
+		}
+		status, err := services.SendReminderByID(db, reminderLinks(cfg), orgID, reminderID, now, func(tx *sql.Tx, id string) error {
+			after, err := snapshot(tx, "reminders", orgID, id)
+			if err != nil {
+				return err
+			}
+			return recordAudit(c, tx, now, services.AuditActionSend, "reminder", id, before, after)
+		})
+		linkFailures, err := paymentLinkFailures(err)
 		if err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "send failed")
 		}
-		if !sent {
+		if status == "" {
 			return fiber.NewError(fiber.StatusNotFound, "reminder not found or already sent")
 		}
-		return c.JSON(fiber.Map{"id": reminderID, "status": "sent"})
+		return c.JSON(fiber.Map{"id": reminderID, "status": status, "payment_link_failed": linkFailures > 0})
 	}
 }
 
-func handleSendDueReminders(db *sql.DB) fiber.Handler {
+func handleSendDueReminders(db *sql.DB, cfg config.Config) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		orgID := orgIDFrom(c)
-		sent, err := services.SendDueReminders(db, orgID, time.Now().UTC())
+		now := cfg.Now()
+		due, err := dueReminderSnapshots(db, orgID, now)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		suppressed := 0
+		sent, err := services.SendDueReminders(db, reminderLinks(cfg), orgID, now, func(tx *sql.Tx, id string) error {
+			after, err := snapshot(tx, "reminders", orgID, id)
+			if err != nil {
+				return err
+			}
+			if after["status"] == services.ReminderSuppressed {
+				suppressed++
+			}
+			return recordAudit(c, tx, now, services.AuditActionSend, "reminder", id, due[id], after)
+		})
+		linkFailures, err := paymentLinkFailures(err)
 		if err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "send failed")
 		}
-		return c.JSON(fiber.Map{"sent": sent})
+		return c.JSON(fiber.Map{"sent": sent, "suppressed": suppressed, "payment_link_failures": linkFailures})
+	}
+}
+
+// paymentLinkFailures counts the reminders a send reported as gone out
+// without their payment link, and returns any other error as is.
+func paymentLinkFailures(err error) (int, error) {
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	failures := 0
+	for _, e := range errs {
+		var linkErr *services.PaymentLinkError
+		if e == nil {
+			continue
+		}
+		if !errors.As(e, &linkErr) {
+			return failures, err
+		}
+		failures++
+	}
+	return failures, nil
+}
+
+func dueReminderSnapshots(db *sql.DB, orgID string, now time.Time) (map[string]map[string]interface{}, error) {
+	rows, err := db.Query(`SELECT id FROM reminders WHERE org_id = ? AND status = 'scheduled' AND scheduled_for <= ?`,
+		orgID, now.Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	due := make(map[string]map[string]interface{}, len(ids))
+	for _, id := range ids {
+		row, err := services.AuditSnapshot(db, `SELECT * FROM reminders WHERE id = ? AND org_id = ?`, id, orgID)
+		if err != nil {
+			return nil, err
+		}
+		due[id] = row
 	}
+	return due, nil
 }
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"nudgepay/internal/services"
+)
+
+const (
+	searchDefaultLimit = 20
+	searchMaxLimit     = 50
+)
+
+func handleSearch(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		q := strings.TrimSpace(c.Query("q"))
+		if services.SearchMatchQuery(q) == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "q is required")
+		}
+		var kinds []string
+		if raw := strings.TrimSpace(c.Query("type")); raw != "" {
+			for _, kind := range strings.Split(raw, ",") {
+				kind = strings.TrimSpace(kind)
+				known := false
+				for _, k := range services.SearchKinds {
+					known = known || k == kind
+				}
+				if !known {
+					return fiber.NewError(fiber.StatusBadRequest, "type must be client, invoice or outbox")
+				}
+				kinds = append(kinds, kind)
+			}
+		}
+		limit := searchDefaultLimit
+		if raw := c.Query("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n <= 0 {
+				return fiber.NewError(fiber.StatusBadRequest, "limit must be a positive integer")
+			}
+			if n > searchMaxLimit {
+				n = searchMaxLimit
+			}
+			limit = n
+		}
+
+		results, err := services.Search(db, orgIDFrom(c), q, kinds, limit)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		out := make([]fiber.Map, 0, len(results))
+		for _, r := range results {
+			out = append(out, fiber.Map{
+				"type":      r.Kind,
+				"id":        r.ResourceID,
+				"title":     r.Title,
+				"highlight": r.Highlight,
+				"snippet":   r.Snippet,
+				"score":     r.Score,
+			})
+		}
+		return c.JSON(fiber.Map{"results": out})
+	}
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"nudgepay/internal/auth"
+	"nudgepay/internal/config"
+	"nudgepay/internal/services"
+)
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func issueSession(c *fiber.Ctx, db *sql.DB, cfg config.Config, userID, orgID, authMethod string) (fiber.Map, error) {
+	sessionID, refreshToken, err := services.CreateSession(db, userID, orgID, authMethod, c.Get(fiber.HeaderUserAgent), c.IP(), cfg.Now())
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	return tokenResponse(cfg, userID, orgID, sessionID, refreshToken)
+}
+
+func tokenResponse(cfg config.Config, userID, orgID, sessionID, refreshToken string) (fiber.Map, error) {
+	token, err := auth.GenerateToken(cfg.TokenKeys(), userID, orgID, sessionID)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "token error")
+	}
+	return fiber.Map{
+		"token":         token,
+		"refresh_token": refreshToken,
+		"expires_in":    int(auth.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+func handleRefresh(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req refreshRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		req.RefreshToken = strings.TrimSpace(req.RefreshToken)
+		if req.RefreshToken == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "refresh_token required")
+		}
+		result, err := services.RotateRefreshToken(db, req.RefreshToken, cfg.Now())
+		if err != nil {
+			if errors.Is(err, services.ErrRefreshTokenReused) {
+				return fiber.NewError(fiber.StatusUnauthorized, "refresh token reuse detected; session revoked")
+			}
+			if errors.Is(err, services.ErrRefreshTokenInvalid) {
+				return fiber.NewError(fiber.StatusUnauthorized, "invalid refresh token")
+			}
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		resp, err := tokenResponse(cfg, result.UserID, result.OrgID, result.SessionID, result.RefreshToken)
+		if err != nil {
+			return err
+		}
+		return c.JSON(resp)
+	}
+}
+
+func handleLogout(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if err := revokeSession(c, db, cfg, sessionIDFrom(c)); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func handleListSessions(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := userIDFrom(c)
+		current := sessionIDFrom(c)
+		rows, err := db.Query(`SELECT id, user_agent, ip, created_at, last_used_at, expires_at FROM sessions
+			WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ? ORDER BY last_used_at DESC`,
+			userID, cfg.Now().Format(time.RFC3339))
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer rows.Close()
+
+		sessions := make([]fiber.Map, 0)
+		for rows.Next() {
+			var id, userAgent, ip, createdAt, lastUsedAt, expiresAt string
+			if err := rows.Scan(&id, &userAgent, &ip, &createdAt, &lastUsedAt, &expiresAt); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "db error")
+			}
+			sessions = append(sessions, fiber.Map{
+				"id":           id,
+				"user_agent":   userAgent,
+				"ip":           ip,
+				"created_at":   createdAt,
+				"last_used_at": lastUsedAt,
+				"expires_at":   expiresAt,
+				"current":      id == current,
+			})
+		}
+		return c.JSON(fiber.Map{"sessions": sessions})
+	}
+}
+
+func handleRevokeSession(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if err := revokeSession(c, db, cfg, c.Params("id")); err != nil {
+			if err == sql.ErrNoRows {
+				return fiber.NewError(fiber.StatusNotFound, "session not found")
+			}
+			return err
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// revokeSession ends one of the caller's sessions and logs it in their
+// current org. It returns sql.ErrNoRows when the session is unknown or
+// already revoked.
+func revokeSession(c *fiber.Ctx, db *sql.DB, cfg config.Config, sessionID string) error {
+	now := cfg.Now()
+	tx, err := db.Begin()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	defer tx.Rollback()
+
+	const query = `SELECT id, org_id, auth_method, user_agent, ip, created_at, revoked_at FROM sessions WHERE id = ? AND user_id = ?`
+	before, err := services.AuditSnapshot(tx, query, sessionID, userIDFrom(c))
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	revoked, err := services.RevokeSession(tx, userIDFrom(c), sessionID, now)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	if !revoked {
+		return sql.ErrNoRows
+	}
+	after, err := services.AuditSnapshot(tx, query, sessionID, userIDFrom(c))
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	if err := recordAudit(c, tx, now, services.AuditActionDelete, "session", sessionID, before, after); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	return nil
+}
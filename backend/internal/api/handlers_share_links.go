@@ -0,0 +1,146 @@
+package api
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"nudgepay/internal/config"
+	"nudgepay/internal/services"
+)
+
+type shareLinkRequest struct {
+	ExpiresAt string `json:"expires_at"`
+}
+
+func shareLinkJSON(link services.InvoiceShareLink) fiber.Map {
+	return fiber.Map{
+		"id":             link.ID,
+		"invoice_id":     link.InvoiceID,
+		"created_by":     nullIfEmpty(link.CreatedBy),
+		"created_at":     link.CreatedAt,
+		"expires_at":     nullIfEmpty(link.ExpiresAt),
+		"revoked_at":     nullIfEmpty(link.RevokedAt),
+		"last_viewed_at": nullIfEmpty(link.LastViewedAt),
+	}
+}
+
+func invoiceExists(db *sql.DB, orgID, invoiceID string) error {
+	var id string
+	if err := db.QueryRow(`SELECT id FROM invoices WHERE id = ? AND org_id = ?`, invoiceID, orgID).Scan(&id); err != nil {
+		if err == sql.ErrNoRows {
+			return fiber.NewError(fiber.StatusNotFound, "invoice not found")
+		}
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	return nil
+}
+
+func handleListShareLinks(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		orgID := orgIDFrom(c)
+		invoiceID := c.Params("id")
+		if err := invoiceExists(db, orgID, invoiceID); err != nil {
+			return err
+		}
+		links, err := services.ListInvoiceShareLinks(db, orgID, invoiceID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		resp := make([]fiber.Map, 0, len(links))
+		for _, link := range links {
+			resp = append(resp, shareLinkJSON(link))
+		}
+		return c.JSON(fiber.Map{"share_links": resp})
+	}
+}
+
+// handleCreateShareLink issues a link to the public invoice page. The URL
+// holds the token, so it is only returned here.
+func handleCreateShareLink(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req shareLinkRequest
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&req); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+			}
+		}
+		now := cfg.Now()
+		var expiresAt *time.Time
+		if req.ExpiresAt != "" {
+			parsed, err := time.Parse(time.RFC3339, req.ExpiresAt)
+			if err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, "expires_at must be RFC3339")
+			}
+			if !parsed.After(now) {
+				return fiber.NewError(fiber.StatusBadRequest, "expires_at must be in the future")
+			}
+			expiresAt = &parsed
+		}
+		orgID := orgIDFrom(c)
+		invoiceID := c.Params("id")
+		if err := invoiceExists(db, orgID, invoiceID); err != nil {
+			return err
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		token, link, err := services.CreateInvoiceShareLink(tx, orgID, invoiceID, userIDFrom(c), expiresAt, now)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		after, err := snapshot(tx, "invoice_share_links", orgID, link.ID)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(c, tx, now, services.AuditActionCreate, "invoice_share_link", link.ID, nil, after); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		resp := shareLinkJSON(link)
+		resp["url"] = services.InvoiceURL(cfg.BaseURL, token)
+		return c.Status(fiber.StatusCreated).JSON(resp)
+	}
+}
+
+func handleRevokeShareLink(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		orgID := orgIDFrom(c)
+		id := c.Params("link_id")
+		now := cfg.Now()
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		before, err := snapshot(tx, "invoice_share_links", orgID, id)
+		if err != nil {
+			return err
+		}
+		revoked, err := services.RevokeInvoiceShareLink(tx, orgID, c.Params("id"), id, now)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if !revoked {
+			return fiber.NewError(fiber.StatusNotFound, "share link not found")
+		}
+		after, err := snapshot(tx, "invoice_share_links", orgID, id)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(c, tx, now, services.AuditActionUpdate, "invoice_share_link", id, before, after); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
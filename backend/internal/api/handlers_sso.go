@@ -0,0 +1,128 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"nudgepay/internal/auth"
+	"nudgepay/internal/config"
+	"nudgepay/internal/services"
+	"nudgepay/internal/sso"
+)
+
+type ssoCallbackRequest struct {
+	State string `json:"state"`
+	Code  string `json:"code"`
+}
+
+// ssoRedirectURI is the frontend page the provider sends users back to. It
+// posts the code and state to handleSSOCallback.
+func ssoRedirectURI(cfg config.Config) string {
+	return strings.TrimRight(cfg.BaseURL, "/") + "/sso/callback"
+}
+
+func handleSSOProviders(cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		names := make([]string, 0, len(cfg.OIDCProviders))
+		for _, p := range cfg.OIDCProviders {
+			names = append(names, p.Name)
+		}
+		return c.JSON(fiber.Map{"providers": names})
+	}
+}
+
+func handleSSOStart(db *sql.DB, cfg config.Config, client *sso.Client) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		provider, ok := cfg.OIDCProvider(c.Params("provider"))
+		if !ok {
+			return fiber.NewError(fiber.StatusNotFound, "unknown provider")
+		}
+		verifier, challenge, err := sso.NewPKCE()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "token error")
+		}
+		nonce, _, err := auth.NewOpaqueToken()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "token error")
+		}
+		state, err := services.CreateSSOState(db, provider.Name, nonce, verifier, cfg.Now())
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		authURL, err := client.AuthorizationURL(provider, ssoRedirectURI(cfg), state, nonce, challenge)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadGateway, "identity provider unavailable")
+		}
+		return c.JSON(fiber.Map{"authorization_url": authURL})
+	}
+}
+
+func handleSSOCallback(db *sql.DB, cfg config.Config, client *sso.Client) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req ssoCallbackRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		if strings.TrimSpace(req.State) == "" || strings.TrimSpace(req.Code) == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "state and code required")
+		}
+		now := cfg.Now()
+		state, err := services.ConsumeSSOState(db, strings.TrimSpace(req.State), now)
+		if err != nil {
+			return accountTokenError(err)
+		}
+		provider, ok := cfg.OIDCProvider(state.Provider)
+		if !ok {
+			return fiber.NewError(fiber.StatusNotFound, "unknown provider")
+		}
+		idToken, err := client.Exchange(provider, strings.TrimSpace(req.Code), ssoRedirectURI(cfg), state.CodeVerifier)
+		if err != nil {
+			return fiber.NewError(fiber.StatusUnauthorized, "sign-in with provider failed")
+		}
+		identity, err := client.VerifyIDToken(provider, idToken, state.Nonce, now)
+		if err != nil {
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid id token")
+		}
+		userID, err := services.ResolveSSOUser(db, provider.Name, identity, now)
+		if err != nil {
+			switch {
+			case errors.Is(err, services.ErrSSOEmailUnverified):
+				return fiber.NewError(fiber.StatusForbidden, "provider has not verified this email address")
+			case errors.Is(err, services.ErrSSOUnknownUser):
+				return fiber.NewError(fiber.StatusForbidden, "no account for this email address")
+			}
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		orgID, err := loginOrg(db, userID, services.AuthMethodSSO)
+		if err != nil {
+			return err
+		}
+		// Accounts with TOTP get the same second step as password logins
+		// unless the org has chosen to trust its provider's second factor.
+		enabled, err := services.TwoFactorEnabled(db, userID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if enabled {
+			skip, err := services.SSOSkipsTwoFactor(db, orgID)
+			if err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "db error")
+			}
+			if !skip {
+				challenge, err := services.StartMFAChallenge(db, userID, services.AuthMethodSSO, now)
+				if err != nil {
+					return fiber.NewError(fiber.StatusInternalServerError, "db error")
+				}
+				return c.JSON(fiber.Map{"two_factor_required": true, "mfa_token": challenge})
+			}
+		}
+		resp, err := issueSession(c, db, cfg, userID, orgID, services.AuthMethodSSO)
+		if err != nil {
+			return err
+		}
+		return c.JSON(resp)
+	}
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"html/template"
+	"net/mail"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"nudgepay/internal/config"
+	"nudgepay/internal/services"
+)
+
+type suppressionRequest struct {
+	Email  string `json:"email"`
+	Reason string `json:"reason"`
+	Note   string `json:"note"`
+}
+
+func suppressionJSON(s services.Suppression) fiber.Map {
+	return fiber.Map{
+		"id":         s.ID,
+		"email":      s.Email,
+		"reason":     s.Reason,
+		"note":       s.Note,
+		"created_by": nullIfEmpty(s.CreatedBy),
+		"created_at": s.CreatedAt,
+	}
+}
+
+func handleListSuppressions(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		reason := strings.TrimSpace(c.Query("reason"))
+		if reason != "" && !services.ValidSuppressionReason(reason) {
+			return fiber.NewError(fiber.StatusBadRequest, "reason must be one of "+strings.Join(services.SuppressionReasons, ", "))
+		}
+		list, err := services.ListSuppressions(db, orgIDFrom(c), strings.TrimSpace(c.Query("email")), reason)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		resp := make([]fiber.Map, 0, len(list))
+		for _, s := range list {
+			resp = append(resp, suppressionJSON(s))
+		}
+		return c.JSON(fiber.Map{"suppressions": resp})
+	}
+}
+
+func handleCreateSuppression(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req suppressionRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		email := strings.TrimSpace(req.Email)
+		if _, err := mail.ParseAddress(email); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "valid email required")
+		}
+		if req.Reason == "" {
+			req.Reason = services.SuppressionManual
+		}
+		if !services.ValidSuppressionReason(req.Reason) {
+			return fiber.NewError(fiber.StatusBadRequest, "reason must be one of "+strings.Join(services.SuppressionReasons, ", "))
+		}
+		orgID := orgIDFrom(c)
+		now := cfg.Now()
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		s, err := services.Suppress(tx, orgID, email, req.Reason, strings.TrimSpace(req.Note), userIDFrom(c), now)
+		if err == services.ErrAlreadySuppressed {
+			return fiber.NewError(fiber.StatusConflict, "email is already suppressed")
+		}
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		after, err := snapshot(tx, "email_suppressions", orgID, s.ID)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(c, tx, now, services.AuditActionCreate, "suppression", s.ID, nil, after); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.Status(fiber.StatusCreated).JSON(suppressionJSON(s))
+	}
+}
+
+// handleDeleteSuppression lets reminders reach the address again, for
+// instance after a bounce was fixed.
+func handleDeleteSuppression(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		orgID := orgIDFrom(c)
+		id := c.Params("id")
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		before, err := snapshot(tx, "email_suppressions", orgID, id)
+		if err != nil {
+			return err
+		}
+		deleted, err := services.DeleteSuppression(tx, orgID, id)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if !deleted {
+			return fiber.NewError(fiber.StatusNotFound, "suppression not found")
+		}
+		if err := recordAudit(c, tx, cfg.Now(), services.AuditActionDelete, "suppression", id, before, nil); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+type unsubscribeView struct {
+	OrgName string
+	Email   string
+	Done    bool
+	Message string
+}
+
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Unsubscribe</title>
+</head>
+<body style="font-family: system-ui, sans-serif; max-width: 40rem; margin: 3rem auto; padding: 0 1rem;">
+{{if .Message}}<h1>Link unavailable</h1>
+<p>{{.Message}}</p>
+{{else if .Done}}<h1>You are unsubscribed</h1>
+<p>{{.OrgName}} will no longer send payment reminders to {{.Email}}.</p>
+{{else}}<h1>Unsubscribe</h1>
+<p>Stop payment reminders from {{.OrgName}} to {{.Email}}?</p>
+<form method="post"><input type="hidden" name="List-Unsubscribe" value="One-Click"><button type="submit">Unsubscribe</button></form>
+{{end}}</body>
+</html>
+`))
+
+func renderUnsubscribePage(c *fiber.Ctx, status int, view unsubscribeView) error {
+	var page bytes.Buffer
+	if err := unsubscribePage.Execute(&page, view); err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return c.Status(status).Send(page.Bytes())
+}
+
+// resolveUnsubscribe returns the org and address an unsubscribe token
+// refers to.
+func resolveUnsubscribe(c *fiber.Ctx, db *sql.DB) (string, unsubscribeView, error) {
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set(fiber.HeaderReferrerPolicy, "no-referrer")
+	c.Set("X-Robots-Tag", "noindex")
+
+	orgID, email, err := services.ResolveUnsubscribeToken(db, c.Params("token"))
+	if err == services.ErrTokenInvalid {
+		return "", unsubscribeView{}, fiber.NewError(fiber.StatusNotFound, "This unsubscribe link is not valid.")
+	}
+	if err != nil {
+		return "", unsubscribeView{}, err
+	}
+	view := unsubscribeView{Email: email}
+	if err := db.QueryRow(`SELECT name FROM organizations WHERE id = ?`, orgID).Scan(&view.OrgName); err != nil {
+		return "", unsubscribeView{}, err
+	}
+	return orgID, view, nil
+}
+
+func renderUnsubscribeError(c *fiber.Ctx, err error) error {
+	status, message := fiber.StatusInternalServerError, "Something went wrong. Please try again later."
+	if e, ok := err.(*fiber.Error); ok {
+		status, message = e.Code, e.Message
+	}
+	return renderUnsubscribePage(c, status, unsubscribeView{Message: message})
+}
+
+// handleUnsubscribePage only asks for confirmation: link scanners fetch
+// URLs in emails, so a GET must not unsubscribe anyone.
+func handleUnsubscribePage(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		orgID, view, err := resolveUnsubscribe(c, db)
+		if err != nil {
+			return renderUnsubscribeError(c, err)
+		}
+		if view.Done, err = services.IsSuppressed(db, orgID, view.Email); err != nil {
+			return renderUnsubscribeError(c, err)
+		}
+		return renderUnsubscribePage(c, fiber.StatusOK, view)
+	}
+}
+
+// handleUnsubscribe is the RFC 8058 one-click endpoint mail clients POST
+// "List-Unsubscribe=One-Click" to, and the target of the confirmation form.
+// Repeating it is harmless.
+func handleUnsubscribe(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		orgID, view, err := resolveUnsubscribe(c, db)
+		if err != nil {
+			return renderUnsubscribeError(c, err)
+		}
+		now := cfg.Now()
+		tx, err := db.Begin()
+		if err != nil {
+			return renderUnsubscribeError(c, err)
+		}
+		defer tx.Rollback()
+
+		s, err := services.Suppress(tx, orgID, view.Email, services.SuppressionUnsubscribe, "", "", now)
+		switch {
+		case err == services.ErrAlreadySuppressed:
+		case err != nil:
+			return renderUnsubscribeError(c, err)
+		default:
+			after, err := services.AuditSnapshot(tx, `SELECT * FROM email_suppressions WHERE id = ? AND org_id = ?`, s.ID, orgID)
+			if err != nil {
+				return renderUnsubscribeError(c, err)
+			}
+			if err := services.RecordAudit(tx, services.AuditEntry{
+				OrgID: orgID, Action: services.AuditActionCreate, ResourceType: "suppression", ResourceID: s.ID, IP: c.IP(),
+			}, nil, after, now); err != nil {
+				return renderUnsubscribeError(c, err)
+			}
+			if err := tx.Commit(); err != nil {
+				return renderUnsubscribeError(c, err)
+			}
+		}
+		view.Done = true
+		return renderUnsubscribePage(c, fiber.StatusOK, view)
+	}
+}
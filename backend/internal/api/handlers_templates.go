@@ -7,18 +7,29 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
+
+	"nudgepay/internal/config"
+	"nudgepay/internal/services"
 )
 
 type templatePayload struct {
-	Name    string `json:"name"`
-	Subject string `json:"subject"`
-	Body    string `json:"body"`
+	Name     string                   `json:"name"`
+	Subject  string                   `json:"subject"`
+	Body     string                   `json:"body"`
+	Language string                   `json:"language"`
+	Variants []templateVariantPayload `json:"variants"`
+}
+
+type templateVariantPayload struct {
+	Language string `json:"language"`
+	Subject  string `json:"subject"`
+	Body     string `json:"body"`
 }
 
 func handleListTemplates(db *sql.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		orgID := orgIDFrom(c)
-		rows, err := db.Query(`SELECT id, name, subject, body, created_at, updated_at FROM templates WHERE org_id = ? ORDER BY created_at DESC`, orgID)
+		rows, err := db.Query(`SELECT id, name, subject, body, language, is_default, version, created_at, updated_at FROM templates WHERE org_id = ? ORDER BY created_at DESC`, orgID)
 		if err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
@@ -26,19 +37,33 @@ func handleListTemplates(db *sql.DB) fiber.Handler {
 
 		templates := make([]fiber.Map, 0)
 		for rows.Next() {
-			var id, name, subject, body, createdAt, updatedAt string
-			if err := rows.Scan(&id, &name, &subject, &body, &createdAt, &updatedAt); err != nil {
+			var id, name, subject, body, language, createdAt, updatedAt string
+			var isDefault bool
+			var version int64
+			if err := rows.Scan(&id, &name, &subject, &body, &language, &isDefault, &version, &createdAt, &updatedAt); err != nil {
 				return fiber.NewError(fiber.StatusInternalServerError, "db error")
 			}
 			templates = append(templates, fiber.Map{
-				"id": id, "name": name, "subject": subject, "body": body, "created_at": createdAt, "updated_at": updatedAt,
+				"id": id, "name": name, "subject": subject, "body": body, "language": language, "is_default": isDefault,
+				"variants": []fiber.Map{}, "version": version, "created_at": createdAt, "updated_at": updatedAt,
 			})
 		}
+		rows.Close()
+
+		variants, err := loadTemplateVariants(db, orgID, "")
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		for _, tmpl := range templates {
+			if list, ok := variants[tmpl["id"].(string)]; ok {
+				tmpl["variants"] = list
+			}
+		}
 		return c.JSON(fiber.Map{"templates": templates})
 	}
 }
 
-func handleCreateTemplate(db *sql.DB) fiber.Handler {
+func handleCreateTemplate(db *sql.DB, cfg config.Config) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		orgID := orgIDFrom(c)
 		var req templatePayload
@@ -51,56 +76,332 @@ func handleCreateTemplate(db *sql.DB) fiber.Handler {
 		if name == "" || subject == "" || body == "" {
 			return fiber.NewError(fiber.StatusBadRequest, "name, subject, and body required")
 		}
+		language, variants, err := parseTemplateLanguages(req)
+		if err != nil {
+			return err
+		}
 		id := uuid.NewString()
-		now := time.Now().UTC().Format(time.RFC3339)
-		if _, err := db.Exec(`INSERT INTO templates (id, org_id, name, subject, body, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
-			id, orgID, name, subject, body, now, now); err != nil {
+		now := cfg.Now()
+		stamp := now.Format(time.RFC3339)
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(`INSERT INTO templates (id, org_id, name, subject, body, language, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, orgID, name, subject, body, language, stamp, stamp); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if err := services.ReplaceTemplateVariants(tx, orgID, id, variants); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		after, err := templateSnapshot(tx, orgID, id)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(c, tx, now, services.AuditActionCreate, "template", id, nil, after); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
 		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"id": id})
 	}
 }
 
-func handleUpdateTemplate(db *sql.DB) fiber.Handler {
+func handleUpdateTemplate(db *sql.DB, cfg config.Config) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		orgID := orgIDFrom(c)
-		id := c.Params("id")
 		var req templatePayload
 		if err := c.BodyParser(&req); err != nil {
 			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
 		}
-		name := strings.TrimSpace(req.Name)
-		subject := strings.TrimSpace(req.Subject)
-		body := strings.TrimSpace(req.Body)
-		if name == "" || subject == "" || body == "" {
-			return fiber.NewError(fiber.StatusBadRequest, "name, subject, and body required")
+		version, err := checkIfMatch(c, db, "templates", orgIDFrom(c), c.Params("id"))
+		if err != nil {
+			return err
+		}
+		return saveTemplate(c, db, cfg.Now(), req, version)
+	}
+}
+
+// handlePatchTemplate applies a JSON merge patch. "variants" is replaced as a
+// whole, and null clears it.
+func handlePatchTemplate(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		orgID := orgIDFrom(c)
+		id := c.Params("id")
+		version, err := checkIfMatch(c, db, "templates", orgID, id)
+		if err != nil {
+			return err
+		}
+		var req templatePayload
+		if err := db.QueryRow(`SELECT name, subject, body, language FROM templates WHERE id = ? AND org_id = ?`, id, orgID).
+			Scan(&req.Name, &req.Subject, &req.Body, &req.Language); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
-		now := time.Now().UTC().Format(time.RFC3339)
-		res, err := db.Exec(`UPDATE templates SET name = ?, subject = ?, body = ?, updated_at = ? WHERE id = ? AND org_id = ?`,
-			name, subject, body, now, id, orgID)
+		variants, err := loadTemplateVariants(db, orgID, id)
 		if err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
-		affected, _ := res.RowsAffected()
-		if affected == 0 {
-			return fiber.NewError(fiber.StatusNotFound, "template not found")
+		req.Variants = []templateVariantPayload{}
+		for _, v := range variants[id] {
+			req.Variants = append(req.Variants, templateVariantPayload{
+				Language: v["language"].(string), Subject: v["subject"].(string), Body: v["body"].(string),
+			})
+		}
+		if err := applyMergePatch(c, &req); err != nil {
+			return err
+		}
+		if req.Variants == nil {
+			req.Variants = []templateVariantPayload{}
 		}
-		return c.JSON(fiber.Map{"id": id})
+		return saveTemplate(c, db, cfg.Now(), req, version)
 	}
 }
 
-func handleDeleteTemplate(db *sql.DB) fiber.Handler {
+// saveTemplate replaces the template's fields, provided it is still at
+// version.
+func saveTemplate(c *fiber.Ctx, db *sql.DB, now time.Time, req templatePayload, version int64) error {
+	orgID := orgIDFrom(c)
+	id := c.Params("id")
+	name := strings.TrimSpace(req.Name)
+	subject := strings.TrimSpace(req.Subject)
+	body := strings.TrimSpace(req.Body)
+	if name == "" || subject == "" || body == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "name, subject, and body required")
+	}
+	language, variants, err := parseTemplateLanguages(req)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	defer tx.Rollback()
+
+	before, err := templateSnapshot(tx, orgID, id)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(`UPDATE templates SET name = ?, subject = ?, body = ?, language = ?, updated_at = ? WHERE id = ? AND org_id = ? AND version = ?`,
+		name, subject, body, language, now.Format(time.RFC3339), id, orgID, version)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	affected, _ := res.RowsAffected()
+	if affected == 0 {
+		return errPreconditionFailed
+	}
+	// Omitting "variants" keeps the stored ones; an empty list clears them.
+	if req.Variants != nil {
+		if err := services.ReplaceTemplateVariants(tx, orgID, id, variants); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+	}
+	after, err := templateSnapshot(tx, orgID, id)
+	if err != nil {
+		return err
+	}
+	if err := recordAudit(c, tx, now, services.AuditActionUpdate, "template", id, before, after); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	c.Set(fiber.HeaderETag, etag(version+1))
+	return c.JSON(fiber.Map{"id": id})
+}
+
+func handleSetDefaultTemplate(db *sql.DB, cfg config.Config) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		orgID := orgIDFrom(c)
 		id := c.Params("id")
-		res, err := db.Exec(`DELETE FROM templates WHERE id = ? AND org_id = ?`, id, orgID)
+		tx, err := db.Begin()
 		if err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "db error")
 		}
-		affected, _ := res.RowsAffected()
-		if affected == 0 {
+		defer tx.Rollback()
+
+		before, err := templateSnapshot(tx, orgID, id)
+		if err != nil {
+			return err
+		}
+		ok, err := services.SetDefaultTemplate(tx, orgID, id)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if !ok {
 			return fiber.NewError(fiber.StatusNotFound, "template not found")
 		}
+		after, err := templateSnapshot(tx, orgID, id)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(c, tx, cfg.Now(), services.AuditActionUpdate, "template", id, before, after); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.JSON(fiber.Map{"id": id, "is_default": true})
+	}
+}
+
+func handleDeleteTemplate(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		orgID := orgIDFrom(c)
+		id := c.Params("id")
+		reassignTo := strings.TrimSpace(c.Query("reassign_to"))
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		before, err := templateSnapshot(tx, orgID, id)
+		if err != nil {
+			return err
+		}
+
+		var isDefault bool
+		if err := tx.QueryRow(`SELECT is_default FROM templates WHERE id = ? AND org_id = ?`, id, orgID).Scan(&isDefault); err != nil {
+			if err == sql.ErrNoRows {
+				return fiber.NewError(fiber.StatusNotFound, "template not found")
+			}
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if isDefault {
+			return fiber.NewError(fiber.StatusConflict, "cannot delete the default template; set another default first")
+		}
+
+		if reassignTo == "" {
+			rows, err := tx.Query(`SELECT DISTINCT i.id, i.number FROM reminders r JOIN invoices i ON r.invoice_id = i.id
+				WHERE r.org_id = ? AND r.template_id = ? AND r.status = 'scheduled' ORDER BY i.number ASC`, orgID, id)
+			if err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "db error")
+			}
+			defer rows.Close()
+			affected := make([]fiber.Map, 0)
+			for rows.Next() {
+				var invoiceID, number string
+				if err := rows.Scan(&invoiceID, &number); err != nil {
+					return fiber.NewError(fiber.StatusInternalServerError, "db error")
+				}
+				affected = append(affected, fiber.Map{"id": invoiceID, "number": number})
+			}
+			if len(affected) > 0 {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error":    "template is used by scheduled reminders; pass reassign_to to move them",
+					"invoices": affected,
+				})
+			}
+		} else {
+			if reassignTo == id {
+				return fiber.NewError(fiber.StatusBadRequest, "reassign_to must be a different template")
+			}
+			var target string
+			if err := tx.QueryRow(`SELECT id FROM templates WHERE id = ? AND org_id = ?`, reassignTo, orgID).Scan(&target); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, "reassign_to template not found")
+			}
+			if _, err := tx.Exec(`UPDATE reminders SET template_id = ? WHERE org_id = ? AND template_id = ?`, target, orgID, id); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "db error")
+			}
+			if _, err := tx.Exec(`UPDATE invoices SET template_id = ? WHERE org_id = ? AND template_id = ?`, target, orgID, id); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "db error")
+			}
+		}
+
+		if _, err := tx.Exec(`DELETE FROM templates WHERE id = ? AND org_id = ?`, id, orgID); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if reassignTo != "" {
+			before["reassigned_to"] = reassignTo
+		}
+		if err := recordAudit(c, tx, cfg.Now(), services.AuditActionDelete, "template", id, before, nil); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
 		return c.SendStatus(fiber.StatusNoContent)
 	}
 }
+
+// templateSnapshot includes the language variants with the template row.
+func templateSnapshot(q queryer, orgID, id string) (map[string]interface{}, error) {
+	row, err := snapshot(q, "templates", orgID, id)
+	if err != nil || row == nil {
+		return row, err
+	}
+	variants, err := loadTemplateVariants(q, orgID, id)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	row["variants"] = []fiber.Map{}
+	if list, ok := variants[id]; ok {
+		row["variants"] = list
+	}
+	return row, nil
+}
+
+func parseTemplateLanguages(req templatePayload) (string, []services.TemplateVariant, error) {
+	language := services.NormalizeLanguage(req.Language)
+	if language == "" {
+		language = services.DefaultLanguage
+	}
+	if !services.ValidLanguage(language) {
+		return "", nil, fiber.NewError(fiber.StatusBadRequest, "invalid language")
+	}
+	seen := map[string]bool{language: true}
+	variants := make([]services.TemplateVariant, 0, len(req.Variants))
+	for _, v := range req.Variants {
+		variant := services.TemplateVariant{
+			Language: services.NormalizeLanguage(v.Language),
+			Subject:  strings.TrimSpace(v.Subject),
+			Body:     strings.TrimSpace(v.Body),
+		}
+		if !services.ValidLanguage(variant.Language) {
+			return "", nil, fiber.NewError(fiber.StatusBadRequest, "invalid variant language")
+		}
+		if variant.Subject == "" || variant.Body == "" {
+			return "", nil, fiber.NewError(fiber.StatusBadRequest, "variant subject and body required")
+		}
+		if seen[variant.Language] {
+			return "", nil, fiber.NewError(fiber.StatusBadRequest, "duplicate variant language")
+		}
+		seen[variant.Language] = true
+		variants = append(variants, variant)
+	}
+	return language, variants, nil
+}
+
+// loadTemplateVariants returns the org's variants by template, or only those
+// of templateID when it is set.
+func loadTemplateVariants(q queryer, orgID, templateID string) (map[string][]fiber.Map, error) {
+	query, args := `SELECT template_id, language, subject, body FROM template_variants WHERE org_id = ?`, []interface{}{orgID}
+	if templateID != "" {
+		query += ` AND template_id = ?`
+		args = append(args, templateID)
+	}
+	rows, err := q.Query(query+` ORDER BY language ASC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants := make(map[string][]fiber.Map)
+	for rows.Next() {
+		var templateID, language, subject, body string
+		if err := rows.Scan(&templateID, &language, &subject, &body); err != nil {
+			return nil, err
+		}
+		variants[templateID] = append(variants[templateID], fiber.Map{
+			"language": language, "subject": subject, "body": body,
+		})
+	}
+	return variants, rows.Err()
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"nudgepay/internal/config"
+	"nudgepay/internal/services"
+)
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type loginTwoFactorRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+func handleTwoFactorSetup(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		enrollment, err := services.BeginTOTPEnrollment(db, userIDFrom(c))
+		if err != nil {
+			return twoFactorError(err)
+		}
+		return c.JSON(fiber.Map{"secret": enrollment.Secret, "otpauth_uri": enrollment.URI})
+	}
+}
+
+func handleTwoFactorEnable(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req twoFactorCodeRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		codes, err := services.ConfirmTOTPEnrollment(tx, userIDFrom(c), req.Code, cfg.Now())
+		if err != nil {
+			return twoFactorError(err)
+		}
+		if err := recordTwoFactorAudit(c, tx, cfg.Now(), services.AuditActionCreate); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.JSON(fiber.Map{"enabled": true, "recovery_codes": codes})
+	}
+}
+
+func handleTwoFactorDisable(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req twoFactorCodeRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		var required bool
+		if err := db.QueryRow(`SELECT require_2fa FROM organizations WHERE id = ?`, orgIDFrom(c)).Scan(&required); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if required {
+			return fiber.NewError(fiber.StatusConflict, "organization requires two-factor authentication")
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		if err := services.DisableTOTP(tx, userIDFrom(c), req.Code, cfg.Now()); err != nil {
+			return twoFactorError(err)
+		}
+		if err := recordTwoFactorAudit(c, tx, cfg.Now(), services.AuditActionDelete); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.JSON(fiber.Map{"enabled": false})
+	}
+}
+
+func handleRegenerateRecoveryCodes(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req twoFactorCodeRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		codes, err := services.RegenerateRecoveryCodes(tx, userIDFrom(c), req.Code, cfg.Now())
+		if err != nil {
+			return twoFactorError(err)
+		}
+		if err := recordTwoFactorAudit(c, tx, cfg.Now(), services.AuditActionUpdate); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.JSON(fiber.Map{"recovery_codes": codes})
+	}
+}
+
+func handleLoginTwoFactor(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req loginTwoFactorRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		if strings.TrimSpace(req.MFAToken) == "" || strings.TrimSpace(req.Code) == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "mfa_token and code required")
+		}
+		now := cfg.Now()
+		challenge := strings.TrimSpace(req.MFAToken)
+		email, err := services.MFAChallengeEmail(db, challenge)
+		if errors.Is(err, services.ErrTokenInvalid) {
+			return fiber.NewError(fiber.StatusUnauthorized, "login challenge expired; sign in again")
+		}
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		// Wrong codes count as failed logins, so a correct password does not
+		// open up unlimited guessing across fresh challenges.
+		if err := checkLoginThrottle(c, db, email, now); err != nil {
+			return err
+		}
+		userID, method, err := services.CompleteMFAChallenge(db, challenge, req.Code, now)
+		if err != nil {
+			if errors.Is(err, services.ErrTokenInvalid) || errors.Is(err, services.ErrTokenExpired) {
+				return fiber.NewError(fiber.StatusUnauthorized, "login challenge expired; sign in again")
+			}
+			if errors.Is(err, services.ErrInvalidCode) {
+				if err := services.RecordLoginFailure(db, email, c.IP(), now); err != nil {
+					return fiber.NewError(fiber.StatusInternalServerError, "db error")
+				}
+			}
+			return twoFactorError(err)
+		}
+		orgID, err := loginOrg(db, userID, method)
+		if err != nil {
+			return err
+		}
+		resp, err := issueSession(c, db, cfg, userID, orgID, method)
+		if err != nil {
+			return err
+		}
+		if err := services.ClearLoginFailures(db, email); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.JSON(resp)
+	}
+}
+
+// recordTwoFactorAudit logs a change to the caller's second factor in their
+// current org. Secrets and recovery codes stay out of the log.
+func recordTwoFactorAudit(c *fiber.Ctx, tx *sql.Tx, now time.Time, action string) error {
+	return recordAudit(c, tx, now, action, "two_factor", userIDFrom(c), nil, nil)
+}
+
+func twoFactorError(err error) error {
+	switch {
+	case errors.Is(err, services.ErrInvalidCode):
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid code")
+	case errors.Is(err, services.ErrTwoFactorEnabled):
+		return fiber.NewError(fiber.StatusConflict, "two-factor authentication already enabled")
+	case errors.Is(err, services.ErrTwoFactorNotEnabled):
+		return fiber.NewError(fiber.StatusConflict, "two-factor authentication not enabled")
+	case errors.Is(err, services.ErrTwoFactorNotPending):
+		return fiber.NewError(fiber.StatusConflict, "start two-factor setup first")
+	}
+	return fiber.NewError(fiber.StatusInternalServerError, "db error")
+}
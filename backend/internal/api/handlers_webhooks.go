@@ -0,0 +1,341 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"nudgepay/internal/config"
+	"nudgepay/internal/services"
+)
+
+const minWebhookSecretLength = 16
+
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+var webhookDeliveryListSpec = listSpec{
+	sorts:       map[string]string{"created_at": "d.created_at"},
+	defaultSort: "-created_at",
+	idColumn:    "d.id",
+}
+
+// parse validates the URL and event types and returns the normalized URL
+// and the event types as stored. Unless allowPrivate is set the URL must not
+// point into our own network.
+func (req webhookRequest) parse(allowPrivate bool) (string, string, error) {
+	target := strings.TrimSpace(req.URL)
+	parsed, err := url.Parse(target)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return "", "", fiber.NewError(fiber.StatusBadRequest, "url must be an http or https URL")
+	}
+	if !allowPrivate {
+		if err := services.CheckWebhookHost(parsed.Hostname()); err != nil {
+			return "", "", fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+	}
+	if len(req.Events) == 0 {
+		return "", "", fiber.NewError(fiber.StatusBadRequest, "at least one event required")
+	}
+	events := make([]string, 0, len(req.Events))
+	seen := map[string]bool{}
+	for _, event := range req.Events {
+		event = strings.TrimSpace(strings.ToLower(event))
+		if !services.ValidWebhookEventType(event) {
+			return "", "", fiber.NewError(fiber.StatusBadRequest, "unknown event "+event)
+		}
+		if !seen[event] {
+			seen[event] = true
+			events = append(events, event)
+		}
+	}
+	return target, strings.Join(events, " "), nil
+}
+
+func webhookJSON(id, target, events, createdAt, updatedAt string) fiber.Map {
+	return fiber.Map{
+		"id":         id,
+		"url":        target,
+		"events":     strings.Fields(events),
+		"created_at": createdAt,
+		"updated_at": updatedAt,
+	}
+}
+
+// webhookSnapshot loads an endpoint for the audit log, without its secret.
+func webhookSnapshot(q queryer, orgID, id string) (map[string]interface{}, error) {
+	row, err := snapshot(q, "webhook_endpoints", orgID, id)
+	if row != nil {
+		delete(row, "secret")
+	}
+	return row, err
+}
+
+func handleListWebhooks(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		rows, err := db.Query(`SELECT id, url, event_types, created_at, updated_at FROM webhook_endpoints
+			WHERE org_id = ? ORDER BY created_at, id`, orgIDFrom(c))
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer rows.Close()
+
+		webhooks := make([]fiber.Map, 0)
+		for rows.Next() {
+			var id, target, events, createdAt, updatedAt string
+			if err := rows.Scan(&id, &target, &events, &createdAt, &updatedAt); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "db error")
+			}
+			webhooks = append(webhooks, webhookJSON(id, target, events, createdAt, updatedAt))
+		}
+		return c.JSON(fiber.Map{"webhooks": webhooks})
+	}
+}
+
+func handleCreateWebhook(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req webhookRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		target, events, err := req.parse(cfg.AllowPrivateWebhooks)
+		if err != nil {
+			return err
+		}
+		secret := strings.TrimSpace(req.Secret)
+		if secret == "" {
+			if secret, err = services.NewWebhookSecret(); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "secret generation failed")
+			}
+		} else if len(secret) < minWebhookSecretLength {
+			return fiber.NewError(fiber.StatusBadRequest, "secret must be at least 16 characters")
+		}
+
+		orgID := orgIDFrom(c)
+		id := uuid.NewString()
+		now := cfg.Now()
+		stamp := now.Format(time.RFC3339)
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(`INSERT INTO webhook_endpoints (id, org_id, url, secret, event_types, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`, id, orgID, target, secret, events, stamp, stamp); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		after, err := webhookSnapshot(tx, orgID, id)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(c, tx, now, services.AuditActionCreate, "webhook", id, nil, after); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		// The secret is only shown here; receivers need it to check signatures.
+		resp := webhookJSON(id, target, events, stamp, stamp)
+		resp["secret"] = secret
+		return c.Status(fiber.StatusCreated).JSON(resp)
+	}
+}
+
+func handleUpdateWebhook(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req webhookRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+		}
+		target, events, err := req.parse(cfg.AllowPrivateWebhooks)
+		if err != nil {
+			return err
+		}
+		orgID := orgIDFrom(c)
+		id := c.Params("id")
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		before, err := webhookSnapshot(tx, orgID, id)
+		if err != nil {
+			return err
+		}
+		if before == nil {
+			return fiber.NewError(fiber.StatusNotFound, "webhook not found")
+		}
+		now := cfg.Now()
+		stamp := now.Format(time.RFC3339)
+		if _, err := tx.Exec(`UPDATE webhook_endpoints SET url = ?, event_types = ?, updated_at = ? WHERE id = ? AND org_id = ?`,
+			target, events, stamp, id, orgID); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		after, err := webhookSnapshot(tx, orgID, id)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(c, tx, now, services.AuditActionUpdate, "webhook", id, before, after); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.JSON(webhookJSON(id, target, events, before["created_at"].(string), stamp))
+	}
+}
+
+func handleDeleteWebhook(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		orgID := orgIDFrom(c)
+		id := c.Params("id")
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		before, err := webhookSnapshot(tx, orgID, id)
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(`DELETE FROM webhook_endpoints WHERE id = ? AND org_id = ?`, id, orgID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			return fiber.NewError(fiber.StatusNotFound, "webhook not found")
+		}
+		if err := recordAudit(c, tx, cfg.Now(), services.AuditActionDelete, "webhook", id, before, nil); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+const webhookDeliveryColumns = `SELECT d.id, d.event_id, ev.event_type, ev.payload, d.status, d.attempts, d.next_attempt_at,
+	d.response_status, d.response_body, d.error, d.delivered_at, d.created_at
+	FROM webhook_deliveries d JOIN webhook_events ev ON ev.id = d.event_id`
+
+func scanWebhookDelivery(scan func(dest ...interface{}) error) (fiber.Map, error) {
+	var id, eventID, eventType, payload, status, body, deliveryErr, createdAt string
+	var attempts int
+	var nextAttemptAt, deliveredAt sql.NullString
+	var responseStatus sql.NullInt64
+	if err := scan(&id, &eventID, &eventType, &payload, &status, &attempts, &nextAttemptAt,
+		&responseStatus, &body, &deliveryErr, &deliveredAt, &createdAt); err != nil {
+		return nil, err
+	}
+	delivery := fiber.Map{
+		"id":              id,
+		"event_id":        eventID,
+		"event_type":      eventType,
+		"payload":         json.RawMessage(payload),
+		"status":          status,
+		"attempts":        attempts,
+		"next_attempt_at": nullIfEmpty(nextAttemptAt.String),
+		"response_status": nil,
+		"response_body":   body,
+		"error":           nullIfEmpty(deliveryErr),
+		"delivered_at":    nullIfEmpty(deliveredAt.String),
+		"created_at":      createdAt,
+	}
+	if responseStatus.Valid {
+		delivery["response_status"] = responseStatus.Int64
+	}
+	return delivery, nil
+}
+
+func handleListWebhookDeliveries(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		orgID := orgIDFrom(c)
+		id := c.Params("id")
+		var exists string
+		if err := db.QueryRow(`SELECT id FROM webhook_endpoints WHERE id = ? AND org_id = ?`, id, orgID).Scan(&exists); err != nil {
+			if err == sql.ErrNoRows {
+				return fiber.NewError(fiber.StatusNotFound, "webhook not found")
+			}
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		p, err := parsePage(c, webhookDeliveryListSpec)
+		if err != nil {
+			return err
+		}
+		query, args := webhookDeliveryColumns+` WHERE d.endpoint_id = ? AND d.org_id = ?`, []interface{}{id, orgID}
+		if status := strings.TrimSpace(c.Query("status")); status != "" {
+			query += " AND d.status = ?"
+			args = append(args, status)
+		}
+		query, args = p.apply(query, args)
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer rows.Close()
+
+		deliveries := make([]fiber.Map, 0)
+		for rows.Next() {
+			delivery, err := scanWebhookDelivery(rows.Scan)
+			if err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "db error")
+			}
+			deliveries = append(deliveries, delivery)
+		}
+		deliveries, next := p.finish(deliveries)
+		return c.JSON(fiber.Map{"deliveries": deliveries, "next_cursor": next})
+	}
+}
+
+func handleRedeliverWebhook(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		orgID := orgIDFrom(c)
+		now := cfg.Now()
+		tx, err := db.Begin()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		defer tx.Rollback()
+
+		id, err := services.RedeliverWebhook(tx, orgID, c.Params("id"), c.Params("delivery_id"), now)
+		if err == sql.ErrNoRows {
+			return fiber.NewError(fiber.StatusNotFound, "delivery not found")
+		}
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		after, err := snapshot(tx, "webhook_deliveries", orgID, id)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(c, tx, now, services.AuditActionSend, "webhook_delivery", id, nil, after); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if err := services.SendWebhookDelivery(db, services.NewWebhookClient(cfg.AllowPrivateWebhooks), id, now); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		delivery, err := scanWebhookDelivery(db.QueryRow(webhookDeliveryColumns+` WHERE d.id = ?`, id).Scan)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return c.Status(fiber.StatusCreated).JSON(delivery)
+	}
+}
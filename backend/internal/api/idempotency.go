@@ -0,0 +1,93 @@
+package api
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"nudgepay/internal/config"
+	"nudgepay/internal/services"
+)
+
+const maxIdempotencyKeyLength = 255
+
+// Responses on these routes carry tokens or secrets, which are not kept at
+// rest, so they ignore Idempotency-Key.
+var (
+	idempotencyExcludedPrefixes = []string{"/api/auth/", "/api/me/", "/api/api-keys"}
+	idempotencyExcludedPaths    = []*regexp.Regexp{
+		regexp.MustCompile(`^/api/webhooks/?$`),                   // the endpoint's signing secret
+		regexp.MustCompile(`^/api/invoices/[^/]+/share-links/?$`), // the page's token
+	}
+)
+
+// idempotent replays the stored response when a POST is retried with the
+// same Idempotency-Key. The caller and request body are part of the request
+// hash, so a replay only ever returns what the same caller already received,
+// and reusing a key for anything else is refused with 422.
+func idempotent(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := strings.TrimSpace(c.Get("Idempotency-Key"))
+		if c.Method() != fiber.MethodPost || key == "" {
+			return c.Next()
+		}
+		for _, prefix := range idempotencyExcludedPrefixes {
+			if strings.HasPrefix(c.Path(), prefix) {
+				return c.Next()
+			}
+		}
+		for _, path := range idempotencyExcludedPaths {
+			if path.MatchString(c.Path()) {
+				return c.Next()
+			}
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return fiber.NewError(fiber.StatusBadRequest, "Idempotency-Key is too long")
+		}
+
+		sum := sha256.New()
+		for _, part := range []string{c.Method(), c.OriginalURL(), userIDFrom(c), apiKeyIDFrom(c)} {
+			sum.Write([]byte(part))
+			sum.Write([]byte{0})
+		}
+		sum.Write(c.Body())
+		hash := hex.EncodeToString(sum.Sum(nil))
+
+		id, stored, err := services.BeginIdempotentRequest(db, orgIDFrom(c), key, hash, cfg.Now())
+		switch {
+		case err == services.ErrIdempotencyKeyReused:
+			return fiber.NewError(fiber.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request")
+		case err == services.ErrIdempotencyKeyInFlight:
+			return fiber.NewError(fiber.StatusConflict, "a request with this Idempotency-Key is still in progress")
+		case err != nil:
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		case stored != nil:
+			c.Set("Idempotent-Replayed", "true")
+			c.Set(fiber.HeaderContentType, stored.ContentType)
+			return c.Status(stored.StatusCode).Send(stored.Body)
+		}
+
+		// Failed requests are not stored, so a corrected retry can reuse the key.
+		if err := c.Next(); err != nil {
+			_ = services.ReleaseIdempotentRequest(db, id)
+			return err
+		}
+		resp := c.Response()
+		if resp.StatusCode() >= fiber.StatusInternalServerError {
+			_ = services.ReleaseIdempotentRequest(db, id)
+			return nil
+		}
+		if err := services.CompleteIdempotentRequest(db, id, services.IdempotentResponse{
+			StatusCode:  resp.StatusCode(),
+			ContentType: string(resp.Header.ContentType()),
+			Body:        append([]byte(nil), resp.Body()...),
+		}, cfg.Now()); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type pdfLine struct {
+	bold bool
+	size int
+	text string
+}
+
+// writeInvoicePDF renders a single A4 page with the standard Helvetica
+// fonts, so no font files need embedding.
+func writeInvoicePDF(w io.Writer, inv publicInvoice) error {
+	lines := []pdfLine{
+		{true, 20, inv.OrgName},
+		{false, 11, ""},
+		{true, 16, "Invoice " + inv.Number},
+		{false, 11, "Billed to: " + inv.BilledTo()},
+		{false, 11, "Issued: " + inv.IssuedOn()},
+		{false, 11, "Due: " + inv.DueDate},
+		{false, 11, ""},
+		{false, 11, "Amount: " + inv.Amount()},
+		{false, 11, "Paid: " + inv.Paid()},
+		{true, 13, "Balance due: " + inv.Balance()},
+	}
+	if len(inv.Payments) > 0 {
+		lines = append(lines, pdfLine{false, 11, ""}, pdfLine{true, 11, "Payments"})
+		for _, p := range inv.Payments {
+			lines = append(lines, pdfLine{false, 11, p.PaidOn + "  " + p.Amount})
+		}
+	}
+	if inv.Notes != "" {
+		lines = append(lines, pdfLine{false, 11, ""}, pdfLine{true, 11, "Notes"})
+		for _, note := range strings.Split(inv.Notes, "\n") {
+			lines = append(lines, pdfLine{false, 11, note})
+		}
+	}
+
+	var content bytes.Buffer
+	y := 780
+	for _, line := range lines {
+		font := "F1"
+		if line.bold {
+			font = "F2"
+		}
+		if line.text != "" {
+			fmt.Fprintf(&content, "BT /%s %d Tf 56 %d Td (%s) Tj ET\n", font, line.size, y, pdfText(line.text))
+		}
+		y -= line.size + 8
+		if y < 56 {
+			break
+		}
+	}
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 4 0 R /F2 5 0 R >> >> /Contents 6 0 R >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+	}
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// pdfText escapes a string for a PDF literal. Latin-1 maps onto
+// WinAnsiEncoding; anything else is replaced.
+func pdfText(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteByte(' ')
+		case r < 0x20 || r > 0xff:
+			b.WriteByte('?')
+		default:
+			b.WriteByte(byte(r))
+		}
+	}
+	return b.String()
+}
@@ -1,33 +1,209 @@
 package api
 
 import (
+	"database/sql"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
 
 	"nudgepay/internal/auth"
+	"nudgepay/internal/config"
+	"nudgepay/internal/services"
 )
 
-func authRequired(secret string) fiber.Handler {
+func bearerToken(c *fiber.Ctx) (string, error) {
+	authHeader := c.Get("Authorization")
+	if authHeader == "" {
+		return "", fiber.NewError(fiber.StatusUnauthorized, "missing authorization header")
+	}
+	parts := strings.SplitN(authHeader, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return "", fiber.NewError(fiber.StatusUnauthorized, "invalid authorization header")
+	}
+	return parts[1], nil
+}
+
+func authRequired(db *sql.DB, cfg config.Config) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		authHeader := c.Get("Authorization")
-		if authHeader == "" {
-			return fiber.NewError(fiber.StatusUnauthorized, "missing authorization header")
+		token, err := bearerToken(c)
+		if err != nil {
+			return err
 		}
-		parts := strings.SplitN(authHeader, " ", 2)
-		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
-			return fiber.NewError(fiber.StatusUnauthorized, "invalid authorization header")
+		if strings.HasPrefix(token, auth.APIKeyPrefix) {
+			key, err := services.AuthenticateAPIKey(db, token, cfg.Now())
+			if err == services.ErrAPIKeyInvalid {
+				return fiber.NewError(fiber.StatusUnauthorized, "invalid api key")
+			}
+			if err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "db error")
+			}
+			c.Locals("org_id", key.OrgID)
+			c.Locals("api_key_id", key.ID)
+			c.Locals("scopes", key.Scopes)
+			return c.Next()
 		}
-		claims, err := auth.ParseToken(secret, parts[1])
+		claims, err := auth.ParseToken(cfg.TokenKeys(), token)
 		if err != nil {
 			return fiber.NewError(fiber.StatusUnauthorized, "invalid token")
 		}
+		active, err := services.SessionActive(db, claims.SessionID, claims.UserID, cfg.Now())
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		if !active {
+			return fiber.NewError(fiber.StatusUnauthorized, "session revoked")
+		}
 		c.Locals("user_id", claims.UserID)
 		c.Locals("org_id", claims.OrgID)
+		c.Locals("session_id", claims.SessionID)
+		return c.Next()
+	}
+}
+
+// portalRequired admits client portal sessions only. The session's client
+// is the sole scope of every portal route.
+func portalRequired(db *sql.DB, cfg config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		token, err := bearerToken(c)
+		if err != nil {
+			return err
+		}
+		session, err := services.AuthenticatePortalSession(db, token, cfg.Now())
+		switch {
+		case err == services.ErrTokenInvalid:
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid portal token")
+		case err == services.ErrTokenExpired:
+			return fiber.NewError(fiber.StatusUnauthorized, "portal session expired")
+		case err != nil:
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		c.Locals("org_id", session.OrgID)
+		c.Locals("client_id", session.ClientID)
+		c.Locals("portal_session_id", session.ID)
 		return c.Next()
 	}
 }
 
+// membershipRequired loads the caller's role in the token's org. API keys
+// belong to the org itself and are limited by scopes instead.
+func membershipRequired(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if apiKeyIDFrom(c) != "" {
+			return c.Next()
+		}
+		role, err := services.MemberRole(db, orgIDFrom(c), userIDFrom(c))
+		if err == services.ErrNotMember {
+			return fiber.NewError(fiber.StatusForbidden, "not a member of this organization")
+		}
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "db error")
+		}
+		c.Locals("role", role)
+		return c.Next()
+	}
+}
+
+// requireRole guards a route with the lowest role allowed to use it. API
+// keys are refused; routes open to them use requireRoleOrScope.
+func requireRole(min string) fiber.Handler {
+	return requireRoleOrScope(min, "")
+}
+
+// requireRoleOrScope admits users holding at least min and API keys granted
+// scope. Every secured route carries one of the two guards.
+func requireRoleOrScope(min, scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if apiKeyIDFrom(c) != "" {
+			if scope == "" {
+				return fiber.NewError(fiber.StatusForbidden, "api keys cannot use this route")
+			}
+			if !services.HasScope(scopesFrom(c), scope) {
+				return fiber.NewError(fiber.StatusForbidden, "api key lacks "+scope+" scope")
+			}
+			return c.Next()
+		}
+		if !services.RoleAtLeast(roleFrom(c), min) {
+			return fiber.NewError(fiber.StatusForbidden, "requires "+min+" role")
+		}
+		return c.Next()
+	}
+}
+
+// ssoEnforced confines password sessions in orgs that require single sign-on
+// to their own profile, from where they can log out or switch orgs.
+func ssoEnforced(db *sql.DB) fiber.Handler {
+	allowed := []string{
+		"GET /api/me", "GET /api/me/orgs", "POST /api/me/orgs/:id/switch", "POST /api/auth/logout",
+	}
+	return func(c *fiber.Ctx) error {
+		if apiKeyIDFrom(c) != "" {
+			return c.Next()
+		}
+		var required bool
+		var method string
+		if err := db.QueryRow(`SELECT o.require_sso, s.auth_method FROM organizations o, sessions s WHERE o.id = ? AND s.id = ?`,
+			orgIDFrom(c), sessionIDFrom(c)).Scan(&required, &method); err != nil {
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid token")
+		}
+		if !required || method == services.AuthMethodSSO || routeAllowed(c, allowed) {
+			return c.Next()
+		}
+		return fiber.NewError(fiber.StatusForbidden, "organization requires single sign-on")
+	}
+}
+
+// twoFactorEnforced blocks members of orgs that require two-factor
+// authentication until they enroll, leaving only the routes needed to do so.
+func twoFactorEnforced(db *sql.DB) fiber.Handler {
+	allowed := []string{
+		"GET /api/me", "GET /api/me/orgs", "POST /api/me/orgs/:id/switch",
+		"POST /api/me/2fa/setup", "POST /api/me/2fa/enable",
+		"POST /api/auth/logout", "POST /api/auth/verify-email/resend",
+	}
+	return func(c *fiber.Ctx) error {
+		if apiKeyIDFrom(c) != "" {
+			return c.Next()
+		}
+		var required, enabled bool
+		if err := db.QueryRow(`SELECT o.require_2fa, u.totp_enabled_at IS NOT NULL FROM organizations o, users u WHERE o.id = ? AND u.id = ?`,
+			orgIDFrom(c), userIDFrom(c)).Scan(&required, &enabled); err != nil {
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid token")
+		}
+		if !required || enabled || routeAllowed(c, allowed) {
+			return c.Next()
+		}
+		return fiber.NewError(fiber.StatusForbidden, "organization requires two-factor authentication; enroll at /api/me/2fa/setup")
+	}
+}
+
+// routeAllowed reports whether the request is one of routes, each written
+// as "METHOD /path" where a :param segment matches any single segment.
+func routeAllowed(c *fiber.Ctx, routes []string) bool {
+	segments := strings.Split(strings.TrimSuffix(c.Path(), "/"), "/")
+	for _, route := range routes {
+		method, path, _ := strings.Cut(route, " ")
+		if method != c.Method() {
+			continue
+		}
+		want := strings.Split(path, "/")
+		if len(want) != len(segments) {
+			continue
+		}
+		match := true
+		for i, segment := range want {
+			if !strings.HasPrefix(segment, ":") && segment != segments[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
 func jsonErrorHandler(c *fiber.Ctx, err error) error {
 	code := fiber.StatusInternalServerError
 	msg := "internal error"
@@ -53,3 +229,51 @@ func userIDFrom(c *fiber.Ctx) string {
 	}
 	return v.(string)
 }
+
+func sessionIDFrom(c *fiber.Ctx) string {
+	v := c.Locals("session_id")
+	if v == nil {
+		return ""
+	}
+	return v.(string)
+}
+
+func roleFrom(c *fiber.Ctx) string {
+	v := c.Locals("role")
+	if v == nil {
+		return ""
+	}
+	return v.(string)
+}
+
+func clientIDFrom(c *fiber.Ctx) string {
+	v := c.Locals("client_id")
+	if v == nil {
+		return ""
+	}
+	return v.(string)
+}
+
+func portalSessionIDFrom(c *fiber.Ctx) string {
+	v := c.Locals("portal_session_id")
+	if v == nil {
+		return ""
+	}
+	return v.(string)
+}
+
+func apiKeyIDFrom(c *fiber.Ctx) string {
+	v := c.Locals("api_key_id")
+	if v == nil {
+		return ""
+	}
+	return v.(string)
+}
+
+func scopesFrom(c *fiber.Ctx) []string {
+	v := c.Locals("scopes")
+	if v == nil {
+		return nil
+	}
+	return v.([]string)
+}
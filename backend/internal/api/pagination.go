@@ -0,0 +1,154 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+)
+
+// listSpec describes how a list endpoint may be sorted. Sort keys are the
+// JSON field names of the listed items, so the cursor can be built from the
+// last item returned.
+type listSpec struct {
+	sorts       map[string]string // sort key -> SQL column
+	defaultSort string            // "-created_at" sorts newest first
+	idColumn    string
+}
+
+type pageCursor struct {
+	Sort  string      `json:"s"`
+	Value interface{} `json:"v"`
+	ID    string      `json:"id"`
+}
+
+type page struct {
+	limit    int
+	sort     string
+	field    string
+	column   string
+	idColumn string
+	desc     bool
+	after    *pageCursor
+}
+
+// parsePage reads limit, sort and cursor. sort is a key from the spec,
+// prefixed with "-" for descending order; ties are broken by id so pages
+// never skip or repeat rows.
+func parsePage(c *fiber.Ctx, spec listSpec) (page, error) {
+	p := page{limit: defaultPageLimit, sort: spec.defaultSort, idColumn: spec.idColumn}
+	if raw := c.Query("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			return p, fiber.NewError(fiber.StatusBadRequest, "limit must be a positive integer")
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+		p.limit = limit
+	}
+	if raw := strings.TrimSpace(c.Query("sort")); raw != "" {
+		p.sort = raw
+	}
+	p.field = strings.TrimPrefix(p.sort, "-")
+	p.desc = strings.HasPrefix(p.sort, "-")
+	column, ok := spec.sorts[p.field]
+	if !ok {
+		return p, fiber.NewError(fiber.StatusBadRequest, "unsupported sort "+p.field)
+	}
+	p.column = column
+	if raw := c.Query("cursor"); raw != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(raw)
+		var cur pageCursor
+		if err != nil || json.Unmarshal(decoded, &cur) != nil || cur.ID == "" {
+			return p, fiber.NewError(fiber.StatusBadRequest, "invalid cursor")
+		}
+		if cur.Sort != p.sort {
+			return p, fiber.NewError(fiber.StatusBadRequest, "cursor was issued for a different sort")
+		}
+		p.after = &cur
+	}
+	return p, nil
+}
+
+// apply adds the keyset condition, ordering and limit to a query whose WHERE
+// clause is already open. One extra row is fetched to detect a next page.
+func (p page) apply(query string, args []interface{}) (string, []interface{}) {
+	op := ">"
+	if p.desc {
+		op = "<"
+	}
+	if p.after != nil {
+		query += " AND (" + p.column + " " + op + " ? OR (" + p.column + " = ? AND " + p.idColumn + " " + op + " ?))"
+		args = append(args, p.after.Value, p.after.Value, p.after.ID)
+	}
+	query += p.orderBy() + " LIMIT ?"
+	args = append(args, p.limit+1)
+	return query, args
+}
+
+// orderBy is the ORDER BY clause for the requested sort.
+func (p page) orderBy() string {
+	dir := "ASC"
+	if p.desc {
+		dir = "DESC"
+	}
+	return " ORDER BY " + p.column + " " + dir + ", " + p.idColumn + " " + dir
+}
+
+// finish trims the extra row and returns the items with the cursor for the
+// next page, or nil on the last page.
+func (p page) finish(items []fiber.Map) ([]fiber.Map, interface{}) {
+	if len(items) <= p.limit {
+		return items, nil
+	}
+	items = items[:p.limit]
+	last := items[len(items)-1]
+	encoded, _ := json.Marshal(pageCursor{Sort: p.sort, Value: last[p.field], ID: last["id"].(string)})
+	return items, base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// parseTimeBound accepts RFC3339 or YYYY-MM-DD. A bare date used as an upper
+// bound includes the whole day.
+func parseTimeBound(value string, endOfDay bool) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if day, err := time.Parse("2006-01-02", value); err == nil {
+		if endOfDay {
+			day = day.AddDate(0, 0, 1)
+		}
+		return day, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// addTimeRange filters column on the from/to query parameters.
+func addTimeRange(c *fiber.Ctx, column, fromParam, toParam, query string, args []interface{}) (string, []interface{}, error) {
+	from, err := parseTimeBound(c.Query(fromParam), false)
+	if err != nil {
+		return query, args, fiber.NewError(fiber.StatusBadRequest, fromParam+" must be a date or RFC3339 time")
+	}
+	to, err := parseTimeBound(c.Query(toParam), true)
+	if err != nil {
+		return query, args, fiber.NewError(fiber.StatusBadRequest, toParam+" must be a date or RFC3339 time")
+	}
+	if !from.IsZero() {
+		query += " AND " + column + " >= ?"
+		args = append(args, from.UTC().Format(time.RFC3339))
+	}
+	if !to.IsZero() {
+		query += " AND " + column + " < ?"
+		args = append(args, to.UTC().Format(time.RFC3339))
+	}
+	return query, args, nil
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const mergePatchContentType = "application/merge-patch+json"
+
+// etag formats a row version as a strong entity tag.
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// checkIfMatch loads the version of a clients, invoices or templates row and
+// holds it against the request's If-Match header, if any. Callers make their
+// UPDATE conditional on the returned version so a write that lands in between
+// also fails with 412.
+func checkIfMatch(c *fiber.Ctx, db *sql.DB, table, orgID, id string) (int64, error) {
+	var version int64
+	if err := db.QueryRow(`SELECT version FROM `+table+` WHERE id = ? AND org_id = ?`, id, orgID).Scan(&version); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, fiber.NewError(fiber.StatusNotFound, strings.TrimSuffix(table, "s")+" not found")
+		}
+		return 0, fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	header := strings.TrimSpace(c.Get(fiber.HeaderIfMatch))
+	if header == "" || header == "*" {
+		return version, nil
+	}
+	current := etag(version)
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimSpace(tag) == current {
+			return version, nil
+		}
+	}
+	return 0, errPreconditionFailed
+}
+
+var errPreconditionFailed = fiber.NewError(fiber.StatusPreconditionFailed, "resource has changed; reload it and retry")
+
+// applyMergePatch applies the request body as a JSON merge patch (RFC 7396)
+// to current, a pointer to a flat payload struct. Absent fields keep their
+// value, null resets a field to its zero value and unknown fields are
+// rejected.
+func applyMergePatch(c *fiber.Ctx, current interface{}) error {
+	contentType := strings.ToLower(strings.TrimSpace(strings.Split(c.Get(fiber.HeaderContentType), ";")[0]))
+	if contentType != mergePatchContentType && contentType != fiber.MIMEApplicationJSON {
+		return fiber.NewError(fiber.StatusUnsupportedMediaType, "content type must be "+mergePatchContentType)
+	}
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(c.Body(), &patch); err != nil || patch == nil {
+		return fiber.NewError(fiber.StatusBadRequest, "patch must be a JSON object")
+	}
+	raw, err := json.Marshal(current)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "invalid payload")
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "invalid payload")
+	}
+	for field, value := range patch {
+		if _, ok := doc[field]; !ok {
+			return fiber.NewError(fiber.StatusBadRequest, "unknown field "+field)
+		}
+		if bytes.Equal(bytes.TrimSpace(value), []byte("null")) {
+			delete(doc, field)
+		} else {
+			doc[field] = value
+		}
+	}
+	merged, err := json.Marshal(doc)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+	}
+	target := reflect.ValueOf(current).Elem()
+	target.Set(reflect.Zero(target.Type()))
+	if err := json.Unmarshal(merged, current); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid payload")
+	}
+	return nil
+}
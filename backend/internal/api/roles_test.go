@@ -0,0 +1,423 @@
+package api_test
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"nudgepay/internal/config"
+)
+
+// routeRoles lists every secured route with the lowest role allowed to call
+// it and the scope an API key needs, if keys may call it at all. The logout
+// route comes last because it ends the caller's session.
+var routeRoles = []struct {
+	method string
+	path   string
+	min    string
+	scope  string
+}{
+	{"POST", "/api/auth/verify-email/resend", "accountant", ""},
+	{"GET", "/api/sessions", "accountant", ""},
+	{"DELETE", "/api/sessions/:id", "accountant", ""},
+	{"GET", "/api/me", "accountant", ""},
+	{"GET", "/api/me/orgs", "accountant", ""},
+	{"POST", "/api/me/orgs", "accountant", ""},
+	{"POST", "/api/me/orgs/:id/switch", "accountant", ""},
+	{"POST", "/api/me/2fa/setup", "accountant", ""},
+	{"POST", "/api/me/2fa/enable", "accountant", ""},
+	{"POST", "/api/me/2fa/disable", "accountant", ""},
+	{"POST", "/api/me/2fa/recovery-codes", "accountant", ""},
+	{"GET", "/api/org", "accountant", "org:read"},
+	{"PUT", "/api/org", "admin", ""},
+	{"GET", "/api/org/payment-webhook", "admin", ""},
+	{"PUT", "/api/org/payment-webhook", "admin", ""},
+	{"GET", "/api/members", "accountant", ""},
+	{"PUT", "/api/members/:id", "admin", ""},
+	{"DELETE", "/api/members/:id", "accountant", ""},
+	{"GET", "/api/invitations", "admin", ""},
+	{"POST", "/api/invitations", "admin", ""},
+	{"DELETE", "/api/invitations/:id", "admin", ""},
+	{"GET", "/api/api-keys", "admin", ""},
+	{"POST", "/api/api-keys", "admin", ""},
+	{"DELETE", "/api/api-keys/:id", "admin", ""},
+	{"GET", "/api/webhooks", "admin", ""},
+	{"POST", "/api/webhooks", "admin", ""},
+	{"PUT", "/api/webhooks/:id", "admin", ""},
+	{"DELETE", "/api/webhooks/:id", "admin", ""},
+	{"GET", "/api/webhooks/:id/deliveries", "admin", ""},
+	{"POST", "/api/webhooks/:id/deliveries/:delivery_id/redeliver", "admin", ""},
+	{"GET", "/api/audit", "admin", "audit:read"},
+	{"GET", "/api/audit/export", "admin", "audit:read"},
+	{"GET", "/api/metrics", "accountant", "metrics:read"},
+	{"GET", "/api/exports/invoices", "accountant", "invoices:read"},
+	{"GET", "/api/exports/reminders", "accountant", "reminders:read"},
+	{"GET", "/api/exports/outbox", "accountant", "outbox:read"},
+	{"GET", "/api/exports/payments", "accountant", "invoices:read"},
+	{"GET", "/api/search", "accountant", ""},
+	{"GET", "/api/clients", "accountant", "clients:read"},
+	{"POST", "/api/clients", "member", "clients:write"},
+	{"GET", "/api/clients/:id", "accountant", "clients:read"},
+	{"PUT", "/api/clients/:id", "member", "clients:write"},
+	{"PATCH", "/api/clients/:id", "member", "clients:write"},
+	{"DELETE", "/api/clients/:id", "member", "clients:write"},
+	{"GET", "/api/templates", "accountant", "templates:read"},
+	{"POST", "/api/templates", "member", "templates:write"},
+	{"PUT", "/api/templates/:id", "member", "templates:write"},
+	{"PATCH", "/api/templates/:id", "member", "templates:write"},
+	{"DELETE", "/api/templates/:id", "member", "templates:write"},
+	{"POST", "/api/templates/:id/default", "member", "templates:write"},
+	{"POST", "/api/import/clients", "member", "clients:write"},
+	{"POST", "/api/import/invoices", "member", "invoices:write"},
+	{"GET", "/api/invoices", "accountant", "invoices:read"},
+	{"POST", "/api/invoices", "member", "invoices:write"},
+	{"GET", "/api/invoices/:id", "accountant", "invoices:read"},
+	{"PUT", "/api/invoices/:id", "member", "invoices:write"},
+	{"PATCH", "/api/invoices/:id", "member", "invoices:write"},
+	{"DELETE", "/api/invoices/:id", "member", "invoices:write"},
+	{"POST", "/api/invoices/:id/payment-link", "member", "invoices:write"},
+	{"GET", "/api/invoices/:id/share-links", "accountant", "invoices:read"},
+	{"POST", "/api/invoices/:id/share-links", "member", "invoices:write"},
+	{"DELETE", "/api/invoices/:id/share-links/:link_id", "member", "invoices:write"},
+	{"GET", "/api/reminders", "accountant", "reminders:read"},
+	{"POST", "/api/reminders/:id/send", "member", "reminders:send"},
+	{"POST", "/api/reminders/send-due", "member", "reminders:send"},
+	{"GET", "/api/outbox", "accountant", "outbox:read"},
+	{"GET", "/api/suppressions", "accountant", "suppressions:read"},
+	{"POST", "/api/suppressions", "member", "suppressions:write"},
+	{"DELETE", "/api/suppressions/:id", "member", "suppressions:write"},
+	{"POST", "/api/auth/logout", "accountant", ""},
+}
+
+var publicRoutes = map[string]bool{
+	"GET /health":                                  true,
+	"POST /api/auth/register":                      true,
+	"POST /api/auth/login":                         true,
+	"POST /api/auth/login/2fa":                     true,
+	"POST /api/auth/refresh":                       true,
+	"POST /api/auth/verify-email":                  true,
+	"POST /api/auth/forgot-password":               true,
+	"POST /api/auth/reset-password":                true,
+	"POST /api/auth/accept-invite":                 true,
+	"GET /api/auth/sso/providers":                  true,
+	"POST /api/auth/sso/:provider/start":           true,
+	"POST /api/auth/sso/callback":                  true,
+	"POST /api/payment-webhooks/:org_id/:provider": true,
+	"GET /pay/:token":                              true,
+	"GET /pay/:token/pdf":                          true,
+	"GET /unsubscribe/:token":                      true,
+	"POST /unsubscribe/:token":                     true,
+	// Portal routes take client portal sessions, never staff credentials.
+	"POST /api/portal/login":           true,
+	"POST /api/portal/session":         true,
+	"POST /api/portal/logout":          true,
+	"GET /api/portal/me":               true,
+	"GET /api/portal/invoices":         true,
+	"GET /api/portal/invoices/:id":     true,
+	"GET /api/portal/invoices/:id/pdf": true,
+	"GET /api/portal/payments":         true,
+	"GET /api/portal/reminders":        true,
+	"GET /api/portal/statement":        true,
+}
+
+var roleOrder = []string{"accountant", "member", "admin", "owner"}
+
+func roleIndex(role string) int {
+	for i, r := range roleOrder {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestEveryRouteHasARoleRule(t *testing.T) {
+	app, cleanup := newTestApp(t)
+	defer cleanup()
+
+	listed := map[string]bool{}
+	for _, rr := range routeRoles {
+		listed[rr.method+" "+rr.path] = true
+	}
+	for _, route := range app.GetRoutes(true) {
+		if route.Method == fiber.MethodHead {
+			continue
+		}
+		key := route.Method + " " + route.Path
+		if !publicRoutes[key] && !listed[key] {
+			t.Errorf("route %s has no entry in routeRoles", key)
+		}
+	}
+}
+
+func TestRoleAccessAcrossRoutes(t *testing.T) {
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", BaseURL: "http://app.test"})
+	defer cleanup()
+
+	owner := registerOrg(t, app, "owner@example.com", "Studio One")
+	tokens := map[string]string{"owner": owner.Token}
+	for _, role := range []string{"admin", "member", "accountant"} {
+		tokens[role] = inviteAndAccept(t, app, database, owner.Token, role+"@example.com", role)
+	}
+
+	for _, rr := range routeRoles {
+		path := strings.ReplaceAll(rr.path, ":id", "00000000-0000-0000-0000-000000000000")
+		for _, role := range roleOrder {
+			resp := performRequest(t, app, rr.method, path, map[string]string{}, tokens[role])
+			resp.Body.Close()
+			allowed := roleIndex(role) >= roleIndex(rr.min)
+			if allowed && resp.StatusCode == http.StatusForbidden {
+				t.Errorf("%s %s as %s: expected access, got 403", rr.method, rr.path, role)
+			}
+			if !allowed && resp.StatusCode != http.StatusForbidden {
+				t.Errorf("%s %s as %s: expected 403, got %d", rr.method, rr.path, role, resp.StatusCode)
+			}
+		}
+	}
+}
+
+func TestAPIKeyScopesAcrossRoutes(t *testing.T) {
+	app, cleanup := newTestApp(t)
+	defer cleanup()
+
+	owner := registerOrg(t, app, "owner@example.com", "Studio One")
+	all := []string{}
+	for _, rr := range routeRoles {
+		if rr.scope != "" {
+			all = append(all, rr.scope)
+		}
+	}
+	keys := map[string]string{
+		"full":   createAPIKey(t, app, owner.Token, all, ""),
+		"narrow": createAPIKey(t, app, owner.Token, []string{"invoices:read"}, ""),
+	}
+
+	for _, rr := range routeRoles {
+		path := strings.ReplaceAll(rr.path, ":id", "00000000-0000-0000-0000-000000000000")
+		for name, key := range keys {
+			resp := performRequest(t, app, rr.method, path, map[string]string{}, key)
+			resp.Body.Close()
+			allowed := rr.scope != "" && (name == "full" || rr.scope == "invoices:read")
+			if allowed && resp.StatusCode == http.StatusForbidden {
+				t.Errorf("%s %s with %s key: expected access, got 403", rr.method, rr.path, name)
+			}
+			if !allowed && resp.StatusCode != http.StatusForbidden {
+				t.Errorf("%s %s with %s key: expected 403, got %d", rr.method, rr.path, name, resp.StatusCode)
+			}
+		}
+	}
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)}
+	app, _, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", Clock: clock.Now})
+	defer cleanup()
+
+	owner := registerOrg(t, app, "owner@example.com", "Studio One")
+	other := registerOrg(t, app, "other@example.com", "Other Co")
+	key := createAPIKey(t, app, owner.Token, []string{"clients:write", "invoices:write", "invoices:read"}, "")
+
+	resp := performRequest(t, app, "POST", "/api/clients", map[string]string{
+		"name": "Billing Sync", "email": "sync@example.com", "company": "SyncCo",
+	}, key)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 creating client with key, got %d", resp.StatusCode)
+	}
+	var client createResponse
+	decodeJSON(t, resp, &client)
+	resp = performRequest(t, app, "POST", "/api/invoices", map[string]interface{}{
+		"client_id": client.ID, "number": "EXT-1", "amount_cents": 5000, "currency": "usd", "due_date": "2030-01-01",
+	}, key)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 pushing invoice with key, got %d", resp.StatusCode)
+	}
+
+	var invoices struct {
+		Invoices []createResponse `json:"invoices"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/invoices", nil, other.Token), &invoices)
+	if len(invoices.Invoices) != 0 {
+		t.Fatalf("expected key writes to stay in the key's org")
+	}
+
+	var list struct {
+		APIKeys []struct {
+			ID         string  `json:"id"`
+			Prefix     string  `json:"prefix"`
+			Key        string  `json:"key"`
+			LastUsedAt *string `json:"last_used_at"`
+		} `json:"api_keys"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/api-keys", nil, owner.Token), &list)
+	if len(list.APIKeys) != 1 || list.APIKeys[0].Key != "" || !strings.HasPrefix(key, list.APIKeys[0].Prefix+"_") {
+		t.Fatalf("expected one listed key without its secret, got %+v", list.APIKeys)
+	}
+	if list.APIKeys[0].LastUsedAt == nil {
+		t.Fatalf("expected last_used_at to be recorded")
+	}
+
+	forged := key[:len(key)-4] + "AAAA"
+	if resp := performRequest(t, app, "GET", "/api/invoices", nil, forged); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a wrong secret, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "DELETE", "/api/api-keys/"+list.APIKeys[0].ID, nil, owner.Token); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 revoking key, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "GET", "/api/invoices", nil, key); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a revoked key, got %d", resp.StatusCode)
+	}
+
+	expiring := createAPIKey(t, app, owner.Token, []string{"invoices:read"}, clock.Now().Add(time.Hour).Format(time.RFC3339))
+	if resp := performRequest(t, app, "GET", "/api/invoices", nil, expiring); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 before expiry, got %d", resp.StatusCode)
+	}
+	clock.Advance(2 * time.Hour)
+	if resp := performRequest(t, app, "GET", "/api/invoices", nil, expiring); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 after expiry, got %d", resp.StatusCode)
+	}
+}
+
+func TestInvitationsAndMemberManagement(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)}
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{JWTSecret: "test-secret", BaseURL: "http://app.test", Clock: clock.Now})
+	defer cleanup()
+
+	owner := registerOrg(t, app, "owner@example.com", "Studio One")
+	other := registerOrg(t, app, "bookkeeper@example.com", "Books Ltd")
+
+	// Invitation emails carry a secret, so they stay out of the org outbox.
+	resp := performRequest(t, app, "POST", "/api/invitations", map[string]string{"email": "late@example.com", "role": "member"}, owner.Token)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 inviting, got %d", resp.StatusCode)
+	}
+	expiredToken := latestEmailToken(t, database, "invitation", "late@example.com")
+	var outbox outboxResponse
+	decodeJSON(t, performRequest(t, app, "GET", "/api/outbox", nil, owner.Token), &outbox)
+	if len(outbox.Outbox) != 0 {
+		t.Fatalf("expected invitation emails hidden from outbox, got %d", len(outbox.Outbox))
+	}
+	clock.Advance(8 * 24 * time.Hour)
+	resp = performRequest(t, app, "POST", "/api/auth/accept-invite", map[string]string{"token": expiredToken, "password": "password123"}, "")
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("expected 410 for expired invitation, got %d", resp.StatusCode)
+	}
+
+	// Re-inviting replaces the pending link.
+	performRequest(t, app, "POST", "/api/invitations", map[string]string{"email": "bookkeeper@example.com", "role": "member"}, owner.Token)
+	stale := latestEmailToken(t, database, "invitation", "bookkeeper@example.com")
+	performRequest(t, app, "POST", "/api/invitations", map[string]string{"email": "bookkeeper@example.com", "role": "accountant"}, owner.Token)
+	fresh := latestEmailToken(t, database, "invitation", "bookkeeper@example.com")
+	resp = performRequest(t, app, "POST", "/api/auth/accept-invite", map[string]string{"token": stale}, "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for replaced invitation, got %d", resp.StatusCode)
+	}
+
+	// Existing accounts gain the membership but are not signed in by the link.
+	resp = performRequest(t, app, "POST", "/api/auth/accept-invite", map[string]string{"token": fresh}, "")
+	var accepted loginResponse
+	decodeJSON(t, resp, &accepted)
+	if resp.StatusCode != http.StatusOK || accepted.Token != "" {
+		t.Fatalf("expected acceptance without a session, got %d", resp.StatusCode)
+	}
+	var members struct {
+		Members []struct {
+			UserID string `json:"user_id"`
+			Email  string `json:"email"`
+			Role   string `json:"role"`
+		} `json:"members"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/members", nil, owner.Token), &members)
+	if len(members.Members) != 2 || members.Members[1].Email != "bookkeeper@example.com" || members.Members[1].Role != "accountant" {
+		t.Fatalf("unexpected members: %+v", members.Members)
+	}
+	var me struct {
+		Org struct {
+			ID string `json:"id"`
+		} `json:"org"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/me", nil, other.Token), &me)
+	if me.Org.ID != other.Org.ID {
+		t.Fatalf("expected bookkeeper to keep their own org")
+	}
+
+	admin := inviteAndAccept(t, app, database, owner.Token, "admin@example.com", "admin")
+	second := inviteAndAccept(t, app, database, owner.Token, "second@example.com", "admin")
+	var secondID string
+	decodeJSON(t, performRequest(t, app, "GET", "/api/members", nil, owner.Token), &members)
+	for _, m := range members.Members {
+		if m.Email == "second@example.com" {
+			secondID = m.UserID
+		}
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		body   map[string]string
+		token  string
+		status int
+	}{
+		{"nobody grants ownership", "POST", "/api/invitations", map[string]string{"email": "x@example.com", "role": "owner"}, owner.Token, http.StatusForbidden},
+		{"admin cannot demote a peer", "PUT", "/api/members/" + secondID, map[string]string{"role": "member"}, admin, http.StatusForbidden},
+		{"owner cannot be removed", "DELETE", "/api/members/" + owner.User.ID, nil, admin, http.StatusConflict},
+		{"owner cannot be demoted", "PUT", "/api/members/" + owner.User.ID, map[string]string{"role": "admin"}, admin, http.StatusConflict},
+		{"existing member not reinvited", "POST", "/api/invitations", map[string]string{"email": "admin@example.com", "role": "member"}, owner.Token, http.StatusConflict},
+		{"owner demotes an admin", "PUT", "/api/members/" + secondID, map[string]string{"role": "member"}, owner.Token, http.StatusOK},
+		{"admin removes a member", "DELETE", "/api/members/" + secondID, nil, admin, http.StatusNoContent},
+	}
+	for _, tc := range cases {
+		resp := performRequest(t, app, tc.method, tc.path, tc.body, tc.token)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s: expected %d, got %d", tc.name, tc.status, resp.StatusCode)
+		}
+	}
+
+	// The removed member's sessions in the org end immediately.
+	if resp := performRequest(t, app, "GET", "/api/me", nil, second); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 after removal, got %d", resp.StatusCode)
+	}
+	resp = performRequest(t, app, "POST", "/api/auth/login", map[string]string{"email": "second@example.com", "password": "password123"}, "")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 logging in without memberships, got %d", resp.StatusCode)
+	}
+}
+
+func inviteAndAccept(t *testing.T, app *fiber.App, database *sql.DB, ownerToken, email, role string) string {
+	t.Helper()
+	resp := performRequest(t, app, "POST", "/api/invitations", map[string]string{"email": email, "role": role}, ownerToken)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("invite %s: expected 201, got %d", email, resp.StatusCode)
+	}
+	token := latestEmailToken(t, database, "invitation", email)
+	resp = performRequest(t, app, "POST", "/api/auth/accept-invite", map[string]string{"token": token, "password": "password123"}, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("accept %s: expected 200, got %d", email, resp.StatusCode)
+	}
+	var out loginResponse
+	decodeJSON(t, resp, &out)
+	if out.Token == "" {
+		t.Fatalf("accept %s: expected a session for the new account", email)
+	}
+	return out.Token
+}
+
+func createAPIKey(t *testing.T, app *fiber.App, token string, scopes []string, expiresAt string) string {
+	t.Helper()
+	resp := performRequest(t, app, "POST", "/api/api-keys", map[string]interface{}{
+		"name": "integration", "scopes": scopes, "expires_at": expiresAt,
+	}, token)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create api key: expected 201, got %d", resp.StatusCode)
+	}
+	var out struct {
+		Key string `json:"key"`
+	}
+	decodeJSON(t, resp, &out)
+	return out.Key
+}
@@ -0,0 +1,300 @@
+package api_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+
+	"nudgepay/internal/config"
+)
+
+// fakeIdP is a minimal OpenID Connect provider: discovery, JWKS, an authorize
+// endpoint that signs in whoever the test chose, and a token endpoint that
+// checks PKCE before handing out an RS256 ID token.
+type fakeIdP struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	clock  *fakeClock
+
+	mu       sync.Mutex
+	subject  string
+	email    string
+	verified bool
+	// badNonce makes the next ID token carry the wrong nonce.
+	badNonce bool
+	codes    map[string]url.Values
+}
+
+func newFakeIdP(t *testing.T, clock *fakeClock) *fakeIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("key error: %v", err)
+	}
+	idp := &fakeIdP{t: t, key: key, clock: clock, codes: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "key-1", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code := "code-" + q.Get("state")[:8]
+		idp.mu.Lock()
+		idp.codes[code] = q
+		idp.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *fakeIdP) provider() config.OIDCProvider {
+	return config.OIDCProvider{Name: "acme", Issuer: idp.server.URL, ClientID: "nudgepay", ClientSecret: "s3cret"}
+}
+
+func (idp *fakeIdP) signIn(subject, email string, verified bool) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.subject, idp.email, idp.verified = subject, email, verified
+}
+
+func (idp *fakeIdP) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	auth, ok := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case !ok, r.PostForm.Get("client_secret") != "s3cret",
+		r.PostForm.Get("redirect_uri") != auth.Get("redirect_uri"),
+		base64.RawURLEncoding.EncodeToString(sum[:]) != auth.Get("code_challenge"):
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	nonce := auth.Get("nonce")
+	if idp.badNonce {
+		nonce, idp.badNonce = "forged", false
+	}
+	now := idp.clock.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss": idp.server.URL, "aud": "nudgepay", "sub": idp.subject,
+		"email": idp.email, "email_verified": idp.verified, "nonce": nonce,
+		"iat": now.Unix(), "exp": now.Add(5 * time.Minute).Unix(),
+	})
+	token.Header["kid"] = "key-1"
+	signed, err := token.SignedString(idp.key)
+	if err != nil {
+		idp.t.Errorf("sign error: %v", err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "token_type": "Bearer"})
+}
+
+// ssoLogin walks the browser part of the flow and returns the callback request
+// the frontend would post.
+func ssoLogin(t *testing.T, app *fiber.App) map[string]string {
+	t.Helper()
+	var start struct {
+		AuthorizationURL string `json:"authorization_url"`
+	}
+	resp := performRequest(t, app, "POST", "/api/auth/sso/acme/start", nil, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("start: expected 200, got %d", resp.StatusCode)
+	}
+	decodeJSON(t, resp, &start)
+	browser := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	idpResp, err := browser.Get(start.AuthorizationURL)
+	if err != nil {
+		t.Fatalf("authorize error: %v", err)
+	}
+	idpResp.Body.Close()
+	back, err := url.Parse(idpResp.Header.Get("Location"))
+	if err != nil || back.Path != "/sso/callback" {
+		t.Fatalf("unexpected redirect %q", idpResp.Header.Get("Location"))
+	}
+	return map[string]string{"state": back.Query().Get("state"), "code": back.Query().Get("code")}
+}
+
+func TestSingleSignOnLoginAndOrgEnforcement(t *testing.T) {
+	clock := &fakeClock{now: time.Now().UTC()}
+	idp := newFakeIdP(t, clock)
+	app, database, cleanup := newTestAppWithConfig(t, config.Config{
+		JWTSecret: "test-secret", BaseURL: "http://app.test", Clock: clock.Now,
+		OIDCProviders: []config.OIDCProvider{idp.provider()},
+	})
+	defer cleanup()
+
+	var providers struct {
+		Providers []string `json:"providers"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/auth/sso/providers", nil, ""), &providers)
+	if len(providers.Providers) != 1 || providers.Providers[0] != "acme" {
+		t.Fatalf("unexpected providers %v", providers.Providers)
+	}
+	if resp := performRequest(t, app, "POST", "/api/auth/sso/nope/start", nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown provider, got %d", resp.StatusCode)
+	}
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+
+	// A password session may not switch enforcement on.
+	resp := performRequest(t, app, "PUT", "/api/org", map[string]interface{}{"name": "Studio One", "require_sso": true}, reg.Token)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 enabling SSO from a password session, got %d", resp.StatusCode)
+	}
+
+	idp.signIn("idp-user-1", "Owner@Example.com", true)
+	callback := ssoLogin(t, app)
+	resp = performRequest(t, app, "POST", "/api/auth/sso/callback", callback, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("callback: expected 200, got %d", resp.StatusCode)
+	}
+	var session loginResponse
+	decodeJSON(t, resp, &session)
+	if session.Token == "" || session.RefreshToken == "" {
+		t.Fatalf("expected tokens after SSO login")
+	}
+	if resp := performRequest(t, app, "POST", "/api/auth/sso/callback", callback, ""); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected replayed state rejected, got %d", resp.StatusCode)
+	}
+	var linked int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM user_identities WHERE provider = 'acme' AND subject = 'idp-user-1'`).Scan(&linked); err != nil || linked != 1 {
+		t.Fatalf("expected identity linked, got %d (%v)", linked, err)
+	}
+
+	idp.badNonce = true
+	if resp := performRequest(t, app, "POST", "/api/auth/sso/callback", ssoLogin(t, app), ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for nonce mismatch, got %d", resp.StatusCode)
+	}
+	idp.signIn("idp-user-2", "stranger@example.com", true)
+	if resp := performRequest(t, app, "POST", "/api/auth/sso/callback", ssoLogin(t, app), ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for unknown user, got %d", resp.StatusCode)
+	}
+	registerOrg(t, app, "unverified@example.com", "Studio Two")
+	idp.signIn("idp-user-3", "unverified@example.com", false)
+	if resp := performRequest(t, app, "POST", "/api/auth/sso/callback", ssoLogin(t, app), ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for unverified email, got %d", resp.StatusCode)
+	}
+
+	resp = performRequest(t, app, "PUT", "/api/org", map[string]interface{}{"name": "Studio One", "require_sso": true}, session.Token)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 enabling SSO, got %d", resp.StatusCode)
+	}
+
+	// Existing password sessions lose access to org data; new ones are refused.
+	if resp := performRequest(t, app, "GET", "/api/clients", nil, reg.Token); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for password session, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "GET", "/api/me", nil, reg.Token); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected /api/me reachable, got %d", resp.StatusCode)
+	}
+	for _, path := range []string{"/api/me/2fa/setup", "/api/me/orgs"} {
+		if resp := performRequest(t, app, "POST", path, map[string]string{"name": "Side Project"}, reg.Token); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected %s blocked for password session, got %d", path, resp.StatusCode)
+		}
+	}
+	resp = performRequest(t, app, "POST", "/api/auth/login", map[string]string{"email": "owner@example.com", "password": "password123"}, "")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected password login refused, got %d", resp.StatusCode)
+	}
+	if resp := performRequest(t, app, "GET", "/api/clients", nil, session.Token); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected SSO session allowed, got %d", resp.StatusCode)
+	}
+
+	// The subject keeps mapping to the same account even if the email changes.
+	idp.signIn("idp-user-1", "renamed@example.com", false)
+	if resp := performRequest(t, app, "POST", "/api/auth/sso/callback", ssoLogin(t, app), ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected linked subject to sign in, got %d", resp.StatusCode)
+	}
+}
+
+func TestSingleSignOnAsksForTwoFactor(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+	idp := newFakeIdP(t, clock)
+	app, _, cleanup := newTestAppWithConfig(t, config.Config{
+		JWTSecret: "test-secret", BaseURL: "http://app.test", Clock: clock.Now,
+		OIDCProviders: []config.OIDCProvider{idp.provider()},
+	})
+	defer cleanup()
+
+	reg := registerOrg(t, app, "owner@example.com", "Studio One")
+	var setup struct {
+		Secret string `json:"secret"`
+	}
+	decodeJSON(t, performRequest(t, app, "POST", "/api/me/2fa/setup", nil, reg.Token), &setup)
+	resp := performRequest(t, app, "POST", "/api/me/2fa/enable", map[string]string{"code": totpCode(t, setup.Secret, clock.Now())}, reg.Token)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("enable: expected 200, got %d", resp.StatusCode)
+	}
+
+	type callbackResponse struct {
+		Token             string `json:"token"`
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		MFAToken          string `json:"mfa_token"`
+	}
+	idp.signIn("idp-user-1", "owner@example.com", true)
+	var challenge callbackResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/auth/sso/callback", ssoLogin(t, app), ""), &challenge)
+	if !challenge.TwoFactorRequired || challenge.MFAToken == "" || challenge.Token != "" {
+		t.Fatalf("expected a second step instead of a token, got %+v", challenge)
+	}
+	clock.Advance(30 * time.Second)
+	resp = performRequest(t, app, "POST", "/api/auth/login/2fa", map[string]string{
+		"mfa_token": challenge.MFAToken, "code": totpCode(t, setup.Secret, clock.Now()),
+	}, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("2fa: expected 200, got %d", resp.StatusCode)
+	}
+	var session loginResponse
+	decodeJSON(t, resp, &session)
+
+	// The session keeps the sso method, so it may enforce single sign-on.
+	resp = performRequest(t, app, "PUT", "/api/org", map[string]interface{}{"name": "Studio One", "require_sso": true, "sso_skip_2fa": true}, session.Token)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 updating org, got %d", resp.StatusCode)
+	}
+	var org struct {
+		SSOSkip2FA bool `json:"sso_skip_2fa"`
+	}
+	decodeJSON(t, performRequest(t, app, "GET", "/api/org", nil, session.Token), &org)
+	if !org.SSOSkip2FA {
+		t.Fatalf("expected sso_skip_2fa saved")
+	}
+
+	var direct callbackResponse
+	decodeJSON(t, performRequest(t, app, "POST", "/api/auth/sso/callback", ssoLogin(t, app), ""), &direct)
+	if direct.TwoFactorRequired || direct.Token == "" {
+		t.Fatalf("expected tokens once the org trusts the provider, got %+v", direct)
+	}
+}
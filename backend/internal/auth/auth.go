@@ -1,16 +1,34 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+
+	// APIKeyPrefix marks bearer credentials that are API keys rather than JWTs.
+	APIKeyPrefix = "np_"
+	// PortalTokenPrefix marks client portal sessions, which are never valid
+	// for the staff API.
+	PortalTokenPrefix = "npc_"
+)
+
 type Claims struct {
-	UserID string `json:"uid"`
-	OrgID  string `json:"oid"`
+	UserID    string `json:"uid"`
+	OrgID     string `json:"oid"`
+	SessionID string `json:"sid"`
 	jwt.RegisteredClaims
 }
 
@@ -23,26 +41,35 @@ func CheckPassword(hash, password string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 }
 
-func GenerateToken(secret, userID, orgID string) (string, error) {
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// CheckDummyPassword does the same bcrypt work as CheckPassword for logins
+// to accounts that do not exist, so response times do not reveal them.
+func CheckDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("nudgepay-dummy-password"), bcrypt.DefaultCost)
+	})
+	_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+func GenerateToken(keys *KeySet, userID, orgID, sessionID string) (string, error) {
 	claims := Claims{
-		UserID: userID,
-		OrgID:  orgID,
+		UserID:    userID,
+		OrgID:     orgID,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(7 * 24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(AccessTokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secret))
+	return keys.sign(claims)
 }
 
-func ParseToken(secret, tokenString string) (*Claims, error) {
-	parsed, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
-		}
-		return []byte(secret), nil
-	})
+func ParseToken(keys *KeySet, tokenString string) (*Claims, error) {
+	parsed, err := jwt.ParseWithClaims(tokenString, &Claims{}, keys.keyFunc)
 	if err != nil {
 		return nil, err
 	}
@@ -52,3 +79,42 @@ func ParseToken(secret, tokenString string) (*Claims, error) {
 	}
 	return claims, nil
 }
+
+// NewOpaqueToken returns a random URL-safe token and the hash to store for it.
+// Only the hash is persisted so a database leak does not expose usable tokens.
+func NewOpaqueToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	return token, HashOpaqueToken(token), nil
+}
+
+func HashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAPIKey returns a key of the form np_<id>_<secret> together with its
+// public id, used for lookup and display, and the hash of the secret part.
+func NewAPIKey() (key, id, secretHash string, err error) {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", "", err
+	}
+	id = hex.EncodeToString(buf)
+	secret, secretHash, err := NewOpaqueToken()
+	if err != nil {
+		return "", "", "", err
+	}
+	return APIKeyPrefix + id + "_" + secret, id, secretHash, nil
+}
+
+func SplitAPIKey(key string) (id, secret string, ok bool) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return "", "", false
+	}
+	id, secret, ok = strings.Cut(strings.TrimPrefix(key, APIKeyPrefix), "_")
+	return id, secret, ok && id != "" && secret != ""
+}
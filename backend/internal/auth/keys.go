@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	AlgorithmHS256   = "hs256"
+	AlgorithmRS256   = "rs256"
+	AlgorithmEd25519 = "ed25519"
+)
+
+// Key signs or verifies access tokens. Its ID goes in the kid header so a
+// KeySet can pick the right key while tokens from a previous key are still
+// around. Keys loaded from a public key can only verify.
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+	sign   interface{}
+	verify interface{}
+}
+
+func NewHMACKey(id, secret string) Key {
+	return Key{ID: id, Method: jwt.SigningMethodHS256, sign: []byte(secret), verify: []byte(secret)}
+}
+
+// ParsePEMKey reads an RS256 or Ed25519 key. A private key signs and
+// verifies; a public key only verifies.
+func ParsePEMKey(id, algorithm string, data []byte) (Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Key{}, fmt.Errorf("key %q: no PEM data", id)
+	}
+	private := strings.Contains(block.Type, "PRIVATE KEY")
+	key := Key{ID: id}
+	var err error
+	switch algorithm {
+	case AlgorithmRS256:
+		key.Method = jwt.SigningMethodRS256
+		if private {
+			rsaKey, parseErr := jwt.ParseRSAPrivateKeyFromPEM(data)
+			if parseErr == nil {
+				key.sign, key.verify = rsaKey, &rsaKey.PublicKey
+			}
+			err = parseErr
+		} else {
+			key.verify, err = jwt.ParseRSAPublicKeyFromPEM(data)
+		}
+	case AlgorithmEd25519:
+		key.Method = jwt.SigningMethodEdDSA
+		if private {
+			edKey, parseErr := jwt.ParseEdPrivateKeyFromPEM(data)
+			if parseErr == nil {
+				key.sign, key.verify = edKey, edKey.(ed25519.PrivateKey).Public()
+			}
+			err = parseErr
+		} else {
+			key.verify, err = jwt.ParseEdPublicKeyFromPEM(data)
+		}
+	default:
+		return Key{}, fmt.Errorf("key %q: unsupported algorithm %q", id, algorithm)
+	}
+	if err != nil {
+		return Key{}, fmt.Errorf("key %q: %w", id, err)
+	}
+	return key, nil
+}
+
+func (k Key) CanSign() bool {
+	return k.sign != nil
+}
+
+// KeySet signs new tokens with one key and verifies tokens signed by any of
+// its keys. Tokens without a kid header, issued before key IDs existed, are
+// checked against the key whose ID is empty.
+type KeySet struct {
+	signing Key
+	keys    map[string]Key
+}
+
+func NewKeySet(signing Key, verifyOnly ...Key) (*KeySet, error) {
+	if !signing.CanSign() {
+		return nil, fmt.Errorf("key %q cannot sign tokens", signing.ID)
+	}
+	set := &KeySet{signing: signing, keys: map[string]Key{signing.ID: signing}}
+	for _, key := range verifyOnly {
+		if _, exists := set.keys[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate key id %q", key.ID)
+		}
+		set.keys[key.ID] = key
+	}
+	return set, nil
+}
+
+// SecretKeySet is the single shared-secret setup used when no key list is
+// configured.
+func SecretKeySet(secret string) *KeySet {
+	key := NewHMACKey("", secret)
+	return &KeySet{signing: key, keys: map[string]Key{"": key}}
+}
+
+func (s *KeySet) SigningKeyID() string {
+	return s.signing.ID
+}
+
+func (s *KeySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(s.signing.Method, claims)
+	if s.signing.ID != "" {
+		token.Header["kid"] = s.signing.ID
+	}
+	return token.SignedString(s.signing.sign)
+}
+
+func (s *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	// The algorithm comes from the key, never from the token header.
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, errors.New("unexpected signing method")
+	}
+	return key.verify, nil
+}
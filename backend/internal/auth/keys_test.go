@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func pemKey(t *testing.T, blockType string, der []byte, err error) []byte {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+func TestKeySetRotation(t *testing.T) {
+	_, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("key error: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(edPrivate)
+	edKey, err := ParsePEMKey("2026-10", AlgorithmEd25519, pemKey(t, "PRIVATE KEY", der, err))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("key error: %v", err)
+	}
+	rsaKey, err := ParsePEMKey("2026-04", AlgorithmRS256, pemKey(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaPrivate), nil))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	der, err = x509.MarshalPKIXPublicKey(&rsaPrivate.PublicKey)
+	rsaPublic, err := ParsePEMKey("2026-04", AlgorithmRS256, pemKey(t, "PUBLIC KEY", der, err))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if rsaPublic.CanSign() {
+		t.Fatalf("public key must be verify-only")
+	}
+	if _, err := NewKeySet(rsaPublic); err == nil {
+		t.Fatalf("expected verify-only signing key rejected")
+	}
+
+	legacy := SecretKeySet("old-secret")
+	legacyToken, err := GenerateToken(legacy, "u1", "o1", "s1")
+	if err != nil {
+		t.Fatalf("sign error: %v", err)
+	}
+	before, err := NewKeySet(rsaKey, NewHMACKey("", "old-secret"))
+	if err != nil {
+		t.Fatalf("key set error: %v", err)
+	}
+	rsaToken, err := GenerateToken(before, "u1", "o1", "s1")
+	if err != nil {
+		t.Fatalf("sign error: %v", err)
+	}
+
+	// Rotate to Ed25519, keeping the RSA public key and the old secret for
+	// tokens that are still in flight.
+	after, err := NewKeySet(edKey, rsaPublic, NewHMACKey("", "old-secret"))
+	if err != nil {
+		t.Fatalf("key set error: %v", err)
+	}
+	edToken, err := GenerateToken(after, "u1", "o1", "s1")
+	if err != nil {
+		t.Fatalf("sign error: %v", err)
+	}
+	for name, token := range map[string]string{"legacy": legacyToken, "rs256": rsaToken, "ed25519": edToken} {
+		claims, err := ParseToken(after, token)
+		if err != nil || claims.SessionID != "s1" {
+			t.Fatalf("%s token: expected valid, got %v", name, err)
+		}
+	}
+	parsed, _, err := jwt.NewParser().ParseUnverified(edToken, &Claims{})
+	if err != nil || parsed.Header["kid"] != "2026-10" || parsed.Header["alg"] != "EdDSA" {
+		t.Fatalf("unexpected header %v (%v)", parsed.Header, err)
+	}
+
+	// Once the old keys are dropped their tokens stop working.
+	final, err := NewKeySet(edKey)
+	if err != nil {
+		t.Fatalf("key set error: %v", err)
+	}
+	if _, err := ParseToken(final, rsaToken); err == nil {
+		t.Fatalf("expected token from removed key rejected")
+	}
+	if _, err := ParseToken(final, legacyToken); err == nil {
+		t.Fatalf("expected kid-less token rejected without a legacy key")
+	}
+}
+
+func TestKeySetRejectsAlgorithmConfusion(t *testing.T) {
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("key error: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaPrivate.PublicKey)
+	publicPEM := pemKey(t, "PUBLIC KEY", der, err)
+	rsaKey, err := ParsePEMKey("k1", AlgorithmRS256, pemKey(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaPrivate), nil))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	set, err := NewKeySet(rsaKey)
+	if err != nil {
+		t.Fatalf("key set error: %v", err)
+	}
+
+	// An HS256 token keyed with the public key PEM must not verify against k1.
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{UserID: "u1", SessionID: "s1"})
+	forged.Header["kid"] = "k1"
+	signed, err := forged.SignedString(publicPEM)
+	if err != nil {
+		t.Fatalf("sign error: %v", err)
+	}
+	if _, err := ParseToken(set, signed); err == nil {
+		t.Fatalf("expected HS256 token for an RS256 key rejected")
+	}
+	unknown := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{UserID: "u1"})
+	unknown.Header["kid"] = "nope"
+	signed, _ = unknown.SignedString([]byte("x"))
+	if _, err := ParseToken(set, signed); err == nil {
+		t.Fatalf("expected unknown kid rejected")
+	}
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// Test vectors from RFC 4226 Appendix D and RFC 6238 Appendix B (SHA1).
+var rfcSeed = []byte("12345678901234567890")
+
+func TestHOTPVectors(t *testing.T) {
+	expected := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, want := range expected {
+		if got := hotp(rfcSeed, uint64(counter), 6); got != want {
+			t.Fatalf("counter %d: expected %s, got %s", counter, want, got)
+		}
+	}
+}
+
+func TestTOTPVectors(t *testing.T) {
+	cases := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tc := range cases {
+		step := TOTPStep(time.Unix(tc.unix, 0))
+		if got := hotp(rfcSeed, uint64(step), 8); got != tc.want {
+			t.Fatalf("t=%d: expected %s, got %s", tc.unix, tc.want, got)
+		}
+	}
+}
+
+func TestVerifyTOTPWindowAndReplay(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfcSeed)
+	now := time.Unix(1111111111, 0)
+	code, err := TOTPCode(secret, now)
+	if err != nil {
+		t.Fatalf("code error: %v", err)
+	}
+	if code != "050471" {
+		t.Fatalf("expected 050471, got %s", code)
+	}
+
+	step, ok := VerifyTOTP(secret, code, now.Add(TOTPPeriod*time.Second), 0)
+	if !ok || step != TOTPStep(now) {
+		t.Fatalf("expected code accepted one step later")
+	}
+	if _, ok := VerifyTOTP(secret, code, now.Add(2*TOTPPeriod*time.Second), 0); ok {
+		t.Fatalf("expected code rejected two steps later")
+	}
+	if _, ok := VerifyTOTP(secret, code, now, step); ok {
+		t.Fatalf("expected replayed code rejected")
+	}
+}
@@ -1,27 +1,237 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+
+	"nudgepay/internal/auth"
+	"nudgepay/internal/mail"
+	"nudgepay/internal/payments"
+)
+
+const (
+	EnvDevelopment = "development"
+
+	// DefaultJWTSecret is only accepted with NUDGEPAY_ENV=development.
+	DefaultJWTSecret = "change-me"
 )
 
+// OIDCProvider is an OpenID Connect identity provider users may sign in with.
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+}
+
 type Config struct {
-	Addr          string
-	DBPath        string
-	JWTSecret     string
+	Env       string
+	Addr      string
+	DBPath    string
+	JWTSecret string
+	// JWTKeys signs and verifies access tokens. When nil, a key set built from
+	// JWTSecret is used.
+	JWTKeys       *auth.KeySet
 	WorkerEnabled bool
 	BaseURL       string
+	OIDCProviders []OIDCProvider
+	// PaymentProvider creates the payment links sent with reminders; nil
+	// leaves {{payment_link}} empty.
+	PaymentProvider payments.PaymentProvider
+	// Mailer sends what is written to the outbox; nil leaves emails there
+	// for another process to pick up.
+	Mailer mail.Sender
+	// AllowPrivateWebhooks lets webhook endpoints use loopback and private
+	// addresses, for local development and tests.
+	AllowPrivateWebhooks bool
+	// Clock overrides the wall clock; tests set it to simulate expiry.
+	Clock func() time.Time
 }
 
-func Load() Config {
+func (c Config) Now() time.Time {
+	if c.Clock != nil {
+		return c.Clock().UTC()
+	}
+	return time.Now().UTC()
+}
+
+func Load() (Config, error) {
 	cfg := Config{
+		Env:           envOr("NUDGEPAY_ENV", "production"),
 		Addr:          envOr("NUDGEPAY_ADDR", ":8080"),
 		DBPath:        envOr("NUDGEPAY_DB", "./nudgepay.db"),
-		JWTSecret:     envOr("NUDGEPAY_JWT_SECRET", "change-me"),
+		JWTSecret:     envOr("NUDGEPAY_JWT_SECRET", DefaultJWTSecret),
 		WorkerEnabled: envBool("NUDGEPAY_WORKER", true),
 		BaseURL:       envOr("NUDGEPAY_BASE_URL", "http://localhost:8080"),
+
+		AllowPrivateWebhooks: envBool("NUDGEPAY_WEBHOOK_ALLOW_PRIVATE", false),
+	}
+	// NUDGEPAY_OIDC_PROVIDERS=google,microsoft reads NUDGEPAY_OIDC_GOOGLE_ISSUER,
+	// NUDGEPAY_OIDC_GOOGLE_CLIENT_ID and NUDGEPAY_OIDC_GOOGLE_CLIENT_SECRET, etc.
+	for _, name := range strings.Split(os.Getenv("NUDGEPAY_OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+		prefix := "NUDGEPAY_OIDC_" + strings.ToUpper(name) + "_"
+		cfg.OIDCProviders = append(cfg.OIDCProviders, OIDCProvider{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+		})
+	}
+	provider, err := loadPaymentProvider(cfg)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.PaymentProvider = provider
+	mailer, err := loadMailer()
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.Mailer = mailer
+	keys, err := loadJWTKeys(cfg.JWTSecret, os.Getenv("NUDGEPAY_JWT_KEYS"))
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.JWTKeys = keys
+	if cfg.Env != EnvDevelopment && usesDefaultSecret(cfg.JWTSecret, os.Getenv("NUDGEPAY_JWT_KEYS")) {
+		return Config{}, errors.New("refusing to sign tokens with the default JWT secret; set NUDGEPAY_JWT_SECRET or NUDGEPAY_JWT_KEYS, or NUDGEPAY_ENV=development")
+	}
+	return cfg, nil
+}
+
+// loadMailer reads NUDGEPAY_SMTP_ADDR (host:port) and NUDGEPAY_SMTP_FROM,
+// with NUDGEPAY_SMTP_USERNAME and NUDGEPAY_SMTP_PASSWORD when the relay
+// needs them.
+func loadMailer() (mail.Sender, error) {
+	addr := strings.TrimSpace(os.Getenv("NUDGEPAY_SMTP_ADDR"))
+	if addr == "" {
+		return nil, nil
+	}
+	from := strings.TrimSpace(os.Getenv("NUDGEPAY_SMTP_FROM"))
+	if from == "" {
+		return nil, errors.New("NUDGEPAY_SMTP_ADDR requires NUDGEPAY_SMTP_FROM")
+	}
+	return &mail.SMTP{
+		Addr:     addr,
+		From:     from,
+		Username: os.Getenv("NUDGEPAY_SMTP_USERNAME"),
+		Password: os.Getenv("NUDGEPAY_SMTP_PASSWORD"),
+	}, nil
+}
+
+// loadPaymentProvider reads NUDGEPAY_PAYMENT_PROVIDER: "stripe" creates
+// Checkout sessions with NUDGEPAY_STRIPE_SECRET_KEY (against
+// NUDGEPAY_STRIPE_API_URL when set), and "fake", development only, keeps
+// links in memory.
+func loadPaymentProvider(cfg Config) (payments.PaymentProvider, error) {
+	switch name := strings.TrimSpace(strings.ToLower(os.Getenv("NUDGEPAY_PAYMENT_PROVIDER"))); name {
+	case "":
+		return nil, nil
+	case payments.ProviderStripe:
+		key := os.Getenv("NUDGEPAY_STRIPE_SECRET_KEY")
+		if key == "" {
+			return nil, errors.New("NUDGEPAY_PAYMENT_PROVIDER=stripe requires NUDGEPAY_STRIPE_SECRET_KEY")
+		}
+		return &payments.StripeCheckout{
+			SecretKey: key,
+			APIURL:    envOr("NUDGEPAY_STRIPE_API_URL", payments.DefaultStripeAPIURL),
+			ReturnURL: cfg.BaseURL,
+		}, nil
+	case payments.ProviderFake:
+		if cfg.Env != EnvDevelopment {
+			return nil, errors.New("NUDGEPAY_PAYMENT_PROVIDER=fake is only allowed with NUDGEPAY_ENV=development")
+		}
+		return payments.NewFakeProvider(cfg.BaseURL), nil
+	default:
+		return nil, fmt.Errorf("NUDGEPAY_PAYMENT_PROVIDER: unknown provider %q", name)
+	}
+}
+
+// loadJWTKeys reads NUDGEPAY_JWT_KEYS, a comma-separated list of
+// id:algorithm:value entries. The first entry signs new tokens and the rest
+// only verify, which lets a key be rotated out without logging everyone out.
+// For hs256 the value is the secret; for rs256 and ed25519 it is the path to
+// a PEM file (a public key is enough for verify-only entries). Without the
+// list, NUDGEPAY_JWT_SECRET signs as before. With it, NUDGEPAY_JWT_SECRET is
+// still accepted for tokens that have no key id, if it was set explicitly.
+func loadJWTKeys(secret, spec string) (*auth.KeySet, error) {
+	if strings.TrimSpace(spec) == "" {
+		return auth.SecretKeySet(secret), nil
+	}
+	var keys []auth.Key
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, errors.New("NUDGEPAY_JWT_KEYS: entries must be id:algorithm:value")
+		}
+		id, algorithm, value := parts[0], strings.ToLower(parts[1]), parts[2]
+		if algorithm == auth.AlgorithmHS256 {
+			keys = append(keys, auth.NewHMACKey(id, value))
+			continue
+		}
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("NUDGEPAY_JWT_KEYS: %w", err)
+		}
+		key, err := auth.ParsePEMKey(id, algorithm, data)
+		if err != nil {
+			return nil, fmt.Errorf("NUDGEPAY_JWT_KEYS: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return auth.SecretKeySet(secret), nil
+	}
+	if secret != DefaultJWTSecret {
+		keys = append(keys, auth.NewHMACKey("", secret))
+	}
+	set, err := auth.NewKeySet(keys[0], keys[1:]...)
+	if err != nil {
+		return nil, fmt.Errorf("NUDGEPAY_JWT_KEYS: %w", err)
+	}
+	return set, nil
+}
+
+func usesDefaultSecret(secret, spec string) bool {
+	if strings.TrimSpace(spec) == "" {
+		return secret == DefaultJWTSecret
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		if len(parts) == 3 && strings.ToLower(parts[1]) == auth.AlgorithmHS256 && parts[2] == DefaultJWTSecret {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenKeys returns the configured key set, falling back to JWTSecret for
+// configs built by hand.
+func (c Config) TokenKeys() *auth.KeySet {
+	if c.JWTKeys != nil {
+		return c.JWTKeys
+	}
+	return auth.SecretKeySet(c.JWTSecret)
+}
+
+func (c Config) OIDCProvider(name string) (OIDCProvider, bool) {
+	for _, p := range c.OIDCProviders {
+		if p.Name == name {
+			return p, true
+		}
 	}
-	return cfg
+	return OIDCProvider{}, false
 }
 
 func envOr(key, fallback string) string {
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"nudgepay/internal/mail"
+	"nudgepay/internal/payments"
+)
+
+func TestLoadRefusesDefaultSecretOutsideDevelopment(t *testing.T) {
+	t.Setenv("NUDGEPAY_JWT_SECRET", "")
+	t.Setenv("NUDGEPAY_JWT_KEYS", "")
+	t.Setenv("NUDGEPAY_ENV", "")
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "default JWT secret") {
+		t.Fatalf("expected default secret refused, got %v", err)
+	}
+	t.Setenv("NUDGEPAY_JWT_KEYS", "k1:hs256:change-me")
+	if _, err := Load(); err == nil {
+		t.Fatalf("expected default secret in key list refused")
+	}
+
+	t.Setenv("NUDGEPAY_JWT_KEYS", "")
+	t.Setenv("NUDGEPAY_ENV", EnvDevelopment)
+	if _, err := Load(); err != nil {
+		t.Fatalf("expected default secret allowed in development, got %v", err)
+	}
+
+	t.Setenv("NUDGEPAY_ENV", "production")
+	t.Setenv("NUDGEPAY_JWT_KEYS", "2026-10:hs256:new-secret,2026-04:hs256:old-secret")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected key list accepted, got %v", err)
+	}
+	if cfg.TokenKeys().SigningKeyID() != "2026-10" {
+		t.Fatalf("expected first key to sign, got %q", cfg.TokenKeys().SigningKeyID())
+	}
+	t.Setenv("NUDGEPAY_JWT_KEYS", "2026-10:ed25519:/does/not/exist.pem")
+	if _, err := Load(); err == nil {
+		t.Fatalf("expected missing key file reported")
+	}
+}
+
+func TestLoadPaymentProvider(t *testing.T) {
+	t.Setenv("NUDGEPAY_JWT_SECRET", "test-secret")
+	t.Setenv("NUDGEPAY_JWT_KEYS", "")
+	t.Setenv("NUDGEPAY_ENV", "production")
+	t.Setenv("NUDGEPAY_PAYMENT_PROVIDER", "")
+	cfg, err := Load()
+	if err != nil || cfg.PaymentProvider != nil {
+		t.Fatalf("expected no payment provider by default, got %v (%v)", cfg.PaymentProvider, err)
+	}
+
+	t.Setenv("NUDGEPAY_PAYMENT_PROVIDER", "stripe")
+	t.Setenv("NUDGEPAY_STRIPE_SECRET_KEY", "")
+	if _, err := Load(); err == nil {
+		t.Fatalf("expected missing Stripe key reported")
+	}
+	t.Setenv("NUDGEPAY_STRIPE_SECRET_KEY", "sk_test_123")
+	t.Setenv("NUDGEPAY_BASE_URL", "https://app.example.com")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("expected Stripe accepted, got %v", err)
+	}
+	stripe, ok := cfg.PaymentProvider.(*payments.StripeCheckout)
+	if !ok || stripe.SecretKey != "sk_test_123" || stripe.APIURL != payments.DefaultStripeAPIURL || stripe.ReturnURL != "https://app.example.com" {
+		t.Fatalf("unexpected provider %#v", cfg.PaymentProvider)
+	}
+
+	t.Setenv("NUDGEPAY_PAYMENT_PROVIDER", "fake")
+	if _, err := Load(); err == nil {
+		t.Fatalf("expected fake provider refused outside development")
+	}
+	t.Setenv("NUDGEPAY_ENV", EnvDevelopment)
+	if cfg, err := Load(); err != nil || cfg.PaymentProvider.Name() != payments.ProviderFake {
+		t.Fatalf("expected fake provider in development, got %v", err)
+	}
+	t.Setenv("NUDGEPAY_PAYMENT_PROVIDER", "paypal")
+	if _, err := Load(); err == nil {
+		t.Fatalf("expected unknown provider reported")
+	}
+}
+
+func TestLoadMailer(t *testing.T) {
+	t.Setenv("NUDGEPAY_JWT_SECRET", "test-secret")
+	t.Setenv("NUDGEPAY_JWT_KEYS", "")
+	t.Setenv("NUDGEPAY_PAYMENT_PROVIDER", "")
+	t.Setenv("NUDGEPAY_SMTP_ADDR", "")
+	cfg, err := Load()
+	if err != nil || cfg.Mailer != nil {
+		t.Fatalf("expected no mailer by default, got %v (%v)", cfg.Mailer, err)
+	}
+
+	t.Setenv("NUDGEPAY_SMTP_ADDR", "smtp.example.com:587")
+	t.Setenv("NUDGEPAY_SMTP_FROM", "")
+	if _, err := Load(); err == nil {
+		t.Fatalf("expected missing sender address reported")
+	}
+	t.Setenv("NUDGEPAY_SMTP_FROM", "billing@studio.test")
+	t.Setenv("NUDGEPAY_SMTP_USERNAME", "relay")
+	t.Setenv("NUDGEPAY_SMTP_PASSWORD", "secret")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("expected SMTP accepted, got %v", err)
+	}
+	smtp, ok := cfg.Mailer.(*mail.SMTP)
+	if !ok || smtp.Addr != "smtp.example.com:587" || smtp.From != "billing@studio.test" || smtp.Username != "relay" || smtp.Password != "secret" {
+		t.Fatalf("unexpected mailer %#v", cfg.Mailer)
+	}
+}
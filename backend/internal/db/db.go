@@ -27,6 +27,10 @@ func migrate(db *sql.DB) error {
 			id TEXT PRIMARY KEY,
 			name TEXT NOT NULL,
 			owner_user_id TEXT NOT NULL,
+			require_2fa INTEGER NOT NULL DEFAULT 0,
+			require_sso INTEGER NOT NULL DEFAULT 0,
+			sso_skip_2fa INTEGER NOT NULL DEFAULT 0,
+			payment_webhook_secret TEXT NOT NULL DEFAULT '',
 			created_at TEXT NOT NULL
 		);`,
 		`CREATE TABLE IF NOT EXISTS users (
@@ -34,6 +38,10 @@ func migrate(db *sql.DB) error {
 			email TEXT NOT NULL UNIQUE,
 			password_hash TEXT NOT NULL,
 			org_id TEXT NOT NULL,
+			email_verified_at TEXT,
+			totp_secret TEXT,
+			totp_enabled_at TEXT,
+			totp_last_step INTEGER NOT NULL DEFAULT 0,
 			created_at TEXT NOT NULL,
 			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE
 		);`,
@@ -45,6 +53,8 @@ func migrate(db *sql.DB) error {
 			company TEXT NOT NULL,
 			phone TEXT NOT NULL,
 			notes TEXT NOT NULL,
+			language TEXT NOT NULL DEFAULT '',
+			version INTEGER NOT NULL DEFAULT 1,
 			created_at TEXT NOT NULL,
 			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE
 		);`,
@@ -54,10 +64,26 @@ func migrate(db *sql.DB) error {
 			name TEXT NOT NULL,
 			subject TEXT NOT NULL,
 			body TEXT NOT NULL,
+			language TEXT NOT NULL DEFAULT 'en',
+			is_default INTEGER NOT NULL DEFAULT 0,
+			version INTEGER NOT NULL DEFAULT 1,
 			created_at TEXT NOT NULL,
 			updated_at TEXT NOT NULL,
 			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE
 		);`,
+		`CREATE TABLE IF NOT EXISTS template_variants (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			template_id TEXT NOT NULL,
+			language TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			body TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL,
+			UNIQUE (template_id, language),
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE,
+			FOREIGN KEY (template_id) REFERENCES templates(id) ON DELETE CASCADE
+		);`,
 		`CREATE TABLE IF NOT EXISTS invoices (
 			id TEXT PRIMARY KEY,
 			org_id TEXT NOT NULL,
@@ -69,6 +95,7 @@ func migrate(db *sql.DB) error {
 			due_date TEXT NOT NULL,
 			status TEXT NOT NULL,
 			notes TEXT NOT NULL,
+			version INTEGER NOT NULL DEFAULT 1,
 			created_at TEXT NOT NULL,
 			updated_at TEXT NOT NULL,
 			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE,
@@ -91,23 +118,532 @@ func migrate(db *sql.DB) error {
 		`CREATE TABLE IF NOT EXISTS outbox (
 			id TEXT PRIMARY KEY,
 			org_id TEXT NOT NULL,
-			reminder_id TEXT NOT NULL,
+			reminder_id TEXT,
+			kind TEXT NOT NULL DEFAULT 'reminder',
 			to_email TEXT NOT NULL,
 			subject TEXT NOT NULL,
 			body TEXT NOT NULL,
+			headers TEXT NOT NULL DEFAULT '',
 			created_at TEXT NOT NULL,
+			delivered_at TEXT,
 			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE,
 			FOREIGN KEY (reminder_id) REFERENCES reminders(id) ON DELETE CASCADE
 		);`,
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			org_id TEXT NOT NULL,
+			user_agent TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			last_used_at TEXT NOT NULL,
+			expires_at TEXT NOT NULL,
+			revoked_at TEXT,
+			auth_method TEXT NOT NULL DEFAULT 'password',
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS refresh_tokens (
+			id TEXT PRIMARY KEY,
+			session_id TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			created_at TEXT NOT NULL,
+			expires_at TEXT NOT NULL,
+			used_at TEXT,
+			FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS user_tokens (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			purpose TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			created_at TEXT NOT NULL,
+			expires_at TEXT NOT NULL,
+			used_at TEXT,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS recovery_codes (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			code_hash TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			used_at TEXT,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS memberships (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			role TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			UNIQUE (org_id, user_id),
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS invitations (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			email TEXT NOT NULL,
+			role TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			invited_by TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			expires_at TEXT NOT NULL,
+			accepted_at TEXT,
+			revoked_at TEXT,
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			key_id TEXT NOT NULL UNIQUE,
+			secret_hash TEXT NOT NULL,
+			scopes TEXT NOT NULL,
+			created_by TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			expires_at TEXT,
+			last_used_at TEXT,
+			revoked_at TEXT,
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS sso_states (
+			id TEXT PRIMARY KEY,
+			state_hash TEXT NOT NULL UNIQUE,
+			provider TEXT NOT NULL,
+			nonce TEXT NOT NULL,
+			code_verifier TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			expires_at TEXT NOT NULL,
+			used_at TEXT
+		);`,
+		`CREATE TABLE IF NOT EXISTS user_identities (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			provider TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			UNIQUE (provider, subject),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS auth_email_requests (
+			id TEXT PRIMARY KEY,
+			email TEXT NOT NULL,
+			purpose TEXT NOT NULL,
+			created_at TEXT NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS login_failures (
+			id TEXT PRIMARY KEY,
+			email TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			created_at TEXT NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS auth_events (
+			id TEXT PRIMARY KEY,
+			kind TEXT NOT NULL,
+			user_id TEXT,
+			email TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			created_at TEXT NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS audit_events (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			actor_user_id TEXT,
+			actor_api_key_id TEXT,
+			action TEXT NOT NULL,
+			resource_type TEXT NOT NULL,
+			resource_id TEXT NOT NULL,
+			changes TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			created_at TEXT NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS idempotency_keys (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			idempotency_key TEXT NOT NULL,
+			request_hash TEXT NOT NULL,
+			status_code INTEGER NOT NULL DEFAULT 0,
+			content_type TEXT NOT NULL DEFAULT '',
+			response_body BLOB,
+			created_at TEXT NOT NULL,
+			expires_at TEXT NOT NULL,
+			UNIQUE (org_id, idempotency_key),
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS payments (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			invoice_id TEXT NOT NULL,
+			provider TEXT NOT NULL,
+			provider_payment_id TEXT NOT NULL,
+			amount_cents INTEGER NOT NULL,
+			currency TEXT NOT NULL,
+			paid_at TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			UNIQUE (org_id, provider, provider_payment_id),
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE,
+			FOREIGN KEY (invoice_id) REFERENCES invoices(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS payment_links (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			invoice_id TEXT NOT NULL,
+			provider TEXT NOT NULL,
+			provider_link_id TEXT NOT NULL,
+			url TEXT NOT NULL,
+			amount_cents INTEGER NOT NULL,
+			currency TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'open',
+			expires_at TEXT,
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL,
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE,
+			FOREIGN KEY (invoice_id) REFERENCES invoices(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS invoice_share_links (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			invoice_id TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			created_by TEXT,
+			created_at TEXT NOT NULL,
+			expires_at TEXT,
+			revoked_at TEXT,
+			last_viewed_at TEXT,
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE,
+			FOREIGN KEY (invoice_id) REFERENCES invoices(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS portal_login_tokens (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			client_id TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			created_at TEXT NOT NULL,
+			expires_at TEXT NOT NULL,
+			used_at TEXT,
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE,
+			FOREIGN KEY (client_id) REFERENCES clients(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS portal_sessions (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			client_id TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			created_at TEXT NOT NULL,
+			expires_at TEXT NOT NULL,
+			revoked_at TEXT,
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE,
+			FOREIGN KEY (client_id) REFERENCES clients(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS email_suppressions (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			email TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			note TEXT NOT NULL DEFAULT '',
+			created_by TEXT,
+			created_at TEXT NOT NULL,
+			UNIQUE (org_id, email),
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS unsubscribe_tokens (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			email TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			created_at TEXT NOT NULL,
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS webhook_endpoints (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			event_types TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL,
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS webhook_events (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			event_type TEXT NOT NULL,
+			resource_id TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			endpoint_id TEXT NOT NULL,
+			event_id TEXT NOT NULL,
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at TEXT,
+			response_status INTEGER,
+			response_body TEXT NOT NULL DEFAULT '',
+			error TEXT NOT NULL DEFAULT '',
+			delivered_at TEXT,
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL,
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE,
+			FOREIGN KEY (endpoint_id) REFERENCES webhook_endpoints(id) ON DELETE CASCADE,
+			FOREIGN KEY (event_id) REFERENCES webhook_events(id) ON DELETE CASCADE
+		);`,
+		// The audit log is append-only.
+		`CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+			BEGIN SELECT RAISE(ABORT, 'audit_events is append-only'); END;`,
+		`CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+			BEGIN SELECT RAISE(ABORT, 'audit_events is append-only'); END;`,
 		`CREATE INDEX IF NOT EXISTS idx_clients_org ON clients(org_id);`,
 		`CREATE INDEX IF NOT EXISTS idx_invoices_org ON invoices(org_id);`,
 		`CREATE INDEX IF NOT EXISTS idx_reminders_due ON reminders(status, scheduled_for);`,
 		`CREATE INDEX IF NOT EXISTS idx_outbox_org ON outbox(org_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_auth_email_requests ON auth_email_requests(email, purpose, created_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_recovery_codes_user ON recovery_codes(user_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_memberships_user ON memberships(user_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_invitations_org ON invitations(org_id, email);`,
+		`CREATE INDEX IF NOT EXISTS idx_api_keys_org ON api_keys(org_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_login_failures_email ON login_failures(email, created_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_login_failures_ip ON login_failures(ip, created_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_events_org ON audit_events(org_id, created_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expiry ON idempotency_keys(expires_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_payments_invoice ON payments(invoice_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_payment_links_invoice ON payment_links(invoice_id, created_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_payment_links_status ON payment_links(status);`,
+		`CREATE INDEX IF NOT EXISTS idx_invoice_share_links_invoice ON invoice_share_links(invoice_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_portal_login_tokens_client ON portal_login_tokens(client_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_invoices_client ON invoices(client_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_endpoints_org ON webhook_endpoints(org_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_events_resource ON webhook_events(org_id, event_type, resource_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_endpoint ON webhook_deliveries(endpoint_id, created_at);`,
 	}
 	for _, stmt := range stmts {
 		if _, err := db.Exec(stmt); err != nil {
 			return fmt.Errorf("migration failed: %w", err)
 		}
 	}
+
+	// Columns added after the initial schema; CREATE TABLE IF NOT EXISTS
+	// leaves existing databases untouched, so backfill them here.
+	columns := []struct {
+		table      string
+		column     string
+		definition string
+	}{
+		{"clients", "language", "TEXT NOT NULL DEFAULT ''"},
+		{"templates", "language", "TEXT NOT NULL DEFAULT 'en'"},
+		{"templates", "is_default", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "email_verified_at", "TEXT"},
+		{"users", "totp_secret", "TEXT"},
+		{"users", "totp_enabled_at", "TEXT"},
+		{"users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+		{"organizations", "require_2fa", "INTEGER NOT NULL DEFAULT 0"},
+		{"organizations", "require_sso", "INTEGER NOT NULL DEFAULT 0"},
+		{"organizations", "sso_skip_2fa", "INTEGER NOT NULL DEFAULT 0"},
+		{"sessions", "auth_method", "TEXT NOT NULL DEFAULT 'password'"},
+		{"user_tokens", "attempts", "INTEGER NOT NULL DEFAULT 0"},
+		{"clients", "version", "INTEGER NOT NULL DEFAULT 1"},
+		{"invoices", "version", "INTEGER NOT NULL DEFAULT 1"},
+		{"templates", "version", "INTEGER NOT NULL DEFAULT 1"},
+		{"organizations", "payment_webhook_secret", "TEXT NOT NULL DEFAULT ''"},
+		{"outbox", "headers", "TEXT NOT NULL DEFAULT ''"},
+		{"outbox", "delivered_at", "TEXT"},
+	}
+	for _, col := range columns {
+		if err := addColumnIfMissing(db, col.table, col.column, col.definition); err != nil {
+			return fmt.Errorf("migration failed: %w", err)
+		}
+	}
+	if err := relaxOutboxReminder(db); err != nil {
+		return fmt.Errorf("migration failed: %w", err)
+	}
+
+	post := []string{
+		// Orgs created before explicit defaults keep their built-in template
+		// (or, failing that, their oldest one) as the default.
+		`UPDATE templates SET is_default = 1 WHERE id IN (
+			SELECT (SELECT x.id FROM templates x WHERE x.org_id = t.org_id
+				ORDER BY (x.name = 'Default Reminder') DESC, x.created_at ASC, x.id ASC LIMIT 1)
+			FROM templates t
+			GROUP BY t.org_id
+			HAVING MAX(t.is_default) = 0
+		);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_templates_default ON templates(org_id) WHERE is_default = 1;`,
+		// Every write to an editable resource bumps its version, which
+		// backs the ETag and If-Match checks in the API.
+		`CREATE TRIGGER IF NOT EXISTS clients_version AFTER UPDATE ON clients WHEN new.version = old.version BEGIN
+			UPDATE clients SET version = old.version + 1 WHERE id = new.id;
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS invoices_version AFTER UPDATE ON invoices WHEN new.version = old.version BEGIN
+			UPDATE invoices SET version = old.version + 1 WHERE id = new.id;
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS templates_version AFTER UPDATE ON templates WHEN new.version = old.version BEGIN
+			UPDATE templates SET version = old.version + 1 WHERE id = new.id;
+		END;`,
+		// Full-text search: search_documents holds one row per searchable
+		// record, kept current by triggers on the source tables, and
+		// search_fts indexes it as external content. FTS5 is SQLite only.
+		`CREATE TABLE IF NOT EXISTS search_documents (
+			id INTEGER PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			resource_id TEXT NOT NULL,
+			title TEXT NOT NULL,
+			detail TEXT NOT NULL,
+			body TEXT NOT NULL,
+			UNIQUE (kind, resource_id),
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_search_documents_org ON search_documents(org_id);`,
+		`CREATE VIRTUAL TABLE IF NOT EXISTS search_fts USING fts5(
+			title, detail, body, content='search_documents', content_rowid='id', tokenize='unicode61 remove_diacritics 2'
+		);`,
+		`CREATE TRIGGER IF NOT EXISTS search_documents_ai AFTER INSERT ON search_documents BEGIN
+			INSERT INTO search_fts (rowid, title, detail, body) VALUES (new.id, new.title, new.detail, new.body);
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS search_documents_ad AFTER DELETE ON search_documents BEGIN
+			INSERT INTO search_fts (search_fts, rowid, title, detail, body) VALUES ('delete', old.id, old.title, old.detail, old.body);
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS search_documents_au AFTER UPDATE ON search_documents BEGIN
+			INSERT INTO search_fts (search_fts, rowid, title, detail, body) VALUES ('delete', old.id, old.title, old.detail, old.body);
+			INSERT INTO search_fts (rowid, title, detail, body) VALUES (new.id, new.title, new.detail, new.body);
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS clients_search_ai AFTER INSERT ON clients BEGIN
+			INSERT INTO search_documents (org_id, kind, resource_id, title, detail, body)
+				VALUES (new.org_id, 'client', new.id, new.name, new.company || ' ' || new.email, new.notes);
+		END;`,
+		// Invoices are indexed with their client's name and company, so a
+		// client edit refreshes its invoices too.
+		`CREATE TRIGGER IF NOT EXISTS clients_search_au AFTER UPDATE OF name, company, email, notes ON clients BEGIN
+			UPDATE search_documents SET title = new.name, detail = new.company || ' ' || new.email, body = new.notes
+				WHERE kind = 'client' AND resource_id = new.id;
+			UPDATE search_documents SET detail = new.name || ' ' || new.company
+				WHERE kind = 'invoice' AND resource_id IN (SELECT id FROM invoices WHERE client_id = new.id);
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS clients_search_ad AFTER DELETE ON clients BEGIN
+			DELETE FROM search_documents WHERE kind = 'client' AND resource_id = old.id;
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS invoices_search_ai AFTER INSERT ON invoices BEGIN
+			INSERT INTO search_documents (org_id, kind, resource_id, title, detail, body)
+				SELECT new.org_id, 'invoice', new.id, new.number, c.name || ' ' || c.company, new.notes
+				FROM clients c WHERE c.id = new.client_id;
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS invoices_search_au AFTER UPDATE OF number, notes, client_id ON invoices BEGIN
+			UPDATE search_documents SET title = new.number, body = new.notes,
+				detail = (SELECT c.name || ' ' || c.company FROM clients c WHERE c.id = new.client_id)
+				WHERE kind = 'invoice' AND resource_id = new.id;
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS invoices_search_ad AFTER DELETE ON invoices BEGIN
+			DELETE FROM search_documents WHERE kind = 'invoice' AND resource_id = old.id;
+		END;`,
+		// Account emails carry sign-in links and stay out of the index.
+		`CREATE TRIGGER IF NOT EXISTS outbox_search_ai AFTER INSERT ON outbox WHEN new.kind = 'reminder' BEGIN
+			INSERT INTO search_documents (org_id, kind, resource_id, title, detail, body)
+				VALUES (new.org_id, 'outbox', new.id, new.subject, new.to_email, new.body);
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS outbox_search_au AFTER UPDATE OF to_email, subject, body ON outbox BEGIN
+			UPDATE search_documents SET title = new.subject, detail = new.to_email, body = new.body
+				WHERE kind = 'outbox' AND resource_id = new.id;
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS outbox_search_ad AFTER DELETE ON outbox BEGIN
+			DELETE FROM search_documents WHERE kind = 'outbox' AND resource_id = old.id;
+		END;`,
+		// Index records written before search existed.
+		`INSERT OR IGNORE INTO search_documents (org_id, kind, resource_id, title, detail, body)
+			SELECT org_id, 'client', id, name, company || ' ' || email, notes FROM clients;`,
+		`INSERT OR IGNORE INTO search_documents (org_id, kind, resource_id, title, detail, body)
+			SELECT i.org_id, 'invoice', i.id, i.number, c.name || ' ' || c.company, i.notes
+			FROM invoices i JOIN clients c ON c.id = i.client_id;`,
+		`INSERT OR IGNORE INTO search_documents (org_id, kind, resource_id, title, detail, body)
+			SELECT org_id, 'outbox', id, subject, to_email, body FROM outbox WHERE kind = 'reminder';`,
+		// Databases from before memberships had one user per org: its owner.
+		`INSERT OR IGNORE INTO memberships (id, org_id, user_id, role, created_at)
+			SELECT lower(hex(randomblob(16))), u.org_id, u.id,
+				CASE WHEN o.owner_user_id = u.id THEN 'owner' ELSE 'admin' END, u.created_at
+			FROM users u JOIN organizations o ON o.id = u.org_id
+			WHERE NOT EXISTS (SELECT 1 FROM memberships);`,
+	}
+	for _, stmt := range post {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("migration failed: %w", err)
+		}
+	}
 	return nil
 }
+
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// relaxOutboxReminder rebuilds an outbox table created when every email had
+// to belong to a reminder, so account emails can share the same outbox.
+func relaxOutboxReminder(db *sql.DB) error {
+	var notNull int
+	err := db.QueryRow(`SELECT "notnull" FROM pragma_table_info('outbox') WHERE name = 'reminder_id'`).Scan(&notNull)
+	if err != nil {
+		return err
+	}
+	if notNull == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmts := []string{
+		`CREATE TABLE outbox_rebuild (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			reminder_id TEXT,
+			kind TEXT NOT NULL DEFAULT 'reminder',
+			to_email TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			body TEXT NOT NULL,
+			headers TEXT NOT NULL DEFAULT '',
+			created_at TEXT NOT NULL,
+			delivered_at TEXT,
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE,
+			FOREIGN KEY (reminder_id) REFERENCES reminders(id) ON DELETE CASCADE
+		);`,
+		`INSERT INTO outbox_rebuild (id, org_id, reminder_id, kind, to_email, subject, body, created_at)
+			SELECT id, org_id, reminder_id, 'reminder', to_email, subject, body, created_at FROM outbox;`,
+		`DROP TABLE outbox;`,
+		`ALTER TABLE outbox_rebuild RENAME TO outbox;`,
+		`CREATE INDEX IF NOT EXISTS idx_outbox_org ON outbox(org_id);`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,78 @@
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+)
+
+// Message is an email ready to send. Headers are extra headers such as
+// List-Unsubscribe.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+	Headers map[string]string
+}
+
+// Sender hands emails to a mail provider.
+type Sender interface {
+	Send(msg Message) error
+}
+
+// SMTP sends through an SMTP relay, authenticating with PLAIN when Username
+// is set.
+type SMTP struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (s *SMTP) Send(msg Message) error {
+	if strings.ContainsAny(msg.To, "\r\n") {
+		return errors.New("invalid recipient")
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, s.From, []string{msg.To}, s.format(msg))
+}
+
+func (s *SMTP) format(msg Message) []byte {
+	headers := map[string]string{
+		"From":                      s.From,
+		"To":                        msg.To,
+		"Subject":                   msg.Subject,
+		"MIME-Version":              "1.0",
+		"Content-Type":              "text/plain; charset=utf-8",
+		"Content-Transfer-Encoding": "8bit",
+	}
+	for name, value := range msg.Headers {
+		headers[name] = value
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Values come from templates and client records, so line breaks are
+	// dropped rather than allowed to start new headers.
+	clean := strings.NewReplacer("\r", "", "\n", " ")
+	var buf bytes.Buffer
+	for _, name := range names {
+		buf.WriteString(clean.Replace(name) + ": " + clean.Replace(headers[name]) + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes()
+}
@@ -3,17 +3,23 @@ package models
 import "time"
 
 type User struct {
-	ID           string
-	Email        string
-	PasswordHash string
-	OrgID        string
-	CreatedAt    time.Time
+	ID              string
+	Email           string
+	PasswordHash    string
+	OrgID           string
+	EmailVerifiedAt *time.Time
+	TOTPSecret      string
+	TOTPEnabledAt   *time.Time
+	TOTPLastStep    int64
+	CreatedAt       time.Time
 }
 
 type Organization struct {
 	ID          string
 	Name        string
 	OwnerUserID string
+	Require2FA  bool
+	RequireSSO  bool
 	CreatedAt   time.Time
 }
 
@@ -25,6 +31,7 @@ type Client struct {
 	Company   string
 	Phone     string
 	Notes     string
+	Language  string
 	CreatedAt time.Time
 }
 
@@ -34,10 +41,24 @@ type Template struct {
 	Name      string
 	Subject   string
 	Body      string
+	Language  string
+	IsDefault bool
+	Variants  []TemplateVariant
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
+type TemplateVariant struct {
+	ID         string
+	OrgID      string
+	TemplateID string
+	Language   string
+	Subject    string
+	Body       string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
 type Invoice struct {
 	ID         string
 	OrgID      string
@@ -68,8 +89,106 @@ type OutboxEmail struct {
 	ID         string
 	OrgID      string
 	ReminderID string
+	Kind       string
 	ToEmail    string
 	Subject    string
 	Body       string
 	CreatedAt  time.Time
 }
+
+type Session struct {
+	ID         string
+	UserID     string
+	OrgID      string
+	AuthMethod string
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+	RevokedAt  *time.Time
+}
+
+type RefreshToken struct {
+	ID        string
+	SessionID string
+	TokenHash string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+type UserToken struct {
+	ID        string
+	UserID    string
+	Purpose   string
+	TokenHash string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	Attempts  int
+}
+
+type RecoveryCode struct {
+	ID        string
+	UserID    string
+	CodeHash  string
+	CreatedAt time.Time
+	UsedAt    *time.Time
+}
+
+type Membership struct {
+	ID        string
+	OrgID     string
+	UserID    string
+	Role      string
+	CreatedAt time.Time
+}
+
+type Invitation struct {
+	ID         string
+	OrgID      string
+	Email      string
+	Role       string
+	TokenHash  string
+	InvitedBy  string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	AcceptedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+type APIKey struct {
+	ID         string
+	OrgID      string
+	Name       string
+	KeyID      string
+	SecretHash string
+	Scopes     []string
+	CreatedBy  string
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+type UserIdentity struct {
+	ID        string
+	UserID    string
+	Provider  string
+	Subject   string
+	CreatedAt time.Time
+}
+
+type AuditEvent struct {
+	ID            string
+	OrgID         string
+	ActorUserID   *string
+	ActorAPIKeyID *string
+	Action        string
+	ResourceType  string
+	ResourceID    string
+	Changes       string
+	IP            string
+	CreatedAt     time.Time
+}
@@ -0,0 +1,203 @@
+package payments
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ProviderStripe  = "stripe"
+	ProviderGeneric = "generic"
+
+	// SignatureTolerance bounds how old a signed payload may be, so a
+	// captured request cannot be replayed later.
+	SignatureTolerance = 5 * time.Minute
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid payment webhook signature")
+	ErrInvalidPayload   = errors.New("invalid payment webhook payload")
+)
+
+// Payment is a completed payment reported by a processor. At least one of
+// InvoiceID and InvoiceNumber identifies the invoice it pays.
+type Payment struct {
+	Provider      string
+	ID            string
+	InvoiceID     string
+	InvoiceNumber string
+	AmountCents   int64
+	Currency      string
+	PaidAt        time.Time
+}
+
+// Sign returns the v1 signature of payload: the hex HMAC-SHA256 of
+// "<unix time>.<payload>". Stripe and the generic schema both use it.
+func Sign(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks a "t=<unix time>,v1=<signature>" header. Several
+// v1 entries are allowed, as Stripe sends one per active secret during a
+// rotation.
+func VerifySignature(header, secret string, payload []byte, now time.Time) error {
+	var timestamp int64
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "t":
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return ErrInvalidSignature
+			}
+			timestamp = parsed
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == 0 || len(signatures) == 0 || secret == "" {
+		return ErrInvalidSignature
+	}
+	age := now.Sub(time.Unix(timestamp, 0))
+	if age > SignatureTolerance || age < -SignatureTolerance {
+		return ErrInvalidSignature
+	}
+	expected := []byte(Sign(secret, timestamp, payload))
+	for _, signature := range signatures {
+		if hmac.Equal(expected, []byte(signature)) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+type stripeEvent struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Created int64  `json:"created"`
+	Data    struct {
+		Object struct {
+			ID                string            `json:"id"`
+			PaymentIntent     string            `json:"payment_intent"`
+			PaymentStatus     string            `json:"payment_status"`
+			ClientReferenceID string            `json:"client_reference_id"`
+			AmountTotal       int64             `json:"amount_total"`
+			AmountReceived    int64             `json:"amount_received"`
+			Currency          string            `json:"currency"`
+			Metadata          map[string]string `json:"metadata"`
+		} `json:"object"`
+	} `json:"data"`
+}
+
+// ParseStripeEvent reads a Stripe event. It reports false for events that
+// do not complete a payment for an invoice: only paid
+// checkout.session.completed and payment_intent.succeeded events whose
+// metadata or client_reference_id names an invoice do. The payment is keyed
+// by its PaymentIntent, so one reported through both events counts once.
+func ParseStripeEvent(payload []byte) (Payment, bool, error) {
+	var event stripeEvent
+	if err := json.Unmarshal(payload, &event); err != nil || event.ID == "" {
+		return Payment{}, false, ErrInvalidPayload
+	}
+	obj := event.Data.Object
+	p := Payment{
+		Provider:      ProviderStripe,
+		InvoiceID:     obj.Metadata["invoice_id"],
+		InvoiceNumber: obj.Metadata["invoice_number"],
+		Currency:      strings.ToUpper(obj.Currency),
+		PaidAt:        time.Unix(event.Created, 0).UTC(),
+	}
+	switch event.Type {
+	case "checkout.session.completed":
+		if obj.PaymentStatus != "paid" {
+			return Payment{}, false, nil
+		}
+		p.ID, p.AmountCents = obj.PaymentIntent, obj.AmountTotal
+		if p.ID == "" {
+			p.ID = obj.ID
+		}
+		if p.InvoiceID == "" {
+			p.InvoiceID = obj.ClientReferenceID
+		}
+	case "payment_intent.succeeded":
+		p.ID, p.AmountCents = obj.ID, obj.AmountReceived
+	default:
+		return Payment{}, false, nil
+	}
+	// Payments taken outside NudgePay carry no invoice reference.
+	if p.InvoiceID == "" && p.InvoiceNumber == "" {
+		return Payment{}, false, nil
+	}
+	if err := p.validate(); err != nil {
+		return Payment{}, false, err
+	}
+	return p, true, nil
+}
+
+type genericPayment struct {
+	ID            string            `json:"id"`
+	InvoiceID     string            `json:"invoice_id"`
+	InvoiceNumber string            `json:"invoice_number"`
+	AmountCents   int64             `json:"amount_cents"`
+	Currency      string            `json:"currency"`
+	PaidAt        string            `json:"paid_at"`
+	Metadata      map[string]string `json:"metadata"`
+}
+
+// ParseGenericPayment reads the processor-neutral schema: a single payment
+// with its id, amount_cents, currency, an optional RFC3339 paid_at and the
+// invoice given as invoice_id or invoice_number, at the top level or in
+// metadata.
+func ParseGenericPayment(payload []byte, now time.Time) (Payment, error) {
+	var body genericPayment
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return Payment{}, ErrInvalidPayload
+	}
+	p := Payment{
+		Provider:      ProviderGeneric,
+		ID:            strings.TrimSpace(body.ID),
+		InvoiceID:     strings.TrimSpace(body.InvoiceID),
+		InvoiceNumber: strings.TrimSpace(body.InvoiceNumber),
+		AmountCents:   body.AmountCents,
+		Currency:      strings.ToUpper(strings.TrimSpace(body.Currency)),
+		PaidAt:        now.UTC(),
+	}
+	if p.InvoiceID == "" {
+		p.InvoiceID = body.Metadata["invoice_id"]
+	}
+	if p.InvoiceNumber == "" {
+		p.InvoiceNumber = body.Metadata["invoice_number"]
+	}
+	if body.PaidAt != "" {
+		paidAt, err := time.Parse(time.RFC3339, body.PaidAt)
+		if err != nil {
+			return Payment{}, ErrInvalidPayload
+		}
+		p.PaidAt = paidAt.UTC()
+	}
+	if err := p.validate(); err != nil {
+		return Payment{}, err
+	}
+	return p, nil
+}
+
+func (p Payment) validate() error {
+	if p.ID == "" || p.AmountCents <= 0 || p.Currency == "" || (p.InvoiceID == "" && p.InvoiceNumber == "") {
+		return ErrInvalidPayload
+	}
+	return nil
+}
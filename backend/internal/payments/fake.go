@@ -0,0 +1,84 @@
+package payments
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ProviderFake = "fake"
+
+// FakeProvider keeps payment links in memory so the whole payment loop can
+// run without a network. Pay completes a link as a client would.
+type FakeProvider struct {
+	// BaseURL prefixes the link URLs it hands out.
+	BaseURL string
+	// TTL, when set, makes links expire.
+	TTL time.Duration
+
+	mu    sync.Mutex
+	seq   int
+	links map[string]*fakeLink
+}
+
+type fakeLink struct {
+	req     LinkRequest
+	payment *Payment
+}
+
+func NewFakeProvider(baseURL string) *FakeProvider {
+	return &FakeProvider{BaseURL: baseURL, links: map[string]*fakeLink{}}
+}
+
+func (f *FakeProvider) Name() string {
+	return ProviderFake
+}
+
+func (f *FakeProvider) CreateLink(req LinkRequest, now time.Time) (Link, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	id := fmt.Sprintf("fake_cs_%d", f.seq)
+	f.links[id] = &fakeLink{req: req}
+	link := Link{ID: id, URL: strings.TrimRight(f.BaseURL, "/") + "/fake-checkout/" + id}
+	if f.TTL > 0 {
+		link.ExpiresAt = now.Add(f.TTL).UTC()
+	}
+	return link, nil
+}
+
+func (f *FakeProvider) LinkPayment(linkID string) (Payment, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	link, ok := f.links[linkID]
+	if !ok {
+		return Payment{}, false, ErrUnknownLink
+	}
+	if link.payment == nil {
+		return Payment{}, false, nil
+	}
+	return *link.payment, true, nil
+}
+
+// Pay completes the link for its full amount.
+func (f *FakeProvider) Pay(linkID string, now time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	link, ok := f.links[linkID]
+	if !ok {
+		return ErrUnknownLink
+	}
+	if link.payment == nil {
+		link.payment = &Payment{
+			Provider:      ProviderFake,
+			ID:            "fake_pi_" + strings.TrimPrefix(linkID, "fake_cs_"),
+			InvoiceID:     link.req.InvoiceID,
+			InvoiceNumber: link.req.InvoiceNumber,
+			AmountCents:   link.req.AmountCents,
+			Currency:      strings.ToUpper(link.req.Currency),
+			PaidAt:        now.UTC(),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package payments
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrUnknownLink = errors.New("unknown payment link")
+
+// LinkRequest describes the invoice a payment link collects.
+type LinkRequest struct {
+	OrgID         string
+	InvoiceID     string
+	InvoiceNumber string
+	Description   string
+	AmountCents   int64
+	Currency      string
+	CustomerEmail string
+}
+
+// Link is a hosted payment page. ExpiresAt is zero when it does not expire.
+type Link struct {
+	ID        string
+	URL       string
+	ExpiresAt time.Time
+}
+
+// PaymentProvider creates hosted payment pages for invoices and reports
+// whether they have been paid.
+type PaymentProvider interface {
+	Name() string
+	CreateLink(req LinkRequest, now time.Time) (Link, error)
+	// LinkPayment returns the payment that completed the link, or false
+	// while it is unpaid.
+	LinkPayment(linkID string) (Payment, bool, error)
+}
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nudgepay/internal/auth"
+)
+
+const (
+	TokenPurposeVerifyEmail   = "verify_email"
+	TokenPurposePasswordReset = "password_reset"
+
+	VerifyEmailTTL   = 48 * time.Hour
+	PasswordResetTTL = time.Hour
+
+	EmailRequestLimit  = 3
+	EmailRequestWindow = time.Hour
+)
+
+var (
+	ErrTokenInvalid = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// AllowEmailRequest records a request to email an address and reports whether
+// it is within EmailRequestLimit per EmailRequestWindow. Requests for unknown
+// addresses count too, so the limit does not reveal which accounts exist.
+func AllowEmailRequest(db *sql.DB, email, purpose string, now time.Time) (bool, error) {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM auth_email_requests WHERE email = ? AND purpose = ? AND created_at > ?`,
+		email, purpose, now.Add(-EmailRequestWindow).Format(time.RFC3339)).Scan(&count); err != nil {
+		return false, err
+	}
+	if count >= EmailRequestLimit {
+		return false, nil
+	}
+	if _, err := db.Exec(`INSERT INTO auth_email_requests (id, email, purpose, created_at) VALUES (?, ?, ?, ?)`,
+		uuid.NewString(), email, purpose, now.Format(time.RFC3339)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func QueueVerificationEmail(tx *sql.Tx, userID, baseURL string, now time.Time) error {
+	var email, orgID string
+	if err := tx.QueryRow(`SELECT email, org_id FROM users WHERE id = ?`, userID).Scan(&email, &orgID); err != nil {
+		return err
+	}
+	token, err := issueUserToken(tx, userID, TokenPurposeVerifyEmail, VerifyEmailTTL, now)
+	if err != nil {
+		return err
+	}
+	link := strings.TrimRight(baseURL, "/") + "/verify-email?token=" + token
+	_, err = enqueueEmail(tx, OutboundEmail{
+		OrgID:   orgID,
+		Kind:    OutboxKindVerifyEmail,
+		ToEmail: email,
+		Subject: "Confirm your NudgePay email address",
+		Body: strings.Join([]string{
+			"Welcome to NudgePay!",
+			"",
+			"Confirm your email address by opening the link below:",
+			link,
+			"",
+			"The link expires in 48 hours.",
+		}, "\n"),
+	}, now)
+	return err
+}
+
+// RequestPasswordReset emails a reset link when the address belongs to a
+// user and silently does nothing otherwise.
+func RequestPasswordReset(db *sql.DB, email, baseURL string, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID, orgID string
+	if err := tx.QueryRow(`SELECT id, org_id FROM users WHERE email = ?`, email).Scan(&userID, &orgID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	token, err := issueUserToken(tx, userID, TokenPurposePasswordReset, PasswordResetTTL, now)
+	if err != nil {
+		return err
+	}
+	link := strings.TrimRight(baseURL, "/") + "/reset-password?token=" + token
+	if _, err := enqueueEmail(tx, OutboundEmail{
+		OrgID:   orgID,
+		Kind:    OutboxKindPasswordReset,
+		ToEmail: email,
+		Subject: "Reset your NudgePay password",
+		Body: strings.Join([]string{
+			"Someone asked to reset the password for this NudgePay account.",
+			"",
+			"Choose a new password by opening the link below:",
+			link,
+			"",
+			"The link expires in 1 hour. If you did not ask for this, you can ignore this email.",
+		}, "\n"),
+	}, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func VerifyEmail(db *sql.DB, token string, now time.Time) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeUserToken(tx, TokenPurposeVerifyEmail, token, now)
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`UPDATE users SET email_verified_at = COALESCE(email_verified_at, ?) WHERE id = ?`,
+		now.Format(time.RFC3339), userID); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+// ResetPassword sets a new password hash and revokes every session of the
+// user, so whoever knew the old password is logged out.
+func ResetPassword(db *sql.DB, token, passwordHash string, now time.Time) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeUserToken(tx, TokenPurposePasswordReset, token, now)
+	if err != nil {
+		return "", err
+	}
+	stamp := now.Format(time.RFC3339)
+	// Receiving the reset link proves ownership of the address as well.
+	if _, err := tx.Exec(`UPDATE users SET password_hash = ?, email_verified_at = COALESCE(email_verified_at, ?) WHERE id = ?`,
+		passwordHash, stamp, userID); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`, stamp, userID); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+func issueUserToken(tx *sql.Tx, userID, purpose string, ttl time.Duration, now time.Time) (string, error) {
+	stamp := now.Format(time.RFC3339)
+	// Only the newest link of each kind stays valid.
+	if _, err := tx.Exec(`UPDATE user_tokens SET used_at = ? WHERE user_id = ? AND purpose = ? AND used_at IS NULL`,
+		stamp, userID, purpose); err != nil {
+		return "", err
+	}
+	token, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`INSERT INTO user_tokens (id, user_id, purpose, token_hash, created_at, expires_at, used_at) VALUES (?, ?, ?, ?, ?, ?, NULL)`,
+		uuid.NewString(), userID, purpose, hash, stamp, now.Add(ttl).Format(time.RFC3339)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func consumeUserToken(tx *sql.Tx, purpose, token string, now time.Time) (string, error) {
+	var id, userID, expiresAt string
+	var usedAt sql.NullString
+	err := tx.QueryRow(`SELECT id, user_id, expires_at, used_at FROM user_tokens WHERE token_hash = ? AND purpose = ?`,
+		auth.HashOpaqueToken(token), purpose).Scan(&id, &userID, &expiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return "", ErrTokenInvalid
+	}
+	if err != nil {
+		return "", err
+	}
+	if usedAt.Valid {
+		return "", ErrTokenInvalid
+	}
+	if expired(expiresAt, now) {
+		return "", ErrTokenExpired
+	}
+	res, err := tx.Exec(`UPDATE user_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL`, now.Format(time.RFC3339), id)
+	if err != nil {
+		return "", err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return "", ErrTokenInvalid
+	}
+	return userID, nil
+}
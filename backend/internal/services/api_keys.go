@@ -0,0 +1,139 @@
+package services
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nudgepay/internal/auth"
+)
+
+const (
+	ScopeClientsRead       = "clients:read"
+	ScopeClientsWrite      = "clients:write"
+	ScopeTemplatesRead     = "templates:read"
+	ScopeTemplatesWrite    = "templates:write"
+	ScopeInvoicesRead      = "invoices:read"
+	ScopeInvoicesWrite     = "invoices:write"
+	ScopeRemindersRead     = "reminders:read"
+	ScopeRemindersSend     = "reminders:send"
+	ScopeOutboxRead        = "outbox:read"
+	ScopeMetricsRead       = "metrics:read"
+	ScopeOrgRead           = "org:read"
+	ScopeAuditRead         = "audit:read"
+	ScopeSuppressionsRead  = "suppressions:read"
+	ScopeSuppressionsWrite = "suppressions:write"
+)
+
+var AllScopes = []string{
+	ScopeClientsRead, ScopeClientsWrite,
+	ScopeTemplatesRead, ScopeTemplatesWrite,
+	ScopeInvoicesRead, ScopeInvoicesWrite,
+	ScopeRemindersRead, ScopeRemindersSend,
+	ScopeOutboxRead, ScopeMetricsRead, ScopeOrgRead,
+	ScopeAuditRead,
+	ScopeSuppressionsRead, ScopeSuppressionsWrite,
+}
+
+// apiKeyTouchInterval limits last_used_at writes for busy keys.
+const apiKeyTouchInterval = time.Minute
+
+var ErrAPIKeyInvalid = errors.New("invalid api key")
+
+type APIKey struct {
+	ID        string
+	Name      string
+	KeyID     string
+	Scopes    []string
+	CreatedAt time.Time
+	ExpiresAt *time.Time
+}
+
+type APIKeyPrincipal struct {
+	ID     string
+	OrgID  string
+	Scopes []string
+}
+
+func ValidScope(scope string) bool {
+	for _, s := range AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func HasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAPIKey stores a new key and returns the full secret. Only a hash of
+// the secret is kept, so it cannot be shown again.
+func CreateAPIKey(q queryer, orgID, createdBy, name string, scopes []string, expiresAt *time.Time, now time.Time) (string, APIKey, error) {
+	key, keyID, secretHash, err := auth.NewAPIKey()
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	var expires interface{}
+	if expiresAt != nil {
+		expires = expiresAt.UTC().Format(time.RFC3339)
+	}
+	record := APIKey{ID: uuid.NewString(), Name: name, KeyID: keyID, Scopes: scopes, CreatedAt: now, ExpiresAt: expiresAt}
+	if _, err := q.Exec(`INSERT INTO api_keys (id, org_id, name, key_id, secret_hash, scopes, created_by, created_at, expires_at, last_used_at, revoked_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NULL, NULL)`,
+		record.ID, orgID, name, keyID, secretHash, strings.Join(scopes, " "), createdBy, now.Format(time.RFC3339), expires); err != nil {
+		return "", APIKey{}, err
+	}
+	return key, record, nil
+}
+
+func AuthenticateAPIKey(db *sql.DB, key string, now time.Time) (APIKeyPrincipal, error) {
+	keyID, secret, ok := auth.SplitAPIKey(key)
+	if !ok {
+		return APIKeyPrincipal{}, ErrAPIKeyInvalid
+	}
+	var principal APIKeyPrincipal
+	var secretHash, scopes string
+	var expiresAt, lastUsedAt, revokedAt sql.NullString
+	err := db.QueryRow(`SELECT id, org_id, secret_hash, scopes, expires_at, last_used_at, revoked_at FROM api_keys WHERE key_id = ?`, keyID).
+		Scan(&principal.ID, &principal.OrgID, &secretHash, &scopes, &expiresAt, &lastUsedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return APIKeyPrincipal{}, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return APIKeyPrincipal{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(auth.HashOpaqueToken(secret)), []byte(secretHash)) != 1 {
+		return APIKeyPrincipal{}, ErrAPIKeyInvalid
+	}
+	if revokedAt.Valid || (expiresAt.Valid && expired(expiresAt.String, now)) {
+		return APIKeyPrincipal{}, ErrAPIKeyInvalid
+	}
+	if !lastUsedAt.Valid || expired(lastUsedAt.String, now.Add(-apiKeyTouchInterval)) {
+		if _, err := db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, now.Format(time.RFC3339), principal.ID); err != nil {
+			return APIKeyPrincipal{}, err
+		}
+	}
+	principal.Scopes = strings.Fields(scopes)
+	return principal, nil
+}
+
+func RevokeAPIKey(q queryer, orgID, id string, now time.Time) (bool, error) {
+	res, err := q.Exec(`UPDATE api_keys SET revoked_at = ? WHERE id = ? AND org_id = ? AND revoked_at IS NULL`,
+		now.Format(time.RFC3339), id, orgID)
+	if err != nil {
+		return false, err
+	}
+	affected, _ := res.RowsAffected()
+	return affected > 0, nil
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	AuditActionCreate = "create"
+	AuditActionUpdate = "update"
+	AuditActionDelete = "delete"
+	AuditActionSend   = "send"
+)
+
+// AuditEntry describes one mutation. Exactly one of ActorUserID and
+// ActorAPIKeyID is normally set.
+type AuditEntry struct {
+	OrgID         string
+	ActorUserID   string
+	ActorAPIKeyID string
+	Action        string
+	ResourceType  string
+	ResourceID    string
+	IP            string
+}
+
+type AuditEvent struct {
+	ID            string
+	ActorUserID   string
+	ActorEmail    string
+	ActorAPIKeyID string
+	Action        string
+	ResourceType  string
+	ResourceID    string
+	Changes       json.RawMessage
+	IP            string
+	CreatedAt     string
+}
+
+type AuditFilter struct {
+	Actor        string
+	Action       string
+	ResourceType string
+	ResourceID   string
+	From         time.Time
+	To           time.Time
+	Limit        int
+}
+
+// RecordAudit appends an event to the org's audit log. before is nil for
+// creates and after is nil for deletes; only fields that differ are kept.
+func RecordAudit(q queryer, entry AuditEntry, before, after map[string]interface{}, now time.Time) error {
+	changes, err := json.Marshal(auditChanges(before, after))
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(`INSERT INTO audit_events (id, org_id, actor_user_id, actor_api_key_id, action, resource_type, resource_id, changes, ip, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		uuid.NewString(), entry.OrgID, sql.NullString{String: entry.ActorUserID, Valid: entry.ActorUserID != ""},
+		sql.NullString{String: entry.ActorAPIKeyID, Valid: entry.ActorAPIKeyID != ""},
+		entry.Action, entry.ResourceType, entry.ResourceID, string(changes), entry.IP, now.Format(time.RFC3339))
+	return err
+}
+
+func auditChanges(before, after map[string]interface{}) map[string]interface{} {
+	changes := map[string]interface{}{}
+	for field, value := range after {
+		if old, ok := before[field]; !ok || !reflect.DeepEqual(old, value) {
+			changes[field] = map[string]interface{}{"before": before[field], "after": value}
+		}
+	}
+	for field, old := range before {
+		if _, ok := after[field]; !ok {
+			changes[field] = map[string]interface{}{"before": old, "after": nil}
+		}
+	}
+	return changes
+}
+
+// AuditSnapshot loads a single row as a field map for RecordAudit. Secrets
+// and the org id are left out. It returns nil when no row matches.
+func AuditSnapshot(q queryer, query string, args ...interface{}) (map[string]interface{}, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	if err := rows.Scan(pointers...); err != nil {
+		return nil, err
+	}
+	snapshot := map[string]interface{}{}
+	for i, column := range columns {
+		if column == "org_id" || strings.HasSuffix(column, "_secret") || strings.HasSuffix(column, "_hash") {
+			continue
+		}
+		if raw, ok := values[i].([]byte); ok {
+			values[i] = string(raw)
+		}
+		snapshot[column] = values[i]
+	}
+	return snapshot, nil
+}
+
+func ListAuditEvents(db *sql.DB, orgID string, filter AuditFilter) ([]AuditEvent, error) {
+	query := `SELECT a.id, a.actor_user_id, u.email, a.actor_api_key_id, a.action, a.resource_type, a.resource_id, a.changes, a.ip, a.created_at
+		FROM audit_events a LEFT JOIN users u ON u.id = a.actor_user_id WHERE a.org_id = ?`
+	args := []interface{}{orgID}
+	if filter.Actor != "" {
+		query += " AND (a.actor_user_id = ? OR a.actor_api_key_id = ? OR u.email = ?)"
+		args = append(args, filter.Actor, filter.Actor, strings.ToLower(filter.Actor))
+	}
+	if filter.Action != "" {
+		query += " AND a.action = ?"
+		args = append(args, filter.Action)
+	}
+	if filter.ResourceType != "" {
+		query += " AND a.resource_type = ?"
+		args = append(args, filter.ResourceType)
+	}
+	if filter.ResourceID != "" {
+		query += " AND a.resource_id = ?"
+		args = append(args, filter.ResourceID)
+	}
+	if !filter.From.IsZero() {
+		query += " AND a.created_at >= ?"
+		args = append(args, filter.From.UTC().Format(time.RFC3339))
+	}
+	if !filter.To.IsZero() {
+		query += " AND a.created_at < ?"
+		args = append(args, filter.To.UTC().Format(time.RFC3339))
+	}
+	query += " ORDER BY a.created_at DESC, a.rowid DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		var event AuditEvent
+		var actorUserID, actorEmail, actorAPIKeyID sql.NullString
+		var changes string
+		if err := rows.Scan(&event.ID, &actorUserID, &actorEmail, &actorAPIKeyID, &event.Action, &event.ResourceType,
+			&event.ResourceID, &changes, &event.IP, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		event.ActorUserID, event.ActorEmail, event.ActorAPIKeyID = actorUserID.String, actorEmail.String, actorAPIKeyID.String
+		event.Changes = json.RawMessage(changes)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
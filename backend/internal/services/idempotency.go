@@ -0,0 +1,77 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// IdempotencyRetention is how long a completed request can be replayed.
+	IdempotencyRetention = 24 * time.Hour
+	// idempotencyLockTimeout bounds how long a request that never finished,
+	// such as one cut off by a restart, blocks retries with its key.
+	idempotencyLockTimeout = time.Minute
+)
+
+var (
+	ErrIdempotencyKeyReused   = errors.New("idempotency key reused with a different request")
+	ErrIdempotencyKeyInFlight = errors.New("idempotency key in use by a request in progress")
+)
+
+type IdempotentResponse struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+// BeginIdempotentRequest claims key for a request identified by hash. It
+// returns the id of the new claim, or the stored response when the same
+// request already completed under this key.
+func BeginIdempotentRequest(db *sql.DB, orgID, key, hash string, now time.Time) (string, *IdempotentResponse, error) {
+	if _, err := db.Exec(`DELETE FROM idempotency_keys WHERE expires_at <= ?`, now.Format(time.RFC3339)); err != nil {
+		return "", nil, err
+	}
+	id := uuid.NewString()
+	res, err := db.Exec(`INSERT OR IGNORE INTO idempotency_keys (id, org_id, idempotency_key, request_hash, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		id, orgID, key, hash, now.Format(time.RFC3339), now.Add(idempotencyLockTimeout).Format(time.RFC3339))
+	if err != nil {
+		return "", nil, err
+	}
+	if affected, _ := res.RowsAffected(); affected == 1 {
+		return id, nil, nil
+	}
+
+	var storedHash, contentType string
+	var status int
+	var body []byte
+	if err := db.QueryRow(`SELECT request_hash, status_code, content_type, response_body FROM idempotency_keys WHERE org_id = ? AND idempotency_key = ?`,
+		orgID, key).Scan(&storedHash, &status, &contentType, &body); err != nil {
+		return "", nil, err
+	}
+	if storedHash != hash {
+		return "", nil, ErrIdempotencyKeyReused
+	}
+	if status == 0 {
+		return "", nil, ErrIdempotencyKeyInFlight
+	}
+	return "", &IdempotentResponse{StatusCode: status, ContentType: contentType, Body: body}, nil
+}
+
+// CompleteIdempotentRequest stores the response for replay during the
+// retention window.
+func CompleteIdempotentRequest(db *sql.DB, id string, resp IdempotentResponse, now time.Time) error {
+	_, err := db.Exec(`UPDATE idempotency_keys SET status_code = ?, content_type = ?, response_body = ?, expires_at = ? WHERE id = ?`,
+		resp.StatusCode, resp.ContentType, resp.Body, now.Add(IdempotencyRetention).Format(time.RFC3339), id)
+	return err
+}
+
+// ReleaseIdempotentRequest drops a claim whose request failed, so a retry
+// with the same key runs again.
+func ReleaseIdempotentRequest(db *sql.DB, id string) error {
+	_, err := db.Exec(`DELETE FROM idempotency_keys WHERE id = ?`, id)
+	return err
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nudgepay/internal/auth"
+)
+
+// InvoiceShareLink lets anyone holding its token view one invoice at
+// /pay/<token>. Only a hash of the token is stored.
+type InvoiceShareLink struct {
+	ID           string
+	InvoiceID    string
+	CreatedBy    string
+	CreatedAt    string
+	ExpiresAt    string
+	RevokedAt    string
+	LastViewedAt string
+}
+
+// InvoiceURL is the public page for a share link token.
+func InvoiceURL(baseURL, token string) string {
+	return strings.TrimRight(baseURL, "/") + "/pay/" + token
+}
+
+// CreateInvoiceShareLink issues a token for the invoice. createdBy is empty
+// for links issued with reminders; expiresAt may be nil.
+func CreateInvoiceShareLink(q queryer, orgID, invoiceID, createdBy string, expiresAt *time.Time, now time.Time) (string, InvoiceShareLink, error) {
+	token, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return "", InvoiceShareLink{}, err
+	}
+	link := InvoiceShareLink{ID: uuid.NewString(), InvoiceID: invoiceID, CreatedBy: createdBy, CreatedAt: now.Format(time.RFC3339)}
+	var expires, creator interface{}
+	if expiresAt != nil {
+		link.ExpiresAt = expiresAt.UTC().Format(time.RFC3339)
+		expires = link.ExpiresAt
+	}
+	if createdBy != "" {
+		creator = createdBy
+	}
+	if _, err := q.Exec(`INSERT INTO invoice_share_links (id, org_id, invoice_id, token_hash, created_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, link.ID, orgID, invoiceID, hash, creator, link.CreatedAt, expires); err != nil {
+		return "", InvoiceShareLink{}, err
+	}
+	return token, link, nil
+}
+
+func ListInvoiceShareLinks(db *sql.DB, orgID, invoiceID string) ([]InvoiceShareLink, error) {
+	rows, err := db.Query(`SELECT id, invoice_id, created_by, created_at, expires_at, revoked_at, last_viewed_at
+		FROM invoice_share_links WHERE org_id = ? AND invoice_id = ? ORDER BY created_at, rowid`, orgID, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := make([]InvoiceShareLink, 0)
+	for rows.Next() {
+		var link InvoiceShareLink
+		var createdBy, expiresAt, revokedAt, lastViewedAt sql.NullString
+		if err := rows.Scan(&link.ID, &link.InvoiceID, &createdBy, &link.CreatedAt, &expiresAt, &revokedAt, &lastViewedAt); err != nil {
+			return nil, err
+		}
+		link.CreatedBy, link.ExpiresAt, link.RevokedAt, link.LastViewedAt = createdBy.String, expiresAt.String, revokedAt.String, lastViewedAt.String
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+func RevokeInvoiceShareLink(q queryer, orgID, invoiceID, id string, now time.Time) (bool, error) {
+	res, err := q.Exec(`UPDATE invoice_share_links SET revoked_at = ? WHERE id = ? AND org_id = ? AND invoice_id = ? AND revoked_at IS NULL`,
+		now.Format(time.RFC3339), id, orgID, invoiceID)
+	if err != nil {
+		return false, err
+	}
+	affected, _ := res.RowsAffected()
+	return affected > 0, nil
+}
+
+// ResolveInvoiceShareLink returns the org and invoice a token opens and
+// notes the visit. Unknown and revoked tokens are ErrTokenInvalid.
+func ResolveInvoiceShareLink(db *sql.DB, token string, now time.Time) (string, string, error) {
+	var id, orgID, invoiceID string
+	var expiresAt, revokedAt sql.NullString
+	err := db.QueryRow(`SELECT id, org_id, invoice_id, expires_at, revoked_at FROM invoice_share_links WHERE token_hash = ?`,
+		auth.HashOpaqueToken(token)).Scan(&id, &orgID, &invoiceID, &expiresAt, &revokedAt)
+	if err == sql.ErrNoRows || (err == nil && revokedAt.Valid) {
+		return "", "", ErrTokenInvalid
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if expiresAt.Valid && expired(expiresAt.String, now) {
+		return "", "", ErrTokenExpired
+	}
+	if _, err := db.Exec(`UPDATE invoice_share_links SET last_viewed_at = ? WHERE id = ?`, now.Format(time.RFC3339), id); err != nil {
+		return "", "", err
+	}
+	return orgID, invoiceID, nil
+}
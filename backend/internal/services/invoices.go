@@ -0,0 +1,114 @@
+package services
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultReminderOffsets are the days relative to the due date on which
+// reminders are scheduled when an invoice does not say otherwise.
+var DefaultReminderOffsets = []int{-3, 0, 7}
+
+type NewInvoice struct {
+	OrgID           string
+	ClientID        string
+	TemplateID      string
+	Number          string
+	AmountCents     int64
+	Currency        string
+	DueDate         time.Time
+	Status          string
+	Notes           string
+	ReminderOffsets []int
+}
+
+// CreateInvoice inserts an invoice, schedules a reminder at 09:00 UTC on
+// each offset day from its due date and emits invoice.created.
+func CreateInvoice(tx *sql.Tx, inv NewInvoice, now time.Time) (string, error) {
+	id := uuid.NewString()
+	created := now.UTC().Format(time.RFC3339)
+	due := time.Date(inv.DueDate.Year(), inv.DueDate.Month(), inv.DueDate.Day(), 0, 0, 0, 0, time.UTC)
+	if _, err := tx.Exec(`INSERT INTO invoices (id, org_id, client_id, template_id, number, amount_cents, currency, due_date, status, notes, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, inv.OrgID, inv.ClientID, inv.TemplateID, inv.Number, inv.AmountCents, inv.Currency, due.Format(time.RFC3339),
+		inv.Status, inv.Notes, created, created); err != nil {
+		return "", err
+	}
+	offsets := inv.ReminderOffsets
+	if len(offsets) == 0 {
+		offsets = DefaultReminderOffsets
+	}
+	for _, offset := range offsets {
+		scheduled := due.Add(9*time.Hour).AddDate(0, 0, offset)
+		if _, err := tx.Exec(`INSERT INTO reminders (id, org_id, invoice_id, template_id, scheduled_for, sent_at, status, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			uuid.NewString(), inv.OrgID, id, inv.TemplateID, scheduled.Format(time.RFC3339), nil, "scheduled", created); err != nil {
+			return "", err
+		}
+	}
+	if err := EmitInvoiceEvent(tx, inv.OrgID, id, WebhookInvoiceCreated, now); err != nil {
+		return "", err
+	}
+	if inv.Status == "paid" {
+		if err := EmitInvoiceEvent(tx, inv.OrgID, id, WebhookInvoicePaid, now); err != nil {
+			return "", err
+		}
+	}
+	return id, nil
+}
+
+// RescheduleReminders moves the invoice's scheduled reminders by as many days
+// as its due date moved from oldDue to newDue, so each keeps its offset.
+// Dates are as stored on the invoice.
+func RescheduleReminders(tx *sql.Tx, orgID, invoiceID, oldDue, newDue string) error {
+	from, err := parseDueDate(oldDue)
+	if err != nil {
+		return err
+	}
+	to, err := parseDueDate(newDue)
+	if err != nil {
+		return err
+	}
+	days := int(to.Sub(from).Hours() / 24)
+	if days == 0 {
+		return nil
+	}
+	rows, err := tx.Query(`SELECT id, scheduled_for FROM reminders WHERE org_id = ? AND invoice_id = ? AND status = 'scheduled'`, orgID, invoiceID)
+	if err != nil {
+		return err
+	}
+	moved := map[string]string{}
+	for rows.Next() {
+		var id, scheduledFor string
+		if err := rows.Scan(&id, &scheduledFor); err != nil {
+			rows.Close()
+			return err
+		}
+		scheduled, err := time.Parse(time.RFC3339, scheduledFor)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		moved[id] = scheduled.AddDate(0, 0, days).UTC().Format(time.RFC3339)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, scheduledFor := range moved {
+		if _, err := tx.Exec(`UPDATE reminders SET scheduled_for = ? WHERE id = ?`, scheduledFor, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseDueDate reads a due date stored as RFC 3339 or as a plain date.
+func parseDueDate(value string) (time.Time, error) {
+	if due, err := time.Parse(time.RFC3339, value); err == nil {
+		return due.UTC().Truncate(24 * time.Hour), nil
+	}
+	return time.Parse("2006-01-02", value)
+}
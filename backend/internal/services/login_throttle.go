@@ -0,0 +1,113 @@
+package services
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Failed logins are counted per email address and per client IP over a
+// sliding LoginFailureWindow. The first LoginFreeFailures cost nothing; after
+// that each failure doubles the wait before the next attempt, and reaching
+// LoginLockoutThreshold locks the address for LoginLockoutDuration. Unknown
+// addresses are tracked the same way so lockouts do not reveal accounts.
+const (
+	LoginFailureWindow    = 15 * time.Minute
+	LoginFreeFailures     = 3
+	LoginLockoutThreshold = 10
+	LoginLockoutDuration  = 15 * time.Minute
+	LoginIPFailureLimit   = 100
+
+	AuthEventAccountLocked = "account_locked"
+	AuthEventIPLocked      = "ip_locked"
+)
+
+// LoginRetryAfter reports how long the caller must wait before another
+// password attempt for email from ip; zero means go ahead.
+func LoginRetryAfter(db *sql.DB, email, ip string, now time.Time) (time.Duration, error) {
+	since := now.Add(-LoginFailureWindow).Format(time.RFC3339)
+	count, last, err := loginFailures(db, `email = ?`, email, since)
+	if err != nil {
+		return 0, err
+	}
+	var until time.Time
+	switch {
+	case count >= LoginLockoutThreshold:
+		until = last.Add(LoginLockoutDuration)
+	case count >= LoginFreeFailures:
+		until = last.Add(time.Second << (count - LoginFreeFailures))
+	}
+	ipCount, ipLast, err := loginFailures(db, `ip = ?`, ip, since)
+	if err != nil {
+		return 0, err
+	}
+	if ipCount >= LoginIPFailureLimit && ipLast.Add(LoginLockoutDuration).After(until) {
+		until = ipLast.Add(LoginLockoutDuration)
+	}
+	if !until.After(now) {
+		return 0, nil
+	}
+	return until.Sub(now), nil
+}
+
+// RecordLoginFailure stores a failed attempt and records an auth event when
+// it locks the address or the IP.
+func RecordLoginFailure(db *sql.DB, email, ip string, now time.Time) error {
+	stamp := now.Format(time.RFC3339)
+	since := now.Add(-LoginFailureWindow).Format(time.RFC3339)
+	if _, err := db.Exec(`DELETE FROM login_failures WHERE created_at <= ?`, since); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`INSERT INTO login_failures (id, email, ip, created_at) VALUES (?, ?, ?, ?)`,
+		uuid.NewString(), email, ip, stamp); err != nil {
+		return err
+	}
+	count, _, err := loginFailures(db, `email = ?`, email, since)
+	if err != nil {
+		return err
+	}
+	if count == LoginLockoutThreshold {
+		var userID sql.NullString
+		if err := db.QueryRow(`SELECT id FROM users WHERE email = ?`, email).Scan(&userID); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err := RecordAuthEvent(db, AuthEventAccountLocked, userID.String, email, ip, now); err != nil {
+			return err
+		}
+	}
+	ipCount, _, err := loginFailures(db, `ip = ?`, ip, since)
+	if err != nil {
+		return err
+	}
+	if ipCount == LoginIPFailureLimit {
+		return RecordAuthEvent(db, AuthEventIPLocked, "", "", ip, now)
+	}
+	return nil
+}
+
+// ClearLoginFailures forgets an address's failures after a successful login.
+func ClearLoginFailures(db *sql.DB, email string) error {
+	_, err := db.Exec(`DELETE FROM login_failures WHERE email = ?`, email)
+	return err
+}
+
+func RecordAuthEvent(db *sql.DB, kind, userID, email, ip string, now time.Time) error {
+	_, err := db.Exec(`INSERT INTO auth_events (id, kind, user_id, email, ip, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		uuid.NewString(), kind, sql.NullString{String: userID, Valid: userID != ""}, email, ip, now.Format(time.RFC3339))
+	return err
+}
+
+func loginFailures(db *sql.DB, where, value, since string) (int, time.Time, error) {
+	var count int
+	var last sql.NullString
+	if err := db.QueryRow(`SELECT COUNT(*), MAX(created_at) FROM login_failures WHERE `+where+` AND created_at > ?`,
+		value, since).Scan(&count, &last); err != nil {
+		return 0, time.Time{}, err
+	}
+	if !last.Valid {
+		return count, time.Time{}, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, last.String)
+	return count, parsed, err
+}
@@ -0,0 +1,285 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nudgepay/internal/auth"
+)
+
+const (
+	RoleOwner      = "owner"
+	RoleAdmin      = "admin"
+	RoleMember     = "member"
+	RoleAccountant = "accountant"
+
+	InvitationTTL = 7 * 24 * time.Hour
+)
+
+// roleRank orders roles so a route can require "at least" a role. The
+// accountant role is read-only.
+var roleRank = map[string]int{
+	RoleAccountant: 1,
+	RoleMember:     2,
+	RoleAdmin:      3,
+	RoleOwner:      4,
+}
+
+var (
+	ErrNotMember        = errors.New("not a member of this organization")
+	ErrAlreadyMember    = errors.New("already a member of this organization")
+	ErrRoleNotAllowed   = errors.New("role not allowed")
+	ErrOwnerImmutable   = errors.New("the owner cannot be changed or removed")
+	ErrPasswordRequired = errors.New("password required")
+)
+
+type Invitation struct {
+	ID        string
+	Email     string
+	Role      string
+	ExpiresAt time.Time
+}
+
+type AcceptedInvitation struct {
+	UserID      string
+	OrgID       string
+	UserCreated bool
+}
+
+func ValidRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+func RoleAtLeast(role, min string) bool {
+	return roleRank[role] >= roleRank[min] && roleRank[role] > 0
+}
+
+func MemberRole(q queryer, orgID, userID string) (string, error) {
+	var role string
+	err := q.QueryRow(`SELECT role FROM memberships WHERE org_id = ? AND user_id = ?`, orgID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrNotMember
+	}
+	return role, err
+}
+
+// DefaultOrgForUser picks the org a fresh login lands in: the user's home
+// org while they still belong to it, otherwise their oldest membership.
+func DefaultOrgForUser(db *sql.DB, userID string) (string, error) {
+	var orgID string
+	err := db.QueryRow(`SELECT m.org_id FROM memberships m JOIN users u ON u.id = m.user_id
+		WHERE m.user_id = ? ORDER BY (m.org_id = u.org_id) DESC, m.created_at ASC LIMIT 1`, userID).Scan(&orgID)
+	if err == sql.ErrNoRows {
+		return "", ErrNotMember
+	}
+	return orgID, err
+}
+
+func AddMembership(tx *sql.Tx, orgID, userID, role string, now time.Time) error {
+	_, err := tx.Exec(`INSERT INTO memberships (id, org_id, user_id, role, created_at) VALUES (?, ?, ?, ?, ?)`,
+		uuid.NewString(), orgID, userID, role, now.Format(time.RFC3339))
+	return err
+}
+
+// canAssign reports whether actorRole may hand out role. Ownership is never
+// assigned this way and nobody can grant more than they hold.
+func canAssign(actorRole, role string) bool {
+	return ValidRole(role) && role != RoleOwner && roleRank[role] <= roleRank[actorRole]
+}
+
+// canManage reports whether actorRole may change or remove a member holding
+// targetRole. Admins manage members below them; the owner manages everyone
+// but themselves.
+func canManage(actorRole, targetRole string) bool {
+	if targetRole == RoleOwner || !RoleAtLeast(actorRole, RoleAdmin) {
+		return false
+	}
+	return actorRole == RoleOwner || roleRank[actorRole] > roleRank[targetRole]
+}
+
+func UpdateMemberRole(q queryer, orgID, actorRole, userID, role string) error {
+	current, err := MemberRole(q, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if current == RoleOwner {
+		return ErrOwnerImmutable
+	}
+	if !canManage(actorRole, current) || !canAssign(actorRole, role) {
+		return ErrRoleNotAllowed
+	}
+	_, err = q.Exec(`UPDATE memberships SET role = ? WHERE org_id = ? AND user_id = ?`, role, orgID, userID)
+	return err
+}
+
+// RemoveMember deletes a membership and revokes the sessions the user had
+// open in the org. Members may always remove themselves, except the owner.
+// The caller commits tx.
+func RemoveMember(tx *sql.Tx, orgID, actorID, actorRole, userID string, now time.Time) error {
+	var role string
+	err := tx.QueryRow(`SELECT role FROM memberships WHERE org_id = ? AND user_id = ?`, orgID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return ErrNotMember
+	}
+	if err != nil {
+		return err
+	}
+	if role == RoleOwner {
+		return ErrOwnerImmutable
+	}
+	if userID != actorID && !canManage(actorRole, role) {
+		return ErrRoleNotAllowed
+	}
+	if _, err := tx.Exec(`DELETE FROM memberships WHERE org_id = ? AND user_id = ?`, orgID, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND org_id = ? AND revoked_at IS NULL`,
+		now.Format(time.RFC3339), userID, orgID); err != nil {
+		return err
+	}
+	// Keep the home org pointing at an org the user still belongs to.
+	_, err = tx.Exec(`UPDATE users SET org_id = COALESCE(
+			(SELECT org_id FROM memberships WHERE user_id = ? ORDER BY created_at ASC LIMIT 1), org_id)
+		WHERE id = ? AND org_id = ?`, userID, userID, orgID)
+	return err
+}
+
+// CreateInvitation emails an invitation link. Pending invitations to the same
+// address are revoked so only the newest link works. The caller commits tx.
+func CreateInvitation(tx *sql.Tx, orgID, inviterID, actorRole, email, role, baseURL string, now time.Time) (Invitation, error) {
+	if !canAssign(actorRole, role) {
+		return Invitation{}, ErrRoleNotAllowed
+	}
+	var existing string
+	err := tx.QueryRow(`SELECT m.id FROM memberships m JOIN users u ON u.id = m.user_id WHERE m.org_id = ? AND u.email = ?`,
+		orgID, email).Scan(&existing)
+	if err == nil {
+		return Invitation{}, ErrAlreadyMember
+	}
+	if err != sql.ErrNoRows {
+		return Invitation{}, err
+	}
+
+	var orgName, inviterEmail string
+	if err := tx.QueryRow(`SELECT o.name, u.email FROM organizations o, users u WHERE o.id = ? AND u.id = ?`,
+		orgID, inviterID).Scan(&orgName, &inviterEmail); err != nil {
+		return Invitation{}, err
+	}
+
+	stamp := now.Format(time.RFC3339)
+	if _, err := tx.Exec(`UPDATE invitations SET revoked_at = ? WHERE org_id = ? AND email = ? AND accepted_at IS NULL AND revoked_at IS NULL`,
+		stamp, orgID, email); err != nil {
+		return Invitation{}, err
+	}
+	token, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return Invitation{}, err
+	}
+	inv := Invitation{ID: uuid.NewString(), Email: email, Role: role, ExpiresAt: now.Add(InvitationTTL)}
+	if _, err := tx.Exec(`INSERT INTO invitations (id, org_id, email, role, token_hash, invited_by, created_at, expires_at, accepted_at, revoked_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, NULL, NULL)`,
+		inv.ID, orgID, email, role, hash, inviterID, stamp, inv.ExpiresAt.Format(time.RFC3339)); err != nil {
+		return Invitation{}, err
+	}
+	link := strings.TrimRight(baseURL, "/") + "/accept-invite?token=" + token
+	if _, err := enqueueEmail(tx, OutboundEmail{
+		OrgID:   orgID,
+		Kind:    OutboxKindInvitation,
+		ToEmail: email,
+		Subject: "You have been invited to " + orgName + " on NudgePay",
+		Body: strings.Join([]string{
+			inviterEmail + " invited you to join " + orgName + " on NudgePay as " + role + ".",
+			"",
+			"Accept the invitation by opening the link below:",
+			link,
+			"",
+			"The link expires in 7 days.",
+		}, "\n"),
+	}, now); err != nil {
+		return Invitation{}, err
+	}
+	return inv, nil
+}
+
+func RevokeInvitation(q queryer, orgID, invitationID string, now time.Time) (bool, error) {
+	res, err := q.Exec(`UPDATE invitations SET revoked_at = ? WHERE id = ? AND org_id = ? AND accepted_at IS NULL AND revoked_at IS NULL`,
+		now.Format(time.RFC3339), invitationID, orgID)
+	if err != nil {
+		return false, err
+	}
+	affected, _ := res.RowsAffected()
+	return affected > 0, nil
+}
+
+// AcceptInvitation adds the invited address to the org. Unknown addresses get
+// a new account, which needs passwordHash; the link proves the address, so it
+// starts out verified. The caller commits tx.
+func AcceptInvitation(tx *sql.Tx, token, passwordHash string, now time.Time) (AcceptedInvitation, error) {
+	var id, orgID, email, role, expiresAt string
+	var acceptedAt, revokedAt sql.NullString
+	err := tx.QueryRow(`SELECT id, org_id, email, role, expires_at, accepted_at, revoked_at FROM invitations WHERE token_hash = ?`,
+		auth.HashOpaqueToken(token)).Scan(&id, &orgID, &email, &role, &expiresAt, &acceptedAt, &revokedAt)
+	if err == sql.ErrNoRows || (err == nil && (acceptedAt.Valid || revokedAt.Valid)) {
+		return AcceptedInvitation{}, ErrTokenInvalid
+	}
+	if err != nil {
+		return AcceptedInvitation{}, err
+	}
+	if expired(expiresAt, now) {
+		return AcceptedInvitation{}, ErrTokenExpired
+	}
+
+	stamp := now.Format(time.RFC3339)
+	result := AcceptedInvitation{OrgID: orgID}
+	err = tx.QueryRow(`SELECT id FROM users WHERE email = ?`, email).Scan(&result.UserID)
+	switch {
+	case err == sql.ErrNoRows:
+		if passwordHash == "" {
+			return AcceptedInvitation{}, ErrPasswordRequired
+		}
+		result.UserID = uuid.NewString()
+		result.UserCreated = true
+		if _, err := tx.Exec(`INSERT INTO users (id, email, password_hash, org_id, email_verified_at, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			result.UserID, email, passwordHash, orgID, stamp, stamp); err != nil {
+			return AcceptedInvitation{}, err
+		}
+	case err != nil:
+		return AcceptedInvitation{}, err
+	}
+
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO memberships (id, org_id, user_id, role, created_at) VALUES (?, ?, ?, ?, ?)`,
+		uuid.NewString(), orgID, result.UserID, role, stamp); err != nil {
+		return AcceptedInvitation{}, err
+	}
+	if _, err := tx.Exec(`UPDATE invitations SET accepted_at = ? WHERE id = ?`, stamp, id); err != nil {
+		return AcceptedInvitation{}, err
+	}
+	return result, nil
+}
+
+// CreateOrganization starts another org owned by an existing user. The
+// caller commits tx.
+func CreateOrganization(tx *sql.Tx, userID, name string, now time.Time) (string, error) {
+	orgID := uuid.NewString()
+	if _, err := tx.Exec(`INSERT INTO organizations (id, name, owner_user_id, created_at) VALUES (?, ?, ?, ?)`,
+		orgID, name, userID, now.Format(time.RFC3339)); err != nil {
+		return "", err
+	}
+	if err := AddMembership(tx, orgID, userID, RoleOwner, now); err != nil {
+		return "", err
+	}
+	return orgID, nil
+}
+
+// SetHomeOrg remembers the org a user last switched to, so their next login
+// lands there.
+func SetHomeOrg(db *sql.DB, userID, orgID string) error {
+	_, err := db.Exec(`UPDATE users SET org_id = ? WHERE id = ? AND EXISTS (SELECT 1 FROM memberships WHERE org_id = ? AND user_id = ?)`,
+		orgID, userID, orgID, userID)
+	return err
+}
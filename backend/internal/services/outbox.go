@@ -0,0 +1,110 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nudgepay/internal/mail"
+)
+
+const (
+	OutboxKindReminder      = "reminder"
+	OutboxKindVerifyEmail   = "verify_email"
+	OutboxKindPasswordReset = "password_reset"
+	OutboxKindInvitation    = "invitation"
+	OutboxKindPortalLogin   = "portal_login"
+
+	// outboxMaxAge keeps emails that waited longer than this, for example
+	// before a mail provider was configured, from going out late.
+	outboxMaxAge = 24 * time.Hour
+)
+
+type OutboundEmail struct {
+	OrgID      string
+	ReminderID string
+	Kind       string
+	ToEmail    string
+	Subject    string
+	Body       string
+	Headers    map[string]string
+}
+
+func enqueueEmail(tx *sql.Tx, email OutboundEmail, now time.Time) (string, error) {
+	var reminderID interface{}
+	if email.ReminderID != "" {
+		reminderID = email.ReminderID
+	}
+	var headers string
+	if len(email.Headers) > 0 {
+		encoded, err := json.Marshal(email.Headers)
+		if err != nil {
+			return "", err
+		}
+		headers = string(encoded)
+	}
+	id := uuid.NewString()
+	if _, err := tx.Exec(`INSERT INTO outbox (id, org_id, reminder_id, kind, to_email, subject, body, headers, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, email.OrgID, reminderID, email.Kind, email.ToEmail, email.Subject, email.Body, headers, now.Format(time.RFC3339)); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// DeliverOutbox sends the outbox emails written in the last day that have
+// not gone out yet and returns how many were sent. Emails that fail stay
+// queued for the next run. Account emails carry one-time sign-in, reset and
+// invitation tokens, so their body is cleared once sent; reminders keep
+// theirs as the record of what the client received.
+func DeliverOutbox(db *sql.DB, sender mail.Sender, now time.Time) (int, error) {
+	rows, err := db.Query(`SELECT id, to_email, subject, body, headers FROM outbox
+		WHERE delivered_at IS NULL AND created_at >= ? ORDER BY created_at, rowid LIMIT 100`,
+		now.Add(-outboxMaxAge).UTC().Format(time.RFC3339))
+	if err != nil {
+		return 0, err
+	}
+	type queued struct {
+		id  string
+		msg mail.Message
+	}
+	var emails []queued
+	for rows.Next() {
+		var email queued
+		var headers string
+		if err := rows.Scan(&email.id, &email.msg.To, &email.msg.Subject, &email.msg.Body, &headers); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if headers != "" {
+			if err := json.Unmarshal([]byte(headers), &email.msg.Headers); err != nil {
+				rows.Close()
+				return 0, err
+			}
+		}
+		emails = append(emails, email)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	var errs []error
+	for _, email := range emails {
+		if err := sender.Send(email.msg); err != nil {
+			errs = append(errs, fmt.Errorf("outbox %s: %w", email.id, err))
+			continue
+		}
+		if _, err := db.Exec(`UPDATE outbox SET delivered_at = ?, body = CASE WHEN kind = ? THEN body ELSE '' END WHERE id = ?`,
+			now.UTC().Format(time.RFC3339), OutboxKindReminder, email.id); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, errors.Join(errs...)
+}
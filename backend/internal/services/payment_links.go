@@ -0,0 +1,239 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nudgepay/internal/payments"
+)
+
+const (
+	PaymentLinkOpen    = "open"
+	PaymentLinkPaid    = "paid"
+	PaymentLinkExpired = "expired"
+
+	// paymentLinkMinLifetime keeps a link that is about to expire out of new
+	// reminders; a fresh one is created instead.
+	paymentLinkMinLifetime = time.Hour
+)
+
+var ErrInvoiceAlreadyPaid = errors.New("invoice is already paid")
+
+type PaymentLink struct {
+	ID          string
+	Provider    string
+	URL         string
+	AmountCents int64
+	Currency    string
+	Status      string
+	ExpiresAt   string
+	CreatedAt   string
+	// Created is set when EnsurePaymentLink made a new link rather than
+	// returning the current one.
+	Created bool
+}
+
+// EnsurePaymentLink returns the invoice's current payment link, creating one
+// when there is none, it is about to expire, the amount changed or refresh
+// is set. Older links stay open until they expire, as clients may still pay
+// through them. It returns sql.ErrNoRows for unknown invoices.
+func EnsurePaymentLink(q queryer, provider payments.PaymentProvider, orgID, invoiceID string, refresh bool, now time.Time) (PaymentLink, error) {
+	var number, currency, status, clientEmail string
+	var amountCents int64
+	if err := q.QueryRow(`SELECT i.number, i.amount_cents, i.currency, i.status, c.email
+		FROM invoices i JOIN clients c ON c.id = i.client_id WHERE i.id = ? AND i.org_id = ?`, invoiceID, orgID).
+		Scan(&number, &amountCents, &currency, &status, &clientEmail); err != nil {
+		return PaymentLink{}, err
+	}
+	if status == "paid" {
+		return PaymentLink{}, ErrInvoiceAlreadyPaid
+	}
+	var paidCents int64
+	if err := q.QueryRow(`SELECT COALESCE(SUM(amount_cents), 0) FROM payments WHERE invoice_id = ?`, invoiceID).
+		Scan(&paidCents); err != nil {
+		return PaymentLink{}, err
+	}
+	due := amountCents - paidCents
+	if due <= 0 {
+		return PaymentLink{}, ErrInvoiceAlreadyPaid
+	}
+
+	if !refresh {
+		link, err := currentPaymentLink(q, provider.Name(), invoiceID, now)
+		if err == nil && link.AmountCents == due && link.Currency == currency {
+			return link, nil
+		}
+		if err != nil && err != sql.ErrNoRows {
+			return PaymentLink{}, err
+		}
+	}
+
+	created, err := provider.CreateLink(payments.LinkRequest{
+		OrgID:         orgID,
+		InvoiceID:     invoiceID,
+		InvoiceNumber: number,
+		Description:   "Invoice " + number,
+		AmountCents:   due,
+		Currency:      currency,
+		CustomerEmail: clientEmail,
+	}, now)
+	if err != nil {
+		return PaymentLink{}, err
+	}
+	stamp := now.UTC().Format(time.RFC3339)
+	link := PaymentLink{
+		ID:          uuid.NewString(),
+		Provider:    provider.Name(),
+		URL:         created.URL,
+		AmountCents: due,
+		Currency:    currency,
+		Status:      PaymentLinkOpen,
+		CreatedAt:   stamp,
+		Created:     true,
+	}
+	var expiresAt sql.NullString
+	if !created.ExpiresAt.IsZero() {
+		link.ExpiresAt = created.ExpiresAt.UTC().Format(time.RFC3339)
+		expiresAt = sql.NullString{String: link.ExpiresAt, Valid: true}
+	}
+	if _, err := q.Exec(`INSERT INTO payment_links (id, org_id, invoice_id, provider, provider_link_id, url, amount_cents, currency, status, expires_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		link.ID, orgID, invoiceID, link.Provider, created.ID, link.URL, due, currency, PaymentLinkOpen, expiresAt, stamp, stamp); err != nil {
+		return PaymentLink{}, err
+	}
+	return link, nil
+}
+
+// OpenPaymentLink returns the invoice's current payment link without
+// creating one. It returns sql.ErrNoRows when no open link covers what is
+// still due.
+func OpenPaymentLink(q queryer, provider payments.PaymentProvider, orgID, invoiceID string, now time.Time) (PaymentLink, error) {
+	var due int64
+	var currency string
+	if err := q.QueryRow(`SELECT i.amount_cents - COALESCE((SELECT SUM(p.amount_cents) FROM payments p WHERE p.invoice_id = i.id), 0), i.currency
+		FROM invoices i WHERE i.id = ? AND i.org_id = ? AND i.status <> 'paid'`, invoiceID, orgID).Scan(&due, &currency); err != nil {
+		return PaymentLink{}, err
+	}
+	link, err := currentPaymentLink(q, provider.Name(), invoiceID, now)
+	if err != nil {
+		return PaymentLink{}, err
+	}
+	if due <= 0 || link.AmountCents != due || link.Currency != currency {
+		return PaymentLink{}, sql.ErrNoRows
+	}
+	return link, nil
+}
+
+func currentPaymentLink(q queryer, provider, invoiceID string, now time.Time) (PaymentLink, error) {
+	var link PaymentLink
+	var expiresAt sql.NullString
+	err := q.QueryRow(`SELECT id, provider, url, amount_cents, currency, status, expires_at, created_at FROM payment_links
+		WHERE invoice_id = ? AND provider = ? AND status = ? AND (expires_at IS NULL OR expires_at > ?)
+		ORDER BY created_at DESC, rowid DESC LIMIT 1`,
+		invoiceID, provider, PaymentLinkOpen, now.Add(paymentLinkMinLifetime).UTC().Format(time.RFC3339)).
+		Scan(&link.ID, &link.Provider, &link.URL, &link.AmountCents, &link.Currency, &link.Status, &expiresAt, &link.CreatedAt)
+	link.ExpiresAt = expiresAt.String
+	return link, err
+}
+
+// paymentLinkURL is the link a reminder for the invoice carries, or "" when
+// payment links are off or nothing is left to pay.
+func paymentLinkURL(q queryer, provider payments.PaymentProvider, orgID, invoiceID string, now time.Time) (string, error) {
+	if provider == nil {
+		return "", nil
+	}
+	link, err := EnsurePaymentLink(q, provider, orgID, invoiceID, false, now)
+	if err == ErrInvoiceAlreadyPaid {
+		return "", nil
+	}
+	return link.URL, err
+}
+
+type openPaymentLink struct {
+	id, orgID, invoiceID, providerLinkID string
+	expiresAt                            sql.NullString
+}
+
+// ReconcilePaymentLinks asks the provider about every open link it issued
+// for an unpaid invoice and records the payments made through them. Links
+// past their expiry are closed. A link that fails does not hold up the
+// rest; the failures are returned together with the number of payments
+// recorded.
+func ReconcilePaymentLinks(db *sql.DB, provider payments.PaymentProvider, now time.Time) (int, error) {
+	rows, err := db.Query(`SELECT l.id, l.org_id, l.invoice_id, l.provider_link_id, l.expires_at FROM payment_links l
+		JOIN invoices i ON i.id = l.invoice_id
+		WHERE l.provider = ? AND l.status = ? AND i.status <> 'paid' ORDER BY l.created_at`, provider.Name(), PaymentLinkOpen)
+	if err != nil {
+		return 0, err
+	}
+	var links []openPaymentLink
+	for rows.Next() {
+		var link openPaymentLink
+		if err := rows.Scan(&link.id, &link.orgID, &link.invoiceID, &link.providerLinkID, &link.expiresAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		links = append(links, link)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	recorded := 0
+	var errs []error
+	for _, link := range links {
+		paid, err := reconcilePaymentLink(db, provider, link, now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("payment link %s: %w", link.id, err))
+			continue
+		}
+		if paid {
+			recorded++
+		}
+	}
+	return recorded, errors.Join(errs...)
+}
+
+// reconcilePaymentLink reports whether a new payment was recorded for link.
+func reconcilePaymentLink(db *sql.DB, provider payments.PaymentProvider, link openPaymentLink, now time.Time) (bool, error) {
+	stamp := now.UTC().Format(time.RFC3339)
+	payment, paid, err := provider.LinkPayment(link.providerLinkID)
+	if err == payments.ErrUnknownLink {
+		paid, err = false, nil
+		link.expiresAt = sql.NullString{String: stamp, Valid: true}
+	}
+	if err != nil {
+		return false, err
+	}
+	if !paid {
+		if link.expiresAt.Valid && link.expiresAt.String <= stamp {
+			_, err := db.Exec(`UPDATE payment_links SET status = ?, updated_at = ? WHERE id = ?`, PaymentLinkExpired, stamp, link.id)
+			return false, err
+		}
+		return false, nil
+	}
+	if payment.PaidAt.IsZero() {
+		payment.PaidAt = now
+	}
+	result, err := ApplyPayment(db, AuditEntry{OrgID: link.orgID}, link.invoiceID, payment, now)
+	if err != nil {
+		return false, err
+	}
+	if _, err := db.Exec(`UPDATE payment_links SET status = ?, updated_at = ? WHERE id = ?`, PaymentLinkPaid, stamp, link.id); err != nil {
+		return false, err
+	}
+	return !result.Duplicate, nil
+}
+
+// expireOpenPaymentLinks closes the links of an invoice that no longer
+// takes payments, so reconciliation stops polling them.
+func expireOpenPaymentLinks(tx *sql.Tx, invoiceID string, now time.Time) error {
+	_, err := tx.Exec(`UPDATE payment_links SET status = ?, updated_at = ? WHERE invoice_id = ? AND status = ?`,
+		PaymentLinkExpired, now.UTC().Format(time.RFC3339), invoiceID, PaymentLinkOpen)
+	return err
+}
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nudgepay/internal/payments"
+)
+
+var (
+	ErrPaymentUnmatched        = errors.New("payment does not match an invoice")
+	ErrPaymentCurrencyMismatch = errors.New("payment currency does not match the invoice")
+)
+
+type PaymentResult struct {
+	PaymentID string
+	InvoiceID string
+	// Duplicate is set when the processor reported a payment already
+	// recorded; nothing was changed.
+	Duplicate bool
+	// InvoicePaid is set when this payment settled the invoice.
+	InvoicePaid        bool
+	CancelledReminders []string
+}
+
+// MatchPaymentInvoice finds the invoice a payment names, by id first and
+// then by number.
+func MatchPaymentInvoice(db *sql.DB, orgID string, p payments.Payment) (string, error) {
+	for _, match := range []struct{ column, value string }{{"id", p.InvoiceID}, {"number", p.InvoiceNumber}} {
+		if match.value == "" {
+			continue
+		}
+		var id string
+		err := db.QueryRow(`SELECT id FROM invoices WHERE org_id = ? AND `+match.column+` = ? ORDER BY created_at LIMIT 1`,
+			orgID, match.value).Scan(&id)
+		if err == nil {
+			return id, nil
+		}
+		if err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+	return "", ErrPaymentUnmatched
+}
+
+// ApplyPayment stores a processor-reported payment against invoiceID. Once
+// payments cover the amount the invoice is marked paid and settled. The
+// payment, and the invoice when it is settled, are audited in the same
+// transaction. entry carries the org and request details; payments arrive
+// from processors, so there is no actor.
+func ApplyPayment(db *sql.DB, entry AuditEntry, invoiceID string, p payments.Payment, now time.Time) (PaymentResult, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return PaymentResult{}, err
+	}
+	defer tx.Rollback()
+
+	orgID := entry.OrgID
+	invoiceQuery := `SELECT * FROM invoices WHERE id = ? AND org_id = ?`
+	before, err := AuditSnapshot(tx, invoiceQuery, invoiceID, orgID)
+	if err != nil {
+		return PaymentResult{}, err
+	}
+
+	result := PaymentResult{InvoiceID: invoiceID}
+	err = tx.QueryRow(`SELECT id, invoice_id FROM payments WHERE org_id = ? AND provider = ? AND provider_payment_id = ?`,
+		orgID, p.Provider, p.ID).Scan(&result.PaymentID, &result.InvoiceID)
+	if err == nil {
+		result.Duplicate = true
+		return result, nil
+	}
+	if err != sql.ErrNoRows {
+		return PaymentResult{}, err
+	}
+
+	var amountCents int64
+	var currency, status string
+	if err := tx.QueryRow(`SELECT amount_cents, currency, status FROM invoices WHERE id = ? AND org_id = ?`, invoiceID, orgID).
+		Scan(&amountCents, &currency, &status); err != nil {
+		if err == sql.ErrNoRows {
+			return PaymentResult{}, ErrPaymentUnmatched
+		}
+		return PaymentResult{}, err
+	}
+	if currency != p.Currency {
+		return PaymentResult{}, ErrPaymentCurrencyMismatch
+	}
+
+	stamp := now.UTC().Format(time.RFC3339)
+	result.PaymentID = uuid.NewString()
+	if _, err := tx.Exec(`INSERT INTO payments (id, org_id, invoice_id, provider, provider_payment_id, amount_cents, currency, paid_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		result.PaymentID, orgID, result.InvoiceID, p.Provider, p.ID, p.AmountCents, p.Currency,
+		p.PaidAt.UTC().Format(time.RFC3339), stamp); err != nil {
+		return PaymentResult{}, err
+	}
+
+	var paidCents int64
+	if err := tx.QueryRow(`SELECT COALESCE(SUM(amount_cents), 0) FROM payments WHERE invoice_id = ?`, result.InvoiceID).
+		Scan(&paidCents); err != nil {
+		return PaymentResult{}, err
+	}
+	if status != "paid" && paidCents >= amountCents {
+		if _, err := tx.Exec(`UPDATE invoices SET status = 'paid', updated_at = ? WHERE id = ?`, stamp, result.InvoiceID); err != nil {
+			return PaymentResult{}, err
+		}
+		result.InvoicePaid = true
+		for _, event := range []string{WebhookInvoiceUpdated, WebhookInvoicePaid} {
+			if err := EmitInvoiceEvent(tx, orgID, result.InvoiceID, event, now); err != nil {
+				return PaymentResult{}, err
+			}
+		}
+		if result.CancelledReminders, err = SettleInvoice(tx, orgID, result.InvoiceID, now); err != nil {
+			return PaymentResult{}, err
+		}
+	}
+
+	after, err := AuditSnapshot(tx, `SELECT * FROM payments WHERE id = ? AND org_id = ?`, result.PaymentID, orgID)
+	if err != nil {
+		return PaymentResult{}, err
+	}
+	entry.Action, entry.ResourceType, entry.ResourceID = AuditActionCreate, "payment", result.PaymentID
+	if err := RecordAudit(tx, entry, nil, after, now); err != nil {
+		return PaymentResult{}, err
+	}
+	if result.InvoicePaid {
+		if after, err = AuditSnapshot(tx, invoiceQuery, invoiceID, orgID); err != nil {
+			return PaymentResult{}, err
+		}
+		entry.Action, entry.ResourceType, entry.ResourceID = AuditActionUpdate, "invoice", invoiceID
+		if err := RecordAudit(tx, entry, before, after, now); err != nil {
+			return PaymentResult{}, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return PaymentResult{}, err
+	}
+	return result, nil
+}
+
+// SettleInvoice cleans up after an invoice is marked paid, however that
+// happened: its scheduled reminders are cancelled, emitting
+// reminder.cancelled, and its open payment links expire. It returns the
+// cancelled reminder ids.
+func SettleInvoice(tx *sql.Tx, orgID, invoiceID string, now time.Time) ([]string, error) {
+	ids, err := cancelPendingReminders(tx, orgID, invoiceID, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := expireOpenPaymentLinks(tx, invoiceID, now); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func cancelPendingReminders(tx *sql.Tx, orgID, invoiceID string, now time.Time) ([]string, error) {
+	rows, err := tx.Query(`SELECT id FROM reminders WHERE org_id = ? AND invoice_id = ? AND status = 'scheduled'`, orgID, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if _, err := tx.Exec(`UPDATE reminders SET status = 'cancelled' WHERE id = ?`, id); err != nil {
+			return nil, err
+		}
+		if err := EmitReminderEvent(tx, orgID, id, WebhookReminderCancelled, now); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
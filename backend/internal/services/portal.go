@@ -0,0 +1,170 @@
+package services
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nudgepay/internal/auth"
+)
+
+const (
+	TokenPurposePortalLogin = "portal_login"
+
+	PortalLoginTTL   = 15 * time.Minute
+	PortalSessionTTL = 12 * time.Hour
+)
+
+// PortalSession is a client's signed-in portal visit. It grants read access
+// to a single client record and nothing else in the org.
+type PortalSession struct {
+	ID        string
+	OrgID     string
+	ClientID  string
+	ExpiresAt string
+}
+
+// RequestPortalLogin emails a magic link to every client record in the org
+// with that address and silently does nothing when there is none. Each link
+// signs in to one client record only.
+func RequestPortalLogin(db *sql.DB, orgID, email, baseURL string, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var orgName string
+	if err := tx.QueryRow(`SELECT name FROM organizations WHERE id = ?`, orgID).Scan(&orgName); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	rows, err := tx.Query(`SELECT id, email FROM clients WHERE org_id = ? AND lower(email) = ? ORDER BY created_at, rowid`, orgID, email)
+	if err != nil {
+		return err
+	}
+	type recipient struct{ clientID, email string }
+	var recipients []recipient
+	for rows.Next() {
+		var r recipient
+		if err := rows.Scan(&r.clientID, &r.email); err != nil {
+			rows.Close()
+			return err
+		}
+		recipients = append(recipients, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	stamp := now.Format(time.RFC3339)
+	for _, r := range recipients {
+		// Only the newest link of each client stays valid.
+		if _, err := tx.Exec(`UPDATE portal_login_tokens SET used_at = ? WHERE client_id = ? AND used_at IS NULL`, stamp, r.clientID); err != nil {
+			return err
+		}
+		token, hash, err := auth.NewOpaqueToken()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO portal_login_tokens (id, org_id, client_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			uuid.NewString(), orgID, r.clientID, hash, stamp, now.Add(PortalLoginTTL).Format(time.RFC3339)); err != nil {
+			return err
+		}
+		link := strings.TrimRight(baseURL, "/") + "/portal/login?token=" + token
+		if _, err := enqueueEmail(tx, OutboundEmail{
+			OrgID:   orgID,
+			Kind:    OutboxKindPortalLogin,
+			ToEmail: r.email,
+			Subject: "Your " + orgName + " invoice portal link",
+			Body: strings.Join([]string{
+				"Open the link below to see your invoices and payments with " + orgName + ":",
+				link,
+				"",
+				"The link expires in 15 minutes and works once. If you did not ask for it, you can ignore this email.",
+			}, "\n"),
+		}, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// StartPortalSession redeems a magic link token for a portal session and
+// returns the bearer token for it.
+func StartPortalSession(db *sql.DB, token string, now time.Time) (string, PortalSession, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", PortalSession{}, err
+	}
+	defer tx.Rollback()
+
+	var id, orgID, clientID, expiresAt string
+	var usedAt sql.NullString
+	err = tx.QueryRow(`SELECT id, org_id, client_id, expires_at, used_at FROM portal_login_tokens WHERE token_hash = ?`,
+		auth.HashOpaqueToken(token)).Scan(&id, &orgID, &clientID, &expiresAt, &usedAt)
+	if err == sql.ErrNoRows || (err == nil && usedAt.Valid) {
+		return "", PortalSession{}, ErrTokenInvalid
+	}
+	if err != nil {
+		return "", PortalSession{}, err
+	}
+	if expired(expiresAt, now) {
+		return "", PortalSession{}, ErrTokenExpired
+	}
+	stamp := now.Format(time.RFC3339)
+	res, err := tx.Exec(`UPDATE portal_login_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL`, stamp, id)
+	if err != nil {
+		return "", PortalSession{}, err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return "", PortalSession{}, ErrTokenInvalid
+	}
+
+	secret, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return "", PortalSession{}, err
+	}
+	session := PortalSession{ID: uuid.NewString(), OrgID: orgID, ClientID: clientID, ExpiresAt: now.Add(PortalSessionTTL).Format(time.RFC3339)}
+	if _, err := tx.Exec(`INSERT INTO portal_sessions (id, org_id, client_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		session.ID, orgID, clientID, hash, stamp, session.ExpiresAt); err != nil {
+		return "", PortalSession{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", PortalSession{}, err
+	}
+	return auth.PortalTokenPrefix + secret, session, nil
+}
+
+// AuthenticatePortalSession looks up the session behind a portal bearer
+// token. Staff JWTs and API keys never match.
+func AuthenticatePortalSession(db *sql.DB, token string, now time.Time) (PortalSession, error) {
+	secret, ok := strings.CutPrefix(token, auth.PortalTokenPrefix)
+	if !ok {
+		return PortalSession{}, ErrTokenInvalid
+	}
+	var session PortalSession
+	var revokedAt sql.NullString
+	err := db.QueryRow(`SELECT id, org_id, client_id, expires_at, revoked_at FROM portal_sessions WHERE token_hash = ?`,
+		auth.HashOpaqueToken(secret)).Scan(&session.ID, &session.OrgID, &session.ClientID, &session.ExpiresAt, &revokedAt)
+	if err == sql.ErrNoRows || (err == nil && revokedAt.Valid) {
+		return PortalSession{}, ErrTokenInvalid
+	}
+	if err != nil {
+		return PortalSession{}, err
+	}
+	if expired(session.ExpiresAt, now) {
+		return PortalSession{}, ErrTokenExpired
+	}
+	return session, nil
+}
+
+func RevokePortalSession(db *sql.DB, id string, now time.Time) error {
+	_, err := db.Exec(`UPDATE portal_sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`, now.Format(time.RFC3339), id)
+	return err
+}
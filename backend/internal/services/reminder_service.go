@@ -2,11 +2,18 @@ package services
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
-	"github.com/google/uuid"
+	"nudgepay/internal/payments"
+)
+
+// Statuses a reminder can leave "scheduled" for when it is due.
+const (
+	ReminderSent       = "sent"
+	ReminderSuppressed = "suppressed"
 )
 
 type ReminderInfo struct {
@@ -15,7 +22,33 @@ type ReminderInfo struct {
 	TemplateID string
 }
 
-func SendDueReminders(db *sql.DB, orgID string, now time.Time) (int, error) {
+// ReminderLinks builds the links reminders carry: {{invoice_url}} on
+// BaseURL and, when Payments is set, {{payment_link}}.
+type ReminderLinks struct {
+	BaseURL  string
+	Payments payments.PaymentProvider
+}
+
+// PaymentLinkError reports a reminder that went out without its payment
+// link because the provider failed. The reminder itself was sent.
+type PaymentLinkError struct {
+	ReminderID string
+	Err        error
+}
+
+func (e *PaymentLinkError) Error() string {
+	return "reminder " + e.ReminderID + ": payment link unavailable: " + e.Err.Error()
+}
+
+func (e *PaymentLinkError) Unwrap() error {
+	return e.Err
+}
+
+// ReminderAudit runs inside the transaction that moves a reminder out of
+// "scheduled", so whatever it records commits or rolls back with the send.
+type ReminderAudit func(tx *sql.Tx, reminderID string) error
+
+func SendDueReminders(db *sql.DB, links ReminderLinks, orgID string, now time.Time, audit ReminderAudit) (int, error) {
 	rows, err := db.Query(`SELECT id, invoice_id, template_id FROM reminders
 		WHERE org_id = ? AND status = 'scheduled' AND scheduled_for <= ?`, orgID, now.Format(time.RFC3339))
 	if err != nil {
@@ -34,90 +67,137 @@ func SendDueReminders(db *sql.DB, orgID string, now time.Time) (int, error) {
 		reminders = append(reminders, info)
 	}
 
+	// Reminders sent without their payment link still count; their
+	// PaymentLinkErrors are returned together once the rest went out.
 	sent := 0
+	var linkErrs []error
 	for _, reminder := range reminders {
-		ok, err := sendReminder(db, orgID, reminder.ID, reminder.InvoiceID, reminder.TemplateID, now)
-		if err != nil {
+		status, err := sendReminder(db, links, orgID, reminder.ID, reminder.InvoiceID, reminder.TemplateID, now, audit)
+		var linkErr *PaymentLinkError
+		if errors.As(err, &linkErr) {
+			linkErrs = append(linkErrs, err)
+		} else if err != nil {
 			return sent, err
 		}
-		if ok {
+		if status == ReminderSent {
 			sent++
 		}
 	}
-	return sent, nil
+	return sent, errors.Join(linkErrs...)
 }
 
-func SendReminderByID(db *sql.DB, orgID, reminderID string, now time.Time) (bool, error) {
+// SendReminderByID returns the reminder's new status, or "" when it is
+// unknown or no longer scheduled. A *PaymentLinkError comes with
+// ReminderSent.
+func SendReminderByID(db *sql.DB, links ReminderLinks, orgID, reminderID string, now time.Time, audit ReminderAudit) (string, error) {
 	var invoiceID string
 	var templateID sql.NullString
 	if err := db.QueryRow(`SELECT invoice_id, template_id FROM reminders WHERE id = ? AND org_id = ?`, reminderID, orgID).
 		Scan(&invoiceID, &templateID); err != nil {
 		if err == sql.ErrNoRows {
-			return false, nil
+			return "", nil
 		}
-		return false, err
+		return "", err
 	}
-	return sendReminder(db, orgID, reminderID, invoiceID, templateID.String, now)
+	return sendReminder(db, links, orgID, reminderID, invoiceID, templateID.String, now, audit)
 }
 
-func sendReminder(db *sql.DB, orgID, reminderID, invoiceID, templateID string, now time.Time) (bool, error) {
+func sendReminder(db *sql.DB, links ReminderLinks, orgID, reminderID, invoiceID, templateID string, now time.Time, audit ReminderAudit) (string, error) {
+	var recipient string
+	if err := db.QueryRow(`SELECT c.email FROM invoices i JOIN clients c ON i.client_id = c.id WHERE i.id = ? AND i.org_id = ?`,
+		invoiceID, orgID).Scan(&recipient); err != nil {
+		return "", err
+	}
+	suppressed, err := IsSuppressed(db, orgID, recipient)
+	if err != nil {
+		return "", err
+	}
+	if suppressed {
+		return suppressReminder(db, orgID, reminderID, now, audit)
+	}
+
 	tx, err := db.Begin()
 	if err != nil {
-		return false, err
+		return "", err
 	}
 	defer tx.Rollback()
 
 	res, err := tx.Exec(`UPDATE reminders SET status = 'sent', sent_at = ? WHERE id = ? AND org_id = ? AND status = 'scheduled'`,
 		now.Format(time.RFC3339), reminderID, orgID)
 	if err != nil {
-		return false, err
+		return "", err
 	}
 	affected, _ := res.RowsAffected()
 	if affected == 0 {
-		return false, nil
+		return "", nil
 	}
 
-	var clientName, clientEmail, clientCompany string
+	var clientName, clientEmail, clientCompany, clientLanguage string
 	var invoiceNumber, currency, dueDate string
 	var amountCents int64
-	if err := tx.QueryRow(`SELECT c.name, c.email, c.company, i.number, i.amount_cents, i.currency, i.due_date
+	if err := tx.QueryRow(`SELECT c.name, c.email, c.company, c.language, i.number, i.amount_cents, i.currency, i.due_date
 		FROM invoices i JOIN clients c ON i.client_id = c.id
 		WHERE i.id = ? AND i.org_id = ?`, invoiceID, orgID).
-		Scan(&clientName, &clientEmail, &clientCompany, &invoiceNumber, &amountCents, &currency, &dueDate); err != nil {
-		return false, err
+		Scan(&clientName, &clientEmail, &clientCompany, &clientLanguage, &invoiceNumber, &amountCents, &currency, &dueDate); err != nil {
+		return "", err
 	}
 
 	if strings.TrimSpace(templateID) == "" {
-		defaultID, err := EnsureDefaultTemplate(db, orgID)
+		defaultID, err := ensureDefaultTemplate(tx, orgID)
 		if err != nil {
-			return false, err
+			return "", err
 		}
 		templateID = defaultID
 	}
 
-	var subject, body string
-	if err := tx.QueryRow(`SELECT subject, body FROM templates WHERE id = ? AND org_id = ?`, templateID, orgID).
-		Scan(&subject, &body); err != nil {
+	subject, body, err := loadTemplateContent(tx, orgID, templateID, clientLanguage)
+	if err != nil {
 		if err == sql.ErrNoRows {
-			fallbackID, err := EnsureDefaultTemplate(db, orgID)
+			fallbackID, err := ensureDefaultTemplate(tx, orgID)
 			if err != nil {
-				return false, err
+				return "", err
 			}
-			if err := tx.QueryRow(`SELECT subject, body FROM templates WHERE id = ? AND org_id = ?`, fallbackID, orgID).
-				Scan(&subject, &body); err != nil {
-				return false, err
+			if subject, body, err = loadTemplateContent(tx, orgID, fallbackID, clientLanguage); err != nil {
+				return "", err
 			}
 		} else {
-			return false, err
+			return "", err
 		}
 	}
 
 	var orgName string
 	if err := tx.QueryRow(`SELECT name FROM organizations WHERE id = ?`, orgID).Scan(&orgName); err != nil {
-		return false, err
+		return "", err
+	}
+
+	// The reminder is claimed before the provider is called, so a concurrent
+	// send cannot open a second checkout session; the transaction stays
+	// open across that call. Only templates that show the link ask for
+	// one, and if the provider fails the reminder goes out without it.
+	var paymentLink string
+	var linkErr error
+	if strings.Contains(subject+body, "{{payment_link}}") {
+		if paymentLink, err = paymentLinkURL(tx, links.Payments, orgID, invoiceID, now); err != nil {
+			paymentLink, linkErr = "", &PaymentLinkError{ReminderID: reminderID, Err: err}
+		}
+	}
+
+	// Each reminder gets its own view link, and only when the template
+	// shows it.
+	var invoiceURL string
+	if strings.Contains(subject+body, "{{invoice_url}}") {
+		token, _, err := CreateInvoiceShareLink(tx, orgID, invoiceID, "", nil, now)
+		if err != nil {
+			return "", err
+		}
+		invoiceURL = InvoiceURL(links.BaseURL, token)
+	}
+	headers, unsubscribeURL, err := unsubscribeHeaders(tx, orgID, clientEmail, links.BaseURL, now)
+	if err != nil {
+		return "", err
 	}
 
-	amount := formatAmount(amountCents, currency)
+	amount := FormatAmount(amountCents, currency)
 	values := map[string]string{
 		"client_name":   clientName,
 		"client_company": clientCompany,
@@ -125,22 +205,74 @@ func sendReminder(db *sql.DB, orgID, reminderID, invoiceID, templateID string, n
 		"amount":         amount,
 		"due_date":       dueDate,
 		"org_name":       orgName,
+		"payment_link":   paymentLink,
+		"invoice_url":    invoiceURL,
+		"unsubscribe_url": unsubscribeURL,
 	}
 
 	finalSubject := applyTemplate(subject, values)
 	finalBody := applyTemplate(body, values)
 
-	outboxID := uuid.NewString()
-	if _, err := tx.Exec(`INSERT INTO outbox (id, org_id, reminder_id, to_email, subject, body, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		outboxID, orgID, reminderID, clientEmail, finalSubject, finalBody, now.Format(time.RFC3339)); err != nil {
-		return false, err
+	email := OutboundEmail{
+		OrgID:      orgID,
+		ReminderID: reminderID,
+		Kind:       OutboxKindReminder,
+		ToEmail:    clientEmail,
+		Subject:    finalSubject,
+		Body:       finalBody,
+		Headers:    headers,
+	}
+	outboxID, err := enqueueEmail(tx, email, now)
+	if err != nil {
+		return "", err
+	}
+	if err := EmitReminderEvent(tx, orgID, reminderID, WebhookReminderSent, now); err != nil {
+		return "", err
+	}
+	if err := EmitOutboxEvent(tx, outboxID, email, now); err != nil {
+		return "", err
+	}
+	if audit != nil {
+		if err := audit(tx, reminderID); err != nil {
+			return "", err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return ReminderSent, linkErr
+}
+
+// suppressReminder closes a due reminder without emailing a recipient on
+// the suppression list.
+func suppressReminder(db *sql.DB, orgID, reminderID string, now time.Time, audit ReminderAudit) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
 	}
+	defer tx.Rollback()
 
+	res, err := tx.Exec(`UPDATE reminders SET status = ? WHERE id = ? AND org_id = ? AND status = 'scheduled'`,
+		ReminderSuppressed, reminderID, orgID)
+	if err != nil {
+		return "", err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return "", nil
+	}
+	if err := EmitReminderEvent(tx, orgID, reminderID, WebhookReminderSuppressed, now); err != nil {
+		return "", err
+	}
+	if audit != nil {
+		if err := audit(tx, reminderID); err != nil {
+			return "", err
+		}
+	}
 	if err := tx.Commit(); err != nil {
-		return false, err
+		return "", err
 	}
-	return true, nil
+	return ReminderSuppressed, nil
 }
 
 func applyTemplate(input string, values map[string]string) string {
@@ -151,7 +283,7 @@ func applyTemplate(input string, values map[string]string) string {
 	return out
 }
 
-func formatAmount(amountCents int64, currency string) string {
+func FormatAmount(amountCents int64, currency string) string {
 	amount := float64(amountCents) / 100.0
 	return fmt.Sprintf("%s %.2f", strings.ToUpper(currency), amount)
 }
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"database/sql"
+	"html"
+	"strings"
+	"unicode"
+)
+
+const (
+	SearchClient  = "client"
+	SearchInvoice = "invoice"
+	SearchOutbox  = "outbox"
+)
+
+var SearchKinds = []string{SearchClient, SearchInvoice, SearchOutbox}
+
+type SearchResult struct {
+	Kind       string
+	ResourceID string
+	Title      string
+	Highlight  string
+	Snippet    string
+	Score      float64
+}
+
+// Matches are wrapped in these control characters by SQLite and turned into
+// <mark> tags once the surrounding text has been HTML-escaped.
+const (
+	markOpen  = "\x02"
+	markClose = "\x03"
+)
+
+// SearchMatchQuery turns free text into an FTS5 query that requires every
+// word, each as a prefix, so user input never reaches the FTS5 syntax.
+func SearchMatchQuery(q string) string {
+	words := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		terms = append(terms, `"`+word+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// Search returns the org's records matching q, best first. Titles weigh
+// more than client details, which weigh more than notes and bodies.
+func Search(db *sql.DB, orgID, q string, kinds []string, limit int) ([]SearchResult, error) {
+	results := []SearchResult{}
+	match := SearchMatchQuery(q)
+	if match == "" {
+		return results, nil
+	}
+	query := `SELECT d.kind, d.resource_id, d.title,
+			highlight(search_fts, 0, char(2), char(3)),
+			snippet(search_fts, -1, char(2), char(3), '…', 16),
+			bm25(search_fts, 10.0, 4.0, 1.0) AS score
+		FROM search_fts JOIN search_documents d ON d.id = search_fts.rowid
+		WHERE search_fts MATCH ? AND d.org_id = ?`
+	args := []interface{}{match, orgID}
+	if len(kinds) > 0 {
+		query += " AND d.kind IN (?" + strings.Repeat(", ?", len(kinds)-1) + ")"
+		for _, kind := range kinds {
+			args = append(args, kind)
+		}
+	}
+	query += " ORDER BY score, d.id LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r SearchResult
+		if err := rows.Scan(&r.Kind, &r.ResourceID, &r.Title, &r.Highlight, &r.Snippet, &r.Score); err != nil {
+			return nil, err
+		}
+		r.Highlight, r.Snippet = markMatches(r.Highlight), markMatches(r.Snippet)
+		// bm25 is lower for better matches; flip it so higher is better.
+		r.Score = -r.Score
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+func markMatches(text string) string {
+	text = html.EscapeString(text)
+	text = strings.ReplaceAll(text, markOpen, "<mark>")
+	return strings.ReplaceAll(text, markClose, "</mark>")
+}
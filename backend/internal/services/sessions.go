@@ -0,0 +1,159 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nudgepay/internal/auth"
+)
+
+const (
+	AuthMethodPassword = "password"
+	AuthMethodSSO      = "sso"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+type RefreshResult struct {
+	SessionID    string
+	UserID       string
+	OrgID        string
+	RefreshToken string
+}
+
+func CreateSession(db *sql.DB, userID, orgID, authMethod, userAgent, ip string, now time.Time) (string, string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	sessionID := uuid.NewString()
+	if _, err := tx.Exec(`INSERT INTO sessions (id, user_id, org_id, user_agent, ip, created_at, last_used_at, expires_at, revoked_at, auth_method)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, NULL, ?)`,
+		sessionID, userID, orgID, userAgent, ip, now.Format(time.RFC3339), now.Format(time.RFC3339),
+		now.Add(auth.RefreshTokenTTL).Format(time.RFC3339), authMethod); err != nil {
+		return "", "", err
+	}
+	refreshToken, err := insertRefreshToken(tx, sessionID, now)
+	if err != nil {
+		return "", "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", "", err
+	}
+	return sessionID, refreshToken, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one. Each token is
+// single-use: presenting one that was already rotated means it leaked, so
+// the whole session and every token descended from it is revoked.
+func RotateRefreshToken(db *sql.DB, refreshToken string, now time.Time) (RefreshResult, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return RefreshResult{}, err
+	}
+	defer tx.Rollback()
+
+	var tokenID, expiresAt string
+	var usedAt, revokedAt sql.NullString
+	var result RefreshResult
+	err = tx.QueryRow(`SELECT rt.id, rt.session_id, rt.expires_at, rt.used_at, s.user_id, s.org_id, s.revoked_at
+		FROM refresh_tokens rt JOIN sessions s ON rt.session_id = s.id
+		WHERE rt.token_hash = ?`, auth.HashOpaqueToken(refreshToken)).
+		Scan(&tokenID, &result.SessionID, &expiresAt, &usedAt, &result.UserID, &result.OrgID, &revokedAt)
+	if err == sql.ErrNoRows {
+		return RefreshResult{}, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return RefreshResult{}, err
+	}
+	if revokedAt.Valid {
+		return RefreshResult{}, ErrRefreshTokenInvalid
+	}
+	if usedAt.Valid {
+		return RefreshResult{}, revokeReusedSession(tx, result.SessionID, now)
+	}
+	if expired(expiresAt, now) {
+		return RefreshResult{}, ErrRefreshTokenInvalid
+	}
+
+	res, err := tx.Exec(`UPDATE refresh_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL`, now.Format(time.RFC3339), tokenID)
+	if err != nil {
+		return RefreshResult{}, err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return RefreshResult{}, revokeReusedSession(tx, result.SessionID, now)
+	}
+	if result.RefreshToken, err = insertRefreshToken(tx, result.SessionID, now); err != nil {
+		return RefreshResult{}, err
+	}
+	if _, err := tx.Exec(`UPDATE sessions SET last_used_at = ?, expires_at = ? WHERE id = ?`,
+		now.Format(time.RFC3339), now.Add(auth.RefreshTokenTTL).Format(time.RFC3339), result.SessionID); err != nil {
+		return RefreshResult{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return RefreshResult{}, err
+	}
+	return result, nil
+}
+
+func RevokeSession(q queryer, userID, sessionID string, now time.Time) (bool, error) {
+	res, err := q.Exec(`UPDATE sessions SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL`,
+		now.Format(time.RFC3339), sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+	affected, _ := res.RowsAffected()
+	return affected > 0, nil
+}
+
+func SessionActive(db *sql.DB, sessionID, userID string, now time.Time) (bool, error) {
+	var expiresAt string
+	var revokedAt sql.NullString
+	err := db.QueryRow(`SELECT expires_at, revoked_at FROM sessions WHERE id = ? AND user_id = ?`, sessionID, userID).
+		Scan(&expiresAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !revokedAt.Valid && !expired(expiresAt, now), nil
+}
+
+func insertRefreshToken(tx *sql.Tx, sessionID string, now time.Time) (string, error) {
+	token, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`INSERT INTO refresh_tokens (id, session_id, token_hash, created_at, expires_at, used_at) VALUES (?, ?, ?, ?, ?, NULL)`,
+		uuid.NewString(), sessionID, hash, now.Format(time.RFC3339), now.Add(auth.RefreshTokenTTL).Format(time.RFC3339)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func revokeReusedSession(tx *sql.Tx, sessionID string, now time.Time) error {
+	if _, err := tx.Exec(`UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`, now.Format(time.RFC3339), sessionID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
+
+func expired(timestamp string, now time.Time) bool {
+	parsed, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return true
+	}
+	return !now.Before(parsed)
+}
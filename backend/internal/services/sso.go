@@ -0,0 +1,118 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nudgepay/internal/auth"
+	"nudgepay/internal/sso"
+)
+
+const SSOStateTTL = 10 * time.Minute
+
+var (
+	ErrSSOUnknownUser     = errors.New("no account for this identity")
+	ErrSSOEmailUnverified = errors.New("identity provider has not verified the email")
+)
+
+type SSOState struct {
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+}
+
+// CreateSSOState remembers what a login sent to the identity provider so the
+// callback can check it. Only a hash of the state parameter is stored.
+func CreateSSOState(db *sql.DB, provider, nonce, codeVerifier string, now time.Time) (string, error) {
+	state, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	if _, err := db.Exec(`INSERT INTO sso_states (id, state_hash, provider, nonce, code_verifier, created_at, expires_at, used_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, NULL)`,
+		uuid.NewString(), hash, provider, nonce, codeVerifier, now.Format(time.RFC3339), now.Add(SSOStateTTL).Format(time.RFC3339)); err != nil {
+		return "", err
+	}
+	return state, nil
+}
+
+func ConsumeSSOState(db *sql.DB, state string, now time.Time) (SSOState, error) {
+	var id, expiresAt string
+	var usedAt sql.NullString
+	var result SSOState
+	err := db.QueryRow(`SELECT id, provider, nonce, code_verifier, expires_at, used_at FROM sso_states WHERE state_hash = ?`,
+		auth.HashOpaqueToken(state)).Scan(&id, &result.Provider, &result.Nonce, &result.CodeVerifier, &expiresAt, &usedAt)
+	if err == sql.ErrNoRows || (err == nil && usedAt.Valid) {
+		return SSOState{}, ErrTokenInvalid
+	}
+	if err != nil {
+		return SSOState{}, err
+	}
+	if expired(expiresAt, now) {
+		return SSOState{}, ErrTokenExpired
+	}
+	res, err := db.Exec(`UPDATE sso_states SET used_at = ? WHERE id = ? AND used_at IS NULL`, now.Format(time.RFC3339), id)
+	if err != nil {
+		return SSOState{}, err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return SSOState{}, ErrTokenInvalid
+	}
+	return result, nil
+}
+
+// ResolveSSOUser finds the account behind a verified identity. A subject seen
+// before keeps mapping to the same user; otherwise the provider-verified
+// email must match an existing account, which is then linked.
+func ResolveSSOUser(db *sql.DB, provider string, identity sso.Identity, now time.Time) (string, error) {
+	var userID string
+	err := db.QueryRow(`SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?`, provider, identity.Subject).Scan(&userID)
+	if err == nil {
+		return userID, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+	if !identity.EmailVerified || identity.Email == "" {
+		return "", ErrSSOEmailUnverified
+	}
+	err = db.QueryRow(`SELECT id FROM users WHERE email = ?`, identity.Email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", ErrSSOUnknownUser
+	}
+	if err != nil {
+		return "", err
+	}
+	stamp := now.Format(time.RFC3339)
+	if _, err := db.Exec(`INSERT OR IGNORE INTO user_identities (id, user_id, provider, subject, created_at) VALUES (?, ?, ?, ?, ?)`,
+		uuid.NewString(), userID, provider, identity.Subject, stamp); err != nil {
+		return "", err
+	}
+	if _, err := db.Exec(`UPDATE users SET email_verified_at = COALESCE(email_verified_at, ?) WHERE id = ?`, stamp, userID); err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+func SSORequired(db *sql.DB, orgID string) (bool, error) {
+	var required bool
+	err := db.QueryRow(`SELECT require_sso FROM organizations WHERE id = ?`, orgID).Scan(&required)
+	return required, err
+}
+
+// SSOSkipsTwoFactor reports whether the org trusts its identity provider's
+// second factor, letting single sign-on logins skip the TOTP challenge.
+func SSOSkipsTwoFactor(db *sql.DB, orgID string) (bool, error) {
+	var skip bool
+	err := db.QueryRow(`SELECT sso_skip_2fa FROM organizations WHERE id = ?`, orgID).Scan(&skip)
+	return skip, err
+}
+
+func SessionAuthMethod(db *sql.DB, sessionID string) (string, error) {
+	var method string
+	err := db.QueryRow(`SELECT auth_method FROM sessions WHERE id = ?`, sessionID).Scan(&method)
+	return method, err
+}
@@ -0,0 +1,149 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nudgepay/internal/auth"
+)
+
+// Reasons an address is on an org's suppression list. Reminders are never
+// sent to suppressed addresses, whatever the reason.
+const (
+	SuppressionManual      = "manual"
+	SuppressionUnsubscribe = "unsubscribe"
+	SuppressionHardBounce  = "hard_bounce"
+	SuppressionComplaint   = "complaint"
+)
+
+var SuppressionReasons = []string{SuppressionManual, SuppressionUnsubscribe, SuppressionHardBounce, SuppressionComplaint}
+
+var ErrAlreadySuppressed = errors.New("address is already suppressed")
+
+type Suppression struct {
+	ID        string
+	Email     string
+	Reason    string
+	Note      string
+	CreatedBy string
+	CreatedAt string
+}
+
+func ValidSuppressionReason(reason string) bool {
+	for _, r := range SuppressionReasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+func IsSuppressed(q queryer, orgID, email string) (bool, error) {
+	var id string
+	err := q.QueryRow(`SELECT id FROM email_suppressions WHERE org_id = ? AND email = ?`,
+		orgID, strings.ToLower(strings.TrimSpace(email))).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Suppress adds an address to the org's list. createdBy is empty when the
+// recipient unsubscribed themselves.
+func Suppress(q queryer, orgID, email, reason, note, createdBy string, now time.Time) (Suppression, error) {
+	s := Suppression{
+		ID:        uuid.NewString(),
+		Email:     strings.ToLower(strings.TrimSpace(email)),
+		Reason:    reason,
+		Note:      note,
+		CreatedBy: createdBy,
+		CreatedAt: now.Format(time.RFC3339),
+	}
+	res, err := q.Exec(`INSERT INTO email_suppressions (id, org_id, email, reason, note, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (org_id, email) DO NOTHING`,
+		s.ID, orgID, s.Email, s.Reason, s.Note, sql.NullString{String: createdBy, Valid: createdBy != ""}, s.CreatedAt)
+	if err != nil {
+		return Suppression{}, err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return Suppression{}, ErrAlreadySuppressed
+	}
+	return s, nil
+}
+
+func ListSuppressions(db *sql.DB, orgID, email, reason string) ([]Suppression, error) {
+	query := `SELECT id, email, reason, note, created_by, created_at FROM email_suppressions WHERE org_id = ?`
+	args := []interface{}{orgID}
+	if email != "" {
+		query += ` AND email = ?`
+		args = append(args, strings.ToLower(email))
+	}
+	if reason != "" {
+		query += ` AND reason = ?`
+		args = append(args, reason)
+	}
+	rows, err := db.Query(query+` ORDER BY created_at DESC, rowid DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := make([]Suppression, 0)
+	for rows.Next() {
+		var s Suppression
+		var createdBy sql.NullString
+		if err := rows.Scan(&s.ID, &s.Email, &s.Reason, &s.Note, &createdBy, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		s.CreatedBy = createdBy.String
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+func DeleteSuppression(q queryer, orgID, id string) (bool, error) {
+	res, err := q.Exec(`DELETE FROM email_suppressions WHERE id = ? AND org_id = ?`, id, orgID)
+	if err != nil {
+		return false, err
+	}
+	affected, _ := res.RowsAffected()
+	return affected > 0, nil
+}
+
+// UnsubscribeURL is the RFC 8058 one-click endpoint for a token.
+func UnsubscribeURL(baseURL, token string) string {
+	return strings.TrimRight(baseURL, "/") + "/unsubscribe/" + token
+}
+
+// unsubscribeHeaders issues a token for the recipient and returns the
+// List-Unsubscribe headers of an email to them. The token does not expire,
+// as mail clients may offer the link long after delivery.
+func unsubscribeHeaders(tx *sql.Tx, orgID, email, baseURL string, now time.Time) (map[string]string, string, error) {
+	token, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := tx.Exec(`INSERT INTO unsubscribe_tokens (id, org_id, email, token_hash, created_at) VALUES (?, ?, ?, ?, ?)`,
+		uuid.NewString(), orgID, strings.ToLower(strings.TrimSpace(email)), hash, now.Format(time.RFC3339)); err != nil {
+		return nil, "", err
+	}
+	url := UnsubscribeURL(baseURL, token)
+	return map[string]string{
+		"List-Unsubscribe":      "<" + url + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}, url, nil
+}
+
+// ResolveUnsubscribeToken returns the org and address a token unsubscribes.
+func ResolveUnsubscribeToken(db *sql.DB, token string) (string, string, error) {
+	var orgID, email string
+	err := db.QueryRow(`SELECT org_id, email FROM unsubscribe_tokens WHERE token_hash = ?`, auth.HashOpaqueToken(token)).
+		Scan(&orgID, &email)
+	if err == sql.ErrNoRows {
+		return "", "", ErrTokenInvalid
+	}
+	return orgID, email, err
+}
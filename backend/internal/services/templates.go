@@ -2,17 +2,121 @@ package services
 
 import (
 	"database/sql"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-const DefaultTemplateName = "Default Reminder"
+const (
+	DefaultTemplateName = "Default Reminder"
+	DefaultLanguage     = "en"
+)
+
+type TemplateVariant struct {
+	Language string
+	Subject  string
+	Body     string
+}
+
+var languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+func NormalizeLanguage(lang string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(lang)), "_", "-")
+}
+
+func ValidLanguage(lang string) bool {
+	return languagePattern.MatchString(lang)
+}
+
+var defaultTemplateEnglish = TemplateVariant{
+	Language: DefaultLanguage,
+	Subject:  "Friendly reminder: invoice {{invoice_number}}",
+	Body: strings.Join([]string{
+		"Hi {{client_name}},",
+		"",
+		"Just a quick reminder that invoice {{invoice_number}} for {{amount}} is due on {{due_date}}.",
+		"If you've already sent payment, please disregard this note.",
+		"",
+		"Thanks,",
+		"{{org_name}}",
+	}, "\n"),
+}
+
+var defaultTemplateVariants = []TemplateVariant{
+	{
+		Language: "de",
+		Subject:  "Freundliche Erinnerung: Rechnung {{invoice_number}}",
+		Body: strings.Join([]string{
+			"Hallo {{client_name}},",
+			"",
+			"nur eine kurze Erinnerung, dass die Rechnung {{invoice_number}} über {{amount}} am {{due_date}} fällig ist.",
+			"Falls Sie die Zahlung bereits veranlasst haben, betrachten Sie diese Nachricht bitte als gegenstandslos.",
+			"",
+			"Vielen Dank,",
+			"{{org_name}}",
+		}, "\n"),
+	},
+	{
+		Language: "es",
+		Subject:  "Recordatorio amistoso: factura {{invoice_number}}",
+		Body: strings.Join([]string{
+			"Hola {{client_name}},",
+			"",
+			"Solo un breve recordatorio de que la factura {{invoice_number}} por {{amount}} vence el {{due_date}}.",
+			"Si ya ha realizado el pago, por favor ignore este mensaje.",
+			"",
+			"Gracias,",
+			"{{org_name}}",
+		}, "\n"),
+	},
+	{
+		Language: "fr",
+		Subject:  "Petit rappel : facture {{invoice_number}}",
+		Body: strings.Join([]string{
+			"Bonjour {{client_name}},",
+			"",
+			"Nous vous rappelons que la facture {{invoice_number}} d'un montant de {{amount}} arrive à échéance le {{due_date}}.",
+			"Si vous avez déjà effectué le paiement, merci de ne pas tenir compte de ce message.",
+			"",
+			"Merci,",
+			"{{org_name}}",
+		}, "\n"),
+	},
+}
 
 func EnsureDefaultTemplate(db *sql.DB, orgID string) (string, error) {
 	var id string
-	err := db.QueryRow(`SELECT id FROM templates WHERE org_id = ? ORDER BY created_at ASC LIMIT 1`, orgID).Scan(&id)
+	err := db.QueryRow(`SELECT id FROM templates WHERE org_id = ? AND is_default = 1`, orgID).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	id, err = ensureDefaultTemplate(tx, orgID)
+	if err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// ensureDefaultTemplate returns the org's explicit default template, creating
+// the built-in multi-language one when the org has none.
+func ensureDefaultTemplate(tx *sql.Tx, orgID string) (string, error) {
+	var id string
+	err := tx.QueryRow(`SELECT id FROM templates WHERE org_id = ? AND is_default = 1`, orgID).Scan(&id)
 	if err == nil {
 		return id, nil
 	}
@@ -22,20 +126,79 @@ func EnsureDefaultTemplate(db *sql.DB, orgID string) (string, error) {
 
 	id = uuid.NewString()
 	now := time.Now().UTC().Format(time.RFC3339)
-	subject := "Friendly reminder: invoice {{invoice_number}}"
-	body := strings.Join([]string{
-		"Hi {{client_name}},",
-		"",
-		"Just a quick reminder that invoice {{invoice_number}} for {{amount}} is due on {{due_date}}.",
-		"If you've already sent payment, please disregard this note.",
-		"",
-		"Thanks,",
-		"{{org_name}}",
-	}, "\n")
-	_, err = db.Exec(`INSERT INTO templates (id, org_id, name, subject, body, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		id, orgID, DefaultTemplateName, subject, body, now, now)
-	if err != nil {
+	if _, err := tx.Exec(`INSERT INTO templates (id, org_id, name, subject, body, language, is_default, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, 1, ?, ?)`,
+		id, orgID, DefaultTemplateName, defaultTemplateEnglish.Subject, defaultTemplateEnglish.Body, defaultTemplateEnglish.Language, now, now); err != nil {
+		return "", err
+	}
+	if err := ReplaceTemplateVariants(tx, orgID, id, defaultTemplateVariants); err != nil {
 		return "", err
 	}
 	return id, nil
 }
+
+func SetDefaultTemplate(tx *sql.Tx, orgID, templateID string) (bool, error) {
+	var exists string
+	if err := tx.QueryRow(`SELECT id FROM templates WHERE id = ? AND org_id = ?`, templateID, orgID).Scan(&exists); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	if _, err := tx.Exec(`UPDATE templates SET is_default = 0 WHERE org_id = ? AND is_default = 1`, orgID); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`UPDATE templates SET is_default = 1 WHERE id = ? AND org_id = ?`, templateID, orgID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func ReplaceTemplateVariants(tx *sql.Tx, orgID, templateID string, variants []TemplateVariant) error {
+	if _, err := tx.Exec(`DELETE FROM template_variants WHERE template_id = ? AND org_id = ?`, templateID, orgID); err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, variant := range variants {
+		if _, err := tx.Exec(`INSERT INTO template_variants (id, org_id, template_id, language, subject, body, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			uuid.NewString(), orgID, templateID, variant.Language, variant.Subject, variant.Body, now, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadTemplateContent returns the subject and body of a template in the
+// requested language. An exact variant match wins, then the primary subtag
+// ("de" for "de-AT"), then the template's own fallback-language content.
+func loadTemplateContent(tx *sql.Tx, orgID, templateID, language string) (string, string, error) {
+	var subject, body, fallback string
+	if err := tx.QueryRow(`SELECT subject, body, language FROM templates WHERE id = ? AND org_id = ?`, templateID, orgID).
+		Scan(&subject, &body, &fallback); err != nil {
+		return "", "", err
+	}
+
+	language = NormalizeLanguage(language)
+	if language == "" || language == fallback {
+		return subject, body, nil
+	}
+	candidates := []string{language}
+	if primary, _, ok := strings.Cut(language, "-"); ok {
+		candidates = append(candidates, primary)
+	}
+	for _, candidate := range candidates {
+		if candidate == fallback {
+			return subject, body, nil
+		}
+		var variantSubject, variantBody string
+		err := tx.QueryRow(`SELECT subject, body FROM template_variants WHERE template_id = ? AND org_id = ? AND language = ?`,
+			templateID, orgID, candidate).Scan(&variantSubject, &variantBody)
+		if err == nil {
+			return variantSubject, variantBody, nil
+		}
+		if err != sql.ErrNoRows {
+			return "", "", err
+		}
+	}
+	return subject, body, nil
+}
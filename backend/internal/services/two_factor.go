@@ -0,0 +1,251 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nudgepay/internal/auth"
+)
+
+const (
+	TokenPurposeMFALogin = "mfa_login"
+	// TokenPurposeMFALoginSSO is the challenge after a single sign-on login,
+	// so the session it leads to keeps the sso auth method.
+	TokenPurposeMFALoginSSO = "mfa_login_sso"
+
+	MFALoginTTL         = 5 * time.Minute
+	MFALoginMaxAttempts = 5
+	RecoveryCodeCount   = 10
+
+	TOTPIssuer = "NudgePay"
+)
+
+var (
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication already enabled")
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication not enabled")
+	ErrTwoFactorNotPending = errors.New("two-factor enrollment not started")
+	ErrInvalidCode         = errors.New("invalid code")
+)
+
+type TOTPEnrollment struct {
+	Secret string
+	URI    string
+}
+
+// BeginTOTPEnrollment stores a fresh pending secret. It only takes effect
+// once ConfirmTOTPEnrollment sees a valid code generated from it.
+func BeginTOTPEnrollment(db *sql.DB, userID string) (TOTPEnrollment, error) {
+	var email string
+	var enabledAt sql.NullString
+	if err := db.QueryRow(`SELECT email, totp_enabled_at FROM users WHERE id = ?`, userID).Scan(&email, &enabledAt); err != nil {
+		return TOTPEnrollment{}, err
+	}
+	if enabledAt.Valid {
+		return TOTPEnrollment{}, ErrTwoFactorEnabled
+	}
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	if _, err := db.Exec(`UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ?`, secret, userID); err != nil {
+		return TOTPEnrollment{}, err
+	}
+	return TOTPEnrollment{Secret: secret, URI: auth.TOTPURI(TOTPIssuer, email, secret)}, nil
+}
+
+// ConfirmTOTPEnrollment, DisableTOTP and RegenerateRecoveryCodes leave
+// committing tx to the caller.
+func ConfirmTOTPEnrollment(tx *sql.Tx, userID, code string, now time.Time) ([]string, error) {
+	var secret, enabledAt sql.NullString
+	var lastStep int64
+	if err := tx.QueryRow(`SELECT totp_secret, totp_enabled_at, totp_last_step FROM users WHERE id = ?`, userID).
+		Scan(&secret, &enabledAt, &lastStep); err != nil {
+		return nil, err
+	}
+	if enabledAt.Valid {
+		return nil, ErrTwoFactorEnabled
+	}
+	if !secret.Valid {
+		return nil, ErrTwoFactorNotPending
+	}
+	step, ok := auth.VerifyTOTP(secret.String, code, now, lastStep)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+	if _, err := tx.Exec(`UPDATE users SET totp_enabled_at = ?, totp_last_step = ? WHERE id = ?`,
+		now.Format(time.RFC3339), step, userID); err != nil {
+		return nil, err
+	}
+	return replaceRecoveryCodes(tx, userID, now)
+}
+
+func DisableTOTP(tx *sql.Tx, userID, code string, now time.Time) error {
+	ok, err := checkSecondFactor(tx, userID, code, now)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCode
+	}
+	if _, err := tx.Exec(`UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0 WHERE id = ?`, userID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID)
+	return err
+}
+
+func RegenerateRecoveryCodes(tx *sql.Tx, userID, code string, now time.Time) ([]string, error) {
+	ok, err := checkSecondFactor(tx, userID, code, now)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+	return replaceRecoveryCodes(tx, userID, now)
+}
+
+func StartMFAChallenge(db *sql.DB, userID, authMethod string, now time.Time) (string, error) {
+	purpose := TokenPurposeMFALogin
+	if authMethod == AuthMethodSSO {
+		purpose = TokenPurposeMFALoginSSO
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	token, err := issueUserToken(tx, userID, purpose, MFALoginTTL, now)
+	if err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// MFAChallengeEmail returns the address of the user a pending challenge
+// belongs to, so the second step can share the password step's throttling.
+func MFAChallengeEmail(db *sql.DB, challenge string) (string, error) {
+	var email string
+	err := db.QueryRow(`SELECT u.email FROM user_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = ? AND t.purpose IN (?, ?) AND t.used_at IS NULL`,
+		auth.HashOpaqueToken(challenge), TokenPurposeMFALogin, TokenPurposeMFALoginSSO).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", ErrTokenInvalid
+	}
+	return email, err
+}
+
+// CompleteMFAChallenge checks the second login step and returns the user and
+// the auth method of the first step. A challenge survives a wrong code but is
+// burned after MFALoginMaxAttempts failures.
+func CompleteMFAChallenge(db *sql.DB, challenge, code string, now time.Time) (string, string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	var id, userID, purpose, expiresAt string
+	var usedAt sql.NullString
+	var attempts int
+	err = tx.QueryRow(`SELECT id, user_id, purpose, expires_at, used_at, attempts FROM user_tokens WHERE token_hash = ? AND purpose IN (?, ?)`,
+		auth.HashOpaqueToken(challenge), TokenPurposeMFALogin, TokenPurposeMFALoginSSO).Scan(&id, &userID, &purpose, &expiresAt, &usedAt, &attempts)
+	if err == sql.ErrNoRows || (err == nil && usedAt.Valid) {
+		return "", "", ErrTokenInvalid
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if expired(expiresAt, now) {
+		return "", "", ErrTokenExpired
+	}
+
+	ok, err := checkSecondFactor(tx, userID, code, now)
+	if err != nil {
+		return "", "", err
+	}
+	if !ok {
+		attempts++
+		var burned interface{}
+		if attempts >= MFALoginMaxAttempts {
+			burned = now.Format(time.RFC3339)
+		}
+		if _, err := tx.Exec(`UPDATE user_tokens SET attempts = ?, used_at = ? WHERE id = ?`, attempts, burned, id); err != nil {
+			return "", "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return "", "", err
+		}
+		return "", "", ErrInvalidCode
+	}
+	if _, err := tx.Exec(`UPDATE user_tokens SET used_at = ? WHERE id = ?`, now.Format(time.RFC3339), id); err != nil {
+		return "", "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", "", err
+	}
+	method := AuthMethodPassword
+	if purpose == TokenPurposeMFALoginSSO {
+		method = AuthMethodSSO
+	}
+	return userID, method, nil
+}
+
+func TwoFactorEnabled(db *sql.DB, userID string) (bool, error) {
+	var enabledAt sql.NullString
+	if err := db.QueryRow(`SELECT totp_enabled_at FROM users WHERE id = ?`, userID).Scan(&enabledAt); err != nil {
+		return false, err
+	}
+	return enabledAt.Valid, nil
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery
+// code, consuming whichever matched.
+func checkSecondFactor(tx *sql.Tx, userID, code string, now time.Time) (bool, error) {
+	var secret, enabledAt sql.NullString
+	var lastStep int64
+	if err := tx.QueryRow(`SELECT totp_secret, totp_enabled_at, totp_last_step FROM users WHERE id = ?`, userID).
+		Scan(&secret, &enabledAt, &lastStep); err != nil {
+		return false, err
+	}
+	if !enabledAt.Valid || !secret.Valid {
+		return false, ErrTwoFactorNotEnabled
+	}
+	if step, ok := auth.VerifyTOTP(secret.String, code, now, lastStep); ok {
+		if _, err := tx.Exec(`UPDATE users SET totp_last_step = ? WHERE id = ?`, step, userID); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	res, err := tx.Exec(`UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`,
+		now.Format(time.RFC3339), userID, auth.HashOpaqueToken(auth.NormalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	affected, _ := res.RowsAffected()
+	return affected > 0, nil
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID string, now time.Time) ([]string, error) {
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return nil, err
+	}
+	codes, err := auth.NewRecoveryCodes(RecoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (id, user_id, code_hash, created_at, used_at) VALUES (?, ?, ?, ?, NULL)`,
+			uuid.NewString(), userID, auth.HashOpaqueToken(code), now.Format(time.RFC3339)); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
@@ -0,0 +1,443 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	WebhookInvoiceCreated     = "invoice.created"
+	WebhookInvoiceUpdated     = "invoice.updated"
+	WebhookInvoicePaid        = "invoice.paid"
+	WebhookInvoiceOverdue     = "invoice.overdue"
+	WebhookReminderSent       = "reminder.sent"
+	WebhookReminderCancelled  = "reminder.cancelled"
+	WebhookReminderSuppressed = "reminder.suppressed"
+	WebhookOutboxQueued       = "outbox.queued"
+)
+
+var WebhookEventTypes = []string{
+	WebhookInvoiceCreated, WebhookInvoiceUpdated, WebhookInvoicePaid, WebhookInvoiceOverdue,
+	WebhookReminderSent, WebhookReminderCancelled, WebhookReminderSuppressed,
+	WebhookOutboxQueued,
+}
+
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed"
+
+	// WebhookSignatureHeader carries "t=<unix time>,v1=<hex HMAC-SHA256>",
+	// computed over "<unix time>.<body>" with the endpoint's secret.
+	WebhookSignatureHeader = "NudgePay-Signature"
+
+	webhookTimeout = 10 * time.Second
+	// webhookLease keeps a delivery from being picked up twice while a
+	// request for it is in progress.
+	webhookLease        = time.Minute
+	webhookBatchSize    = 100
+	webhookResponseKept = 1024
+)
+
+// webhookBackoff is the wait before each retry of a failed delivery. Once it
+// runs out the delivery is marked failed and only a manual redelivery sends
+// it again.
+var webhookBackoff = []time.Duration{
+	time.Minute, 5 * time.Minute, 30 * time.Minute, 2 * time.Hour, 6 * time.Hour, 24 * time.Hour,
+}
+
+// ErrWebhookAddressBlocked is returned for endpoints on loopback, private,
+// link-local (including the 169.254.169.254 metadata service) and other
+// non-public addresses, which must never be reachable through a webhook.
+var ErrWebhookAddressBlocked = errors.New("webhook url must point to a public address")
+
+func webhookIPBlocked(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+}
+
+// CheckWebhookHost rejects an endpoint host that is, or resolves to, a
+// blocked address. A host that does not resolve yet is accepted; every
+// delivery checks the address it actually connects to.
+func CheckWebhookHost(host string) error {
+	if strings.EqualFold(strings.TrimSuffix(host, "."), "localhost") {
+		return ErrWebhookAddressBlocked
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		resolved, err := net.LookupIP(host)
+		if err != nil {
+			return nil
+		}
+		ips = resolved
+	}
+	for _, ip := range ips {
+		if webhookIPBlocked(ip) {
+			return ErrWebhookAddressBlocked
+		}
+	}
+	return nil
+}
+
+// NewWebhookClient returns the client deliveries are sent with. Unless
+// allowPrivate is set it refuses to connect to a blocked address, checked on
+// the resolved IP at dial time so DNS changes after the endpoint was saved
+// cannot get around it. Redirects are never followed: a 3xx is a failed
+// delivery.
+func NewWebhookClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || webhookIPBlocked(ip) {
+				return ErrWebhookAddressBlocked
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   webhookTimeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// queryer is satisfied by *sql.DB and *sql.Tx, so events can be emitted in
+// the transaction that made the change.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type WebhookEvent struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	CreatedAt string                 `json:"created_at"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+func ValidWebhookEventType(eventType string) bool {
+	for _, t := range WebhookEventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func NewWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(buf), nil
+}
+
+// WebhookSignature is the v1 signature receivers recompute to check that a
+// payload came from us and was sent at timestamp.
+func WebhookSignature(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// EmitWebhookEvent records an event and queues a delivery to each of the
+// org's endpoints subscribed to its type.
+func EmitWebhookEvent(q queryer, orgID, eventType, resourceID string, data map[string]interface{}, now time.Time) error {
+	event := WebhookEvent{ID: uuid.NewString(), Type: eventType, CreatedAt: now.UTC().Format(time.RFC3339), Data: data}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := q.Exec(`INSERT INTO webhook_events (id, org_id, event_type, resource_id, payload, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		event.ID, orgID, eventType, resourceID, string(payload), event.CreatedAt); err != nil {
+		return err
+	}
+
+	rows, err := q.Query(`SELECT id, event_types FROM webhook_endpoints WHERE org_id = ?`, orgID)
+	if err != nil {
+		return err
+	}
+	endpoints := []string{}
+	for rows.Next() {
+		var id, types string
+		if err := rows.Scan(&id, &types); err != nil {
+			rows.Close()
+			return err
+		}
+		for _, t := range strings.Fields(types) {
+			if t == eventType {
+				endpoints = append(endpoints, id)
+				break
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, endpointID := range endpoints {
+		if _, err := queueWebhookDelivery(q, orgID, endpointID, event.ID, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queueWebhookDelivery(q queryer, orgID, endpointID, eventID string, now time.Time) (string, error) {
+	id := uuid.NewString()
+	created := now.UTC().Format(time.RFC3339)
+	_, err := q.Exec(`INSERT INTO webhook_deliveries (id, org_id, endpoint_id, event_id, status, next_attempt_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, id, orgID, endpointID, eventID, WebhookDeliveryPending, created, created, created)
+	return id, err
+}
+
+// EmitInvoiceEvent emits eventType with the invoice's current fields.
+func EmitInvoiceEvent(q queryer, orgID, invoiceID, eventType string, now time.Time) error {
+	var clientID, number, currency, dueDate, status, notes, createdAt, updatedAt string
+	var amountCents int64
+	if err := q.QueryRow(`SELECT client_id, number, amount_cents, currency, due_date, status, notes, created_at, updated_at
+		FROM invoices WHERE id = ? AND org_id = ?`, invoiceID, orgID).
+		Scan(&clientID, &number, &amountCents, &currency, &dueDate, &status, &notes, &createdAt, &updatedAt); err != nil {
+		return err
+	}
+	return EmitWebhookEvent(q, orgID, eventType, invoiceID, map[string]interface{}{
+		"id":           invoiceID,
+		"client_id":    clientID,
+		"number":       number,
+		"amount_cents": amountCents,
+		"currency":     currency,
+		"due_date":     dueDate,
+		"status":       status,
+		"notes":        notes,
+		"created_at":   createdAt,
+		"updated_at":   updatedAt,
+	}, now)
+}
+
+// EmitReminderEvent emits eventType with the reminder's current fields.
+func EmitReminderEvent(q queryer, orgID, reminderID, eventType string, now time.Time) error {
+	var invoiceID, number, scheduledFor, status string
+	var sentAt sql.NullString
+	if err := q.QueryRow(`SELECT r.invoice_id, i.number, r.scheduled_for, r.sent_at, r.status
+		FROM reminders r JOIN invoices i ON i.id = r.invoice_id WHERE r.id = ? AND r.org_id = ?`, reminderID, orgID).
+		Scan(&invoiceID, &number, &scheduledFor, &sentAt, &status); err != nil {
+		return err
+	}
+	data := map[string]interface{}{
+		"id":             reminderID,
+		"invoice_id":     invoiceID,
+		"invoice_number": number,
+		"scheduled_for":  scheduledFor,
+		"sent_at":        nil,
+		"status":         status,
+	}
+	if sentAt.Valid {
+		data["sent_at"] = sentAt.String
+	}
+	return EmitWebhookEvent(q, orgID, eventType, reminderID, data, now)
+}
+
+// EmitOutboxEvent emits outbox.queued for a reminder email written to the
+// outbox. Nothing sends from the outbox yet, so there are no delivered or
+// failed events to report.
+func EmitOutboxEvent(q queryer, outboxID string, email OutboundEmail, now time.Time) error {
+	return EmitWebhookEvent(q, email.OrgID, WebhookOutboxQueued, outboxID, map[string]interface{}{
+		"id":          outboxID,
+		"reminder_id": email.ReminderID,
+		"to_email":    email.ToEmail,
+		"subject":     email.Subject,
+		"created_at":  now.UTC().Format(time.RFC3339),
+	}, now)
+}
+
+// EmitOverdueInvoices emits invoice.overdue once for each unpaid invoice
+// whose due date has passed.
+func EmitOverdueInvoices(db *sql.DB, orgID string, now time.Time) (int, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	rows, err := db.Query(`SELECT id FROM invoices i WHERE org_id = ? AND status != 'paid' AND due_date < ?
+		AND NOT EXISTS (SELECT 1 FROM webhook_events e WHERE e.org_id = i.org_id AND e.event_type = ? AND e.resource_id = i.id)`,
+		orgID, today.Format(time.RFC3339), WebhookInvoiceOverdue)
+	if err != nil {
+		return 0, err
+	}
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for i, id := range ids {
+		if err := EmitInvoiceEvent(db, orgID, id, WebhookInvoiceOverdue, now); err != nil {
+			return i, err
+		}
+	}
+	return len(ids), nil
+}
+
+// DeliverDueWebhooks sends pending deliveries whose next attempt is due and
+// returns how many succeeded. A nil client is NewWebhookClient(false).
+func DeliverDueWebhooks(db *sql.DB, client *http.Client, now time.Time) (int, error) {
+	rows, err := db.Query(`SELECT id FROM webhook_deliveries WHERE status = ? AND next_attempt_at <= ?
+		ORDER BY next_attempt_at LIMIT ?`, WebhookDeliveryPending, now.UTC().Format(time.RFC3339), webhookBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, id := range ids {
+		ok, err := attemptWebhookDelivery(db, client, id, now)
+		if err != nil {
+			return delivered, err
+		}
+		if ok {
+			delivered++
+		}
+	}
+	return delivered, nil
+}
+
+// RedeliverWebhook queues a fresh delivery of the event behind deliveryID
+// and returns the new delivery's id; SendWebhookDelivery sends it straight
+// away. Earlier attempts stay in the log.
+func RedeliverWebhook(q queryer, orgID, endpointID, deliveryID string, now time.Time) (string, error) {
+	var eventID string
+	if err := q.QueryRow(`SELECT event_id FROM webhook_deliveries WHERE id = ? AND endpoint_id = ? AND org_id = ?`,
+		deliveryID, endpointID, orgID).Scan(&eventID); err != nil {
+		return "", err
+	}
+	return queueWebhookDelivery(q, orgID, endpointID, eventID, now)
+}
+
+// SendWebhookDelivery makes an attempt at a pending delivery now instead of
+// waiting for the worker.
+func SendWebhookDelivery(db *sql.DB, client *http.Client, id string, now time.Time) error {
+	_, err := attemptWebhookDelivery(db, client, id, now)
+	return err
+}
+
+// attemptWebhookDelivery makes one attempt at a pending delivery and records
+// the outcome, scheduling a retry if it failed. It reports whether the
+// endpoint accepted the event.
+func attemptWebhookDelivery(db *sql.DB, client *http.Client, id string, now time.Time) (bool, error) {
+	stamp := now.UTC().Format(time.RFC3339)
+	res, err := db.Exec(`UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id = ? AND status = ? AND next_attempt_at <= ?`,
+		now.Add(webhookLease).UTC().Format(time.RFC3339), id, WebhookDeliveryPending, stamp)
+	if err != nil {
+		return false, err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return false, nil
+	}
+
+	var attempts int
+	var url, secret, eventType, payload string
+	if err := db.QueryRow(`SELECT d.attempts, e.url, e.secret, ev.event_type, ev.payload
+		FROM webhook_deliveries d
+		JOIN webhook_endpoints e ON e.id = d.endpoint_id
+		JOIN webhook_events ev ON ev.id = d.event_id
+		WHERE d.id = ?`, id).Scan(&attempts, &url, &secret, &eventType, &payload); err != nil {
+		return false, err
+	}
+
+	statusCode, body, sendErr := sendWebhook(client, url, secret, id, eventType, []byte(payload), now)
+	attempts++
+	var responseStatus interface{}
+	if statusCode != 0 {
+		responseStatus = statusCode
+	}
+	errText := ""
+	if sendErr != nil {
+		errText = sendErr.Error()
+	}
+
+	if sendErr == nil {
+		_, err = db.Exec(`UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = NULL, response_status = ?,
+			response_body = ?, error = '', delivered_at = ?, updated_at = ? WHERE id = ?`,
+			WebhookDeliveryDelivered, attempts, responseStatus, body, stamp, stamp, id)
+		return err == nil, err
+	}
+	status, next := WebhookDeliveryPending, interface{}(nil)
+	if attempts <= len(webhookBackoff) {
+		next = now.Add(webhookBackoff[attempts-1]).UTC().Format(time.RFC3339)
+	} else {
+		status = WebhookDeliveryFailed
+	}
+	_, err = db.Exec(`UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ?, response_status = ?,
+		response_body = ?, error = ?, updated_at = ? WHERE id = ?`,
+		status, attempts, next, responseStatus, body, errText, stamp, id)
+	return false, err
+}
+
+// sendWebhook posts a signed payload. Any 2xx response counts as delivered.
+func sendWebhook(client *http.Client, url, secret, deliveryID, eventType string, payload []byte, now time.Time) (int, string, error) {
+	if client == nil {
+		client = NewWebhookClient(false)
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, "", err
+	}
+	timestamp := now.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "NudgePay-Webhooks/1.0")
+	req.Header.Set("NudgePay-Event", eventType)
+	req.Header.Set("NudgePay-Delivery", deliveryID)
+	req.Header.Set(WebhookSignatureHeader, fmt.Sprintf("t=%d,v1=%s", timestamp, WebhookSignature(secret, timestamp, payload)))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, webhookResponseKept))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, string(body), fmt.Errorf("endpoint responded with %d", resp.StatusCode)
+	}
+	return resp.StatusCode, string(body), nil
+}
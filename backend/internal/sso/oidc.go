@@ -0,0 +1,261 @@
+package sso
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"nudgepay/internal/config"
+)
+
+// metadataTTL bounds how long discovery documents and signing keys are
+// cached. Unknown key ids trigger an early refresh for key rotation, at most
+// once per refreshInterval so forged kids cannot hammer the provider.
+const (
+	metadataTTL     = time.Hour
+	refreshInterval = time.Minute
+)
+
+var (
+	ErrInvalidIDToken = errors.New("invalid id token")
+	ErrNonceMismatch  = errors.New("id token nonce mismatch")
+)
+
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// Client runs the authorization code flow with PKCE against any OpenID
+// Connect provider that publishes a discovery document.
+type Client struct {
+	http *http.Client
+
+	mu    sync.Mutex
+	cache map[string]*metadata
+}
+
+func NewClient(httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Client{http: httpClient, cache: map[string]*metadata{}}
+}
+
+// NewPKCE returns a code verifier and its S256 challenge (RFC 7636).
+func NewPKCE() (verifier, challenge string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	verifier = base64.RawURLEncoding.EncodeToString(buf)
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func (c *Client) AuthorizationURL(p config.OIDCProvider, redirectURI, state, nonce, challenge string) (string, error) {
+	meta, err := c.metadata(p, false)
+	if err != nil {
+		return "", err
+	}
+	values := url.Values{}
+	values.Set("response_type", "code")
+	values.Set("client_id", p.ClientID)
+	values.Set("redirect_uri", redirectURI)
+	values.Set("scope", "openid email profile")
+	values.Set("state", state)
+	values.Set("nonce", nonce)
+	values.Set("code_challenge", challenge)
+	values.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + values.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the raw ID token.
+func (c *Client) Exchange(p config.OIDCProvider, code, redirectURI, verifier string) (string, error) {
+	meta, err := c.metadata(p, false)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("client_id", p.ClientID)
+	form.Set("client_secret", p.ClientSecret)
+	form.Set("code_verifier", verifier)
+	resp, err := c.http.PostForm(meta.TokenEndpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %d", resp.StatusCode)
+	}
+	var body struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return body.IDToken, nil
+}
+
+type idTokenClaims struct {
+	Nonce         string      `json:"nonce"`
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"`
+	jwt.RegisteredClaims
+}
+
+// VerifyIDToken checks the signature against the provider's published keys
+// along with issuer, audience, expiry and the nonce sent with the request.
+func (c *Client) VerifyIDToken(p config.OIDCProvider, raw, nonce string, now time.Time) (Identity, error) {
+	meta, err := c.metadata(p, false)
+	if err != nil {
+		return Identity{}, err
+	}
+	claims := &idTokenClaims{}
+	_, err = jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return c.signingKey(p, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithIssuer(meta.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(func() time.Time { return now }),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return Identity{}, ErrNonceMismatch
+	}
+	if claims.Subject == "" {
+		return Identity{}, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	}
+	// Some providers send email_verified as the string "true".
+	verified := claims.EmailVerified == true || claims.EmailVerified == "true"
+	return Identity{
+		Subject:       claims.Subject,
+		Email:         strings.TrimSpace(strings.ToLower(claims.Email)),
+		EmailVerified: verified,
+	}, nil
+}
+
+func (c *Client) signingKey(p config.OIDCProvider, kid string) (*rsa.PublicKey, error) {
+	meta, err := c.metadata(p, false)
+	if err != nil {
+		return nil, err
+	}
+	if key := pickKey(meta.keys, kid); key != nil {
+		return key, nil
+	}
+	meta, err = c.metadata(p, true)
+	if err != nil {
+		return nil, err
+	}
+	if key := pickKey(meta.keys, kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func pickKey(keys map[string]*rsa.PublicKey, kid string) *rsa.PublicKey {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key
+		}
+	}
+	return keys[kid]
+}
+
+func (c *Client) metadata(p config.OIDCProvider, refresh bool) (*metadata, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if meta, ok := c.cache[p.Issuer]; ok {
+		age := time.Since(meta.fetchedAt)
+		if age < refreshInterval || (!refresh && age < metadataTTL) {
+			return meta, nil
+		}
+	}
+
+	meta := &metadata{}
+	if err := c.getJSON(strings.TrimRight(p.Issuer, "/")+"/.well-known/openid-configuration", meta); err != nil {
+		return nil, err
+	}
+	// OpenID Connect Discovery 1.0 section 4.3.
+	if strings.TrimRight(meta.Issuer, "/") != strings.TrimRight(p.Issuer, "/") {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", meta.Issuer, p.Issuer)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := c.getJSON(meta.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	meta.keys = map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		meta.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	meta.fetchedAt = time.Now()
+	c.cache[p.Issuer] = meta
+	return meta, nil
+}
+
+func (c *Client) getJSON(endpoint string, dst interface{}) error {
+	resp, err := c.http.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", endpoint, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
@@ -2,8 +2,8 @@
 
 import { useRouter } from 'next/navigation';
 import { FormEvent, useState } from 'react';
-import { login, register } from '@/lib/api';
-import { setToken } from '@/lib/auth';
+import { login, loginTwoFactor, register } from '@/lib/api';
+import { setSession } from '@/lib/auth';
 
 interface AuthFormProps {
   mode: 'login' | 'signup';
@@ -14,6 +14,8 @@ export function AuthForm({ mode }: AuthFormProps) {
   const [email, setEmail] = useState('');
   const [password, setPassword] = useState('');
   const [orgName, setOrgName] = useState('');
+  const [mfaToken, setMfaToken] = useState<string | null>(null);
+  const [code, setCode] = useState('');
   const [error, setError] = useState<string | null>(null);
   const [loading, setLoading] = useState(false);
 
@@ -23,19 +25,58 @@ export function AuthForm({ mode }: AuthFormProps) {
     setLoading(true);
 
     try {
+      if (mfaToken) {
+        setSession(await loginTwoFactor({ mfa_token: mfaToken, code: code.trim() }));
+        router.push('/dashboard');
+        return;
+      }
       const payload =
         mode === 'signup'
           ? await register({ email, password, org_name: orgName })
           : await login({ email, password });
-      setToken(payload.token);
+      if ('two_factor_required' in payload) {
+        setMfaToken(payload.mfa_token);
+        return;
+      }
+      setSession(payload);
       router.push('/dashboard');
     } catch (err) {
-      setError(err instanceof Error ? err.message : 'Something went wrong');
+      const message = err instanceof Error ? err.message : 'Something went wrong';
+      // The challenge is short lived; start over with the password.
+      if (mfaToken && message.startsWith('login challenge expired')) {
+        setMfaToken(null);
+        setCode('');
+      }
+      setError(message);
     } finally {
       setLoading(false);
     }
   }
 
+  if (mfaToken) {
+    return (
+      <form className="form" onSubmit={handleSubmit}>
+        <label>
+          Authentication code
+          <input
+            className="input"
+            value={code}
+            onChange={(event) => setCode(event.target.value)}
+            placeholder="123456"
+            autoComplete="one-time-code"
+            autoFocus
+            required
+          />
+        </label>
+        <div className="text-muted">Enter the code from your authenticator app or a recovery code.</div>
+        {error ? <div className="text-muted">{error}</div> : null}
+        <button className="button" type="submit" disabled={loading}>
+          {loading ? 'Working...' : 'Verify'}
+        </button>
+      </form>
+    );
+  }
+
   return (
     <form className="form" onSubmit={handleSubmit}>
       {mode === 'signup' ? (
@@ -6,6 +6,7 @@ import { getToken } from '@/lib/auth';
 
 export function ClientsPanel() {
   const [clients, setClients] = useState<Client[]>([]);
+  const [nextCursor, setNextCursor] = useState<string | null>(null);
   const [error, setError] = useState<string | null>(null);
   const [name, setName] = useState('');
   const [email, setEmail] = useState('');
@@ -19,10 +20,26 @@ export function ClientsPanel() {
       return;
     }
     listClients(token)
-      .then((data) => setClients(data.clients))
+      .then((data) => {
+        setClients(data.clients);
+        setNextCursor(data.next_cursor ?? null);
+      })
       .catch((err) => setError(err instanceof Error ? err.message : 'Failed to load'));
   }, [token]);
 
+  async function handleLoadMore() {
+    if (!token || !nextCursor) {
+      return;
+    }
+    try {
+      const data = await listClients(token, nextCursor);
+      setClients((current) => [...current, ...data.clients]);
+      setNextCursor(data.next_cursor ?? null);
+    } catch (err) {
+      setError(err instanceof Error ? err.message : 'Failed to load');
+    }
+  }
+
   async function handleCreate(event: FormEvent) {
     event.preventDefault();
     if (!token) {
@@ -40,6 +57,7 @@ export function ClientsPanel() {
       setCompany('');
       const data = await listClients(token);
       setClients(data.clients);
+      setNextCursor(data.next_cursor ?? null);
     } catch (err) {
       setError(err instanceof Error ? err.message : 'Failed to create');
     }
@@ -97,6 +115,11 @@ export function ClientsPanel() {
             ))}
           </tbody>
         </table>
+        {nextCursor ? (
+          <button className="button" type="button" onClick={handleLoadMore}>
+            Load more
+          </button>
+        ) : null}
       </div>
     </div>
   );
@@ -1,12 +1,13 @@
 'use client';
 
 import { FormEvent, useEffect, useState } from 'react';
-import { Client, Invoice, createInvoice, listClients, listInvoices } from '@/lib/api';
+import { Client, Invoice, createInvoice, listAllClients, listInvoices } from '@/lib/api';
 import { getToken } from '@/lib/auth';
 
 export function InvoicesPanel() {
   const [clients, setClients] = useState<Client[]>([]);
   const [invoices, setInvoices] = useState<Invoice[]>([]);
+  const [nextCursor, setNextCursor] = useState<string | null>(null);
   const [clientID, setClientID] = useState('');
   const [number, setNumber] = useState('');
   const [amount, setAmount] = useState('');
@@ -21,14 +22,28 @@ export function InvoicesPanel() {
       return;
     }
 
-    Promise.all([listClients(token), listInvoices(token)])
-      .then(([clientsData, invoicesData]) => {
-        setClients(clientsData.clients);
+    Promise.all([listAllClients(token), listInvoices(token)])
+      .then(([allClients, invoicesData]) => {
+        setClients(allClients);
         setInvoices(invoicesData.invoices);
+        setNextCursor(invoicesData.next_cursor ?? null);
       })
       .catch((err) => setError(err instanceof Error ? err.message : 'Failed to load'));
   }, [token]);
 
+  async function handleLoadMore() {
+    if (!token || !nextCursor) {
+      return;
+    }
+    try {
+      const data = await listInvoices(token, nextCursor);
+      setInvoices((current) => [...current, ...data.invoices]);
+      setNextCursor(data.next_cursor ?? null);
+    } catch (err) {
+      setError(err instanceof Error ? err.message : 'Failed to load');
+    }
+  }
+
   async function handleCreate(event: FormEvent) {
     event.preventDefault();
     if (!token) {
@@ -56,6 +71,7 @@ export function InvoicesPanel() {
       setDueDate('');
       const invoicesData = await listInvoices(token);
       setInvoices(invoicesData.invoices);
+      setNextCursor(invoicesData.next_cursor ?? null);
     } catch (err) {
       setError(err instanceof Error ? err.message : 'Failed to create');
     }
@@ -132,6 +148,11 @@ export function InvoicesPanel() {
             ))}
           </tbody>
         </table>
+        {nextCursor ? (
+          <button className="button" type="button" onClick={handleLoadMore}>
+            Load more
+          </button>
+        ) : null}
       </div>
     </div>
   );
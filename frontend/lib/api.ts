@@ -1,3 +1,5 @@
+import { clearToken, getRefreshToken, setSession } from './auth';
+
 export const API_URL = process.env.NEXT_PUBLIC_API_URL || 'http://localhost:8080';
 
 export interface Client {
@@ -43,28 +45,82 @@ export interface Metrics {
 
 interface ClientsResponse {
   clients: Client[];
+  next_cursor?: string | null;
 }
 
 interface InvoicesResponse {
   invoices: Invoice[];
+  next_cursor?: string | null;
 }
 
 interface RemindersResponse {
   reminders: Reminder[];
+  next_cursor?: string | null;
 }
 
 interface OutboxResponse {
   outbox: OutboxEmail[];
+  next_cursor?: string | null;
+}
+
+export interface Session {
+  token: string;
+  refresh_token: string;
+  expires_in: number;
+}
+
+let refreshing: Promise<string | null> | null = null;
+
+// refreshSession trades the stored refresh token for a new session. Requests
+// that fail at the same time share one refresh, since the refresh token is
+// single use.
+function refreshSession(): Promise<string | null> {
+  if (!refreshing) {
+    refreshing = (async () => {
+      const refreshToken = getRefreshToken();
+      if (!refreshToken) {
+        return null;
+      }
+      const response = await fetch(`${API_URL}/api/auth/refresh`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ refresh_token: refreshToken })
+      }).catch(() => null);
+      if (!response || !response.ok) {
+        clearToken();
+        return null;
+      }
+      const session = (await response.json()) as Session;
+      setSession(session);
+      return session.token;
+    })().finally(() => {
+      refreshing = null;
+    });
+  }
+  return refreshing;
 }
 
-async function request<T>(path: string, options: RequestInit = {}): Promise<T> {
-  const response = await fetch(`${API_URL}${path}`, {
+function send(path: string, options: RequestInit, headers: Record<string, string>) {
+  return fetch(`${API_URL}${path}`, {
+    ...options,
     headers: {
       'Content-Type': 'application/json',
-      ...(options.headers || {})
-    },
-    ...options
+      ...headers
+    }
   });
+}
+
+async function request<T>(path: string, options: RequestInit = {}): Promise<T> {
+  const headers = { ...((options.headers as Record<string, string>) || {}) };
+  let response = await send(path, options, headers);
+
+  // Access tokens are short lived: refresh once and retry when one expires.
+  if (response.status === 401 && headers.Authorization) {
+    const token = await refreshSession();
+    if (token) {
+      response = await send(path, options, { ...headers, Authorization: `Bearer ${token}` });
+    }
+  }
 
   if (!response.ok) {
     const payload = await response.json().catch(() => ({ error: 'Request failed' }));
@@ -78,35 +134,66 @@ export function register(payload: {
   email: string;
   password: string;
   org_name: string;
-}): Promise<{ token: string }> {
+}): Promise<Session> {
   return request('/api/auth/register', {
     method: 'POST',
     body: JSON.stringify(payload)
   });
 }
 
+export interface TwoFactorChallenge {
+  two_factor_required: true;
+  mfa_token: string;
+}
+
 export function login(payload: {
   email: string;
   password: string;
-}): Promise<{ token: string }> {
+}): Promise<Session | TwoFactorChallenge> {
   return request('/api/auth/login', {
     method: 'POST',
     body: JSON.stringify(payload)
   });
 }
 
+export function loginTwoFactor(payload: {
+  mfa_token: string;
+  code: string;
+}): Promise<Session> {
+  return request('/api/auth/login/2fa', {
+    method: 'POST',
+    body: JSON.stringify(payload)
+  });
+}
+
 export function getMetrics(token: string): Promise<Metrics> {
   return request<Metrics>('/api/metrics', {
     headers: { Authorization: `Bearer ${token}` }
   });
 }
 
-export function listClients(token: string): Promise<ClientsResponse> {
-  return request<ClientsResponse>('/api/clients', {
+function withCursor(path: string, cursor?: string | null) {
+  return cursor ? `${path}?cursor=${encodeURIComponent(cursor)}` : path;
+}
+
+export function listClients(token: string, cursor?: string | null): Promise<ClientsResponse> {
+  return request<ClientsResponse>(withCursor('/api/clients', cursor), {
     headers: { Authorization: `Bearer ${token}` }
   });
 }
 
+// listAllClients follows next_cursor to the end, for pickers that need every client.
+export async function listAllClients(token: string): Promise<Client[]> {
+  const clients: Client[] = [];
+  let cursor: string | null | undefined;
+  do {
+    const page = await listClients(token, cursor);
+    clients.push(...page.clients);
+    cursor = page.next_cursor;
+  } while (cursor);
+  return clients;
+}
+
 export function createClient(token: string, payload: {
   name: string;
   email: string;
@@ -121,8 +208,8 @@ export function createClient(token: string, payload: {
   });
 }
 
-export function listInvoices(token: string): Promise<InvoicesResponse> {
-  return request<InvoicesResponse>('/api/invoices', {
+export function listInvoices(token: string, cursor?: string | null): Promise<InvoicesResponse> {
+  return request<InvoicesResponse>(withCursor('/api/invoices', cursor), {
     headers: { Authorization: `Bearer ${token}` }
   });
 }
@@ -1,4 +1,5 @@
 const tokenKey = 'nudgepay_token';
+const refreshTokenKey = 'nudgepay_refresh_token';
 
 export function getToken(): string | null {
   if (typeof window === 'undefined') {
@@ -14,9 +15,25 @@ export function setToken(token: string) {
   window.localStorage.setItem(tokenKey, token);
 }
 
+export function getRefreshToken(): string | null {
+  if (typeof window === 'undefined') {
+    return null;
+  }
+  return window.localStorage.getItem(refreshTokenKey);
+}
+
+export function setSession(session: { token: string; refresh_token: string }) {
+  if (typeof window === 'undefined') {
+    return;
+  }
+  window.localStorage.setItem(tokenKey, session.token);
+  window.localStorage.setItem(refreshTokenKey, session.refresh_token);
+}
+
 export function clearToken() {
   if (typeof window === 'undefined') {
     return;
   }
   window.localStorage.removeItem(tokenKey);
+  window.localStorage.removeItem(refreshTokenKey);
 }
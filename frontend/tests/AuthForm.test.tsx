@@ -1,18 +1,23 @@
-import { render, screen } from '@testing-library/react';
+import { fireEvent, render, screen, waitFor } from '@testing-library/react';
 import { describe, expect, it, vi } from 'vitest';
 import { AuthForm } from '@/components/AuthForm';
+import { login, loginTwoFactor } from '@/lib/api';
+import { setSession } from '@/lib/auth';
+
+const { push } = vi.hoisted(() => ({ push: vi.fn() }));
 
 vi.mock('next/navigation', () => ({
-  useRouter: () => ({ push: vi.fn() })
+  useRouter: () => ({ push })
 }));
 
 vi.mock('@/lib/api', () => ({
-  login: vi.fn(() => Promise.resolve({ token: 'token' })),
-  register: vi.fn(() => Promise.resolve({ token: 'token' }))
+  login: vi.fn(() => Promise.resolve({ token: 'token', refresh_token: 'refresh', expires_in: 900 })),
+  loginTwoFactor: vi.fn(() => Promise.resolve({ token: 'token', refresh_token: 'refresh', expires_in: 900 })),
+  register: vi.fn(() => Promise.resolve({ token: 'token', refresh_token: 'refresh', expires_in: 900 }))
 }));
 
 vi.mock('@/lib/auth', () => ({
-  setToken: vi.fn()
+  setSession: vi.fn()
 }));
 
 describe('AuthForm', () => {
@@ -27,4 +32,21 @@ describe('AuthForm', () => {
     expect(screen.queryByText('Studio or agency name')).toBeNull();
     expect(screen.getByPlaceholderText('you@studio.com')).toBeInTheDocument();
   });
+
+  it('asks for a code when two-factor authentication is on', async () => {
+    vi.mocked(login).mockResolvedValueOnce({ two_factor_required: true, mfa_token: 'challenge' });
+    render(<AuthForm mode="login" />);
+    fireEvent.change(screen.getByPlaceholderText('you@studio.com'), { target: { value: 'ada@studio.com' } });
+    fireEvent.change(screen.getByPlaceholderText('••••••••'), { target: { value: 'password123' } });
+    fireEvent.click(screen.getByText('Log in'));
+
+    const codeInput = await screen.findByPlaceholderText('123456');
+    expect(setSession).not.toHaveBeenCalled();
+    fireEvent.change(codeInput, { target: { value: ' 654321 ' } });
+    fireEvent.click(screen.getByText('Verify'));
+
+    await waitFor(() => expect(push).toHaveBeenCalledWith('/dashboard'));
+    expect(loginTwoFactor).toHaveBeenCalledWith({ mfa_token: 'challenge', code: '654321' });
+    expect(setSession).toHaveBeenCalledWith({ token: 'token', refresh_token: 'refresh', expires_in: 900 });
+  });
 });
@@ -0,0 +1,74 @@
+import { afterEach, beforeEach, describe, expect, it, vi } from 'vitest';
+import { listAllClients, listClients } from '@/lib/api';
+import { getRefreshToken, getToken, setSession } from '@/lib/auth';
+
+function jsonResponse(status: number, body: unknown) {
+  return new Response(JSON.stringify(body), {
+    status,
+    headers: { 'Content-Type': 'application/json' }
+  });
+}
+
+describe('request', () => {
+  beforeEach(() => {
+    window.localStorage.clear();
+  });
+
+  afterEach(() => {
+    vi.unstubAllGlobals();
+  });
+
+  it('refreshes an expired access token and retries', async () => {
+    setSession({ token: 'old', refresh_token: 'refresh-1' });
+    const fetchMock = vi.fn((url: string, init: RequestInit) => {
+      if (url.endsWith('/api/auth/refresh')) {
+        expect(JSON.parse(init.body as string)).toEqual({ refresh_token: 'refresh-1' });
+        return Promise.resolve(jsonResponse(200, { token: 'new', refresh_token: 'refresh-2', expires_in: 900 }));
+      }
+      const auth = (init.headers as Record<string, string>).Authorization;
+      if (auth === 'Bearer new') {
+        return Promise.resolve(jsonResponse(200, { clients: [], next_cursor: null }));
+      }
+      return Promise.resolve(jsonResponse(401, { error: 'invalid token' }));
+    });
+    vi.stubGlobal('fetch', fetchMock);
+
+    await expect(listClients('old')).resolves.toEqual({ clients: [], next_cursor: null });
+    expect(fetchMock).toHaveBeenCalledTimes(3);
+    expect(getToken()).toBe('new');
+    expect(getRefreshToken()).toBe('refresh-2');
+  });
+
+  it('signs out when the refresh token is rejected', async () => {
+    setSession({ token: 'old', refresh_token: 'revoked' });
+    vi.stubGlobal(
+      'fetch',
+      vi.fn(() => Promise.resolve(jsonResponse(401, { error: 'invalid token' })))
+    );
+
+    await expect(listClients('old')).rejects.toThrow('invalid token');
+    expect(getToken()).toBeNull();
+    expect(getRefreshToken()).toBeNull();
+  });
+});
+
+describe('listAllClients', () => {
+  afterEach(() => {
+    vi.unstubAllGlobals();
+  });
+
+  it('follows next_cursor until the last page', async () => {
+    const fetchMock = vi.fn((url: string) => {
+      if (url.endsWith('/api/clients')) {
+        return Promise.resolve(jsonResponse(200, { clients: [{ id: 'c1' }], next_cursor: 'a b' }));
+      }
+      expect(url.endsWith('/api/clients?cursor=a%20b')).toBe(true);
+      return Promise.resolve(jsonResponse(200, { clients: [{ id: 'c2' }], next_cursor: null }));
+    });
+    vi.stubGlobal('fetch', fetchMock);
+
+    const clients = await listAllClients('token');
+    expect(clients.map((client) => client.id)).toEqual(['c1', 'c2']);
+    expect(fetchMock).toHaveBeenCalledTimes(2);
+  });
+});